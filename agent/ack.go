@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/teller/protocol"
+)
+
+// inflight is a batch that's been written but not yet committed. Its offsets
+// are only committed once the server ACKs seq, and every batch sent before
+// it has been committed too; until it's ACKed, frame is kept so it can be
+// written again on a new connection. key says which stream it went out on
+// (see streamFor), and sent when it last was. replayed is the .replay file
+// the batch was the last of, removed once it's committed.
+type inflight struct {
+	key      string
+	seq      uint64
+	frame    []byte
+	offsets  map[string]int64
+	cursors  map[string]string
+	sent     time.Time
+	acked    bool
+	replayed string
+}
+
+// ackMsg is an ACK read off the stream for key.
+type ackMsg struct {
+	key string
+	seq uint64
+}
+
+// acking reports whether batches wait for the server's ACK.
+func (a *App) acking() bool {
+	return a.AckWindow > 0
+}
+
+// windowFull reports whether as many batches as AckWindow allows are waiting
+// on the server, in which case no more are sent until some are ACKed.
+func (a *App) windowFull() bool {
+	return a.acking() && a.unacked() >= a.AckWindow
+}
+
+// memFull reports whether the pending batch and the batches awaiting an ACK
+// take up MaxBufferBytes between them, in which case no more lines are read
+// until some are ACKed, or with a spool, the batch is spooled.
+func (a *App) memFull() bool {
+	return a.MaxBufferBytes > 0 && a.batch.size+a.inflightBytes >= a.MaxBufferBytes
+}
+
+// overflow reports whether a batch of n bytes should go to the spool rather
+// than be held in memory until it's ACKed, for want of room under
+// MaxBufferBytes.
+func (a *App) overflow(n int) bool {
+	return a.Spool != nil && a.acking() && a.MaxBufferBytes > 0 && a.inflightBytes+n > a.MaxBufferBytes
+}
+
+// nextSeq hands out batch sequence numbers. They start from the clock rather
+// than 1 so ACKs for frames spooled by a previous run can't be mistaken for
+// ACKs of this run's batches.
+func (a *App) nextSeq() uint64 {
+	if a.seq == 0 {
+		a.seq = uint64(time.Now().UnixNano())
+	}
+	a.seq++
+	return a.seq
+}
+
+// readAcks passes the ACKs the server sends on stream, which carries key's
+// batches, to a.acks until the stream goes away or the sender has stopped.
+// Broken streams are noticed, and reconnected, by the writing side, so read
+// errors just end the loop.
+func (a *App) readAcks(stream quic.Stream, key string) {
+	for {
+		seq, err := protocol.ReadAck(stream)
+		if err != nil {
+			return
+		}
+		select {
+		case a.acks <- ackMsg{key: key, seq: seq}:
+		case <-a.quit.Done():
+			return
+		}
+	}
+}
+
+// ack marks every in-flight batch on m's stream up to and including m.seq
+// as acknowledged. The server handles a stream's batches in order, so
+// acknowledging one acknowledges everything sent on it before. Unknown
+// sequence numbers are ignored.
+//
+// Offsets are then committed oldest batch first, stopping at the first one
+// still waiting. A file's lines can be split over streams (see
+// PrioritySeverity), and the streams' ACKs come back in any order, so
+// committing a later batch before an earlier one could skip lines the server
+// never got.
+func (a *App) ack(m ackMsg) {
+	n := 0
+	for i := range a.inflight {
+		f := &a.inflight[i]
+		if f.key == m.key && f.seq <= m.seq && !f.acked {
+			f.acked = true
+			a.inflightBytes -= len(f.frame)
+			f.frame = nil
+			n++
+		}
+	}
+	done := 0
+	for done < len(a.inflight) && a.inflight[done].acked {
+		a.commitInflight(a.inflight[done])
+		done++
+	}
+	a.inflight = slices.Delete(a.inflight, 0, done)
+	a.Stats.Acks.Add(int64(n))
+	a.Stats.Unacked.Store(int64(a.unacked()))
+}
+
+// commitInflight commits f's offsets, and with it the last of a replay
+// delivered, removes the replayed file.
+func (a *App) commitInflight(f inflight) {
+	a.commit(f.offsets, f.cursors)
+	if f.replayed != "" {
+		removeReplayed(f.replayed)
+	}
+}
+
+// unacked counts the in-flight batches the server hasn't ACKed yet.
+func (a *App) unacked() int {
+	n := 0
+	for _, f := range a.inflight {
+		if !f.acked {
+			n++
+		}
+	}
+	return n
+}
+
+// resend writes every unacknowledged batch for the main stream again on a
+// fresh one, oldest first, since whatever the old stream had in flight may
+// never have arrived. Per-file streams do their own resending when they're
+// reopened.
+func (a *App) resend() error {
+	var n int
+	for i := range a.inflight {
+		f := &a.inflight[i]
+		if f.key != "" || f.acked {
+			continue
+		}
+		if err := a.writeStream("", f.frame); err != nil {
+			return err
+		}
+		f.sent = time.Now()
+		n++
+	}
+	if n > 0 {
+		slog.Info("Resent unacknowledged batches", "batches", n)
+	}
+	return nil
+}
+
+// spoolInflight moves the unacknowledged batches into the spool when the
+// connection drops. Whatever is in the spool already went in after they were
+// sent, a batch that overflowed the window, so they go in ahead of it and
+// still leave in the order they were read. The spool is durable, so their
+// offsets can be committed once they're in it. If they can't be spooled
+// they stay in flight, to be sent again once there's a connection, and
+// nothing after them is committed until they've been ACKed.
+func (a *App) spoolInflight() {
+	var frames [][]byte
+	for _, f := range a.inflight {
+		if !f.acked {
+			frames = append(frames, f.frame)
+		}
+	}
+	if err := a.Spool.PushFront(frames); err != nil {
+		slog.Error("Error spooling unacknowledged batches, keeping them to send again", "batches", len(frames), "err", err)
+		return
+	}
+	for _, f := range a.inflight {
+		a.commitInflight(f)
+	}
+	a.inflight = a.inflight[:0]
+	a.inflightBytes = 0
+	a.Stats.Unacked.Store(0)
+}
+
+// drained keeps frame, just written from the spool, in flight until the
+// server ACKs it, so a connection dropping first puts it back in the spool
+// rather than losing it. Its offsets were committed when it was spooled.
+// Frames without a batch header, spooled before ACKing was turned on, get
+// no ACK to wait for.
+func (a *App) drained(frame []byte) {
+	if !a.acking() || len(frame) < protocol.HeaderSize+8 || protocol.Codec(frame[4]) != protocol.TypeBatch {
+		return
+	}
+	seq := binary.BigEndian.Uint64(frame[protocol.HeaderSize:])
+	a.inflight = append(a.inflight, inflight{seq: seq, frame: frame, sent: time.Now()})
+	a.inflightBytes += len(frame)
+	a.Stats.Unacked.Store(int64(a.unacked()))
+}
+
+// ackOverdue reports whether a batch has waited longer than AckTimeout for
+// its ACK. ACKs come back in order on each stream, so that means the server
+// has stopped answering, even if writes to it still go through.
+func (a *App) ackOverdue() bool {
+	for _, f := range a.inflight {
+		if !f.acked && time.Since(f.sent) > a.AckTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAcks tears the connection down and dials again if the server has
+// stopped ACKing, as a hung server otherwise looks just like a slow one:
+// QUIC keeps accepting writes, and teller keeps shipping into nothing until
+// the window fills. The unACKed batches are then sent again, or spooled,
+// as after any other reconnect.
+func (a *App) checkAcks(ctx context.Context) error {
+	if !a.up || !a.ackOverdue() {
+		return nil
+	}
+	slog.Warn("No ACK from the server in time, reconnecting", "server", a.ServerAddr, "timeout", a.AckTimeout, "unacked", a.unacked())
+	a.Stats.AckTimeouts.Add(1)
+	if a.Spool != nil {
+		a.goDown(ctx)
+		return nil
+	}
+	if err := a.reconnect(ctx); err != nil {
+		return err
+	}
+	return a.resend()
+}
@@ -0,0 +1,314 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestCommitAfterAck ships a file to a server that never ACKs, checks the
+// state file doesn't move while the lines are unACKed, then stops teller
+// and starts it again against one that does, as a crash and restart would,
+// and checks the lines are sent again and only then committed.
+func TestCommitAfterAck(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "one\ntwo\n")
+	config := func(srv *testServer) Config {
+		cfg := srv.quicConfig()
+		cfg.Files = []string{path}
+		cfg.FromBeginning = true
+		cfg.StateFile = filepath.Join(dir, "state.json")
+		cfg.StateInterval = 10 * time.Millisecond
+		cfg.AckWindow = 4
+		return cfg
+	}
+	committed := func() int64 {
+		st, err := readState(filepath.Join(dir, "state.json"))
+		if err != nil {
+			return 0
+		}
+		return st.Offsets[path]
+	}
+
+	silent := newTestServer(t, false)
+	a := newTestApp(t, config(silent), nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	for _, want := range []string{"one", "two"} {
+		if got := silent.next(t); got != want {
+			t.Fatalf("server got %q, want %q", got, want)
+		}
+	}
+	// A few state saves' worth, any of which a crash could come after
+	time.Sleep(100 * time.Millisecond)
+	if off := committed(); off != 0 {
+		t.Fatalf("offset %d was committed before the server ACKed it", off)
+	}
+	cancel()
+	<-done
+	if off := committed(); off != 0 {
+		t.Fatalf("offset %d was committed on the way out without an ACK", off)
+	}
+	a.Close()
+
+	acking := newTestServer(t, true)
+	cfg := config(acking)
+	cfg.Once = true
+	a = newTestApp(t, cfg, nil, nil)
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	for _, want := range []string{"one", "two"} {
+		if got := acking.next(t); got != want {
+			t.Fatalf("after restarting the server got %q, want %q", got, want)
+		}
+	}
+	if off := committed(); off != 8 {
+		t.Fatalf("committed offset is %d once ACKed, want 8", off)
+	}
+}
+
+// spoolOrder runs two files through a spool across a dropped connection:
+// lines sent but not ACKed when it drops, lines read while it's down, and
+// lines read once it's back. broken, if set, is run once the spool is open,
+// before anything's sent. It returns what the server got on the new
+// connection, and the state file's offsets as they were while it was down.
+func spoolOrder(t *testing.T, broken func(spoolDir string)) (got []string, down map[string]int64) {
+	srv := newTestServer(t, false)
+	cfg := srv.quicConfig()
+	cfg.SpoolDir = filepath.Join(t.TempDir(), "spool")
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	cfg.StateInterval = 10 * time.Millisecond
+	cfg.AckWindow = 8
+	cfg.BatchSize = 1
+	gates := map[string]chan struct{}{"a.log": make(chan struct{}), "b.log": make(chan struct{})}
+	a := newTestApp(t, cfg, map[string]Source{
+		"a.log": newFakeSource(gates["a.log"], true, textLines("a1", "a2", "a3", "a4")...),
+		"b.log": newFakeSource(gates["b.log"], true, textLines("b1", "b2", "b3")...),
+	}, nil)
+	if broken != nil {
+		broken(cfg.SpoolDir)
+	}
+	// release lets the next line of file through, and waits for it to have
+	// been batched and sent, or spooled
+	release := func(file string) {
+		t.Helper()
+		sent := a.Stats.LinesSent.Load()
+		gates[file] <- struct{}{}
+		deadline := time.Now().Add(5 * time.Second)
+		for a.Stats.LinesSent.Load() == sent {
+			if time.Now().After(deadline) {
+				t.Fatalf("the line from %s wasn't sent", file)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	first := <-srv.conns
+	for _, file := range []string{"a.log", "a.log", "b.log"} {
+		release(file)
+		srv.next(t)
+	}
+	// Sent, and never to be ACKed on this connection
+	first.CloseWithError(0, "going away")
+	time.Sleep(100 * time.Millisecond)
+	release("a.log")
+	release("b.log")
+	time.Sleep(3 * cfg.StateInterval)
+	st, err := readState(cfg.StateFile)
+	if err != nil {
+		st = &tailState{}
+	}
+	down = st.Offsets
+
+	srv.ack.Store(true)
+	for range 5 {
+		got = append(got, srv.next(t))
+	}
+	release("a.log")
+	release("b.log")
+	got = append(got, srv.next(t), srv.next(t))
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := map[string]int64{"a.log": 12, "b.log": 9}; !maps.Equal(a.offsets, want) {
+		t.Errorf("offsets are %v once everything's ACKed, want %v", a.offsets, want)
+	}
+	return got, down
+}
+
+// TestSpoolOrder checks that across a reconnect the server gets each file's
+// lines in the order they were read: those that were in flight when the
+// connection dropped, then those spooled while it was down, then the live
+// ones.
+func TestSpoolOrder(t *testing.T) {
+	got, down := spoolOrder(t, nil)
+	want := []string{"a1", "a2", "b1", "a3", "b2", "a4", "b3"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("server got %q on the new connection, want %q", got, want)
+	}
+	// The lines that were in flight are in the spool, as durable as if
+	// they'd been ACKed, and the spooled ones are behind them
+	if want := map[string]int64{"a.log": 9, "b.log": 6}; !maps.Equal(down, want) {
+		t.Errorf("offsets while down were %v, want %v", down, want)
+	}
+}
+
+// TestSpoolInflightFails has the batches in flight fail to go into the
+// spool when the connection drops, and checks they're kept and sent again
+// on the new connection, ahead of what was spooled, with no offset
+// committed past them in the meantime.
+func TestSpoolInflightFails(t *testing.T) {
+	got, down := spoolOrder(t, func(dir string) {
+		// Where the spool would be rewritten to put them in front
+		if err := os.Mkdir(filepath.Join(dir, spoolAltFile), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := []string{"a1", "a2", "b1", "a3", "b2", "a4", "b3"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("server got %q on the new connection, want %q", got, want)
+	}
+	if len(down) != 0 {
+		t.Errorf("offsets %v were committed while the lines before them weren't in the spool", down)
+	}
+}
+
+// settle takes the lines srv reads until it's gone a while without one.
+func settle(t *testing.T, srv *testServer) []string {
+	t.Helper()
+	var got []string
+	for {
+		select {
+		case l := <-srv.lines:
+			got = append(got, message(t, []byte(l)))
+		case <-time.After(200 * time.Millisecond):
+			return got
+		}
+	}
+}
+
+// bufferLines are twenty lines of eight bytes each, newline included, for
+// the memory buffer to fill up with.
+func bufferLines() []string {
+	var texts []string
+	for i := range 20 {
+		texts = append(texts, fmt.Sprintf("line %02d", i))
+	}
+	return texts
+}
+
+// bufferConfig has each line a batch of its own, with a few of them in
+// flight filling the memory buffer.
+func bufferConfig(srv *testServer) Config {
+	cfg := srv.quicConfig()
+	cfg.AckWindow = 100
+	cfg.BatchSize = 1
+	cfg.BatchBytes = 512
+	cfg.MaxBufferBytes = 1024
+	return cfg
+}
+
+// TestMemoryBufferStall has a server sit on its ACKs, and checks reading
+// stops once the batches in flight fill -max-memory-buffer-bytes, counting
+// the one stall, and picks up where it left off once they're ACKed.
+func TestMemoryBufferStall(t *testing.T) {
+	srv := newTestServer(t, false)
+	texts := bufferLines()
+	a := newTestApp(t, bufferConfig(srv), map[string]Source{"app.log": newFakeSource(nil, true, textLines(texts...)...)}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	got := settle(t, srv)
+	if len(got) == 0 || len(got) == len(texts) {
+		t.Fatalf("server got %d lines before the buffer filled, want some but not all", len(got))
+	}
+	if n := a.Stats.BufferStalls.Load(); n != 1 {
+		t.Errorf("counted %d stalls, want 1", n)
+	}
+	if n := a.Stats.BufferBytes.Load(); n < 1024 {
+		t.Errorf("buffer holds %d bytes with reading stopped, under the 1024 cap", n)
+	}
+	srv.ackHeld(-1)
+	for len(got) < len(texts) {
+		got = append(got, srv.next(t))
+	}
+	if !slices.Equal(got, texts) {
+		t.Errorf("server got %q, want %q", got, texts)
+	}
+}
+
+// TestMemoryBufferOverflow is TestMemoryBufferStall with a spool, where the
+// batch that doesn't fit goes to disk instead, and checks nothing spooled
+// has its offset saved until the batches sent ahead of it are ACKed.
+func TestMemoryBufferOverflow(t *testing.T) {
+	srv := newTestServer(t, false)
+	cfg := bufferConfig(srv)
+	cfg.SpoolDir = filepath.Join(t.TempDir(), "spool")
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	cfg.StateInterval = 10 * time.Millisecond
+	texts := bufferLines()
+	a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, true, textLines(texts...)...)}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	saved := func() int64 {
+		t.Helper()
+		time.Sleep(5 * cfg.StateInterval)
+		st, err := readState(cfg.StateFile)
+		if err != nil {
+			return 0
+		}
+		return st.Offsets["app.log"]
+	}
+
+	got := settle(t, srv)
+	if len(got) < 2 {
+		t.Fatalf("server got %d lines before the buffer filled, want a few", len(got))
+	}
+	if a.Stats.BufferOverflows.Load() == 0 {
+		t.Fatal("no batch overflowed to the spool")
+	}
+	if off := saved(); off != 0 {
+		t.Fatalf("offset %d saved with nothing ACKed", off)
+	}
+	// The first batch ACKed, the second still isn't, and the spooled ones
+	// wait behind it
+	srv.ackHeld(1)
+	if off := saved(); off != 8 {
+		t.Fatalf("offset %d saved with only the first line ACKed, want 8", off)
+	}
+	srv.ackHeld(-1)
+	for len(got) < len(texts) {
+		got = append(got, srv.next(t))
+	}
+	if !slices.Equal(got, texts) {
+		t.Errorf("server got %q, want %q", got, texts)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for saved() != 8*int64(len(texts)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("offset %d saved once everything was ACKed, want %d", saved(), 8*len(texts))
+		}
+	}
+}
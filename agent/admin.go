@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+const (
+	// How often the status page reloads itself
+	adminRefresh = 5 * time.Second
+	// How long the status page waits on the sender for what only it knows
+	adminAskTimeout = time.Second
+)
+
+// adminView is what the status page shows.
+type adminView struct {
+	Hostname, Version, Sink string
+	Uptime                  string
+	Refresh                 int
+	State                   string
+	Status                  *protocol.Status // nil if the sender didn't answer
+	Counts                  []adminCount
+	Spool                   []adminCount
+	LastError, LastErrorAt  string
+	Files                   []adminFile
+	Tees                    []adminTee
+}
+
+type adminCount struct {
+	Name  string
+	Value int64
+}
+
+type adminFile struct {
+	Name, Offset string
+	Lag          int64
+}
+
+type adminTee struct {
+	Name, Sink, State string
+	LinesSent         int64
+}
+
+// handleAdmin serves the status page, -admin-ui, a view of how teller's
+// doing for a person rather than Prometheus. What the sender owns, the
+// server, offsets and what the connection agreed on, is asked of it with a
+// status command; a sender that's tied up reconnecting can't answer, and the
+// page makes do with the counters.
+func (a *App) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	s := &a.Stats
+	v := adminView{
+		Hostname: a.Hostname,
+		Version:  a.cfg.Version,
+		Sink:     a.Sink,
+		Uptime:   time.Since(a.started).Round(time.Second).String(),
+		Refresh:  int(adminRefresh.Seconds()),
+		State:    s.ConnState().String(),
+		Status:   a.askStatus(r.Context()),
+		Counts: []adminCount{
+			{"lines read", s.LinesRead.Load()},
+			{"lines sent", s.LinesSent.Load()},
+			{"batches sent", s.Batches.Load()},
+			{"filtered out", s.LinesFiltered.Load()},
+			{"sampled out", s.LinesSampledOut.Load()},
+			{"routed away", s.LinesRouted.Load()},
+			{"dropped over the rate limit", s.LinesRateDropped.Load()},
+			{"dropped failing to encode", s.EncodeErrors.Load()},
+			{"batches rejected", s.BatchesRejected.Load()},
+			{"send errors", s.SendErrors.Load()},
+			{"reconnects", s.Reconnects.Load()},
+		},
+	}
+	if a.Spool != nil {
+		v.Spool = []adminCount{
+			{"entries", int64(a.Spool.Len())},
+			{"bytes", a.Spool.Bytes()},
+			{"dropped", a.Spool.Dropped()},
+		}
+	}
+	if err, at := s.LastError(); err != "" {
+		v.LastError = err
+		v.LastErrorAt = at.UTC().Format(time.RFC3339) + ", " + time.Since(at).Round(time.Second).String() + " ago"
+	}
+
+	lag := a.Lag.snapshot()
+	files := make(map[string]int64)
+	maps.Copy(files, lag)
+	if v.Status != nil {
+		for file := range v.Status.Offsets {
+			if _, ok := files[file]; !ok {
+				files[file] = 0
+			}
+		}
+	}
+	for _, file := range slices.Sorted(maps.Keys(files)) {
+		f := adminFile{Name: file, Offset: "?", Lag: lag[file]}
+		if v.Status != nil {
+			if off, ok := v.Status.Offsets[file]; ok {
+				f.Offset = strconv.FormatInt(off, 10)
+			}
+		}
+		v.Files = append(v.Files, f)
+	}
+	for _, t := range a.Tees {
+		v.Tees = append(v.Tees, adminTee{Name: t.Name, Sink: t.Sink, State: t.Stats.ConnState().String(), LinesSent: t.Stats.LinesSent.Load()})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminTemplate.Execute(w, v); err != nil {
+		slog.Debug("Error writing status page", "err", err)
+	}
+}
+
+// askStatus has the sender answer a status command, or returns nil if it
+// doesn't within adminAskTimeout.
+func (a *App) askStatus(ctx context.Context) *protocol.Status {
+	ctx, cancel := context.WithTimeout(ctx, adminAskTimeout)
+	defer cancel()
+	got := make(chan *protocol.Status, 1)
+	c := command{Command: protocol.Command{Cmd: protocol.CmdStatus}, quiet: true, answer: func(r protocol.Reply) error {
+		got <- r.Status
+		return nil
+	}}
+	select {
+	case a.commands <- c:
+	case <-ctx.Done():
+		return nil
+	}
+	select {
+	case st := <-got:
+		return st
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+var adminTemplate = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>teller on {{.Hostname}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td.n { text-align: right; font-family: monospace; }
+.connected { color: #080; } .disconnected, .reconnecting, .err { color: #b00; }
+.note { color: #777; }
+</style>
+</head>
+<body>
+<h1>teller on {{.Hostname}}</h1>
+<table>
+<tr><th>version</th><td>{{.Version}}</td></tr>
+<tr><th>uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>sink</th><td>{{.Sink}}</td></tr>
+<tr><th>state</th><td class="{{.State}}">{{.State}}</td></tr>
+{{- with .Status}}
+<tr><th>server</th><td>{{.Server}}</td></tr>
+{{- if .Paused}}
+<tr><th>paused</th><td>yes</td></tr>
+{{- end}}
+{{- if .SlowDownMs}}
+<tr><th>slowed down</th><td>{{.SlowDownMs}}ms to go</td></tr>
+{{- end}}
+<tr><th>lines batched</th><td>{{.Buffered}}</td></tr>
+<tr><th>batches unacked</th><td>{{.Unacked}}</td></tr>
+{{- if .Protocol}}
+<tr><th>protocol</th><td>{{.Protocol}}</td></tr>
+{{- end}}
+{{- if .Codec}}
+<tr><th>compression</th><td>{{.Codec}}</td></tr>
+{{- end}}
+{{- if .TLS}}
+<tr><th>tls</th><td>{{.TLS}}{{with .ALPN}}, alpn {{.}}{{end}}</td></tr>
+{{- end}}
+{{- end}}
+{{- if .LastError}}
+<tr><th>last error</th><td class="err">{{.LastError}} <span class="note">({{.LastErrorAt}})</span></td></tr>
+{{- end}}
+</table>
+{{- if not .Status}}
+<p class="note">the sender didn't answer in time, it may be reconnecting: the server, offsets and connection details are left out.</p>
+{{- end}}
+
+<h2>lines</h2>
+<table>
+{{- range .Counts}}
+<tr><th>{{.Name}}</th><td class="n">{{.Value}}</td></tr>
+{{- end}}
+</table>
+{{- with .Spool}}
+
+<h2>spool</h2>
+<table>
+{{- range .}}
+<tr><th>{{.Name}}</th><td class="n">{{.Value}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .Files}}
+
+<h2>sources</h2>
+<table>
+<tr><th>file</th><th>offset</th><th>lag bytes</th></tr>
+{{- range .}}
+<tr><td>{{.Name}}</td><td class="n">{{.Offset}}</td><td class="n">{{.Lag}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- with .Tees}}
+
+<h2>tees</h2>
+<table>
+<tr><th>name</th><th>sink</th><th>state</th><th>lines sent</th></tr>
+{{- range .}}
+<tr><td>{{.Name}}</td><td>{{.Sink}}</td><td class="{{.State}}">{{.State}}</td><td class="n">{{.LinesSent}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+<p class="note">reloads every {{.Refresh}}s. <a href="/metrics">/metrics</a> has the rest.</p>
+</body>
+</html>
+`))
@@ -0,0 +1,740 @@
+// Package agent is teller's shipping, for embedding in another program. A
+// Config says what to read and where to ship it, New checks it and sets an
+// App up, Run ships until its context is done and Close lets go of what New
+// opened. The teller command is a thin wrapper around it, turning flags into
+// a Config.
+package agent
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// ErrUndelivered is what Run returns with Once when some of what was read
+// couldn't be delivered.
+var ErrUndelivered = errors.New("not everything was delivered")
+
+// ErrMaxRuntime, as the cause of Run's context ending, has the stop event
+// say teller stopped for having run as long as it was meant to, rather than
+// being told to.
+var ErrMaxRuntime = errors.New("reached the maximum run time")
+
+// Config is everything New needs to set an App up. Each field is the teller
+// flag named after it, and taken the same way; see teller -h and the README
+// for what they do. DefaultConfig has the flags' defaults, and a zero field
+// means what the flag's zero value does, so start from it.
+type Config struct {
+	SourceKind       string   // -source
+	Files            []string // -file; "-" alone is stdin, and none is log.txt
+	Programs         []SourceProgram
+	Program          string
+	ProcName         string
+	EventLogChannels []string
+	JournalUnits     []string // -journald-unit
+	FromBeginning    bool
+	Once             bool
+	WaitForFile      time.Duration
+	CatchUpRotated   bool
+	RotatedPattern   string
+	// Readers, if set, are read instead of SourceKind's source, each until
+	// EOF as stdin is and under the name it's keyed by, for a host that
+	// hands teller its logs rather than have it open them, as under WASI.
+	Readers map[string]io.Reader
+
+	Hostname string
+	FQDN     bool
+	Pid      int      // 0 for this process's own
+	Tags     []string // -tag key=value pairs
+
+	StateFile     string
+	StateDir      string
+	StateInterval time.Duration // -state-save-interval
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolKeyFile  string
+	FailoverFile  string
+	// ReplayFailover is -replay-failover-file.
+	ReplayFailover bool
+
+	BatchSize            int
+	BatchBytes           int           // -write-buffer-size
+	BatchInterval        time.Duration // -batch-flush-interval
+	Compression          string
+	AckWindow            int
+	AckTimeout           time.Duration
+	MaxBufferBytes       int // -max-memory-buffer-bytes
+	MaxReconnectAttempts int
+
+	Servers        []string
+	ServerStrategy string
+	AddressFamily  string
+	Proxy          string // -proxy, socks5://[user:password@]host[:port]
+	// TLS is -ca-cert, -server-name, -insecure, -client-cert, -client-key,
+	// -pin-sha256 and -alpn.
+	TLS               TLSOptions
+	ZeroRTT           bool // -enable-0rtt
+	MaxClockSkew      time.Duration
+	CorrectClockSkew  bool
+	DialTimeout       time.Duration
+	WriteTimeout      time.Duration
+	CloseTimeout      time.Duration
+	KeepAlive         time.Duration // -keepalive-period
+	IdleTimeout       time.Duration // -max-idle-timeout
+	StartupJitter     time.Duration
+	HeartbeatInterval time.Duration
+	Lifecycle         bool // -lifecycle-events
+	StatsInterval     time.Duration
+
+	ParseFormat      string
+	ReportParseErrs  bool // -report-parse-errors
+	TimestampRegex   string
+	TimestampLayout  string
+	TimestampTZ      string
+	TimestampField   string
+	TimestampFormat  string
+	FieldMap         []string
+	OmitEmpty        bool
+	IncludeMeta      bool // -include-metadata
+	LevelRegex       string
+	MaxLineBytes     int
+	Delimiter        string
+	DedupWindow      time.Duration
+	DedupStrip       string
+	MultilinePattern string
+	MultilineTimeout time.Duration
+
+	Include           []*regexp.Regexp
+	Exclude           []*regexp.Regexp
+	Redact            []*regexp.Regexp
+	RedactPresets     []string
+	RedactPlaceholder string
+	SampleRate        float64
+	SampleMode        string
+	MaxLinesPerSec    float64
+	MaxBytesPerSec    float64
+	RateLimitMode     string
+
+	Sink             string
+	SyslogFormat     string
+	UDPMaxPacketSize int
+	HTTP3Path        string
+	Tees             []string // -tee specs
+	Routes           []string // -route rules
+	StreamPerFile    bool
+	UseDatagrams     bool
+	PriorityLevel    string
+	Control          bool
+	ControlSocket    string
+
+	MetricsAddr       string
+	AdminUI           bool // status page at / on MetricsAddr
+	HealthAddr        string
+	ReadyTimeout      time.Duration
+	ConnStatsInterval time.Duration // -log-conn-stats
+	LagWarnBytes      int64
+	LagWarnAfter      time.Duration
+
+	// ConfigDigest goes in lifecycle events to tell configurations apart;
+	// teller's is a hash of its flags.
+	ConfigDigest string
+	// LogLevel is what the control stream's log-level command changes. Nil
+	// has the command refused.
+	LogLevel *slog.LevelVar
+	// Version, Commit and BuildDate describe the build, for the server and
+	// teller_build_info.
+	Version   string
+	Commit    string
+	BuildDate string
+
+	// dryRun, set by Validate, has New leave the spools unopened.
+	dryRun bool
+}
+
+// DefaultConfig is a Config with teller's defaults.
+func DefaultConfig() Config {
+	return Config{
+		SourceKind:        "file",
+		Program:           defaultProgram,
+		RotatedPattern:    ".*",
+		StateInterval:     5 * time.Second,
+		SpoolMaxBytes:     100 << 20,
+		BatchSize:         100,
+		BatchBytes:        1 << 20,
+		BatchInterval:     200 * time.Millisecond,
+		Compression:       "none",
+		AckTimeout:        30 * time.Second,
+		Servers:           []string{"neo.nullferatu.com:5140"},
+		ServerStrategy:    "priority",
+		AddressFamily:     familyAuto,
+		DialTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		CloseTimeout:      5 * time.Second,
+		KeepAlive:         10 * time.Second,
+		IdleTimeout:       time.Minute,
+		HeartbeatInterval: 5 * time.Second,
+		Lifecycle:         true,
+		ParseFormat:       "raw",
+		TimestampLayout:   "rfc3339",
+		TimestampField:    "time",
+		TimestampFormat:   "rfc3339",
+		MultilineTimeout:  time.Second,
+		Delimiter:         `\n`,
+		RedactPlaceholder: "[REDACTED]",
+		SampleRate:        1,
+		SampleMode:        "random",
+		RateLimitMode:     "block",
+		Sink:              sinkQUIC,
+		SyslogFormat:      "rfc5424",
+		UDPMaxPacketSize:  1472,
+		HTTP3Path:         "/",
+		ReadyTimeout:      30 * time.Second,
+		LagWarnAfter:      time.Minute,
+		Version:           "dev",
+	}
+}
+
+// New checks cfg and sets up an App, along with its tees, to ship what it
+// says. Saved offsets are loaded and spools opened, so Close it when done.
+func New(cfg Config) (*App, error) {
+	files := cfg.Files
+	if len(files) == 1 && files[0] == "-" {
+		cfg.SourceKind = "stdin"
+	}
+	if len(files) == 0 {
+		files = []string{"log.txt"}
+	}
+	channels := cfg.EventLogChannels
+	if len(channels) == 0 {
+		channels = []string{"Application", "System"}
+	}
+	switch cfg.SourceKind {
+	case "file", "eventlog", "journald", "stdin":
+	default:
+		return nil, fmt.Errorf("invalid -source %q (want file, eventlog, journald or stdin)", cfg.SourceKind)
+	}
+	if cfg.SourceKind == "file" && cfg.Readers == nil && !tailsFiles {
+		return nil, fmt.Errorf("-source file can't tail files under WASI, read stdin instead (-source stdin)")
+	}
+	if cfg.Once && (cfg.SourceKind == "eventlog" || cfg.SourceKind == "journald") {
+		return nil, fmt.Errorf("-once only works with -source file or stdin")
+	}
+
+	codec, err := protocol.ParseCodec(cfg.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -compression: %v", err)
+	}
+
+	tlsConf, certs, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %v", err)
+	}
+	if cfg.ZeroRTT {
+		// Shared by every Clone, so tickets outlive the connection they
+		// came on
+		tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	if cfg.MaxClockSkew < 0 {
+		return nil, fmt.Errorf("-max-clock-skew can't be negative")
+	}
+	if cfg.CorrectClockSkew && cfg.MaxClockSkew == 0 {
+		return nil, fmt.Errorf("-correct-clock-skew needs -max-clock-skew")
+	}
+
+	if cfg.HeartbeatInterval <= 0 {
+		return nil, fmt.Errorf("-heartbeat-interval must be positive")
+	}
+	// The whole batch goes in one frame when compressed or ACKed, so it has
+	// to fit in one, with room for the line that tips it over
+	if cfg.BatchBytes <= 0 || cfg.BatchBytes > protocol.MaxFrameSize/2 {
+		return nil, fmt.Errorf("-write-buffer-size must be between 1 and %d", protocol.MaxFrameSize/2)
+	}
+	if cfg.MaxBufferBytes != 0 && cfg.MaxBufferBytes < cfg.BatchBytes {
+		return nil, fmt.Errorf("-max-memory-buffer-bytes must be 0 or at least -write-buffer-size (%d)", cfg.BatchBytes)
+	}
+	if cfg.StateInterval <= 0 {
+		return nil, fmt.Errorf("-state-save-interval must be positive")
+	}
+	if cfg.DialTimeout <= 0 {
+		return nil, fmt.Errorf("-dial-timeout must be positive")
+	}
+	if cfg.StartupJitter < 0 {
+		return nil, fmt.Errorf("-startup-jitter can't be negative")
+	}
+	if cfg.WaitForFile < 0 {
+		return nil, fmt.Errorf("-wait-for-file can't be negative")
+	}
+	if cfg.StateFile != "" && cfg.StateDir != "" {
+		return nil, fmt.Errorf("-state-file and -state-dir can't both be set")
+	}
+	if cfg.CatchUpRotated {
+		if cfg.SourceKind != "file" || (cfg.StateFile == "" && cfg.StateDir == "") {
+			return nil, fmt.Errorf("-catch-up-rotated needs -source file and a -state-file or -state-dir")
+		}
+		if _, err := filepath.Match("x"+cfg.RotatedPattern, ""); err != nil || cfg.RotatedPattern == "" {
+			return nil, fmt.Errorf("invalid -rotated-pattern %q", cfg.RotatedPattern)
+		}
+	}
+	if cfg.Pid < 0 {
+		return nil, fmt.Errorf("-pid must be a positive integer")
+	}
+	if cfg.AdminUI && cfg.MetricsAddr == "" {
+		return nil, fmt.Errorf("-admin-ui needs -metrics-addr to serve it on")
+	}
+	if cfg.HealthAddr != "" && cfg.ReadyTimeout <= cfg.HeartbeatInterval {
+		slog.Warn("-ready-timeout isn't longer than -heartbeat-interval, an idle teller will flap between ready and not",
+			"ready_timeout", cfg.ReadyTimeout, "heartbeat_interval", cfg.HeartbeatInterval)
+	}
+	if cfg.IdleTimeout <= 0 {
+		return nil, fmt.Errorf("-max-idle-timeout must be positive")
+	}
+	if cfg.KeepAlive < 0 {
+		return nil, fmt.Errorf("-keepalive-period can't be negative")
+	}
+	if cfg.WriteTimeout < 0 {
+		return nil, fmt.Errorf("-write-timeout can't be negative")
+	}
+	if cfg.AckTimeout < 0 {
+		return nil, fmt.Errorf("-ack-timeout can't be negative")
+	}
+	if cfg.CloseTimeout < 0 {
+		return nil, fmt.Errorf("-close-timeout can't be negative")
+	}
+	if cfg.KeepAlive >= cfg.IdleTimeout {
+		slog.Warn("-keepalive-period isn't shorter than -max-idle-timeout, idle connections will time out between keep-alives",
+			"keepalive", cfg.KeepAlive, "idle_timeout", cfg.IdleTimeout)
+	}
+
+	switch cfg.ParseFormat {
+	case "raw", "rfc3164", "rfc5424", "json":
+	default:
+		return nil, fmt.Errorf("invalid -parse-format %q (want raw, rfc3164, rfc5424 or json)", cfg.ParseFormat)
+	}
+
+	var mlStart *regexp.Regexp
+	if cfg.MultilinePattern != "" {
+		if mlStart, err = regexp.Compile(cfg.MultilinePattern); err != nil {
+			return nil, fmt.Errorf("invalid -multiline-pattern: %v", err)
+		}
+	}
+
+	if cfg.MaxLineBytes < 0 {
+		return nil, fmt.Errorf("-max-line-bytes can't be negative")
+	}
+	delim, err := parseDelimiter(cmp.Or(cfg.Delimiter, `\n`))
+	if err != nil {
+		return nil, fmt.Errorf("invalid -delimiter: %v", err)
+	}
+	if cfg.DedupWindow < 0 {
+		return nil, fmt.Errorf("-dedup-window can't be negative")
+	}
+	var ddStrip *regexp.Regexp
+	if cfg.DedupStrip != "" {
+		if ddStrip, err = regexp.Compile(cfg.DedupStrip); err != nil {
+			return nil, fmt.Errorf("invalid -dedup-strip: %v", err)
+		}
+	}
+
+	var lvlRegex *regexp.Regexp
+	var stamps *timestampParser
+	if cfg.TimestampRegex != "" {
+		if stamps, err = newTimestampParser(cfg.TimestampRegex, cfg.TimestampLayout, cfg.TimestampTZ); err != nil {
+			return nil, fmt.Errorf("invalid -timestamp-regex: %v", err)
+		}
+	}
+
+	if cfg.LevelRegex != "" {
+		if lvlRegex, err = regexp.Compile(cfg.LevelRegex); err != nil {
+			return nil, fmt.Errorf("invalid -level-regex: %v", err)
+		}
+		if lvlRegex.SubexpIndex("level") < 0 {
+			return nil, fmt.Errorf("invalid -level-regex: no (?P<level>...) group")
+		}
+	}
+
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("-sample-rate must be between 0 and 1")
+	}
+	if cfg.SampleMode != "random" && cfg.SampleMode != "hash" {
+		return nil, fmt.Errorf("invalid -sample-mode %q (want random or hash)", cfg.SampleMode)
+	}
+
+	switch cfg.Sink {
+	case sinkQUIC, sinkTCP, sinkTLS, sinkUDP, sinkGRPC, sinkHTTP3, sinkStdout, sinkNull:
+	default:
+		return nil, fmt.Errorf("invalid -sink %q (want quic, tcp, tls, udp, grpc, http3, stdout or null)", cfg.Sink)
+	}
+	if !hasSockets && cfg.Sink != sinkStdout && cfg.Sink != sinkNull {
+		return nil, fmt.Errorf("-sink %s can't reach a server under WASI, which has no sockets; use -sink stdout for the host to ship what teller prints", cfg.Sink)
+	}
+	if !strings.HasPrefix(cfg.HTTP3Path, "/") {
+		return nil, fmt.Errorf("invalid -http3-path %q (want one starting with /)", cfg.HTTP3Path)
+	}
+	evSchema, err := newSchema(cfg.FieldMap, cfg.OmitEmpty, cfg.TimestampFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -field-map or -timestamp-format: %v", err)
+	}
+	// Syslog sinks read the events back to format them
+	if evSchema != nil && !jsonSink(cfg.Sink) {
+		return nil, fmt.Errorf("-field-map, -omit-empty and -timestamp-format only apply to -sink quic, http3, stdout or null")
+	}
+	if _, ok := syslogFormats[cfg.SyslogFormat]; !ok {
+		return nil, fmt.Errorf("invalid -syslog-format %q (want rfc5424 or rfc3164)", cfg.SyslogFormat)
+	}
+	if cfg.UDPMaxPacketSize <= 0 {
+		return nil, fmt.Errorf("-udp-max-packet-size must be positive")
+	}
+
+	if cfg.ReplayFailover && cfg.FailoverFile == "" {
+		return nil, fmt.Errorf("-replay-failover-file needs -failover-file")
+	}
+	if cfg.StreamPerFile && cfg.SpoolDir != "" {
+		return nil, fmt.Errorf("-stream-per-file can't be used with -spool-dir")
+	}
+	if cfg.UseDatagrams && (cfg.AckWindow > 0 || cfg.StreamPerFile) {
+		// Datagrams are never acknowledged, and belong to no stream
+		return nil, fmt.Errorf("-use-datagrams can't be used with -ack-window or -stream-per-file")
+	}
+	var prioSev *int
+	if cfg.PriorityLevel != "" {
+		sev, ok := severities[strings.ToLower(cfg.PriorityLevel)]
+		if !ok {
+			return nil, fmt.Errorf("invalid -priority-level %q", cfg.PriorityLevel)
+		}
+		if cfg.SpoolDir != "" || cfg.StreamPerFile {
+			return nil, fmt.Errorf("-priority-level can't be used with -spool-dir or -stream-per-file")
+		}
+		prioSev = &sev
+	}
+
+	redactor, err := newRedactor(cfg.RedactPresets, cfg.Redact, cfg.RedactPlaceholder)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -redact-preset: %v", err)
+	}
+
+	if cfg.RateLimitMode != "block" && cfg.RateLimitMode != "drop" {
+		return nil, fmt.Errorf("invalid -rate-limit-mode %q (want block or drop)", cfg.RateLimitMode)
+	}
+
+	var servers []string
+	for _, s := range cfg.Servers {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no -server given")
+	}
+	for _, s := range servers {
+		if err := checkServer(s); err != nil {
+			return nil, fmt.Errorf("invalid -server: %v", err)
+		}
+	}
+	switch cfg.AddressFamily {
+	case familyAuto, familyIPv4, familyIPv6:
+	default:
+		return nil, fmt.Errorf("invalid -address-family %q (want auto, ipv4 or ipv6)", cfg.AddressFamily)
+	}
+	var proxy *socksProxy
+	if cfg.Proxy != "" {
+		if proxy, err = parseProxy(cfg.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid -proxy: %v", err)
+		}
+		switch cfg.Sink {
+		case sinkQUIC, sinkHTTP3, sinkTCP, sinkTLS:
+		default:
+			return nil, fmt.Errorf("-proxy only works with -sink quic, http3, tcp or tls")
+		}
+	}
+	if cfg.ServerStrategy != "priority" && cfg.ServerStrategy != "round-robin" {
+		return nil, fmt.Errorf("invalid -server-strategy %q (want priority or round-robin)", cfg.ServerStrategy)
+	}
+	for _, spec := range cfg.Tees {
+		if _, _, err := parseTee(spec); err != nil {
+			return nil, fmt.Errorf("invalid -tee: %v", err)
+		}
+	}
+	if len(cfg.Tees) > 0 && cfg.SourceKind == "stdin" {
+		return nil, fmt.Errorf("-tee can't be used with -source stdin")
+	}
+	if len(cfg.Tees) > 0 && cfg.Readers != nil {
+		return nil, fmt.Errorf("-tee can't be used with Readers, which only one App can read")
+	}
+	routes, err := parseRoutes(cfg.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -route: %v", err)
+	}
+	if routes != nil {
+		for _, to := range routes.targets() {
+			if to != "sink" && !slices.ContainsFunc(cfg.Tees, func(spec string) bool { return teeName(spec) == to }) {
+				return nil, fmt.Errorf("invalid -route: no -tee %s to route to", to)
+			}
+		}
+	}
+
+	hostname, err := resolveHostname(cfg.Hostname, cfg.FQDN)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Shipping as", "hostname", hostname)
+	fqdn := hostname
+	if !strings.Contains(fqdn, ".") {
+		fqdn = lookupFQDN(fqdn)
+	}
+	tags, err := parseTags(cfg.Tags, map[string]string{
+		"teller_version": cfg.Version,
+		"fqdn":           fqdn,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid -tag: %v", err)
+	}
+	var spoolKey []byte
+	if cfg.SpoolDir != "" {
+		if spoolKey, err = loadSpoolKey(cfg.SpoolKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	newApp := func(sink string, servers []string) *App {
+		a := &App{
+			cfg:                  cfg,
+			Servers:              servers,
+			ServerStrategy:       cfg.ServerStrategy,
+			AddressFamily:        cfg.AddressFamily,
+			proxy:                proxy,
+			active:               -1,
+			TLSConfig:            tlsConf,
+			clientCert:           certs,
+			ZeroRTT:              cfg.ZeroRTT,
+			MaxClockSkew:         cfg.MaxClockSkew,
+			CorrectClockSkew:     cfg.CorrectClockSkew,
+			Sink:                 sink,
+			StreamPerFile:        cfg.StreamPerFile && sink == sinkQUIC,
+			Datagrams:            cfg.UseDatagrams && sink == sinkQUIC,
+			PrioritySeverity:     prioSev,
+			Control:              cfg.Control,
+			ControlSocket:        cfg.ControlSocket,
+			SourceKind:           cfg.SourceKind,
+			FromBeginning:        cfg.FromBeginning,
+			Once:                 cfg.Once,
+			WaitForFile:          cfg.WaitForFile,
+			CatchUpRotated:       cfg.CatchUpRotated,
+			RotatedPattern:       cfg.RotatedPattern,
+			IncludeMeta:          cfg.IncludeMeta,
+			InputFiles:           files,
+			Program:              cfg.Program,
+			ProcName:             cfg.ProcName,
+			Programs:             cfg.Programs,
+			EventLogChannels:     channels,
+			JournalUnits:         cfg.JournalUnits,
+			Hostname:             hostname,
+			Pid:                  cmp.Or(cfg.Pid, processID()),
+			started:              time.Now(),
+			commands:             make(chan command),
+			redial:               make(chan struct{}, 1),
+			StateFile:            cfg.StateFile,
+			StateDir:             cfg.StateDir,
+			StateInterval:        cfg.StateInterval,
+			MaxReconnectAttempts: cfg.MaxReconnectAttempts,
+			DialTimeout:          cfg.DialTimeout,
+			WriteTimeout:         cfg.WriteTimeout,
+			ReadyTimeout:         cfg.ReadyTimeout,
+			KeepAlive:            cfg.KeepAlive,
+			IdleTimeout:          cfg.IdleTimeout,
+			CloseTimeout:         cfg.CloseTimeout,
+			Filter:               Filter{Include: cfg.Include, Exclude: cfg.Exclude},
+			Sampler:              Sampler{Rate: cfg.SampleRate, Hash: cfg.SampleMode == "hash"},
+			routes:               routes,
+			Redactor:             redactor,
+			RateLimit:            newRateLimiter(cfg.MaxLinesPerSec, cfg.MaxBytesPerSec, cfg.RateLimitMode == "drop"),
+			Lag:                  lagTracker{Warn: cfg.LagWarnBytes, After: cfg.LagWarnAfter},
+			MultilineStart:       mlStart,
+			DedupWindow:          cfg.DedupWindow,
+			MaxLineBytes:         cfg.MaxLineBytes,
+			Delimiter:            delim,
+			DedupStrip:           ddStrip,
+			MultilineTimeout:     cfg.MultilineTimeout,
+			ParseFormat:          cfg.ParseFormat,
+			TimestampField:       cfg.TimestampField,
+			LevelRegex:           lvlRegex,
+			Timestamps:           stamps,
+			Tags:                 tags,
+			HeartbeatInterval:    cfg.HeartbeatInterval,
+			StatsInterval:        cfg.StatsInterval,
+			Lifecycle:            cfg.Lifecycle,
+			ConfigDigest:         cfg.ConfigDigest,
+			BatchSize:            max(cfg.BatchSize, 1),
+			BatchBytes:           cfg.BatchBytes,
+			BatchInterval:        cfg.BatchInterval,
+			Compression:          codec,
+			AckWindow:            max(cfg.AckWindow, 0),
+			AckTimeout:           cfg.AckTimeout,
+			MaxBufferBytes:       cfg.MaxBufferBytes,
+			FailoverFile:         cfg.FailoverFile,
+			ReplayFailover:       cfg.ReplayFailover,
+		}
+		if sink != sinkQUIC {
+			a.PrioritySeverity = nil
+		}
+		if jsonSink(sink) {
+			a.Schema = evSchema
+		}
+		if cfg.ReportParseErrs {
+			a.parseReports = &parseReporter{}
+		}
+		return a
+	}
+
+	app := newApp(cfg.Sink, servers)
+	if cfg.Readers != nil && !cfg.dryRun {
+		app.Sources = make(map[string]Source, len(cfg.Readers))
+		for name, r := range cfg.Readers {
+			app.Sources[name] = newReaderSource(r, nil, 0, app.MaxLineBytes, app.Delimiter)
+		}
+	}
+	app.loadState()
+	if cfg.SpoolDir != "" && app.Sink == sinkQUIC && !cfg.dryRun {
+		spool, err := OpenSpool(cfg.SpoolDir, cfg.SpoolMaxBytes, spoolKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spool: %v", err)
+		}
+		app.Spool = spool
+	}
+
+	// Each tee tails the sources for itself, with a state file and spool of
+	// its own, so one that's down or slow only holds itself up
+	for _, spec := range cfg.Tees {
+		sink, servers, _ := parseTee(spec)
+		t := newApp(sink, servers)
+		t.Name = teeName(spec)
+		t.Control, t.ControlSocket = false, ""
+		t.RateLimit = newRateLimiter(cfg.MaxLinesPerSec, cfg.MaxBytesPerSec, cfg.RateLimitMode == "drop")
+		// -server-name is for -server; tees go by their own hosts
+		t.TLSConfig = tlsConf.Clone()
+		t.TLSConfig.ServerName = ""
+		if t.StateFile != "" {
+			t.StateFile += "." + t.Name
+		}
+		if t.StateDir != "" {
+			t.StateDir += "." + t.Name
+		}
+		if t.FailoverFile != "" {
+			t.FailoverFile += "." + t.Name
+		}
+		t.loadState()
+		app.Tees = append(app.Tees, t)
+		if cfg.SpoolDir != "" && t.Sink == sinkQUIC && !cfg.dryRun {
+			spool, err := OpenSpool(cfg.SpoolDir+"."+t.Name, cfg.SpoolMaxBytes, spoolKey)
+			if err != nil {
+				app.Close()
+				return nil, fmt.Errorf("failed to open spool for -tee %s: %v", spec, err)
+			}
+			t.Spool = spool
+		}
+	}
+	return app, nil
+}
+
+// Run ships until ctx is done, or with Once until what the sources held is
+// shipped, to the App's sink and its tees. It starts the metrics and health
+// servers and connection stats logging if the Config asked for them; those
+// last as long as the process. With Once it returns ErrUndelivered if
+// something didn't get through.
+func (a *App) Run(ctx context.Context) error {
+	if a.cfg.MetricsAddr != "" {
+		go a.ServeMetrics(a.cfg.MetricsAddr)
+	}
+	if a.cfg.HealthAddr != "" {
+		go a.ServeHealth(a.cfg.HealthAddr)
+	}
+	if a.cfg.ConnStatsInterval > 0 && a.Sink == sinkQUIC {
+		go a.logConnStats(a.cfg.ConnStatsInterval)
+	}
+
+	// A fleet restarted at once would otherwise all dial in the same second
+	if jitter := a.cfg.StartupJitter; jitter > 0 && remoteSink(a.Sink) {
+		wait := rand.N(jitter)
+		slog.Info("Waiting before connecting", "wait", wait.Round(time.Millisecond), "jitter", jitter)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	disconnect, err := a.openSink(ctx, syslogFormats[a.cfg.SyslogFormat], a.cfg.UDPMaxPacketSize)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	defer disconnect()
+
+	switch {
+	case a.Sources != nil:
+		slog.Info("Reading sources", "sources", strings.Join(slices.Sorted(maps.Keys(a.Sources)), ","))
+	case a.SourceKind == "eventlog":
+		slog.Info("Following event log", "channels", strings.Join(a.EventLogChannels, ","))
+	case a.SourceKind == "journald":
+		slog.Info("Following journal", "units", strings.Join(a.JournalUnits, ","))
+	case a.SourceKind == "stdin":
+		slog.Info("Reading stdin")
+	default:
+		slog.Info("Tailing files", "files", strings.Join(a.InputFiles, ","))
+	}
+	// If shipping stops on its own the tees are shut down with it
+	teeCtx, stopTees := context.WithCancel(ctx)
+	defer stopTees()
+	var wg sync.WaitGroup
+	for _, t := range a.Tees {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runTee(teeCtx, t, syslogFormats[t.cfg.SyslogFormat], t.cfg.UDPMaxPacketSize)
+		}()
+	}
+	if err := a.TailAndProcess(ctx); err != nil {
+		stopTees()
+		wg.Wait()
+		return err
+	}
+	wg.Wait()
+	if !a.Once {
+		return nil
+	}
+	err = nil
+	for _, t := range append([]*App{a}, a.Tees...) {
+		if !t.shippedAll() {
+			sink := t.Sink
+			if t.Name != "" {
+				sink = t.Name
+			}
+			slog.Error("Not everything was delivered", "sink", sink)
+			err = ErrUndelivered
+		}
+	}
+	return err
+}
+
+// Close closes the spools New opened, the App's and its tees'.
+func (a *App) Close() error {
+	var errs []error
+	for _, t := range append([]*App{a}, a.Tees...) {
+		if t.Spool != nil {
+			errs = append(errs, t.Spool.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
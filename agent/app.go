@@ -0,0 +1,1822 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/teller/protocol"
+)
+
+const (
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 30 * time.Second
+
+	// Batches smaller than this aren't worth the CPU to compress and often
+	// come out bigger than they went in.
+	minCompressSize = 256
+)
+
+type SyslogLine struct {
+	Priority  *int   `json:"priority,omitempty"`
+	Version   int    `json:"version,omitempty"`
+	Timestamp string `json:"timestamp"`
+	Hostname  string `json:"hostname"`
+	Program   string `json:"program"`
+	Pid       int    `json:"pid"`
+	MsgID     string `json:"msgid,omitempty"`
+	File      string `json:"file"`
+	Message   string `json:"message"`
+
+	// Level is the line's severity name, lowercased, and Severity the
+	// matching syslog severity number where there is one.
+	Level    string `json:"level,omitempty"`
+	Severity *int   `json:"severity,omitempty"`
+
+	// SampleRate is set when only this fraction of lines is being shipped,
+	// so the server can scale counts back up.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// StructuredData is RFC5424 structured data, keyed by SD-ID and then by
+	// parameter name.
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	// Raw is the line as read, kept when parsing may not have captured all
+	// of it.
+	Raw string `json:"raw,omitempty"`
+	// Fields are a JSON line's own fields, other than the ones that went
+	// into the fields above.
+	Fields map[string]any `json:"fields,omitempty"`
+	// Tags are the -tag labels, the same on every event.
+	Tags map[string]string `json:"tags,omitempty"`
+	// RepeatCount is how many identical lines were held back by -dedup-window
+	// in favour of this one.
+	RepeatCount int `json:"repeat_count,omitempty"`
+	// Truncated says the message was cut short to -max-line-bytes.
+	Truncated bool `json:"truncated,omitempty"`
+	// Stats is teller's own numbers, on protocol.StatsProgram events only.
+	Stats *protocol.StatsReport `json:"stats,omitempty"`
+	// Lifecycle says teller started or stopped, on
+	// protocol.LifecycleProgram events only.
+	Lifecycle *protocol.Lifecycle `json:"lifecycle,omitempty"`
+	// ParseError says why Raw couldn't be parsed, on
+	// protocol.ParseErrorProgram events only.
+	ParseError *protocol.ParseError `json:"parse_error,omitempty"`
+	// Meta is where and when the line was read, with -include-metadata.
+	Meta *Meta `json:"meta,omitempty"`
+}
+
+// Meta is diagnostic detail about reading a line, for telling whether lag
+// comes from the program logging, teller or the network.
+type Meta struct {
+	// Offset is the source's position just past the line, as saved in the
+	// state file, and Cursor the journal's equivalent.
+	Offset int64  `json:"offset"`
+	Cursor string `json:"cursor,omitempty"`
+	// ReadAt is when teller read the line, and ReadLagSeconds how long
+	// after the line's own timestamp that was, if it has one.
+	ReadAt         string  `json:"read_at"`
+	ReadLagSeconds float64 `json:"read_lag_seconds,omitempty"`
+}
+
+// marks are what emit knows about an event beyond its text and fields.
+type marks struct {
+	repeats   int    // identical events dedup held back in its favour
+	truncated bool   // text was cut to MaxLineBytes
+	offset    int64  // the line's Offset, for Meta
+	cursor    string // and its Cursor
+}
+
+// event is an encoded line ready for the stream, along with the file it came
+// from and the offset just past it so the sender can record progress. A
+// forget event carries no data and tells the sender to drop the file's offset
+// because the file has been deleted. A start event marks where tailing a file
+// began, so that position is saved even before anything from it is
+// delivered; with reset set it replaces whatever position the file had. A
+// skip event carries no data either, just the position past a line that was
+// dropped, so the file's offset still moves on. cursor is the position for
+// sources, like the journal, whose positions aren't a number.
+type event struct {
+	file   string
+	offset int64
+	cursor string
+	data   []byte
+	// buf, if set, holds data and is released once it's been batched
+	buf *lineBuf
+	// priority events go out on the priority stream (see PrioritySeverity)
+	priority bool
+	forget   bool
+	start    bool
+	reset    bool
+	skip     bool
+}
+
+type App struct {
+	// cfg is what New set the App up from, for Run and for what doesn't
+	// have a field of its own: the build, the log level.
+	cfg Config
+
+	Conn   quic.Connection
+	Stream quic.Stream
+
+	// StreamPerFile has every file shipped on a stream of its own, kept in
+	// streams, while heartbeats stay on Stream. See streamFor.
+	StreamPerFile bool
+	streams       map[string]quic.Stream
+	// PrioritySeverity, if set, has lines at least that severe (numerically
+	// no greater) shipped on a priority stream of their own, so they don't
+	// queue behind a backlog of everything else. See priorityKey.
+	PrioritySeverity *int
+
+	// Control has teller open a control stream on every connection, and
+	// ControlSocket is a unix socket to take commands on as well; commands
+	// carries what arrives on either, and the status page's questions. paused
+	// is set by the pause command and stops lines being shipped. slowUntil is
+	// when a slow-down command stops holding them, zero without one.
+	Control       bool
+	ControlSocket string
+	commands      chan command
+	paused        bool
+	slowUntil     time.Time
+	slowStart     time.Time
+	slowTimer     *time.Timer
+
+	// Servers are the addresses to fail over between, ServerStrategy says in
+	// what order (priority or round-robin), and ServerAddr is whichever one
+	// we're connected to, at index active. AddressFamily limits which of a
+	// server's addresses are dialled: auto, ipv4 or ipv6.
+	Servers        []string
+	ServerStrategy string
+	ServerAddr     string
+	AddressFamily  string
+	active         int
+	// proxy, if set, is the SOCKS5 proxy to reach the servers through
+	proxy *socksProxy
+
+	TLSConfig *tls.Config
+	// clientCert is the client certificate TLSConfig presents, nil without
+	// one, and redial has the sender reconnect once ReloadClientCert has
+	// swapped it.
+	clientCert *clientCert
+	redial     chan struct{}
+	// ZeroRTT has reconnects resume the TLS session and send the stream's
+	// hello in 0-RTT data, before the handshake is done. TLSConfig needs a
+	// ClientSessionCache for there to be a session to resume. dialed is
+	// when the current connection was dialled.
+	ZeroRTT bool
+	dialed  time.Time
+
+	// Datagrams has the lines of the main stream's batches sent as QUIC
+	// datagrams, one each, when the server takes them; lines too big for
+	// one, and everything else, still go on the streams.
+	Datagrams bool
+
+	// MaxClockSkew, if set, has the stream's hello ask for the server's time
+	// and a warning logged when the local clock is further off it than this.
+	// CorrectClockSkew then stamps events with the server's time instead,
+	// by adding clockFix, the skew measured at the last handshake.
+	MaxClockSkew     time.Duration
+	CorrectClockSkew bool
+	clockFix         atomic.Int64
+
+	// OnConnState, if set, is called with the old and new state whenever
+	// the connection changes state. It may be called from any goroutine and
+	// must return quickly.
+	OnConnState func(from, to ConnState)
+
+	// FromBeginning has sources without a saved position start from the
+	// oldest line they have instead of only shipping what's new.
+	FromBeginning bool
+
+	// Once has files read to their end rather than followed, so
+	// TailAndProcess returns when what they held has been shipped; complete
+	// is set if it all got through. See shippedAll.
+	Once     bool
+	complete bool
+
+	// WaitForFile, if set, is how long a plain -file that doesn't exist at
+	// startup is waited for before it's given up on (see Watcher.await),
+	// which sets missing.
+	WaitForFile time.Duration
+	missing     bool
+
+	// CatchUpRotated has a plain -file that was rotated while teller was
+	// down have the rest of the file it was in, found among the paths
+	// matching it plus RotatedPattern, shipped first. See rotatedBacklog.
+	CatchUpRotated bool
+	RotatedPattern string
+
+	// SourceKind is where lines come from: files (InputFiles), the event
+	// log (EventLogChannels), the journal (JournalUnits) or stdin.
+	SourceKind       string
+	EventLogChannels []string
+	JournalUnits     []string
+	// Sources, if set, are shipped instead of whatever SourceKind would
+	// open, each under the name it's keyed by. Along with Output, or a Conn
+	// that isn't a real connection, it lets TailAndProcess run on lines and
+	// a destination made up for it.
+	Sources map[string]Source
+
+	// Sink is where lines go: sinkQUIC, or sinkTCP, sinkTLS, sinkUDP,
+	// sinkGRPC, sinkHTTP3, sinkStdout or sinkNull, which are written through
+	// Output instead. Any Sink other than
+	// sinkQUIC is written through Output, so a caller can bring its own.
+	Sink   string
+	Output Sink
+
+	// Name is the -tee spec a tee ships to, cleaned up for file names and
+	// metric labels, and empty for the main App. Tees are the Apps shipping
+	// the same sources to the other sinks, each with its own connection,
+	// state file and spool; they're listed here for the metrics.
+	Name string
+	Tees []*App
+
+	InputFiles []string
+	// Program is what lines are shipped as, unless Programs has a name for
+	// their file or the line has one of its own. ProcName is too, and lines
+	// naming their own program don't override it; Programs still do.
+	Program  string
+	ProcName string
+	Programs []SourceProgram
+	Hostname string
+	// Pid is what lines are shipped with, unless the line has its own.
+	// teller's own events always carry its real PID.
+	Pid       int
+	StateFile string
+	// StateDir, instead of StateFile, keeps each file's offset in a record
+	// of its own there, written only when that file's offset moves.
+	StateDir string
+	// StateInterval is how often the offsets are saved, if they've moved.
+	StateInterval time.Duration
+	// Tags go on every event. Nil means none.
+	Tags map[string]string
+
+	// Spool, when set, takes frames while the server is unreachable. up and
+	// reconnected are only used in that mode: up says whether Stream is
+	// usable, and reconnected carries the connection a background reconnect
+	// made, for the sender to take up.
+	Spool       *Spool
+	up          bool
+	reconnected chan redialed
+
+	// Lifecycle has a protocol.LifecycleProgram event sent on starting and
+	// on a graceful stop, saying which ConfigDigest teller runs with.
+	Lifecycle    bool
+	ConfigDigest string
+
+	// Filter picks which lines are shipped at all.
+	Filter Filter
+
+	// Sampler thins out the lines that pass Filter.
+	Sampler Sampler
+	// routes are the -route rules, run on the lines that make the sample.
+	// Nil means none.
+	routes *router
+
+	// Redactor blanks out secrets in the lines that make the sample.
+	Redactor Redactor
+
+	// RateLimit caps how fast lines are shipped. Nil means no cap.
+	RateLimit *rateLimiter
+	// Lag tracks how far behind each file shipping is.
+	Lag lagTracker
+
+	// MultilineStart, if set, matches lines that begin a new event; any
+	// other line is a continuation of the one before. A pending event is
+	// sent after MultilineTimeout without a new line.
+	MultilineStart   *regexp.Regexp
+	MultilineTimeout time.Duration
+
+	// DedupWindow, if set, collapses runs of identical lines arriving
+	// within it into one event plus a count. DedupStrip is cut out of
+	// lines before they're compared.
+	DedupWindow time.Duration
+	DedupStrip  *regexp.Regexp
+
+	// MaxLineBytes, if set, is the most of a line that's shipped; longer
+	// ones are cut short and marked truncated.
+	MaxLineBytes int
+
+	// Delimiter is the byte that ends each line, newline unless -delimiter
+	// says otherwise.
+	Delimiter byte
+
+	// ParseFormat is how lines are parsed into a SyslogLine: raw wraps the
+	// whole line as the message, rfc3164 and rfc5424 pull the syslog fields
+	// out, json carries a JSON object's fields over. TimestampField is the
+	// JSON field holding a line's own timestamp.
+	ParseFormat    string
+	TimestampField string
+	// parseReports, with -report-parse-errors, rations the lines that don't
+	// parse shipped as protocol.ParseErrorProgram events.
+	parseReports *parseReporter
+	// Timestamps, if set, takes each line's time from the line itself rather
+	// than from when it was read.
+	Timestamps *timestampParser
+
+	// IncludeMeta has each line carry a Meta.
+	IncludeMeta bool
+
+	// Schema, if set, lays events out as something other than teller's own
+	// JSON.
+	Schema *schema
+
+	// LevelRegex, if set, pulls the level out of each line through its
+	// "level" group.
+	LevelRegex *regexp.Regexp
+
+	// HeartbeatInterval is how often a keep-alive event is sent.
+	HeartbeatInterval time.Duration
+	// StatsInterval, if set, is how often teller ships a report of its own
+	// numbers, on the stream alongside the lines. See queueStats.
+	StatsInterval time.Duration
+	started       time.Time
+
+	// BatchSize, BatchBytes and BatchInterval bound how many lines are held
+	// back, how many bytes of them, and for how long, so they can go out in
+	// one write.
+	BatchSize     int
+	BatchBytes    int
+	BatchInterval time.Duration
+	batch         *batch
+	Stats         Stats
+
+	// Compression is the codec teller would like to compress batches with
+	// on the wire, and Codec the one the server agreed to when the stream
+	// was opened (see negotiate), which is what's used. answer is the
+	// server's reply to the hello, if it sent one; probing has the hello ask
+	// for one even when there's nothing to negotiate (see Probe).
+	Compression protocol.Codec
+	Codec       protocol.Codec
+	answer      *protocol.HelloReply
+	probing     bool
+
+	// AckWindow, when non-zero, has every batch carry a sequence number for
+	// the server to ACK, with up to AckWindow of them unacknowledged at once.
+	// A batch's offsets are only committed once it's ACKed, and unACKed
+	// batches are written again after a reconnect. acks carries the sequence
+	// numbers read off the stream. A batch that's gone AckTimeout without an
+	// ACK has teller reconnect (see checkAcks).
+	AckWindow  int
+	AckTimeout time.Duration
+	seq        uint64
+	inflight   []inflight
+	acks       chan ackMsg
+
+	// FailoverFile, if set, is where batches that can't be delivered go when
+	// there's no spool (see failOver), and ReplayFailover has them shipped
+	// from there once batches get through again, when replayDue.
+	FailoverFile   string
+	ReplayFailover bool
+	replayDue      bool
+	replaying      bool
+
+	// MaxBufferBytes, when non-zero, caps the pending batch and the unACKed
+	// batches together (see memFull). inflightBytes is the size of the
+	// unACKed ones, and memStalled whether reading is held off for it.
+	MaxBufferBytes int
+	inflightBytes  int
+	memStalled     bool
+
+	events chan event
+	// quit is cancelled once TailAndProcess has returned, so the tailers
+	// and readers feeding it stop rather than wait on it forever
+	quit context.Context
+
+	// saved holds the offsets read from StateFile at startup. offsets is the
+	// sender's view: per file, the position just past the last line written
+	// to the stream. savedCursors and cursors are the same for sources with
+	// cursors.
+	saved        map[string]int64
+	offsets      map[string]int64
+	savedCursors map[string]string
+	cursors      map[string]string
+	// savedHeads and heads are the first bytes of each file, with
+	// CatchUpRotated; see updateHeads. heads is nil without it.
+	savedHeads map[string][]byte
+	heads      map[string][]byte
+	// dirty is set when offsets or cursors have changed since the last save,
+	// and changed has which files' did, with StateDir
+	dirty   bool
+	changed map[string]bool
+
+	// MaxReconnectAttempts bounds how many times reconnect will redial before
+	// giving up. Zero means keep trying forever.
+	MaxReconnectAttempts int
+	// DialTimeout bounds each attempt to connect to a server, and
+	// WriteTimeout each write to a stream on it.
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+	// ReadyTimeout is how long teller may go without a successful write
+	// before /readyz says it isn't ready.
+	ReadyTimeout time.Duration
+	// KeepAlive and IdleTimeout are the QUIC keep-alive period and max idle
+	// timeout.
+	KeepAlive   time.Duration
+	IdleTimeout time.Duration
+	// CloseTimeout is how long to wait on exit for the server to have the
+	// last of what was sent.
+	CloseTimeout time.Duration
+}
+
+// TailAndProcess ships lines until every tail has ended or ctx is cancelled.
+// On cancellation the pending batch is flushed and offsets saved before it
+// returns. An error means shipping stopped on its own, because the server
+// couldn't be reached or written to.
+func (a *App) TailAndProcess(ctx context.Context) error {
+	var stop context.CancelFunc
+	a.quit, stop = context.WithCancel(context.Background())
+	defer stop()
+
+	// Without loadState there's simply nothing saved to start from
+	a.offsets = make(map[string]int64)
+	a.cursors = make(map[string]string)
+	maps.Copy(a.offsets, a.saved)
+	maps.Copy(a.cursors, a.savedCursors)
+	for file, off := range a.offsets {
+		a.Lag.set(file, off)
+	}
+	if a.CatchUpRotated {
+		a.heads = maps.Clone(a.savedHeads)
+		if a.heads == nil {
+			a.heads = make(map[string][]byte)
+		}
+	}
+	go a.Lag.run(a.HeartbeatInterval, a.quit.Done())
+
+	// Each file gets its own tailer, or each channel its own reader; they
+	// all feed the one sender below
+	var run func()
+	switch {
+	case a.Sources != nil:
+		run = a.runSources
+	case a.SourceKind == "eventlog":
+		run = a.runEventLog
+	case a.SourceKind == "journald":
+		run = a.runJournal
+	case a.SourceKind == "stdin":
+		run = a.runStdin
+	default:
+		w, err := NewWatcher(a, a.InputFiles)
+		if err != nil {
+			return fmt.Errorf("error setting up file watcher: %v", err)
+		}
+		run = w.Run
+	}
+	// Opened before the tailers start, so failing to open it leaves
+	// nothing running behind
+	if a.ControlSocket != "" {
+		stop := make(chan struct{})
+		defer close(stop)
+		ln, err := a.listenControl(a.ControlSocket, stop)
+		if err != nil {
+			return fmt.Errorf("error opening control socket %s: %v", a.ControlSocket, err)
+		}
+		defer ln.Close()
+	}
+	a.events = make(chan event)
+	a.acks = make(chan ackMsg, 64)
+	a.streams = make(map[string]quic.Stream)
+	go func() {
+		run()
+		close(a.events)
+	}()
+
+	// Open one stream for sending logs
+	if a.Sink == sinkQUIC {
+		if err := a.OpenStream(ctx); err != nil {
+			return fmt.Errorf("error opening QUIC stream to %s: %v", a.ServerAddr, err)
+		}
+	}
+	// finish can commit offsets, so it goes before saveState
+	defer a.saveState()
+	defer a.finish()
+	a.up = true
+	a.reconnected = make(chan redialed, 1)
+	if a.Spool != nil && a.Spool.Len() > 0 {
+		slog.Info("Draining spooled entries from a previous run", "entries", a.Spool.Len())
+		a.drain(ctx)
+	}
+
+	if a.Sink == sinkQUIC {
+		slog.Info("Stream opened, sending logs", "server", a.ServerAddr)
+	}
+	a.batch = newBatch(a.StreamPerFile)
+	if a.Lifecycle {
+		if err := a.queueLifecycle(protocol.PhaseStart, ""); err != nil {
+			slog.Warn("Error encoding start event", "err", err)
+		}
+		if err := a.flush(ctx); err != nil {
+			return fmt.Errorf("error writing to stream: %v", err)
+		}
+	}
+	// Whatever didn't get through last time goes first
+	if a.ReplayFailover {
+		if err := a.replayFailover(ctx); err != nil {
+			return fmt.Errorf("error writing to stream: %v", err)
+		}
+	}
+
+	ticker := time.NewTicker(a.HeartbeatInterval)
+	defer ticker.Stop()
+	saveTicker := time.NewTicker(a.StateInterval)
+	defer saveTicker.Stop()
+	var ackTick <-chan time.Time
+	if a.acking() && a.AckTimeout > 0 {
+		t := time.NewTicker(max(a.AckTimeout/4, 10*time.Millisecond))
+		defer t.Stop()
+		ackTick = t.C
+	}
+	var statsTick <-chan time.Time
+	if a.StatsInterval > 0 {
+		t := time.NewTicker(a.StatsInterval)
+		defer t.Stop()
+		statsTick = t.C
+	}
+
+	flushTimer := time.NewTimer(a.BatchInterval)
+	flushTimer.Stop()
+	defer flushTimer.Stop()
+	defer func() {
+		slog.Info("Sent lines", "lines", a.Stats.LinesSent.Load(), "batches", a.Stats.Batches.Load(),
+			"avg_batch", a.Stats.AvgBatchSize())
+		if a.Codec != protocol.CodecNone {
+			c := a.Stats.codec(a.Codec)
+			slog.Info("Compressed batches", "raw_bytes", a.Stats.RawBytes.Load(), "wire_bytes", a.Stats.WireBytes.Load(),
+				"codec", a.Codec.String(), "ratio", a.Stats.CompressionRatio(), "recent_ratio", c.Ratio(),
+				"compress_time", time.Duration(c.Nanos.Load()).Round(time.Microsecond))
+		}
+	}()
+
+	// flushWaiting is set when the flush timer fired while the ACK window was
+	// full, so the batch goes out as soon as there's room.
+	flushWaiting := false
+
+	for {
+		// With the window full, or shipping held and the batch full, lines
+		// are left waiting in the tailers
+		events := a.events
+		a.Stats.BufferBytes.Store(int64(a.batch.size + a.inflightBytes))
+		if a.windowFull() || (a.held() && a.batchFull()) {
+			events = nil
+		} else if a.memFull() {
+			if !a.memStalled {
+				a.Stats.BufferStalls.Add(1)
+				slog.Debug("Memory buffer full, holding off reading", "server", a.ServerAddr, "bytes", a.batch.size+a.inflightBytes)
+			}
+			events = nil
+		}
+		a.memStalled = events == nil && a.memFull()
+
+		select {
+		case <-ctx.Done():
+			reason := "shutdown"
+			if errors.Is(context.Cause(ctx), ErrMaxRuntime) {
+				reason = "max runtime"
+			}
+			slog.Info("Shutting down, flushing pending lines", "reason", reason)
+			a.queueStop(reason)
+			if err := a.flush(ctx); err != nil {
+				slog.Error("Error writing to stream", "server", a.ServerAddr, "err", err)
+			}
+			return nil
+
+		case ev, ok := <-events:
+			if !ok {
+				slog.Info("All tails closed, exiting")
+				a.queueStop("sources ended")
+				if err := a.flush(ctx); err != nil {
+					return fmt.Errorf("error writing to stream: %v", err)
+				}
+				a.complete = true
+				return nil
+			}
+			if ev.forget {
+				// Send what we have first so its offset isn't committed
+				// after the file has been forgotten
+				if err := a.flush(ctx); err != nil {
+					return fmt.Errorf("error writing to stream: %v", err)
+				}
+				delete(a.offsets, ev.file)
+				delete(a.cursors, ev.file)
+				delete(a.heads, ev.file)
+				a.touch(ev.file)
+				a.Lag.forget(ev.file)
+				continue
+			}
+			if ev.skip {
+				a.skipped(ev)
+				continue
+			}
+			if ev.start {
+				if _, ok := a.offsets[ev.file]; !ok || ev.reset {
+					delete(a.heads, ev.file)
+					a.offsets[ev.file] = ev.offset
+					a.touch(ev.file)
+					a.Lag.set(ev.file, ev.offset)
+				}
+				continue
+			}
+			a.batch.add(ev)
+			ev.buf.release()
+			if a.batch.lines == 1 {
+				flushTimer.Reset(a.BatchInterval)
+			}
+			if a.batchFull() && !a.held() {
+				if err := a.flush(ctx); err != nil {
+					return fmt.Errorf("error writing to stream: %v", err)
+				}
+			}
+
+		case c := <-a.commands:
+			a.handleCommand(ctx, c)
+
+		case <-a.redial:
+			if err := a.redialNow(ctx); err != nil {
+				return fmt.Errorf("error reconnecting: %v", err)
+			}
+
+		case <-a.slowDownDone():
+			slog.Info("Server slow-down over, sending again", "server", a.ServerAddr, "held", time.Since(a.slowStart).Round(time.Millisecond))
+			a.slowUntil = time.Time{}
+			if a.batch.lines > 0 && !a.held() && !a.windowFull() {
+				flushWaiting = false
+				if err := a.flush(ctx); err != nil {
+					return fmt.Errorf("error writing to stream: %v", err)
+				}
+			}
+
+		case <-flushTimer.C:
+			if a.windowFull() || a.held() {
+				flushWaiting = true
+				continue
+			}
+			if err := a.flush(ctx); err != nil {
+				return fmt.Errorf("error writing to stream: %v", err)
+			}
+
+		case m := <-a.acks:
+			a.ack(m)
+			if a.up && a.Spool != nil && a.Spool.Len() > 0 {
+				a.drain(ctx)
+			}
+			if flushWaiting && !a.windowFull() && !a.held() {
+				flushWaiting = false
+				if err := a.flush(ctx); err != nil {
+					return fmt.Errorf("error writing to stream: %v", err)
+				}
+			}
+
+		case r := <-a.reconnected:
+			if r.err != nil {
+				a.setConnState(StateDisconnected)
+				return fmt.Errorf("error reconnecting: %v", r.err)
+			}
+			a.use(r.link)
+			if err := a.OpenStream(ctx); err != nil {
+				slog.Warn("Error opening QUIC stream", "server", a.ServerAddr, "err", err)
+				a.Stats.noteError(err)
+				a.goDown(ctx)
+				continue
+			}
+			a.reconnectedTo()
+			a.up = true
+			// Anything that couldn't be spooled when the connection went
+			// is older than what's in the spool
+			if err := a.resend(); err != nil {
+				slog.Warn("Error resending unacknowledged batches", "server", a.ServerAddr, "err", err)
+				a.Stats.noteError(err)
+				a.goDown(ctx)
+				continue
+			}
+			slog.Info("Draining spooled entries", "server", a.ServerAddr, "entries", a.Spool.Len())
+			a.drain(ctx)
+			if err := a.flush(ctx); err != nil {
+				return fmt.Errorf("error writing to stream: %v", err)
+			}
+
+		case <-ticker.C:
+			if err := a.heartbeat(ctx); err != nil {
+				// With a failover file batches can do without the server,
+				// so keep going and let the next one try again
+				if a.FailoverFile != "" {
+					slog.Warn("Heartbeat failed", "server", a.ServerAddr, "err", err)
+					continue
+				}
+				return fmt.Errorf("heartbeat failed: %v", err)
+			}
+
+		case <-ackTick:
+			if err := a.checkAcks(ctx); err != nil {
+				return fmt.Errorf("error reconnecting: %v", err)
+			}
+
+		case <-statsTick:
+			if err := a.queueStats(); err != nil {
+				slog.Warn("Error reporting stats", "err", err)
+				continue
+			}
+			if a.batch.lines == 1 {
+				flushTimer.Reset(a.BatchInterval)
+			}
+
+		case <-saveTicker.C:
+			// Saving every so often, rather than on every ACK, means a crash
+			// replays at most a few seconds of lines without touching disk
+			// for each one
+			a.saveState()
+		}
+	}
+}
+
+// tailFile starts tailing file at offset. With reopen the path keeps being
+// followed across rotations; without it the tail ends once the file is gone.
+// A gzipped file, an archive rather than a live log, is read once to its end
+// and not followed, with offsets counting the bytes it decompresses to.
+func (a *App) tailFile(file string, offset int64, reopen bool) (Source, error) {
+	if isGzip(file) {
+		if !a.Once {
+			slog.Info("File is gzipped, reading it to the end rather than tailing it", "file", file)
+		}
+		return openRotated(file, offset, a.MaxLineBytes, a.Delimiter)
+	}
+	return newFileSource(file, offset, reopen, a.Once, a.MaxLineBytes, a.Delimiter)
+}
+
+// pump hands each line from src to the sender until the source ends. file
+// names the source, and is what its offsets are saved under. With a
+// multiline pattern set, lines are first glued into events, and a pending
+// event is sent once no more lines have arrived for MultilineTimeout.
+// Events that come with their own fields are never glued together. With a
+// dedup window set, runs of identical events are then collapsed. The source
+// is stopped if the sender stops first.
+func (a *App) pump(file string, src Source) {
+	var ml *multiline
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if a.MultilineStart != nil {
+		ml = &multiline{start: a.MultilineStart}
+		timer = time.NewTimer(a.MultilineTimeout)
+		timer.Stop()
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	emit := func(l Line, repeats int) { a.emit(file, l, repeats) }
+	send := func(l Line) { emit(l, 0) }
+	var dd *dedup
+	var ddTimer *time.Timer
+	var ddTimeout <-chan time.Time
+	if a.DedupWindow > 0 {
+		dd = &dedup{strip: a.DedupStrip, held: &a.Stats.LinesDeduped}
+		ddTimer = time.NewTimer(a.DedupWindow)
+		ddTimer.Stop()
+		defer ddTimer.Stop()
+		ddTimeout = ddTimer.C
+		send = func(l Line) {
+			if dd.add(l, emit) {
+				ddTimer.Reset(a.DedupWindow)
+			}
+		}
+	}
+
+	for {
+		select {
+		case line, ok := <-src.Lines():
+			if !ok {
+				if text, end, ok := ml.take(); ok {
+					send(Line{Text: text, Offset: end})
+				}
+				if dd != nil {
+					dd.close(emit)
+				}
+				slog.Info("Tail channel closed", "file", file)
+				return
+			}
+			if line.Err != nil {
+				slog.Error("Tail error", "file", file, "err", line.Err)
+				continue
+			}
+			a.Stats.LinesRead.Add(1)
+
+			if ml == nil || line.Event != nil {
+				send(line)
+				continue
+			}
+			if text, end, ok := ml.add(line.Text, line.Offset); ok {
+				send(Line{Text: text, Offset: end})
+			}
+			timer.Reset(a.MultilineTimeout)
+
+		case <-timeout:
+			if text, end, ok := ml.take(); ok {
+				send(Line{Text: text, Offset: end})
+			}
+
+		case <-ddTimeout:
+			dd.close(emit)
+
+		case <-a.quit.Done():
+			src.Stop()
+			return
+		}
+	}
+}
+
+// emit filters, encodes and hands one event to the sender. l.Offset is the
+// offset in file just past the event's last line, and repeats how many
+// identical events dedup held back in its favour.
+func (a *App) emit(file string, l Line, repeats int) {
+	text := l.Text
+	m := marks{repeats: repeats, offset: l.Offset, cursor: l.Cursor}
+	if !utf8.ValidString(text) || (l.Event != nil && !utf8.ValidString(l.Event.Message)) {
+		text = a.sanitize(text, &l)
+	}
+	if a.MaxLineBytes > 0 && len(text) > a.MaxLineBytes {
+		text, m.truncated = truncateUTF8(text, a.MaxLineBytes), true
+		a.Stats.LinesTruncated.Add(1)
+	}
+	if !a.Filter.Match(text) {
+		a.Stats.LinesFiltered.Add(1)
+		slog.Debug("Line filtered out", "file", file)
+		a.skip(file, l)
+		return
+	}
+	if !a.Sampler.Keep(text) {
+		a.Stats.LinesSampledOut.Add(1)
+		a.skip(file, l)
+		return
+	}
+	if len(a.Redactor.Rules) > 0 {
+		text = a.redact(text, &l)
+	}
+	lb, err := a.encode(file, text, l.Event, m)
+	if err != nil {
+		a.Stats.EncodeErrors.Add(1)
+		slog.Warn("Error marshalling JSON, dropping line", "file", file, "offset", l.Offset, "err", err)
+		a.skip(file, l)
+		return
+	}
+	if a.routes != nil {
+		ship, resampled := a.route(file, text, lb)
+		if !ship {
+			a.Stats.LinesRouted.Add(1)
+			lb.release()
+			a.skip(file, l)
+			return
+		}
+		if resampled {
+			lb.buf.Reset()
+			if lb, err = lb.marshal(a.Schema); err != nil {
+				a.Stats.EncodeErrors.Add(1)
+				slog.Warn("Error marshalling JSON, dropping line", "file", file, "offset", l.Offset, "err", err)
+				a.skip(file, l)
+				return
+			}
+		}
+	}
+	ok, throttled := a.RateLimit.wait(a.quit, len(lb.Bytes()))
+	if throttled {
+		a.Stats.LinesThrottled.Add(1)
+	}
+	if a.quit.Err() != nil {
+		lb.release()
+		return
+	}
+	if !ok {
+		a.Stats.LinesRateDropped.Add(1)
+		slog.Debug("Line dropped by rate limit", "file", file)
+		lb.release()
+		a.skip(file, l)
+		return
+	}
+	a.deliver(event{file: file, offset: l.Offset, cursor: l.Cursor, data: lb.Bytes(), buf: lb, priority: a.urgent(lb.sl)})
+}
+
+// skip tells the sender l was dropped, so file's offset moves past it.
+func (a *App) skip(file string, l Line) {
+	a.deliver(event{file: file, offset: l.Offset, cursor: l.Cursor, skip: true})
+}
+
+// skipped moves ev.file's position past a dropped line, once every line
+// read from the file before it is committed: with the pending batch if
+// that has lines from the file, behind the batches awaiting an ACK if there
+// are any, or else right away.
+func (a *App) skipped(ev event) {
+	offsets := map[string]int64{ev.file: ev.offset}
+	cursors := map[string]string{}
+	if ev.cursor != "" {
+		cursors[ev.file] = ev.cursor
+	}
+	_, pending := a.batch.offsets[ev.file]
+	switch n := len(a.inflight); {
+	case pending:
+		maps.Copy(a.batch.offsets, offsets)
+		maps.Copy(a.batch.cursors, cursors)
+	case n > 0 && a.inflight[n-1].acked && a.inflight[n-1].offsets != nil && a.inflight[n-1].cursors != nil:
+		// The last one is only waiting its turn too, so this joins it
+		// rather than piling up entries while the filter drops a run
+		maps.Copy(a.inflight[n-1].offsets, offsets)
+		maps.Copy(a.inflight[n-1].cursors, cursors)
+	case n > 0:
+		a.inflight = append(a.inflight, inflight{acked: true, offsets: offsets, cursors: cursors})
+	default:
+		a.commit(offsets, cursors)
+	}
+}
+
+// deliver hands ev to the sender. It reports false, and ev is dropped, if
+// the sender has stopped.
+func (a *App) deliver(ev event) bool {
+	select {
+	case a.events <- ev:
+		return true
+	case <-a.quit.Done():
+		ev.buf.release()
+		return false
+	}
+}
+
+// sanitize replaces invalid UTF-8 in text, and in the message of l's event
+// if it has one, with U+FFFD, returning the sanitized text. Filters,
+// redaction and the syslog sinks then all see the same characters the
+// server will, and a line passed through as its own JSON stays valid JSON.
+func (a *App) sanitize(text string, l *Line) string {
+	a.Stats.LinesBadUTF8.Add(1)
+	if l.Event != nil {
+		ev := *l.Event
+		ev.Message = strings.ToValidUTF8(ev.Message, "\uFFFD")
+		l.Event = &ev
+	}
+	return strings.ToValidUTF8(text, "\uFFFD")
+}
+
+// redact applies the Redactor to text, and to the message of l's event if it
+// has one, returning the redacted text.
+func (a *App) redact(text string, l *Line) string {
+	text, n := a.Redactor.Redact(text)
+	if l.Event != nil {
+		ev := *l.Event
+		var m int
+		ev.Message, m = a.Redactor.Redact(ev.Message)
+		n += m
+		l.Event = &ev
+	}
+	if n > 0 {
+		a.Stats.LinesRedacted.Add(1)
+		a.Stats.Redactions.Add(int64(n))
+	}
+	return text
+}
+
+// urgent reports whether sl belongs on the priority stream. Lines passed
+// through as their own JSON have no severity we know of, so they never are.
+func (a *App) urgent(sl SyslogLine) bool {
+	return a.PrioritySeverity != nil && sl.Severity != nil && *sl.Severity <= *a.PrioritySeverity
+}
+
+// encode turns a raw line into the JSON payload of a frame, in a pooled
+// lineBuf the caller releases. Lines that already look like JSON are passed
+// through as-is. Events that came with fields of their own (pre) only have
+// the gaps filled in.
+func (a *App) encode(file, text string, pre *SyslogLine, m marks) (*lineBuf, error) {
+	lb := getLineBuf()
+	sl := &lb.sl
+	if pre != nil {
+		*sl = *pre
+		sl.File = file
+		if program, force := a.programFor(file); force {
+			sl.Program = program
+		}
+		if m.truncated {
+			sl.Message = text
+		}
+		if sl.Hostname == "" {
+			sl.Hostname = a.Hostname
+		}
+		if sl.Level == "" {
+			setLevel(sl, a.LevelRegex, text)
+		}
+		if a.Sampler.Rate < 1 {
+			sl.SampleRate = a.Sampler.Rate
+		}
+		sl.Tags = a.Tags
+		sl.RepeatCount = m.repeats
+		sl.Truncated = m.truncated
+		if a.IncludeMeta {
+			lb.setMeta(m, time.Now(), sl.Timestamp != "")
+		}
+		return lb.marshal(a.Schema)
+	}
+	trimmedLine := strings.TrimSpace(text)
+	// A truncated line isn't valid JSON any more, so it's shipped as text
+	if a.ParseFormat != "json" && !m.truncated && len(trimmedLine) > 0 && trimmedLine[0] == '{' {
+		lb.buf.WriteString(trimmedLine)
+		return lb, nil
+	}
+	// Prepare the log line
+	now := a.now()
+	program, force := a.programFor(file)
+	*sl = SyslogLine{
+		Hostname: a.Hostname,
+		Program:  program,
+		Pid:      a.Pid,
+		File:     file,
+		Message:  text,
+	}
+	// Lines that don't parse are shipped raw rather than dropped
+	parsed := true
+	switch a.ParseFormat {
+	case "rfc3164":
+		parsed = parseRFC3164(sl, text, now)
+	case "rfc5424":
+		parsed = parseRFC5424(sl, text)
+	case "json":
+		parsed = parseJSON(sl, trimmedLine, a.TimestampField)
+	}
+	if force {
+		sl.Program = program
+	}
+	failed := ""
+	if !parsed {
+		a.Stats.ParseErrors.Add(1)
+		failed = a.ParseFormat
+	}
+	if a.Timestamps != nil {
+		if ts, ok := a.Timestamps.parse(text, now); ok {
+			sl.Timestamp = ts.Format(time.RFC3339Nano)
+		} else {
+			a.Stats.TimestampFallbacks.Add(1)
+			failed = cmp.Or(failed, "timestamp")
+		}
+	}
+	if failed != "" && a.parseReports != nil {
+		a.reportParseError(failed, file, text)
+	}
+	// Parsing leaves it empty if the line has no timestamp of its own
+	stamped := sl.Timestamp != ""
+	if !stamped {
+		sl.Timestamp = now.Format(time.RFC3339)
+	}
+	if sl.Level == "" {
+		setLevel(sl, a.LevelRegex, text)
+	}
+	if a.Sampler.Rate < 1 {
+		sl.SampleRate = a.Sampler.Rate
+	}
+	sl.Tags = a.Tags
+	sl.RepeatCount = m.repeats
+	sl.Truncated = m.truncated
+	if a.IncludeMeta {
+		lb.setMeta(m, now, stamped)
+	}
+
+	return lb.marshal(a.Schema)
+}
+
+// flush sends the pending batch and, once it's out, commits its offsets.
+// Frames are length-prefixed so the server can find message boundaries no
+// matter how the bytes get split up. With a stream per file, each file's
+// share of the batch goes out on its own stream. Priority lines go first, on
+// the priority stream; their offsets travel with the rest of the batch, or
+// with them if there's nothing else, as the rest is older or no newer.
+func (a *App) flush(ctx context.Context) error {
+	failed := a.Stats.FailoverLines.Load()
+	if err := a.flushBatch(ctx); err != nil {
+		return err
+	}
+	// Batches are getting through again, so the ones that didn't can follow
+	if a.replayDue && !a.replaying && a.Stats.FailoverLines.Load() == failed {
+		return a.replayFailover(ctx)
+	}
+	return nil
+}
+
+// flushBatch is flush without the failover file's replay.
+func (a *App) flushBatch(ctx context.Context) error {
+	if a.batch.lines == 0 {
+		return nil
+	}
+	if a.Sink != sinkQUIC {
+		if err := a.writeLocal(ctx); err != nil {
+			if a.FailoverFile == "" {
+				return err
+			}
+			if err := a.failOver(a.batch.buf, a.batch.offsets, a.batch.cursors, err); err != nil {
+				return err
+			}
+			a.batch.reset()
+			return nil
+		}
+		a.commit(a.batch.offsets, a.batch.cursors)
+		a.Stats.Batches.Add(1)
+		a.Stats.LinesSent.Add(int64(a.batch.lines))
+		a.batch.reset()
+		return nil
+	}
+	if len(a.batch.prio) > 0 {
+		offsets, cursors := a.batch.offsets, a.batch.cursors
+		if len(a.batch.buf) > 0 {
+			offsets, cursors = nil, nil
+		}
+		if err := a.sendBatch(ctx, priorityKey, a.batch.prio, offsets, cursors); err != nil {
+			return err
+		}
+	}
+	if !a.StreamPerFile && len(a.batch.buf) > 0 {
+		buf := a.batch.buf
+		if a.Datagrams {
+			buf = a.sendDatagrams(buf)
+		}
+		if len(buf) == 0 {
+			a.commit(a.batch.offsets, a.batch.cursors)
+		} else if err := a.sendBatch(ctx, "", buf, a.batch.offsets, a.batch.cursors); err != nil {
+			return err
+		}
+	}
+	for file, buf := range a.batch.files {
+		var offsets map[string]int64
+		if o, ok := a.batch.offsets[file]; ok {
+			offsets = map[string]int64{file: o}
+		}
+		var cursors map[string]string
+		if c, ok := a.batch.cursors[file]; ok {
+			cursors = map[string]string{file: c}
+		}
+		if err := a.sendBatch(ctx, file, buf, offsets, cursors); err != nil {
+			return err
+		}
+	}
+	a.Stats.Batches.Add(1)
+	a.Stats.LinesSent.Add(int64(a.batch.lines))
+	a.batch.reset()
+	return nil
+}
+
+// sendBatch compresses and sends the frames in buf on key's stream, then
+// commits offsets. When ACKing, the offsets wait in a.inflight for the
+// server's ACK instead.
+func (a *App) sendBatch(ctx context.Context, key string, buf []byte, offsets map[string]int64, cursors map[string]string) error {
+	out := a.compress(buf)
+	var seq uint64
+	if a.acking() {
+		seq = a.nextSeq()
+		out = protocol.AppendBatchFrame(nil, seq, out)
+	}
+	if a.overflow(len(out)) {
+		// No room to keep it until it's ACKed, but the spool is as good.
+		// Batches still awaiting an ACK were sent before it, so its offsets
+		// wait behind theirs, and sends drain the spool first, so it goes
+		// out behind them too. If the connection drops before then they're
+		// spooled ahead of it.
+		if err := a.Spool.Push(out); err != nil {
+			return err
+		}
+		a.Stats.BufferOverflows.Add(1)
+		a.Stats.RawBytes.Add(int64(len(buf)))
+		a.Stats.WireBytes.Add(int64(len(out)))
+		a.inflight = append(a.inflight, inflight{key: key, acked: true, offsets: maps.Clone(offsets), cursors: maps.Clone(cursors)})
+		return nil
+	}
+	spooled, err := a.send(ctx, key, out)
+	if err != nil {
+		if a.FailoverFile == "" {
+			return err
+		}
+		return a.failOver(buf, offsets, cursors, err)
+	}
+	a.Stats.RawBytes.Add(int64(len(buf)))
+	a.Stats.WireBytes.Add(int64(len(out)))
+	switch {
+	case a.acking() && !spooled:
+		a.inflight = append(a.inflight, inflight{key: key, seq: seq, frame: out, offsets: maps.Clone(offsets), cursors: maps.Clone(cursors), sent: time.Now()})
+		a.inflightBytes += len(out)
+		a.Stats.Unacked.Store(int64(a.unacked()))
+	case a.acking() && len(a.inflight) > 0:
+		// Spooled behind batches that couldn't be, so it waits on them
+		a.inflight = append(a.inflight, inflight{key: key, acked: true, offsets: maps.Clone(offsets), cursors: maps.Clone(cursors)})
+	default:
+		a.commit(offsets, cursors)
+	}
+	return nil
+}
+
+// compress packs the frames in buf into one compressed frame, unless
+// compression is off, buf is too small to bother, or it didn't shrink.
+func (a *App) compress(buf []byte) []byte {
+	if a.Codec == protocol.CodecNone || len(buf) < minCompressSize {
+		return buf
+	}
+	start := time.Now()
+	z, err := protocol.Compress(a.Codec, buf)
+	if err != nil {
+		slog.Warn("Error compressing batch, sending it uncompressed", "err", err)
+		return buf
+	}
+	took := time.Since(start)
+	if protocol.HeaderSize+len(z) >= len(buf) {
+		a.Stats.codec(a.Codec).add(len(buf), len(buf), took)
+		return buf
+	}
+	a.Stats.codec(a.Codec).add(len(buf), protocol.HeaderSize+len(z), took)
+	return protocol.AppendCodecFrame(nil, a.Codec, z)
+}
+
+// send ships one or more frames on key's stream, and reports whether they
+// went to the spool rather than the stream. Without a spool it's just Write.
+// With one, which means there's only the main stream, a failed
+// write parks the frames on disk and reconnects in the background, and later
+// frames queue up behind it until the connection is back and the spool has
+// drained, so ordering is kept.
+func (a *App) send(ctx context.Context, key string, frame []byte) (spooled bool, err error) {
+	if a.Spool == nil {
+		return false, a.Write(ctx, key, frame)
+	}
+	if a.up && a.Spool.Len() > 0 {
+		a.drain(ctx)
+	}
+	if a.up && a.Spool.Len() == 0 {
+		err := a.writeStream(key, frame)
+		if err == nil {
+			return false, nil
+		}
+		slog.Warn("Error writing to stream (server might be down), spooling", "server", a.ServerAddr, "err", explainHandshakeError(err, a.TLSConfig))
+		a.goDown(ctx)
+	}
+	return true, a.Spool.Push(frame)
+}
+
+// heartbeat sends a keep-alive. While spooling there's no stream to beat on,
+// and a heartbeat is never worth spooling.
+func (a *App) heartbeat(ctx context.Context) error {
+	if a.Sink != sinkQUIC {
+		return nil
+	}
+	frame, err := protocol.AppendHeartbeatFrame(nil, protocol.Heartbeat{
+		Timestamp: a.now().Format(time.RFC3339),
+		Hostname:  a.Hostname,
+		Pid:       processID(),
+	})
+	if err != nil {
+		return err
+	}
+	if a.Spool == nil {
+		if err := a.Write(ctx, "", frame); err != nil {
+			return err
+		}
+		a.Stats.Heartbeats.Add(1)
+		return nil
+	}
+	if !a.up {
+		return nil
+	}
+	if err := a.writeStream("", frame); err != nil {
+		slog.Warn("Heartbeat failed (server might be down), spooling", "server", a.ServerAddr, "err", err)
+		a.goDown(ctx)
+		return nil
+	}
+	a.Stats.Heartbeats.Add(1)
+	return nil
+}
+
+// goDown marks the stream unusable and redials in the background, the new
+// connection landing on a.reconnected. Only the dialling happens there; the
+// sender takes the connection up and opens the stream on it, so nothing
+// else of the App is touched behind its back. Batches still waiting on an
+// ACK are spooled, since there's no telling whether they arrived.
+func (a *App) goDown(ctx context.Context) {
+	a.up = false
+	if a.acking() {
+		a.spoolInflight()
+	}
+	a.hangUp()
+	order := a.serverOrder()
+	go func() {
+		var r redialed
+		r.err = a.retry(ctx, func() (err error) {
+			r.link, err = a.connect(ctx, order)
+			return err
+		})
+		a.reconnected <- r
+	}()
+}
+
+// drain writes out the spool, oldest first. A record is only removed once
+// it's been written, so a failure part way leaves the rest queued for the
+// next reconnect. When ACKing, what's written waits in flight for its ACK
+// like any other batch, and draining stops while the window is full, to go
+// on as ACKs come in.
+func (a *App) drain(ctx context.Context) {
+	for !a.windowFull() {
+		frame, err := a.Spool.Peek()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			slog.Error("Error reading spool", "err", err)
+			return
+		}
+		if err := a.writeStream("", frame); err != nil {
+			slog.Warn("Error draining spool (server might be down)", "server", a.ServerAddr, "err", err)
+			a.goDown(ctx)
+			return
+		}
+		if err := a.Spool.Pop(); err != nil {
+			slog.Error("Error updating spool", "err", err)
+			return
+		}
+		a.drained(frame)
+	}
+}
+
+// Write sends data on key's stream. If the write fails the connection is
+// torn down and re-established, any unACKed batches are resent, and the same
+// payload is retried, so the caller only sees an error once reconnecting has
+// given up.
+func (a *App) Write(ctx context.Context, key string, data []byte) error {
+	err := a.writeStream(key, data)
+	for err != nil {
+		slog.Warn("Error writing to stream (server might be down)", "server", a.ServerAddr, "err", explainHandshakeError(err, a.TLSConfig))
+		if err := a.reconnect(ctx); err != nil {
+			return err
+		}
+		if err = a.resend(); err == nil {
+			err = a.writeStream(key, data)
+		}
+	}
+	return nil
+}
+
+// writeStream is a single attempt at writing to key's stream, keeping the
+// connection metrics up to date. A per-file stream that fails while the
+// connection is still alive is replaced and the write tried once more on the
+// new one, so trouble with one file's stream doesn't cost a reconnect.
+func (a *App) writeStream(key string, data []byte) error {
+	s, err := a.streamFor(key)
+	if err == nil {
+		err = a.writeTo(s, data)
+	}
+	if err != nil && key != "" && a.Conn.Context().Err() == nil {
+		slog.Warn("Error writing to file stream, opening a new one", "server", a.ServerAddr, "file", key, "err", err)
+		a.Stats.SendErrors.Add(1)
+		a.Stats.noteError(err)
+		a.dropStream(key)
+		if s, err = a.streamFor(key); err == nil {
+			err = a.writeTo(s, data)
+		}
+	}
+	if err != nil {
+		if key != "" {
+			a.dropStream(key)
+		}
+		a.Stats.SendErrors.Add(1)
+		a.Stats.noteError(err)
+		a.setConnState(StateDisconnected)
+		return err
+	}
+	a.Stats.LastWrite.Store(time.Now().UnixNano())
+	return nil
+}
+
+// writeTo writes all of data to s, giving up after WriteTimeout. QUIC flow
+// control makes a write wait for as long as the server isn't reading, which
+// would otherwise wedge the sender along with it; a write that times out is
+// an error like any other, and has the stream replaced or teller reconnect,
+// with the whole of data sent again on the new one. A write that stops short
+// without an error is carried on from where it got to, since a frame cut
+// short would have the server take the next one's bytes for the rest of it.
+// When an error leaves part of data written, s is reset, so the server sees
+// the stream fail rather than a frame that's half there, and s mustn't be
+// written to again.
+func (a *App) writeTo(s quic.SendStream, data []byte) error {
+	if a.WriteTimeout > 0 {
+		s.SetWriteDeadline(time.Now().Add(a.WriteTimeout))
+	}
+	for written := 0; written < len(data); {
+		n, err := s.Write(data[written:])
+		written += n
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			if written > 0 {
+				s.CancelWrite(0)
+				return fmt.Errorf("%w (wrote %d of %d bytes, so the stream was reset)", err, written, len(data))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenStream opens the stream logs are shipped on, introducing teller on it.
+func (a *App) OpenStream(ctx context.Context) error {
+	stream, err := a.Conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	h := protocol.StreamHello{Purpose: "logs", Hostname: a.Hostname, Version: a.cfg.Version, Protocol: protocol.Version}
+	if a.Compression != protocol.CodecNone {
+		h.Codecs = []string{a.Compression.String(), protocol.CodecNone.String()}
+	} else if a.MaxClockSkew > 0 || a.probing {
+		// Offering no compression still gets an answer, with the time in it
+		h.Codecs = []string{protocol.CodecNone.String()}
+	}
+	hello, err := protocol.AppendHelloFrame(nil, h)
+	if err != nil {
+		return err
+	}
+	asked := time.Now()
+	if err := a.writeTo(stream, hello); err != nil {
+		stream.CancelWrite(0)
+		return err
+	}
+	if early, ok := a.Conn.(quic.EarlyConnection); ok && a.ZeroRTT {
+		if stream, err = a.confirmEarly(ctx, early, stream, hello); err != nil {
+			return err
+		}
+	}
+	a.Stats.LastWrite.Store(time.Now().UnixNano())
+	a.Codec = a.negotiate(stream, asked)
+	a.Stream = stream
+	if a.Datagrams && !a.Conn.ConnectionState().SupportsDatagrams {
+		slog.Warn("Server doesn't take datagrams, sending everything on the stream", "server", a.ServerAddr)
+	}
+	if a.acking() {
+		go a.readAcks(stream, "")
+	}
+	if a.Control {
+		if err := a.openControl(); err != nil {
+			slog.Warn("Error opening control stream", "server", a.ServerAddr, "err", err)
+		}
+	}
+	// Per-file and priority streams belonged to the old connection, and are
+	// reopened on this one as they're needed
+	if len(a.streams) > 0 {
+		a.closeStreams()
+	}
+	return nil
+}
+
+// confirmEarly waits for the handshake of a connection dialled for 0-RTT to
+// finish, so the hello on stream is all that goes out before the server has
+// proved who it is; a hello is harmless if replayed, a batch isn't. If the
+// server turned the early data down, stream went with it, and the hello is
+// sent again on a new one.
+func (a *App) confirmEarly(ctx context.Context, early quic.EarlyConnection, stream quic.Stream, hello []byte) (quic.Stream, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.DialTimeout)
+	defer cancel()
+	conn, err := early.NextConnection(ctx)
+	if err == nil {
+		err = context.Cause(conn.Context())
+	}
+	if err != nil {
+		stream.CancelWrite(0)
+		return nil, fmt.Errorf("error completing handshake: %v", explainHandshakeError(err, a.TLSConfig))
+	}
+	a.Conn = conn
+	handshakeDone(&a.Stats, link{conn: conn, dialed: a.dialed}, a.ServerAddr)
+	// A stream lost to the rejection fails even an empty write
+	if _, err := stream.Write(nil); !errors.Is(err, quic.Err0RTTRejected) {
+		return stream, nil
+	}
+	slog.Debug("Server turned down 0-RTT, sending the hello again", "server", a.ServerAddr)
+	if stream, err = conn.OpenStreamSync(ctx); err != nil {
+		return nil, err
+	}
+	if err := a.writeTo(stream, hello); err != nil {
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// handshakeDone records how long the handshake of the connection just
+// made took, counted from the dial, and whether it resumed a session.
+func handshakeDone(stats *Stats, l link, addr string) {
+	took := time.Since(l.dialed)
+	cs := l.conn.ConnectionState()
+	c := &stats.Conn
+	c.Handshake.Store(int64(took))
+	if cs.TLS.DidResume {
+		c.Resumed.Add(1)
+	}
+	if cs.Used0RTT {
+		c.EarlyData.Add(1)
+	}
+	slog.Debug("Handshake done", "server", addr, "took", took.Round(time.Microsecond), "resumed", cs.TLS.DidResume, "0rtt", cs.Used0RTT)
+}
+
+// helloTimeout is how long to wait for the server to pick a codec before
+// taking it for one that predates negotiating.
+const helloTimeout = 2 * time.Second
+
+// negotiate waits for the server's answer to the codecs the stream's hello,
+// sent at asked, offered, and returns the codec it picked. An older server
+// doesn't answer, and one that answers with something teller didn't offer
+// can't be trusted to decompress anything, so both get CodecNone.
+func (a *App) negotiate(stream quic.Stream, asked time.Time) protocol.Codec {
+	if a.Compression == protocol.CodecNone && a.MaxClockSkew <= 0 && !a.probing {
+		return protocol.CodecNone
+	}
+	stream.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+	r, err := protocol.ReadHelloReply(stream)
+	if err != nil {
+		if a.Compression == protocol.CodecNone {
+			slog.Warn("Server didn't answer the hello, can't check the clock against it", "server", a.ServerAddr, "err", err)
+		} else {
+			slog.Warn("Server didn't agree to a compression codec, sending uncompressed", "server", a.ServerAddr, "codec", a.Compression, "err", err)
+		}
+		return protocol.CodecNone
+	}
+	a.answer = &r
+	a.checkClock(r.Time, asked, time.Now())
+	if a.Compression == protocol.CodecNone {
+		return protocol.CodecNone
+	}
+	c, err := protocol.ParseCodec(r.Codec)
+	if err != nil || (c != a.Compression && c != protocol.CodecNone) {
+		slog.Warn("Server picked a codec teller didn't offer, sending uncompressed", "server", a.ServerAddr, "codec", r.Codec)
+		return protocol.CodecNone
+	}
+	if c != a.Compression {
+		slog.Warn("Server can't decompress, sending uncompressed", "server", a.ServerAddr, "codec", a.Compression)
+	} else {
+		slog.Debug("Server agreed to compression", "server", a.ServerAddr, "codec", c, "protocol", r.Protocol)
+	}
+	return c
+}
+
+// checkClock works out how far the local clock is from the server's, which
+// said it was serverTime somewhere between asked and got, so is taken to
+// have answered halfway between them. The skew is the server's time less
+// ours, positive when the local clock is behind.
+func (a *App) checkClock(serverTime string, asked, got time.Time) {
+	if a.MaxClockSkew <= 0 {
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, serverTime)
+	if err != nil {
+		slog.Debug("Server didn't say what time it is, can't check the clock against it", "server", a.ServerAddr)
+		return
+	}
+	skew := t.Sub(asked.Add(got.Sub(asked) / 2))
+	a.Stats.ClockSkew.Store(int64(skew))
+	if skew.Abs() <= a.MaxClockSkew {
+		a.clockFix.Store(0)
+		slog.Debug("Clock checked against the server's", "server", a.ServerAddr, "skew", skew.Round(time.Millisecond))
+		return
+	}
+	slog.Warn("Local clock is off from the server's, check NTP", "server", a.ServerAddr, "skew", skew.Round(time.Millisecond), "max", a.MaxClockSkew, "correcting", a.CorrectClockSkew)
+	if a.CorrectClockSkew {
+		a.clockFix.Store(int64(skew))
+	}
+}
+
+// now is the time to stamp events with: the local clock, or the server's
+// as of the last handshake when -correct-clock-skew has found them apart.
+func (a *App) now() time.Time {
+	return time.Now().Add(time.Duration(a.clockFix.Load()))
+}
+
+// reconnect closes the stale connection and dials the server again with
+// exponential backoff and jitter. The tail itself is never touched, so lines
+// that arrive while we're away simply wait in the tail until we're back.
+// Cancelling ctx, on shutdown, stops it mid-wait or mid-dial.
+func (a *App) reconnect(ctx context.Context) error {
+	a.hangUp()
+	err := a.retry(ctx, func() error {
+		if err := a.InitQUICConnection(ctx); err != nil {
+			return err
+		}
+		if err := a.OpenStream(ctx); err != nil {
+			a.Conn.CloseWithError(0, "stream open failed")
+			a.setConnState(StateReconnecting)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		a.setConnState(StateDisconnected)
+		return err
+	}
+	a.reconnectedTo()
+	return nil
+}
+
+// hangUp closes the stale connection ahead of reconnecting.
+func (a *App) hangUp() {
+	a.setConnState(StateDisconnected)
+	if a.Conn != nil {
+		a.Conn.CloseWithError(0, "reconnecting")
+	}
+	a.setConnState(StateReconnecting)
+}
+
+// reconnectedTo logs and counts a reconnect that's been seen through.
+func (a *App) reconnectedTo() {
+	slog.Info("Reconnected", "server", a.ServerAddr, "handshake", time.Duration(a.Stats.Conn.Handshake.Load()).Round(time.Microsecond))
+	a.Stats.Reconnects.Add(1)
+}
+
+// retry calls try, with exponential backoff and jitter ahead of each
+// attempt, until it succeeds, MaxReconnectAttempts have failed or ctx is
+// cancelled.
+func (a *App) retry(ctx context.Context, try func() error) error {
+	backoff := initialBackoff
+	for attempt := 1; a.MaxReconnectAttempts == 0 || attempt <= a.MaxReconnectAttempts; attempt++ {
+		// Full backoff plus up to 50% extra so a fleet doesn't redial in lockstep
+		wait := backoff + rand.N(backoff/2)
+		slog.Info("Reconnecting", "wait", wait.Round(time.Millisecond), "attempt", attempt)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up reconnecting: %v", ctx.Err())
+		}
+		backoff = min(backoff*2, maxBackoff)
+
+		if err := try(); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("gave up reconnecting: %v", ctx.Err())
+			}
+			slog.Warn("Reconnect failed", "attempt", attempt, "err", err)
+			a.Stats.noteError(err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("giving up after %d reconnect attempts", a.MaxReconnectAttempts)
+}
+
+// InitQUICConnection connects to the first server that will have us, in the
+// order the server strategy dictates, and makes it the active one. Each dial
+// gets DialTimeout, and cancelling ctx abandons the lot.
+func (a *App) InitQUICConnection(ctx context.Context) error {
+	l, err := a.connect(ctx, a.serverOrder())
+	if err != nil {
+		return err
+	}
+	a.use(l)
+	return nil
+}
+
+// link is a connection made to one of the Servers, not yet in use.
+// redialed is what a background reconnect comes back with.
+type (
+	link struct {
+		conn   quic.Connection
+		server int // index into Servers
+		dialed time.Time
+	}
+	redialed struct {
+		link link
+		err  error
+	}
+)
+
+// connect tries the servers in order, and returns a connection to the first
+// one that will have us. It leaves the App as it is, so it can be run off
+// the sender.
+func (a *App) connect(ctx context.Context, order []int) (link, error) {
+	var errs []error
+	for _, i := range order {
+		addr := a.Servers[i]
+		l, err := a.dial(ctx, addr)
+		if err != nil {
+			if len(a.Servers) > 1 {
+				slog.Warn("Error connecting", "server", addr, "err", err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		l.server = i
+		return l, nil
+	}
+	if len(errs) == 1 {
+		return link{}, errs[0]
+	}
+	return link{}, fmt.Errorf("no server reachable: %v", errors.Join(errs...))
+}
+
+// use makes l the current connection, and its server the active one.
+func (a *App) use(l link) {
+	addr := a.Servers[l.server]
+	if a.active >= 0 && a.active != l.server {
+		slog.Info("Switched server", "from", a.Servers[a.active], "server", addr)
+	}
+	a.Conn, a.dialed = l.conn, l.dialed
+	a.active = l.server
+	a.ServerAddr = addr
+	a.setConnState(StateConnected)
+}
+
+// serverOrder lists server indexes in the order to try them. priority always
+// starts from the top of the list, so teller fails back to the first server
+// as soon as it's reachable again. round-robin starts from the server after
+// the active one, spreading reconnects across the list.
+func (a *App) serverOrder() []int {
+	start := 0
+	if a.ServerStrategy == "round-robin" && a.active >= 0 {
+		start = a.active + 1
+	}
+	order := make([]int, len(a.Servers))
+	for i := range order {
+		order[i] = (start + i) % len(a.Servers)
+	}
+	return order
+}
+
+// dial opens a QUIC connection to addr.
+func (a *App) dial(ctx context.Context, addr string) (link, error) {
+	// Using KeepAlive so the connection doesn't die silently
+	quicConf := &quic.Config{
+		KeepAlivePeriod: a.KeepAlive,
+		MaxIdleTimeout:  a.IdleTimeout,
+		EnableDatagrams: a.Datagrams,
+		Tracer:          a.Stats.Conn.tracer,
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, a.DialTimeout)
+	targets, err := resolveUDP(rctx, addr, a.AddressFamily)
+	cancel()
+	if err != nil {
+		return link{}, fmt.Errorf("error resolving %s: %v", addr, err)
+	}
+	tlsConf := a.TLSConfig.Clone()
+	if tlsConf.ServerName == "" {
+		// quic-go would go by the address dialled, not the name
+		tlsConf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	// A name with several addresses, say an IPv6 and an IPv4 one, has them
+	// tried in turn, each for up to DialTimeout
+	var errs []error
+	for _, target := range targets {
+		l, err := a.dialUDP(ctx, target, tlsConf, quicConf)
+		if err == nil {
+			if !a.ZeroRTT {
+				handshakeDone(&a.Stats, l, addr)
+			}
+			return l, nil
+		}
+		if len(targets) > 1 {
+			slog.Debug("Error dialing address", "server", addr, "addr", target, "err", err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", target, explainHandshakeError(err, a.TLSConfig)))
+	}
+	return link{}, fmt.Errorf("error dialing QUIC: %v", errors.Join(errs...))
+}
+
+// dialUDP dials the QUIC server at target from a socket of target's family,
+// or through the proxy's UDP relay, which is closed along with the
+// connection.
+func (a *App) dialUDP(ctx context.Context, target *net.UDPAddr, tlsConf *tls.Config, quicConf *quic.Config) (link, error) {
+	network := "udp6"
+	if target.IP.To4() != nil {
+		network = "udp4"
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.DialTimeout)
+	defer cancel()
+	var pc net.PacketConn
+	var err error
+	if a.proxy != nil {
+		pc, err = a.proxy.listenUDP(ctx)
+	} else {
+		pc, err = net.ListenUDP(network, nil)
+	}
+	if err != nil {
+		return link{}, err
+	}
+
+	dialed := time.Now()
+	var conn quic.Connection
+	if a.ZeroRTT {
+		// With a session ticket from an earlier connection this returns
+		// before the handshake is done; OpenStream sees it through
+		conn, err = quic.DialEarly(ctx, pc, target, tlsConf, quicConf)
+	} else {
+		conn, err = quic.Dial(ctx, pc, target, tlsConf, quicConf)
+	}
+	if err != nil {
+		pc.Close()
+		return link{}, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		pc.Close()
+	}()
+	return link{conn: conn, dialed: dialed}, nil
+}
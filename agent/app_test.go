@@ -0,0 +1,753 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/teller/protocol"
+)
+
+// fakeSource hands out lines, then ends unless it's been told to hold open.
+// Each line waits for a receive on gate first, if gate is set, so a test
+// can let them through one at a time.
+type fakeSource struct {
+	lines chan Line
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newFakeSource(gate <-chan struct{}, hold bool, lines ...Line) *fakeSource {
+	s := &fakeSource{lines: make(chan Line), done: make(chan struct{})}
+	go func() {
+		defer close(s.lines)
+		for _, l := range lines {
+			if gate != nil {
+				select {
+				case <-gate:
+				case <-s.done:
+					return
+				}
+			}
+			select {
+			case s.lines <- l:
+			case <-s.done:
+				return
+			}
+		}
+		if hold {
+			<-s.done
+		}
+	}()
+	return s
+}
+
+func (s *fakeSource) Lines() <-chan Line { return s.lines }
+func (s *fakeSource) Stop()              { s.once.Do(func() { close(s.done) }) }
+
+// textLines makes lines of texts the way a file would give them, with
+// offsets counting their bytes and newlines.
+func textLines(texts ...string) []Line {
+	var lines []Line
+	var off int64
+	for _, t := range texts {
+		off += int64(len(t)) + 1
+		lines = append(lines, Line{Text: t, Offset: off})
+	}
+	return lines
+}
+
+// fakeSink keeps every batch written to it. errs are returned by the first
+// writes, one each, with the batch thrown away; a nil one lets its write
+// through.
+type fakeSink struct {
+	mu      sync.Mutex
+	batches [][][]byte
+	errs    []error
+	closed  bool
+}
+
+func (s *fakeSink) Write(ctx context.Context, events [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	var batch [][]byte
+	for _, e := range events {
+		batch = append(batch, bytes.Clone(e))
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// messages returns the message of every event written, in order.
+func (s *fakeSink) messages(t *testing.T) []string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msgs []string
+	for _, b := range s.batches {
+		for _, e := range b {
+			msgs = append(msgs, message(t, e))
+		}
+	}
+	return msgs
+}
+
+func message(t *testing.T, event []byte) string {
+	t.Helper()
+	var sl SyslogLine
+	if err := json.Unmarshal(event, &sl); err != nil {
+		t.Fatalf("event %q isn't JSON: %v", event, err)
+	}
+	return sl.Message
+}
+
+// testConfig is a Config that leaves out everything a test doesn't want:
+// the lifecycle events, looking up the host, the real server.
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Hostname = "test"
+	cfg.Lifecycle = false
+	cfg.Sink = sinkNull
+	cfg.BatchInterval = 10 * time.Millisecond
+	cfg.HeartbeatInterval = time.Hour
+	return cfg
+}
+
+// newTestApp sets up an App from cfg reading srcs and writing to out, each
+// if it's set.
+func newTestApp(t *testing.T, cfg Config, srcs map[string]Source, out Sink) *App {
+	t.Helper()
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+	if srcs != nil {
+		a.Sources = srcs
+	}
+	if out != nil {
+		a.Output = out
+	}
+	return a
+}
+
+func TestTailAndProcess(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		setup   func(*Config)
+		lines   []Line
+		want    []string
+		batches int
+		offset  int64
+	}{
+		{
+			name:    "lines",
+			lines:   textLines("one", "two", "three"),
+			want:    []string{"one", "two", "three"},
+			batches: 1,
+			offset:  14,
+		},
+		{
+			name:    "batch size",
+			setup:   func(c *Config) { c.BatchSize = 2 },
+			lines:   textLines("a", "b", "c", "d", "e"),
+			want:    []string{"a", "b", "c", "d", "e"},
+			batches: 3,
+			offset:  10,
+		},
+		{
+			name:    "excluded lines still move the offset",
+			setup:   func(c *Config) { c.Exclude = []*regexp.Regexp{regexp.MustCompile("debug")} },
+			lines:   textLines("keep", "debug 1", "debug 2"),
+			want:    []string{"keep"},
+			batches: 1,
+			offset:  21,
+		},
+		{
+			name:    "an event with fields of its own",
+			lines:   []Line{{Text: "from the journal", Offset: 7, Event: &SyslogLine{Message: "from the journal", Program: "sshd"}}},
+			want:    []string{"from the journal"},
+			batches: 1,
+			offset:  7,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tc.setup != nil {
+				tc.setup(&cfg)
+			}
+			out := &fakeSink{}
+			a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, false, tc.lines...)}, out)
+			if err := a.TailAndProcess(context.Background()); err != nil {
+				t.Fatalf("TailAndProcess: %v", err)
+			}
+
+			if got := out.messages(t); !slices.Equal(got, tc.want) {
+				t.Errorf("shipped %q, want %q", got, tc.want)
+			}
+			if len(out.batches) != tc.batches {
+				t.Errorf("shipped %d batches, want %d", len(out.batches), tc.batches)
+			}
+			if got := a.offsets["app.log"]; got != tc.offset {
+				t.Errorf("offset is %d, want %d", got, tc.offset)
+			}
+			if !a.shippedAll() {
+				t.Error("shippedAll is false")
+			}
+			if !out.closed {
+				t.Error("sink wasn't closed")
+			}
+		})
+	}
+}
+
+func TestTailAndProcessWriteErrors(t *testing.T) {
+	errDown := errors.New("collector is down")
+	for _, tc := range []struct {
+		name     string
+		failover bool
+		errs     []error
+		wantErr  bool
+		shipped  []string
+		failed   []string
+	}{
+		{
+			name:    "stops",
+			errs:    []error{errDown},
+			wantErr: true,
+		},
+		{
+			name:     "to the failover file",
+			failover: true,
+			errs:     []error{errDown},
+			failed:   []string{"one", "two"},
+		},
+		{
+			name:     "back once it's up",
+			failover: true,
+			errs:     []error{errDown},
+			shipped:  []string{"three"},
+			failed:   []string{"one", "two"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.BatchSize = 2
+			if tc.failover {
+				cfg.FailoverFile = filepath.Join(t.TempDir(), "failover.json")
+			}
+			texts := []string{"one", "two"}
+			texts = append(texts, tc.shipped...)
+			out := &fakeSink{errs: tc.errs}
+			a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, false, textLines(texts...)...)}, out)
+			err := a.TailAndProcess(context.Background())
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), errDown.Error()) {
+					t.Fatalf("TailAndProcess returned %v, want the write error", err)
+				}
+				if off := a.offsets["app.log"]; off != 0 {
+					t.Errorf("offset moved to %d for lines that weren't delivered", off)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TailAndProcess: %v", err)
+			}
+			if got := out.messages(t); !slices.Equal(got, tc.shipped) {
+				t.Errorf("shipped %q, want %q", got, tc.shipped)
+			}
+			b, err := os.ReadFile(cfg.FailoverFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var failed []string
+			for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				failed = append(failed, message(t, []byte(l)))
+			}
+			if !slices.Equal(failed, tc.failed) {
+				t.Errorf("failover file has %q, want %q", failed, tc.failed)
+			}
+			if got := a.Stats.FailoverLines.Load(); got != int64(len(tc.failed)) {
+				t.Errorf("FailoverLines is %d, want %d", got, len(tc.failed))
+			}
+		})
+	}
+}
+
+// TestInvalidUTF8 ships lines with bytes that aren't UTF-8, and checks
+// they arrive as valid JSON with the bad bytes replaced, rather than being
+// dropped for failing to marshal.
+func TestInvalidUTF8(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		line Line
+		want string
+	}{
+		{"bad bytes", Line{Text: "bad \xff\xfe byte", Offset: 14}, "bad \uFFFD byte"},
+		{"cut off sequence", Line{Text: "cut \xe2\x82", Offset: 7}, "cut \uFFFD"},
+		{"overlong encoding", Line{Text: "\xc0\xafslash", Offset: 8}, "\uFFFDslash"},
+		{"in an event", Line{Text: "ev \x80", Offset: 5, Event: &SyslogLine{Message: "ev \x80", Program: "sshd"}}, "ev \uFFFD"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &fakeSink{}
+			a := newTestApp(t, testConfig(), map[string]Source{"app.log": newFakeSource(nil, false, tc.line)}, out)
+			if err := a.TailAndProcess(context.Background()); err != nil {
+				t.Fatalf("TailAndProcess: %v", err)
+			}
+			if len(out.batches) != 1 || len(out.batches[0]) != 1 {
+				t.Fatalf("shipped %d batches, want the one line", len(out.batches))
+			}
+			ev := out.batches[0][0]
+			if !utf8.Valid(ev) || !json.Valid(ev) {
+				t.Fatalf("shipped %q, which isn't valid UTF-8 JSON", ev)
+			}
+			if got := message(t, ev); got != tc.want {
+				t.Errorf("message is %q, want %q", got, tc.want)
+			}
+			if n := a.Stats.LinesBadUTF8.Load(); n != 1 {
+				t.Errorf("LinesBadUTF8 is %d, want 1", n)
+			}
+			if n := a.Stats.EncodeErrors.Load(); n != 0 {
+				t.Errorf("EncodeErrors is %d, want 0", n)
+			}
+			if off := a.offsets["app.log"]; off != tc.line.Offset {
+				t.Errorf("offset is %d, want %d", off, tc.line.Offset)
+			}
+		})
+	}
+}
+
+// shortStream is a quic.SendStream taking at most max bytes a write, and
+// failing with err once it's taken limit bytes, or returning nothing at all
+// from then on if err is nil.
+type shortStream struct {
+	quic.SendStream
+	max, limit int
+	err        error
+	buf        bytes.Buffer
+	canceled   bool
+	deadline   time.Time
+}
+
+func (s *shortStream) Write(p []byte) (int, error) {
+	room := s.limit - s.buf.Len()
+	if room <= 0 {
+		return 0, s.err
+	}
+	n := min(len(p), s.max, room)
+	s.buf.Write(p[:n])
+	return n, nil
+}
+
+func (s *shortStream) CancelWrite(quic.StreamErrorCode) { s.canceled = true }
+
+func (s *shortStream) SetWriteDeadline(t time.Time) error {
+	s.deadline = t
+	return nil
+}
+
+func TestWriteTo(t *testing.T) {
+	errReset := errors.New("stream reset by peer")
+	frame := protocol.AppendFrame(nil, []byte(`{"message":"a line long enough to take several writes"}`))
+	for _, tc := range []struct {
+		name     string
+		stream   *shortStream
+		err      error
+		canceled bool
+	}{
+		{name: "short writes", stream: &shortStream{max: 3, limit: len(frame)}},
+		{name: "error part way", stream: &shortStream{max: 3, limit: 10, err: errReset}, err: errReset, canceled: true},
+		{name: "error before any", stream: &shortStream{max: 3, limit: 0, err: errReset}, err: errReset},
+		{name: "nothing written part way", stream: &shortStream{max: 3, limit: 10}, err: io.ErrShortWrite, canceled: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &App{WriteTimeout: time.Second}
+			err := a.writeTo(tc.stream, frame)
+			if !errors.Is(err, tc.err) || (err == nil) != (tc.err == nil) {
+				t.Fatalf("writeTo returned %v, want %v", err, tc.err)
+			}
+			if tc.err == nil && !bytes.Equal(tc.stream.buf.Bytes(), frame) {
+				t.Errorf("stream got %q, want the whole frame %q", tc.stream.buf.Bytes(), frame)
+			}
+			if tc.stream.canceled != tc.canceled {
+				t.Errorf("stream reset is %v, want %v", tc.stream.canceled, tc.canceled)
+			}
+			if tc.stream.deadline.IsZero() {
+				t.Error("no write deadline was set")
+			}
+		})
+	}
+}
+
+// TestRunStopsTees checks that shipping stopping for good takes the tees
+// down with it, rather than leaving Run waiting on them forever.
+func TestRunStopsTees(t *testing.T) {
+	cfg := testConfig()
+	cfg.Tees = []string{sinkNull}
+	// Somewhere it can't be opened, so TailAndProcess gives up at once
+	cfg.ControlSocket = filepath.Join(t.TempDir(), "missing", "control.sock")
+	src := newFakeSource(nil, true, textLines("one")...)
+	a := newTestApp(t, cfg, map[string]Source{"app.log": src}, nil)
+	// and never ends on its own
+	tee := newFakeSource(nil, true, textLines("one")...)
+	a.Tees[0].Sources = map[string]Source{"app.log": tee}
+
+	done := make(chan error, 1)
+	go func() { done <- a.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "control socket") {
+			t.Fatalf("Run returned %v, want the control socket error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return once shipping had stopped")
+	}
+	// The sources are stopped on their way out, which needn't be before
+	// Run returns
+	select {
+	case <-tee.done:
+	case <-time.After(time.Second):
+		t.Error("the tee's source wasn't stopped")
+	}
+}
+
+// testServer is a QUIC server on loopback taking what teller sends. The
+// lines it reads come in on lines and the connections on conns, heartbeats
+// are counted, and while ack is set every batch is ACKed; the ones read
+// while it isn't are kept for ackHeld. With stall set it takes the streams
+// but never reads them.
+type testServer struct {
+	addr  string
+	ln    *quic.Listener
+	ack   atomic.Bool
+	stall bool
+	lines chan string
+	beats atomic.Int64
+	conns chan quic.Connection
+
+	mu   sync.Mutex // held, and writing ACKs
+	held []heldBatch
+}
+
+// heldBatch is a batch the testServer read without ACKing it.
+type heldBatch struct {
+	st  quic.Stream
+	seq uint64
+}
+
+func newTestServer(tb testing.TB, ack bool) *testServer {
+	tb.Helper()
+	return newTestServerTLS(tb, ack, nil)
+}
+
+// newTestServerTLS is newTestServer, requiring clients to present a
+// certificate signed by one of clientCAs, if it isn't nil.
+func newTestServerTLS(tb testing.TB, ack bool, clientCAs *x509.CertPool) *testServer {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"rider-protocol"},
+	}
+	if clientCAs != nil {
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		tc.ClientCAs = clientCAs
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tc, &quic.Config{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := &testServer{
+		addr:  ln.Addr().String(),
+		ln:    ln,
+		lines: make(chan string, 1000),
+		conns: make(chan quic.Connection, 10),
+	}
+	s.ack.Store(ack)
+	tb.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		c, err := s.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		s.conns <- c
+		go func() {
+			for {
+				st, err := c.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go s.read(st)
+			}
+		}()
+	}
+}
+
+func (s *testServer) read(st quic.Stream) {
+	if s.stall {
+		return
+	}
+	for {
+		c, data, err := protocol.ReadFrame(st)
+		if err != nil {
+			return
+		}
+		switch c {
+		case protocol.TypeHello:
+			var h protocol.StreamHello
+			if json.Unmarshal(data, &h) == nil && len(h.Codecs) > 0 {
+				protocol.WriteHelloReply(st, protocol.HelloReply{Protocol: protocol.Version, Codec: protocol.CodecNone.String()})
+			}
+		case protocol.TypeHeartbeat:
+			s.beats.Add(1)
+		case protocol.TypeBatch:
+			seq := binary.BigEndian.Uint64(data)
+			r := protocol.NewReader(bytes.NewReader(data[8:]))
+			for {
+				p, err := r.Next()
+				if err != nil {
+					break
+				}
+				s.lines <- string(p)
+			}
+			s.mu.Lock()
+			if s.ack.Load() {
+				protocol.WriteAck(st, seq)
+			} else {
+				s.held = append(s.held, heldBatch{st, seq})
+			}
+			s.mu.Unlock()
+		case protocol.CodecNone:
+			s.lines <- string(data)
+		}
+	}
+}
+
+// ackHeld ACKs the first n batches read while ack was off, or with n < 0
+// every one of them, and turns ack on.
+func (s *testServer) ackHeld(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 0 || n > len(s.held) {
+		n = len(s.held)
+		s.ack.Store(true)
+	}
+	for _, b := range s.held[:n] {
+		protocol.WriteAck(b.st, b.seq)
+	}
+	s.held = s.held[n:]
+}
+
+// next returns the message of the next line the server read.
+func (s *testServer) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case l := <-s.lines:
+		return message(t, []byte(l))
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't get a line in time")
+		return ""
+	}
+}
+
+// quicConfig is testConfig shipping to s.
+func (s *testServer) quicConfig() Config {
+	cfg := testConfig()
+	cfg.Sink = sinkQUIC
+	cfg.Servers = []string{s.addr}
+	cfg.TLS.Insecure = true
+	cfg.CloseTimeout = time.Second
+	return cfg
+}
+
+func TestHeartbeats(t *testing.T) {
+	srv := newTestServer(t, false)
+	cfg := srv.quicConfig()
+	cfg.HeartbeatInterval = 20 * time.Millisecond
+	a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, true)}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.beats.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server got %d heartbeats, want 3", srv.beats.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := a.Stats.Heartbeats.Load(); got < 3 {
+		t.Errorf("Heartbeats is %d, want at least 3", got)
+	}
+}
+
+// TestReconnect has the server hang up between two lines, and checks the
+// second gets through on a new connection.
+func TestReconnect(t *testing.T) {
+	srv := newTestServer(t, false)
+	cfg := srv.quicConfig()
+	gate := make(chan struct{})
+	a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(gate, true, textLines("before", "after")...)}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+
+	first := <-srv.conns
+	gate <- struct{}{}
+	if got := srv.next(t); got != "before" {
+		t.Fatalf("server got %q, want before", got)
+	}
+	first.CloseWithError(0, "going away")
+	// Give the close time to reach teller before the next write
+	time.Sleep(100 * time.Millisecond)
+	gate <- struct{}{}
+	if got := srv.next(t); got != "after" {
+		t.Fatalf("server got %q, want after", got)
+	}
+	select {
+	case <-srv.conns:
+	default:
+		t.Error("teller didn't connect again")
+	}
+	if got := a.Stats.Reconnects.Load(); got != 1 {
+		t.Errorf("Reconnects is %d, want 1", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+// TestWriteTimeout ships to a server that stops reading, so flow control
+// soon has writes wait, and checks they time out and teller reconnects
+// rather than hang, and still shuts down when asked.
+func TestWriteTimeout(t *testing.T) {
+	srv := newTestServer(t, false)
+	srv.stall = true
+	cfg := srv.quicConfig()
+	cfg.WriteTimeout = 100 * time.Millisecond
+	// Enough to fill the stream's flow control window many times over
+	line := strings.Repeat("x", 1000)
+	var texts []string
+	for range 5000 {
+		texts = append(texts, line)
+	}
+	a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, true, textLines(texts...)...)}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	deadline := time.Now().Add(10 * time.Second)
+	for a.Stats.Reconnects.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("teller didn't give up on the stalled stream and reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.Stats.SendErrors.Load() == 0 {
+		t.Error("the timed out write wasn't counted as a send error")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run hung on the stalled stream after being asked to stop")
+	}
+}
+
+// BenchmarkTailAndProcess feeds lines through the send path, to a QUIC
+// server on loopback and to nothing, with the stream writes buffered up to
+// -write-buffer-size and flushed a batch at a time.
+func BenchmarkTailAndProcess(b *testing.B) {
+	line := strings.Repeat("x", 100)
+	for _, sink := range []string{sinkQUIC, sinkNull} {
+		b.Run(sink, func(b *testing.B) {
+			cfg := testConfig()
+			if sink == sinkQUIC {
+				srv := newTestServer(b, false)
+				go func() {
+					for range srv.lines {
+					}
+				}()
+				cfg = srv.quicConfig()
+			}
+			lines := make([]Line, b.N)
+			for i := range lines {
+				lines[i] = Line{Text: line, Offset: int64(i+1) * 101}
+			}
+			a, err := New(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer a.Close()
+			a.Sources = map[string]Source{"app.log": newFakeSource(nil, false, lines...)}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			if err := a.Run(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+		})
+	}
+}
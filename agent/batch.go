@@ -0,0 +1,63 @@
+package agent
+
+import "github.com/rexlx/teller/protocol"
+
+// batch accumulates frames so a burst of lines goes out in a single write.
+// offsets tracks how far into each file the batch reaches, and is only
+// committed once the batch has been sent, along with cursors for sources
+// that have them (see event). A per-file batch keeps each file's
+// frames apart in files, for sending on the file's own stream, rather than
+// in buf. Priority events go in prio, for the priority stream.
+type batch struct {
+	buf     []byte
+	files   map[string][]byte
+	prio    []byte
+	lines   int
+	size    int // bytes of frames, in buf, files and prio
+	offsets map[string]int64
+	cursors map[string]string
+}
+
+func newBatch(perFile bool) *batch {
+	b := &batch{offsets: make(map[string]int64), cursors: make(map[string]string)}
+	if perFile {
+		b.files = make(map[string][]byte)
+	}
+	return b
+}
+
+func (b *batch) add(ev event) {
+	if ev.priority {
+		b.prio = protocol.AppendFrame(b.prio, ev.data)
+	} else if b.files != nil {
+		b.files[ev.file] = protocol.AppendFrame(b.files[ev.file], ev.data)
+	} else {
+		b.buf = protocol.AppendFrame(b.buf, ev.data)
+	}
+	b.lines++
+	b.size += protocol.HeaderSize + len(ev.data)
+	// Events teller makes up itself, like stats, aren't from a file
+	if ev.file == "" {
+		return
+	}
+	b.offsets[ev.file] = ev.offset
+	if ev.cursor != "" {
+		b.cursors[ev.file] = ev.cursor
+	}
+}
+
+// batchFull reports whether the pending batch is as big as it's allowed to
+// get.
+func (a *App) batchFull() bool {
+	return a.batch.lines >= a.BatchSize || a.batch.size >= a.BatchBytes || (a.Spool != nil && a.memFull())
+}
+
+func (b *batch) reset() {
+	b.buf = b.buf[:0]
+	b.prio = b.prio[:0]
+	clear(b.files)
+	b.lines = 0
+	b.size = 0
+	clear(b.offsets)
+	clear(b.cursors)
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+const benchLine = `Oct 11 22:14:15 web1 sshd[4721]: Accepted publickey for deploy from 10.0.0.7 port 52114 ssh2: ED25519 SHA256:q8cY1ijX`
+
+func benchApp(tb testing.TB, format string) *App {
+	tb.Helper()
+	cfg := testConfig()
+	cfg.ParseFormat = format
+	a, err := New(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { a.Close() })
+	return a
+}
+
+// TestEncodeMatchesMarshal checks the pooled encoder writes exactly what
+// json.Marshal would, reused line after line, so pooling doesn't change a
+// byte on the wire.
+func TestEncodeMatchesMarshal(t *testing.T) {
+	for _, format := range []string{"raw", "rfc3164"} {
+		a := benchApp(t, format)
+		for i, text := range []string{benchLine, "<b>&</b> needs escaping", "short", benchLine + " again"} {
+			lb, err := a.encode("app.log", text, nil, marks{offset: int64(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(&lb.sl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(lb.Bytes()) != string(want) {
+				t.Errorf("%s: encoded %s, json.Marshal gives %s", format, lb.Bytes(), want)
+			}
+			lb.release()
+		}
+	}
+}
+
+// BenchmarkEncode is a line's encoding, as emit does it, from text to the
+// JSON copied into the batch.
+func BenchmarkEncode(b *testing.B) {
+	for _, format := range []string{"raw", "rfc3164"} {
+		b.Run(format, func(b *testing.B) {
+			a := benchApp(b, format)
+			b.ReportAllocs()
+			for i := range b.N {
+				lb, err := a.encode("app.log", benchLine, nil, marks{offset: int64(i)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				lb.release()
+			}
+		})
+	}
+}
+
+// BenchmarkBatch is encoding lines into a batch until it's full, and
+// framing it to send, over and over.
+func BenchmarkBatch(b *testing.B) {
+	a := benchApp(b, "raw")
+	bt := newBatch(false)
+	b.ReportAllocs()
+	for i := range b.N {
+		lb, err := a.encode("app.log", benchLine, nil, marks{offset: int64(i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		bt.add(event{file: "app.log", data: lb.Bytes(), offset: int64(i)})
+		lb.release()
+		if bt.lines == a.BatchSize {
+			_ = protocol.AppendBatchFrame(nil, uint64(i), bt.buf)
+			bt.reset()
+		}
+	}
+}
+
+// BenchmarkCompress is compressing a full batch with each codec.
+func BenchmarkCompress(b *testing.B) {
+	a := benchApp(b, "raw")
+	bt := newBatch(false)
+	for i := range a.BatchSize {
+		lb, err := a.encode("app.log", fmt.Sprintf("%s %d", benchLine, i), nil, marks{offset: int64(i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		bt.add(event{file: "app.log", data: lb.Bytes(), offset: int64(i)})
+		lb.release()
+	}
+	for _, c := range []protocol.Codec{protocol.CodecGzip, protocol.CodecZstd} {
+		b.Run(c.String(), func(b *testing.B) {
+			a.Codec = c
+			b.SetBytes(int64(len(bt.buf)))
+			b.ReportAllocs()
+			for range b.N {
+				a.compress(bt.buf)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package agent
+
+import "log/slog"
+
+// ConnState is where teller's connection to the server stands.
+type ConnState int32
+
+const (
+	// StateDisconnected: not connected and not trying to be, before the
+	// first dial, after a write failed, once reconnecting has given up, and
+	// on the way out
+	StateDisconnected ConnState = iota
+	// StateConnecting: dialling for the first time
+	StateConnecting
+	// StateConnected: up and shipping
+	StateConnected
+	// StateReconnecting: the connection was lost and is being dialled again
+	StateReconnecting
+)
+
+// connStates are the states' names, as reported in status and metrics.
+var connStates = [...]string{
+	StateDisconnected: "disconnected",
+	StateConnecting:   "connecting",
+	StateConnected:    "connected",
+	StateReconnecting: "reconnecting",
+}
+
+func (s ConnState) String() string {
+	if int(s) < len(connStates) {
+		return connStates[s]
+	}
+	return "unknown"
+}
+
+// ConnState returns the connection's current state.
+func (s *Stats) ConnState() ConnState {
+	return ConnState(s.connState.Load())
+}
+
+// setConnState moves the connection to state s, telling OnConnState if
+// that's a change.
+func (a *App) setConnState(s ConnState) {
+	old := ConnState(a.Stats.connState.Swap(int32(s)))
+	if old == s {
+		return
+	}
+	slog.Debug("Connection state changed", "server", a.ServerAddr, "from", old, "to", s)
+	if a.OnConnState != nil {
+		a.OnConnState(old, s)
+	}
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/logging"
+)
+
+// ConnStats are what quic-go reports about the current connection: round
+// trip times, congestion window and bytes in flight are as of its last
+// update; packet counts add up across connections.
+type ConnStats struct {
+	SmoothedRTT   atomic.Int64 // nanoseconds
+	MinRTT        atomic.Int64
+	LatestRTT     atomic.Int64
+	Cwnd          atomic.Int64
+	BytesInFlight atomic.Int64
+	PacketsSent   atomic.Int64
+	PacketsLost   atomic.Int64
+
+	// Handshake is how long the last connection took to set up, in
+	// nanoseconds from dialling; Resumed and EarlyData count handshakes that
+	// resumed a session, and that got 0-RTT data accepted too.
+	Handshake atomic.Int64
+	Resumed   atomic.Int64
+	EarlyData atomic.Int64
+}
+
+// LossRate is the fraction of packets sent so far that were declared lost.
+func (s *ConnStats) LossRate() float64 {
+	n := s.PacketsSent.Load()
+	if n == 0 {
+		return 0
+	}
+	return float64(s.PacketsLost.Load()) / float64(n)
+}
+
+// tracer is a quic.Config Tracer that keeps s up to date.
+func (s *ConnStats) tracer(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+	sent := func() { s.PacketsSent.Add(1) }
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			sent()
+		},
+		SentShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			sent()
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			s.PacketsLost.Add(1)
+		},
+		UpdatedMetrics: func(rtt *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+			s.SmoothedRTT.Store(int64(rtt.SmoothedRTT()))
+			s.MinRTT.Store(int64(rtt.MinRTT()))
+			s.LatestRTT.Store(int64(rtt.LatestRTT()))
+			s.Cwnd.Store(int64(cwnd))
+			s.BytesInFlight.Store(int64(bytesInFlight))
+		},
+	}
+}
+
+// logConnStats logs the connection's stats every interval while it's up.
+func (a *App) logConnStats(every time.Duration) {
+	s := &a.Stats.Conn
+	for range time.Tick(every) {
+		if a.Stats.ConnState() != StateConnected {
+			continue
+		}
+		slog.Info("Connection stats",
+			"srtt", time.Duration(s.SmoothedRTT.Load()),
+			"min_rtt", time.Duration(s.MinRTT.Load()),
+			"cwnd", s.Cwnd.Load(),
+			"bytes_in_flight", s.BytesInFlight.Load(),
+			"packets_sent", s.PacketsSent.Load(),
+			"packets_lost", s.PacketsLost.Load(),
+			"loss_rate", s.LossRate())
+	}
+}
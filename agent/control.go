@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// command is a control command along with where to answer it: the control
+// stream, or a connection to the control socket.
+type command struct {
+	protocol.Command
+	answer func(protocol.Reply) error
+	// quiet commands, the status page's, aren't logged
+	quiet bool
+}
+
+// openControl opens the control stream on the current connection and starts
+// reading commands off it. Commands are carried out by the sender, which owns
+// the state they touch, via a.commands.
+func (a *App) openControl() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := a.Conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	hello, err := protocol.AppendHelloFrame(nil, protocol.StreamHello{Purpose: "control", Hostname: a.Hostname, Version: a.cfg.Version, Protocol: protocol.Version})
+	if err != nil {
+		return err
+	}
+	if err := a.writeTo(s, hello); err != nil {
+		s.CancelWrite(0)
+		return err
+	}
+	go func() {
+		defer s.Close()
+		for {
+			var c protocol.Command
+			if err := protocol.ReadJSON(s, &c); err != nil {
+				slog.Debug("Control stream closed", "server", a.ServerAddr, "err", err)
+				return
+			}
+			a.commands <- command{Command: c, answer: func(r protocol.Reply) error {
+				b, err := json.Marshal(r)
+				if err == nil {
+					err = a.writeTo(s, protocol.AppendFrame(nil, b))
+				}
+				if err != nil {
+					s.CancelWrite(0)
+				}
+				return err
+			}}
+		}
+	}()
+	return nil
+}
+
+// slowDown holds off sending for d, or until the slow-down already under way
+// ends if that's later. Lines wait as they do while paused.
+func (a *App) slowDown(d time.Duration) {
+	a.Stats.SlowDowns.Add(1)
+	until := time.Now().Add(d)
+	if until.Before(a.slowUntil) {
+		return
+	}
+	if a.slowUntil.IsZero() {
+		a.slowStart = time.Now()
+		slog.Warn("Server asked teller to slow down, holding off sending", "server", a.ServerAddr, "for", d)
+	}
+	a.slowUntil = until
+	if a.slowTimer == nil {
+		a.slowTimer = time.NewTimer(d)
+	} else {
+		a.slowTimer.Reset(d)
+	}
+}
+
+// slowDownDone is the end of a slow-down, or nil when there isn't one.
+func (a *App) slowDownDone() <-chan time.Time {
+	if a.slowUntil.IsZero() {
+		return nil
+	}
+	return a.slowTimer.C
+}
+
+// held is whether shipping is paused or slowed down.
+func (a *App) held() bool {
+	return a.paused || !a.slowUntil.IsZero()
+}
+
+// status is what the status command answers with.
+func (a *App) status() *protocol.Status {
+	st := &protocol.Status{
+		Hostname:  a.Hostname,
+		Server:    a.ServerAddr,
+		State:     a.Stats.ConnState().String(),
+		Paused:    a.paused,
+		Buffered:  a.batch.lines,
+		Offsets:   maps.Clone(a.offsets),
+		LinesSent: a.Stats.LinesSent.Load(),
+		Unacked:   a.unacked(),
+	}
+	if a.Spool != nil {
+		st.SpoolEntries = a.Spool.Len()
+	}
+	if !a.slowUntil.IsZero() {
+		st.SlowDownMs = max(time.Until(a.slowUntil).Milliseconds(), 1)
+	}
+	if a.Sink == sinkQUIC && a.Conn != nil && a.Conn.Context().Err() == nil {
+		cs := a.Conn.ConnectionState().TLS
+		st.Codec = a.Codec.String()
+		st.TLS = tls.VersionName(cs.Version) + ", " + tls.CipherSuiteName(cs.CipherSuite)
+		st.ALPN = cs.NegotiatedProtocol
+		if a.answer != nil {
+			st.Protocol = a.answer.Protocol
+		}
+	}
+	return st
+}
+
+// handleCommand carries out c and answers it.
+func (a *App) handleCommand(ctx context.Context, c command) {
+	if !c.quiet {
+		slog.Info("Control command", "server", a.ServerAddr, "cmd", c.Cmd, "id", c.ID)
+	}
+	r := protocol.Reply{ID: c.ID, OK: true}
+	switch c.Cmd {
+	case protocol.CmdPause:
+		a.paused = true
+	case protocol.CmdResume:
+		a.paused = false
+		// Send what was batched while paused instead of waiting on the timer
+		if a.batch.lines > 0 && !a.windowFull() {
+			if err := a.flush(ctx); err != nil {
+				r.OK, r.Error = false, err.Error()
+			}
+		}
+	case protocol.CmdFlush:
+		if err := a.flush(ctx); err != nil {
+			r.OK, r.Error = false, err.Error()
+		}
+	case protocol.CmdSlowDown:
+		if c.Ms <= 0 || c.Ms > protocol.MaxSlowDown {
+			r.OK, r.Error = false, fmt.Sprintf("ms must be between 1 and %d", protocol.MaxSlowDown)
+			break
+		}
+		a.slowDown(time.Duration(c.Ms) * time.Millisecond)
+	case protocol.CmdStatus:
+		r.Status = a.status()
+	case protocol.CmdLogLevel:
+		if a.cfg.LogLevel == nil {
+			r.OK, r.Error = false, "log level can't be changed"
+		} else if err := a.cfg.LogLevel.UnmarshalText([]byte(c.Level)); err != nil {
+			r.OK, r.Error = false, err.Error()
+		}
+	case protocol.CmdRotateState:
+		if err := a.rotateState(); err != nil {
+			r.OK, r.Error = false, err.Error()
+		}
+	default:
+		r.OK, r.Error = false, "unknown command "+c.Cmd
+	}
+	if err := c.answer(r); err != nil {
+		slog.Warn("Error answering control command", "server", a.ServerAddr, "cmd", c.Cmd, "err", err)
+	}
+}
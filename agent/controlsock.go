@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// listenControl opens the control socket at path. It takes the same commands
+// as the control stream, one per line as a word with any argument after it
+// ("pause", "log-level debug"), and answers each with a line of JSON, so nc
+// is all it takes to drive. Commands are carried out by the sender via
+// a.commands, as the stream's are; stop is closed once it's stopped taking
+// them.
+func (a *App) listenControl(path string, stop <-chan struct{}) (net.Listener, error) {
+	// A socket left behind by a teller that died can be removed, one still
+	// answering can't
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Anyone who can connect can pause shipping
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go a.serveControl(conn, stop)
+		}
+	}()
+	return ln, nil
+}
+
+// serveControl runs the commands sent on conn until the other end is done
+// with it.
+func (a *App) serveControl(conn net.Conn, stop <-chan struct{}) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for sc.Scan() {
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if cmd == "" {
+			continue
+		}
+		c := protocol.Command{Cmd: cmd, Level: strings.TrimSpace(arg)}
+		if cmd == protocol.CmdSlowDown {
+			// Locally it's a duration, 30s say
+			d, _ := time.ParseDuration(c.Level)
+			c.Ms, c.Level = d.Milliseconds(), ""
+		}
+		done := make(chan error, 1)
+		select {
+		case a.commands <- command{Command: c, answer: func(r protocol.Reply) error {
+			err := enc.Encode(r)
+			done <- err
+			return err
+		}}:
+		case <-stop:
+			return
+		}
+		if err := <-done; err != nil {
+			slog.Debug("Control socket connection closed", "err", err)
+			return
+		}
+	}
+}
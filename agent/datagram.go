@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/teller/protocol"
+)
+
+// sendDatagrams sends each frame in buf, a run of CodecNone frames, as a
+// QUIC datagram of its own, and returns the frames that didn't fit in one,
+// which are left for the stream. Datagrams are never retransmitted, so
+// anything lost on the way stays lost. While spooling, or on a connection
+// the server didn't enable datagrams on, all of buf is left.
+func (a *App) sendDatagrams(buf []byte) []byte {
+	if a.Conn == nil || (a.Spool != nil && (!a.up || a.Spool.Len() > 0)) || !a.Conn.ConnectionState().SupportsDatagrams {
+		return buf
+	}
+	var rest []byte
+	for len(buf) > 0 {
+		n := protocol.HeaderSize + int(binary.BigEndian.Uint32(buf))
+		frame := buf[:n]
+		buf = buf[n:]
+		err := a.Conn.SendDatagram(frame)
+		var tooBig *quic.DatagramTooLargeError
+		switch {
+		case err == nil:
+			a.Stats.Datagrams.Add(1)
+			a.Stats.RawBytes.Add(int64(n))
+			a.Stats.WireBytes.Add(int64(n))
+		case errors.As(err, &tooBig):
+			slog.Debug("Line too big for a datagram, sending it on the stream", "size", n, "max", tooBig.MaxDatagramPayloadSize)
+			a.Stats.DatagramsTooLarge.Add(1)
+			rest = append(rest, frame...)
+		default:
+			// The connection's gone; the stream will find out and reconnect
+			slog.Warn("Error sending datagram", "server", a.ServerAddr, "err", err)
+			return append(append(rest, frame...), buf...)
+		}
+	}
+	a.Stats.LastWrite.Store(time.Now().UnixNano())
+	return rest
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"regexp"
+	"sync/atomic"
+)
+
+// dedup holds back lines identical to the one just shipped. The first line
+// of a run goes out as usual; repeats within window of it are counted and,
+// once the window closes or a different line turns up, shipped as a single
+// event, the last of them, with its repeat count. Lines are compared after
+// strip (timestamps, say) is cut out of them.
+type dedup struct {
+	strip *regexp.Regexp
+	// held counts the lines held back
+	held *atomic.Int64
+
+	open  bool
+	key   string
+	last  Line
+	count int
+}
+
+func (d *dedup) keyOf(text string) string {
+	if d.strip == nil {
+		return text
+	}
+	return d.strip.ReplaceAllString(text, "")
+}
+
+// add passes l to emit unless it repeats the line the window is open for.
+// It reports whether a new window was opened, in which case close should be
+// called once window is up.
+func (d *dedup) add(l Line, emit func(Line, int)) bool {
+	key := d.keyOf(l.Text)
+	if d.open && key == d.key {
+		d.last = l
+		d.count++
+		d.held.Add(1)
+		return false
+	}
+	d.close(emit)
+	d.open, d.key = true, key
+	emit(l, 0)
+	return true
+}
+
+// close ends the window, shipping any repeats held back.
+func (d *dedup) close(emit func(Line, int)) {
+	if d.count > 0 {
+		emit(d.last, d.count)
+	}
+	d.open, d.key, d.last, d.count = false, "", Line{}, 0
+}
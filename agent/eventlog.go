@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/xml"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventLogPrefix makes up the name an event log channel's offset is saved
+// under, "eventlog:System" and so on, so it can't collide with a file.
+const eventLogPrefix = "eventlog:"
+
+// eventXML is the part of the XML rendering of a Windows event that teller
+// uses.
+type eventXML struct {
+	System struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Provider"`
+		EventID     int `xml:"EventID"`
+		Level       int `xml:"Level"`
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+		EventRecordID int64 `xml:"EventRecordID"`
+		Execution     struct {
+			ProcessID int `xml:"ProcessID,attr"`
+		} `xml:"Execution"`
+		Channel  string `xml:"Channel"`
+		Computer string `xml:"Computer"`
+	} `xml:"System"`
+	EventData struct {
+		Data []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Data"`
+	} `xml:"EventData"`
+}
+
+// eventLevels maps Windows event levels onto syslog severities. Level 0,
+// "log always", is left to the default.
+var eventLevels = map[int]int{
+	1: 2, // critical
+	2: 3, // error
+	3: 4, // warning
+	4: 6, // information
+	5: 7, // verbose
+}
+
+// parseEvent turns an event's XML rendering, and its formatted message if
+// there is one, into a Line. The provider becomes the program and the event
+// ID the msgid. Without a formatted message, the event's data values stand
+// in for it.
+func parseEvent(raw []byte, msg string) (Line, error) {
+	var x eventXML
+	if err := xml.Unmarshal(raw, &x); err != nil {
+		return Line{}, err
+	}
+	sys := &x.System
+	if msg == "" {
+		var parts []string
+		for _, d := range x.EventData.Data {
+			if d.Name != "" {
+				parts = append(parts, d.Name+"="+d.Value)
+			} else {
+				parts = append(parts, d.Value)
+			}
+		}
+		msg = strings.Join(parts, " ")
+	}
+
+	sl := &SyslogLine{
+		Timestamp: sys.TimeCreated.SystemTime,
+		Hostname:  sys.Computer,
+		Program:   sys.Provider.Name,
+		Pid:       sys.Execution.ProcessID,
+		MsgID:     strconv.Itoa(sys.EventID),
+		Message:   strings.TrimSpace(msg),
+	}
+	if t, err := time.Parse(time.RFC3339Nano, sys.TimeCreated.SystemTime); err == nil {
+		sl.Timestamp = t.Format(time.RFC3339)
+	}
+	if sev, ok := eventLevels[sys.Level]; ok {
+		sl.Level = levelNames[sev]
+		sl.Severity = &sev
+	}
+	return Line{Text: sl.Message, Offset: sys.EventRecordID, Event: sl}, nil
+}
+
+// runEventLog follows every configured event log channel until they all end.
+// A channel's offset is the record ID of the last event shipped from it;
+// without one saved, only events from now on are shipped, as with files,
+// unless FromBeginning is set.
+func (a *App) runEventLog() {
+	var wg sync.WaitGroup
+	for _, ch := range a.EventLogChannels {
+		key := eventLogPrefix + ch
+		after, ok := a.saved[key]
+		if !ok {
+			after = -1
+			if a.FromBeginning {
+				after = 0
+			}
+		}
+		src, err := openEventLog(ch, after)
+		if err != nil {
+			slog.Error("Error opening event log", "channel", ch, "err", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.pump(key, src)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package agent
+
+import "errors"
+
+func openEventLog(channel string, after int64) (Source, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
@@ -0,0 +1,275 @@
+//go:build windows
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The handful of wevtapi.dll calls the event log source needs.
+var (
+	wevtapi                      = windows.NewLazySystemDLL("wevtapi.dll")
+	procEvtQuery                 = wevtapi.NewProc("EvtQuery")
+	procEvtNext                  = wevtapi.NewProc("EvtNext")
+	procEvtRender                = wevtapi.NewProc("EvtRender")
+	procEvtClose                 = wevtapi.NewProc("EvtClose")
+	procEvtOpenPublisherMetadata = wevtapi.NewProc("EvtOpenPublisherMetadata")
+	procEvtFormatMessage         = wevtapi.NewProc("EvtFormatMessage")
+)
+
+const (
+	evtQueryChannelPath      = 0x1
+	evtQueryForwardDirection = 0x100
+	evtQueryReverseDirection = 0x200
+	evtRenderEventXml        = 1
+	evtFormatMessageEvent    = 1
+
+	// How often the channel is queried for new events
+	eventLogPoll = time.Second
+)
+
+// eventLogSource follows a Windows event log channel by querying it every
+// eventLogPoll for records newer than the last one seen.
+type eventLogSource struct {
+	channel string
+	last    int64
+	lines   chan Line
+	done    chan struct{}
+	once    sync.Once
+
+	// publishers caches metadata handles for formatting messages, by
+	// provider name. A zero handle means the provider has none.
+	publishers map[string]windows.Handle
+}
+
+// openEventLog starts following channel after record ID after, or from the
+// newest record if after is negative.
+func openEventLog(channel string, after int64) (Source, error) {
+	if err := wevtapi.Load(); err != nil {
+		return nil, err
+	}
+	s := &eventLogSource{
+		channel:    channel,
+		last:       after,
+		lines:      make(chan Line),
+		done:       make(chan struct{}),
+		publishers: make(map[string]windows.Handle),
+	}
+	if after < 0 {
+		last, err := s.newest()
+		if err != nil {
+			return nil, fmt.Errorf("error finding the newest event in %s: %v", channel, err)
+		}
+		s.last = last
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *eventLogSource) Lines() <-chan Line { return s.lines }
+
+func (s *eventLogSource) Stop() { s.once.Do(func() { close(s.done) }) }
+
+func (s *eventLogSource) run() {
+	defer close(s.lines)
+	defer func() {
+		for _, h := range s.publishers {
+			if h != 0 {
+				evtClose(h)
+			}
+		}
+	}()
+	t := time.NewTicker(eventLogPoll)
+	defer t.Stop()
+	for {
+		if err := s.poll(); err != nil {
+			select {
+			case s.lines <- Line{Err: err, Offset: s.last}:
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// poll sends every event newer than s.last.
+func (s *eventLogSource) poll() error {
+	q, err := evtQuery(s.channel, fmt.Sprintf("*[System[EventRecordID > %d]]", s.last), evtQueryChannelPath|evtQueryForwardDirection)
+	if err != nil {
+		return err
+	}
+	defer evtClose(q)
+	for {
+		events, err := evtNext(q)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		for i, ev := range events {
+			line, err := s.render(ev)
+			if err == nil {
+				select {
+				case s.lines <- line:
+				case <-s.done:
+					for _, e := range events[i:] {
+						evtClose(e)
+					}
+					return nil
+				}
+				s.last = line.Offset
+			}
+			evtClose(ev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// newest returns the record ID of the newest event in the channel, or 0 if
+// it's empty.
+func (s *eventLogSource) newest() (int64, error) {
+	q, err := evtQuery(s.channel, "*", evtQueryChannelPath|evtQueryReverseDirection)
+	if err != nil {
+		return 0, err
+	}
+	defer evtClose(q)
+	events, err := evtNext(q)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	defer func() {
+		for _, ev := range events {
+			evtClose(ev)
+		}
+	}()
+	line, err := s.render(events[0])
+	if err != nil {
+		return 0, err
+	}
+	return line.Offset, nil
+}
+
+func (s *eventLogSource) render(ev windows.Handle) (Line, error) {
+	raw, err := evtRender(ev)
+	if err != nil {
+		return Line{}, err
+	}
+	line, err := parseEvent(raw, "")
+	if err != nil {
+		return Line{}, fmt.Errorf("error parsing event: %v", err)
+	}
+	if msg := s.format(line.Event.Program, ev); msg != "" {
+		line.Event.Message = msg
+		line.Text = msg
+	}
+	return line, nil
+}
+
+// format renders the event's message from its provider's message table.
+// Providers without one, or events it can't format, give "".
+func (s *eventLogSource) format(provider string, ev windows.Handle) string {
+	pub, ok := s.publishers[provider]
+	if !ok {
+		pub, _ = evtOpenPublisherMetadata(provider)
+		s.publishers[provider] = pub
+	}
+	if pub == 0 {
+		return ""
+	}
+	msg, err := evtFormatMessage(pub, ev)
+	if err != nil {
+		return ""
+	}
+	return msg
+}
+
+func evtQuery(channel, query string, flags uint32) (windows.Handle, error) {
+	c, err := windows.UTF16PtrFromString(channel)
+	if err != nil {
+		return 0, err
+	}
+	q, err := windows.UTF16PtrFromString(query)
+	if err != nil {
+		return 0, err
+	}
+	h, _, err := procEvtQuery.Call(0, uintptr(unsafe.Pointer(c)), uintptr(unsafe.Pointer(q)), uintptr(flags))
+	if h == 0 {
+		return 0, fmt.Errorf("EvtQuery: %v", err)
+	}
+	return windows.Handle(h), nil
+}
+
+// evtNext returns up to 64 events from a query, or none once it's exhausted.
+func evtNext(q windows.Handle) ([]windows.Handle, error) {
+	var events [64]windows.Handle
+	var n uint32
+	ok, _, err := procEvtNext.Call(uintptr(q), uintptr(len(events)), uintptr(unsafe.Pointer(&events[0])), uintptr(windows.INFINITE), 0, uintptr(unsafe.Pointer(&n)))
+	if ok == 0 {
+		if errors.Is(err, windows.ERROR_NO_MORE_ITEMS) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("EvtNext: %v", err)
+	}
+	return append([]windows.Handle(nil), events[:n]...), nil
+}
+
+// evtRender returns the event as UTF-8 XML.
+func evtRender(ev windows.Handle) ([]byte, error) {
+	var used, props uint32
+	buf := make([]uint16, 4096)
+	for {
+		ok, _, err := procEvtRender.Call(0, uintptr(ev), evtRenderEventXml, uintptr(len(buf)*2), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&props)))
+		if ok != 0 {
+			return []byte(windows.UTF16ToString(buf[:used/2])), nil
+		}
+		if !errors.Is(err, windows.ERROR_INSUFFICIENT_BUFFER) {
+			return nil, fmt.Errorf("EvtRender: %v", err)
+		}
+		buf = make([]uint16, used/2+1)
+	}
+}
+
+func evtOpenPublisherMetadata(provider string) (windows.Handle, error) {
+	p, err := windows.UTF16PtrFromString(provider)
+	if err != nil {
+		return 0, err
+	}
+	h, _, err := procEvtOpenPublisherMetadata.Call(0, uintptr(unsafe.Pointer(p)), 0, 0, 0)
+	if h == 0 {
+		return 0, err
+	}
+	return windows.Handle(h), nil
+}
+
+func evtFormatMessage(pub, ev windows.Handle) (string, error) {
+	var used uint32
+	buf := make([]uint16, 1024)
+	for {
+		ok, _, err := procEvtFormatMessage.Call(uintptr(pub), uintptr(ev), 0, 0, 0, evtFormatMessageEvent, uintptr(len(buf)), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&used)))
+		if ok != 0 {
+			return windows.UTF16ToString(buf[:used]), nil
+		}
+		if !errors.Is(err, windows.ERROR_INSUFFICIENT_BUFFER) {
+			return "", err
+		}
+		buf = make([]uint16, used+1)
+	}
+}
+
+func evtClose(h windows.Handle) {
+	procEvtClose.Call(uintptr(h))
+}
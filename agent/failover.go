@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// failOver appends the events in buf, a batch's frames, to FailoverFile as
+// JSON lines once they can't be delivered, then commits their offsets as if
+// they had been: they're safe on disk, for replayFailover or a person to
+// ship. If that fails too, cause is what's returned.
+func (a *App) failOver(buf []byte, offsets map[string]int64, cursors map[string]string, cause error) error {
+	n, err := appendEvents(a.FailoverFile, buf)
+	if err != nil {
+		slog.Error("Error writing to the failover file", "file", a.FailoverFile, "err", err)
+		return cause
+	}
+	slog.Warn("Couldn't deliver a batch, appended it to the failover file", "server", a.ServerAddr, "file", a.FailoverFile, "lines", n, "err", cause)
+	a.Stats.FailoverLines.Add(int64(n))
+	if a.ReplayFailover {
+		a.replayDue = true
+	}
+	// Batches still waiting on an ACK were sent before this one, so its
+	// offsets wait behind theirs
+	if a.acking() && len(a.inflight) > 0 {
+		a.inflight = append(a.inflight, inflight{acked: true, offsets: maps.Clone(offsets), cursors: maps.Clone(cursors)})
+	} else {
+		a.commit(offsets, cursors)
+	}
+	return nil
+}
+
+// appendEvents appends each event framed in buf to the file at path, one per
+// line, and syncs it. It returns how many there were.
+func appendEvents(path string, buf []byte) (int, error) {
+	var out []byte
+	n := 0
+	r := protocol.NewReader(bytes.NewReader(buf))
+	for {
+		payload, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		out = append(append(out, payload...), '\n')
+		n++
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return n, f.Close()
+}
+
+// replayFailover ships what's in FailoverFile, once batches are getting
+// through again. The file is moved aside to FailoverFile.replay first, so
+// whatever fails again lands in a fresh one; a .replay left by a run that
+// stopped part way through is shipped before anything newer. If the
+// connection is lost again, the batch that failed and the rest of the file
+// go back in the failover file for next time. When ACKing, the .replay is
+// kept until the server has ACKed what was sent from it, and there's no
+// replaying again until then. Only errors from flush itself are returned.
+func (a *App) replayFailover(ctx context.Context) error {
+	if slices.ContainsFunc(a.inflight, func(f inflight) bool { return f.replayed != "" }) {
+		return nil
+	}
+	a.replayDue = false
+	a.replaying = true
+	defer func() { a.replaying = false }()
+
+	path := a.FailoverFile + ".replay"
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(a.FailoverFile, path); errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			slog.Error("Error replaying the failover file", "file", a.FailoverFile, "err", err)
+			return nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Error("Error replaying the failover file", "file", path, "err", err)
+		return nil
+	}
+	defer f.Close()
+
+	slog.Info("Replaying the failover file", "file", a.FailoverFile)
+	failed := a.Stats.FailoverLines.Load()
+	r := bufio.NewReader(f)
+	n, pending := 0, 0
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			a.batch.add(event{data: line})
+			pending++
+		}
+		if rerr == nil && !a.batchFull() {
+			continue
+		}
+		if err := a.flushBatch(ctx); err != nil {
+			return err
+		}
+		if a.Stats.FailoverLines.Load() != failed {
+			// It went straight back, so the rest goes after it
+			if err := appendRest(a.FailoverFile, r); err != nil {
+				slog.Error("Error writing to the failover file, keeping the rest where it is", "file", path, "err", err)
+				return nil
+			}
+			slog.Warn("Stopped replaying the failover file, batches aren't getting through", "file", a.FailoverFile)
+			break
+		}
+		a.Stats.FailoverReplayed.Add(int64(pending))
+		n, pending = n+pending, 0
+		if rerr == io.EOF {
+			slog.Info("Replayed the failover file", "file", a.FailoverFile, "lines", n)
+			// That was a .replay from before, and there's more since
+			if _, err := os.Stat(a.FailoverFile); err == nil {
+				a.replayDue = a.ReplayFailover
+			}
+			break
+		}
+		if rerr != nil {
+			slog.Error("Error reading the failover file", "file", path, "err", rerr)
+			return nil
+		}
+	}
+	if a.acking() && len(a.inflight) > 0 {
+		// Not delivered until it's ACKed, and until then a restart would
+		// have it replayed again
+		a.inflight[len(a.inflight)-1].replayed = path
+		return nil
+	}
+	removeReplayed(path)
+	return nil
+}
+
+// removeReplayed removes a .replay file that's been shipped.
+func removeReplayed(path string) {
+	if err := os.Remove(path); err != nil {
+		slog.Error("Error removing the replayed failover file", "file", path, "err", err)
+	}
+}
+
+// appendRest appends what's left to read in r to the file at path.
+func appendRest(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
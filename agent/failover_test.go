@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failoverLines is the messages in the failover file at path, none if it's
+// not there.
+func failoverLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		got = append(got, message(t, []byte(l)))
+	}
+	return got
+}
+
+// TestReplayFailover has a batch go to the failover file, and checks it's
+// replayed after the next one gets through, or if that replay fails, that
+// it's back in the failover file rather than gone.
+func TestReplayFailover(t *testing.T) {
+	errDown := errors.New("collector is down")
+	for _, tc := range []struct {
+		name    string
+		errs    []error
+		shipped []string
+		left    []string
+	}{
+		{"replayed", []error{errDown}, []string{"three", "four", "one", "two"}, nil},
+		// and again at shutdown, when it's tried once more
+		{"failed again", []error{errDown, nil, errDown, errDown}, []string{"three", "four"}, []string{"one", "two"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.BatchSize = 2
+			cfg.FailoverFile = filepath.Join(t.TempDir(), "failover.json")
+			cfg.ReplayFailover = true
+			out := &fakeSink{errs: tc.errs}
+			a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, false, textLines("one", "two", "three", "four")...)}, out)
+			if err := a.TailAndProcess(context.Background()); err != nil {
+				t.Fatalf("TailAndProcess: %v", err)
+			}
+			if got := out.messages(t); !slices.Equal(got, tc.shipped) {
+				t.Errorf("shipped %q, want %q", got, tc.shipped)
+			}
+			if got := failoverLines(t, cfg.FailoverFile); !slices.Equal(got, tc.left) {
+				t.Errorf("failover file has %q, want %q", got, tc.left)
+			}
+			if _, err := os.Stat(cfg.FailoverFile + ".replay"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("the .replay file is still there (%v)", err)
+			}
+			if got := a.Stats.FailoverReplayed.Load(); got != int64(len(tc.shipped)-2) {
+				t.Errorf("FailoverReplayed is %d, want %d", got, len(tc.shipped)-2)
+			}
+		})
+	}
+}
+
+// writeFailover writes a failover file of messages, as a run that couldn't
+// deliver them would have left it.
+func writeFailover(t *testing.T, path string, messages ...string) {
+	t.Helper()
+	var b strings.Builder
+	for _, m := range messages {
+		b.WriteString(`{"hostname":"test","program":"teller","message":"` + m + `"}` + "\n")
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReplayFailoverOnConnect checks a failover file left by an earlier run
+// is shipped as soon as teller connects, ahead of anything new, and removed.
+func TestReplayFailoverOnConnect(t *testing.T) {
+	srv := newTestServer(t, true)
+	cfg := srv.quicConfig()
+	cfg.FailoverFile = filepath.Join(t.TempDir(), "failover.json")
+	cfg.ReplayFailover = true
+	cfg.Once = true
+	writeFailover(t, cfg.FailoverFile, "old 1", "old 2")
+	a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, false, textLines("new")...)}, nil)
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var got []string
+	for range 3 {
+		got = append(got, srv.next(t))
+	}
+	if want := []string{"old 1", "old 2", "new"}; !slices.Equal(got, want) {
+		t.Errorf("server got %q, want %q", got, want)
+	}
+	for _, path := range []string{cfg.FailoverFile, cfg.FailoverFile + ".replay"} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s is still there once replayed (%v)", filepath.Base(path), err)
+		}
+	}
+}
+
+// TestReplayFailoverAcked checks that with -ack-window the replayed file is
+// kept until the server ACKs what was sent from it, so if teller stopped
+// before then it'd be replayed again rather than lost.
+func TestReplayFailoverAcked(t *testing.T) {
+	srv := newTestServer(t, false)
+	cfg := srv.quicConfig()
+	cfg.FailoverFile = filepath.Join(t.TempDir(), "failover.json")
+	cfg.ReplayFailover = true
+	cfg.AckWindow = 8
+	writeFailover(t, cfg.FailoverFile, "old 1", "old 2")
+	a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, true)}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, want := range []string{"old 1", "old 2"} {
+		if got := srv.next(t); got != want {
+			t.Fatalf("server got %q, want %q", got, want)
+		}
+	}
+	replay := cfg.FailoverFile + ".replay"
+	time.Sleep(100 * time.Millisecond)
+	if got := failoverLines(t, replay); !slices.Equal(got, []string{"old 1", "old 2"}) {
+		t.Fatalf("before the ACK the .replay file has %q, want both lines", got)
+	}
+	srv.ackHeld(-1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(replay); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the .replay file wasn't removed once it was ACKed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
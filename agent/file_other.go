@@ -0,0 +1,21 @@
+//go:build !windows
+
+package agent
+
+import "os"
+
+// openFile opens a file to tail.
+func openFile(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+// syncDir flushes dir's entries to disk, so a file just renamed into it
+// survives a crash. It's best effort: not every filesystem can.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
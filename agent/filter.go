@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Filter decides which lines get shipped. A line passes if it matches any
+// Include pattern (or there are none) and no Exclude pattern.
+type Filter struct {
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+}
+
+func (f *Filter) Match(line string) bool {
+	for _, re := range f.Exclude {
+		if re.MatchString(line) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, re := range f.Include {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// multiline glues continuation lines onto the line that started their
+// event. A line that doesn't match start is appended, newline separated, to
+// the pending event; one that does closes the pending event and starts the
+// next.
+type multiline struct {
+	start   *regexp.Regexp
+	lines   []string
+	end     int64
+	pending bool
+}
+
+// add feeds in a line ending at offset end. If it starts a new event, the
+// previous one is returned.
+func (m *multiline) add(line string, end int64) (string, int64, bool) {
+	var text string
+	var prevEnd int64
+	done := false
+	if m.pending && m.start.MatchString(line) {
+		text, prevEnd, done = m.take()
+	}
+	m.lines = append(m.lines, line)
+	m.end = end
+	m.pending = true
+	return text, prevEnd, done
+}
+
+// take returns the pending event, if any, and resets. It's safe on a nil m.
+func (m *multiline) take() (string, int64, bool) {
+	if m == nil || !m.pending {
+		return "", 0, false
+	}
+	text := strings.Join(m.lines, "\n")
+	m.lines = m.lines[:0]
+	m.pending = false
+	return text, m.end, true
+}
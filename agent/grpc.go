@@ -0,0 +1,274 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/rexlx/teller/protocol/tellerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// grpcSink ships events to a collector implementing tellerpb.LogService,
+// each batch one message on a client stream that's kept open for as long as
+// the connection lasts. Like syslogSink, servers are tried in order, and a
+// failed write has the stream reopened with backoff and the whole batch sent
+// again. The collector only answers when the stream is closed, so a batch
+// sent just as it goes away can be lost.
+type grpcSink struct {
+	servers      []string
+	hostname     string
+	creds        credentials.TransportCredentials
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	closeTimeout time.Duration
+	maxAttempts  int
+	stats        *Stats
+	// setState, if set, is told when the connection comes and goes
+	setState func(ConnState)
+	// network, if set, is tcp4 or tcp6 to dial only that family
+	network string
+
+	conn   *grpc.ClientConn
+	stream tellerpb.LogService_ShipClient
+	// cancel ends the stream, and with it a Send that's stuck
+	cancel context.CancelFunc
+	addr   string
+	// sent is how many lines have gone on the stream, to check the
+	// collector's count against
+	sent int64
+}
+
+// newGRPCSink makes a sink for servers, over TLS set up by tlsConf. Nothing is
+// dialled until connect or the first write.
+func newGRPCSink(servers []string, hostname string, tlsConf *tls.Config, dialTimeout time.Duration, maxAttempts int, stats *Stats) *grpcSink {
+	// gRPC offers h2 itself
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = nil
+	return &grpcSink{servers: servers, hostname: hostname, creds: credentials.NewTLS(tlsConf), dialTimeout: dialTimeout, maxAttempts: maxAttempts, stats: stats}
+}
+
+func (s *grpcSink) Write(ctx context.Context, events [][]byte) error {
+	b := &tellerpb.Batch{Lines: make([]*tellerpb.SyslogLine, len(events))}
+	for i, e := range events {
+		b.Lines[i] = grpcLine(e, s.hostname)
+	}
+
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.connect(ctx)
+		if err == nil {
+			if err = s.send(b); err == nil {
+				s.sent += int64(len(b.Lines))
+				s.stats.LastWrite.Store(time.Now().UnixNano())
+				return nil
+			}
+			slog.Warn("Error writing to gRPC server (server might be down)", "server", s.addr, "err", err)
+			s.stats.SendErrors.Add(1)
+			s.drop()
+		} else {
+			slog.Warn("Error connecting to gRPC server", "err", err)
+		}
+		s.stats.noteError(err)
+		if s.maxAttempts > 0 && attempt >= s.maxAttempts {
+			s.state(StateDisconnected)
+			return fmt.Errorf("giving up after %d reconnect attempts", s.maxAttempts)
+		}
+		s.state(StateReconnecting)
+		wait := backoff + rand.N(backoff/2)
+		slog.Info("Reconnecting", "wait", wait.Round(time.Millisecond), "attempt", attempt+1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			s.state(StateDisconnected)
+			return fmt.Errorf("gave up reconnecting: %v", ctx.Err())
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// send puts b on the stream, giving up after writeTimeout (if set) when the
+// collector has stopped reading.
+func (s *grpcSink) send(b *tellerpb.Batch) error {
+	var timer *time.Timer
+	if s.writeTimeout > 0 {
+		timer = time.AfterFunc(s.writeTimeout, s.cancel)
+	}
+	err := s.stream.Send(b)
+	if timer != nil && !timer.Stop() {
+		return fmt.Errorf("write timed out after %v", s.writeTimeout)
+	}
+	if errors.Is(err, io.EOF) {
+		// The collector ended the stream; why is in its answer
+		if _, err = s.stream.CloseAndRecv(); err == nil {
+			err = errors.New("server closed the stream")
+		}
+	}
+	return err
+}
+
+// connect opens a stream to the first server that answers, unless one is
+// open already.
+func (s *grpcSink) connect(ctx context.Context) error {
+	if s.stream != nil {
+		return nil
+	}
+	var errs []error
+	for _, addr := range s.servers {
+		// passthrough leaves resolving to dial, so -address-family holds
+		conn, err := grpc.NewClient("passthrough:///"+addr, grpc.WithTransportCredentials(s.creds), grpc.WithContextDialer(s.dial))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", addr, err))
+			continue
+		}
+		// The stream outlives ctx, which only bounds opening it, along
+		// with dialTimeout
+		sctx, cancel := context.WithCancel(context.Background())
+		timer := time.AfterFunc(s.dialTimeout, cancel)
+		stop := context.AfterFunc(ctx, cancel)
+		stream, err := tellerpb.NewLogServiceClient(conn).Ship(sctx)
+		timedOut := !timer.Stop()
+		stop()
+		if err != nil {
+			cancel()
+			conn.Close()
+			if timedOut {
+				err = fmt.Errorf("no answer in %v", s.dialTimeout)
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", addr, err))
+			continue
+		}
+		if s.addr != "" {
+			s.stats.Reconnects.Add(1)
+		}
+		s.conn, s.stream, s.cancel, s.addr, s.sent = conn, stream, cancel, addr, 0
+		s.state(StateConnected)
+		slog.Info("Connected to gRPC server", "server", addr)
+		return nil
+	}
+	return fmt.Errorf("no server reachable: %v", errors.Join(errs...))
+}
+
+func (s *grpcSink) dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: s.dialTimeout, KeepAlive: 30 * time.Second}
+	return d.DialContext(ctx, cmp.Or(s.network, "tcp"), addr)
+}
+
+// drop abandons a stream that's gone bad.
+func (s *grpcSink) drop() {
+	s.cancel()
+	s.conn.Close()
+	s.conn, s.stream = nil, nil
+	s.state(StateDisconnected)
+}
+
+// redial closes the stream and its connection, for the next write to dial
+// a new one. Close has already logged what went wrong closing them.
+func (s *grpcSink) redial() {
+	s.Close()
+}
+
+func (s *grpcSink) state(st ConnState) {
+	if s.setState != nil {
+		s.setState(st)
+	}
+}
+
+// Close ends the stream and waits, up to closeTimeout, for the collector to
+// say how many lines it got.
+func (s *grpcSink) Close() error {
+	if s.stream == nil {
+		return nil
+	}
+	var timer *time.Timer
+	if s.closeTimeout > 0 {
+		timer = time.AfterFunc(s.closeTimeout, s.cancel)
+	}
+	sum, err := s.stream.CloseAndRecv()
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		slog.Warn("gRPC server didn't confirm the last batches", "server", s.addr, "err", err)
+	} else if sum.GetLines() != s.sent {
+		slog.Warn("gRPC server got a different number of lines than were sent", "server", s.addr, "sent", s.sent, "received", sum.GetLines())
+	}
+	s.cancel()
+	cerr := s.conn.Close()
+	s.conn, s.stream = nil, nil
+	s.state(StateDisconnected)
+	return cmp.Or(err, cerr)
+}
+
+// grpcLine decodes an event into its protobuf form. Lines that were shipped
+// as their own JSON become the message of an event from hostname, as they do
+// for syslog.
+func grpcLine(event []byte, hostname string) *tellerpb.SyslogLine {
+	var sl SyslogLine
+	if err := json.Unmarshal(event, &sl); err != nil || (sl.Message == "" && sl.Program == "") {
+		return &tellerpb.SyslogLine{Hostname: hostname, Message: string(event)}
+	}
+	pl := &tellerpb.SyslogLine{
+		Version:     int32(sl.Version),
+		Timestamp:   sl.Timestamp,
+		Hostname:    sl.Hostname,
+		Program:     sl.Program,
+		Pid:         int32(sl.Pid),
+		Msgid:       sl.MsgID,
+		File:        sl.File,
+		Message:     sl.Message,
+		Level:       sl.Level,
+		SampleRate:  sl.SampleRate,
+		Raw:         sl.Raw,
+		Tags:        sl.Tags,
+		RepeatCount: int32(sl.RepeatCount),
+		Truncated:   sl.Truncated,
+		Stats:       jsonStruct(sl.Stats),
+		Lifecycle:   jsonStruct(sl.Lifecycle),
+	}
+	if sl.Priority != nil {
+		p := int32(*sl.Priority)
+		pl.Priority = &p
+	}
+	if sl.Severity != nil {
+		sev := int32(*sl.Severity)
+		pl.Severity = &sev
+	}
+	if len(sl.StructuredData) > 0 {
+		pl.StructuredData = make(map[string]*tellerpb.Params, len(sl.StructuredData))
+		for id, params := range sl.StructuredData {
+			pl.StructuredData[id] = &tellerpb.Params{Params: params}
+		}
+	}
+	if len(sl.Fields) > 0 {
+		pl.Fields, _ = structpb.NewStruct(sl.Fields)
+	}
+	if m := sl.Meta; m != nil {
+		pl.Meta = &tellerpb.Meta{Offset: m.Offset, Cursor: m.Cursor, ReadAt: m.ReadAt, ReadLagSeconds: m.ReadLagSeconds}
+	}
+	return pl
+}
+
+// jsonStruct is v, a JSON object when marshalled, as a Struct, or nil if v is.
+func jsonStruct(v any) *structpb.Struct {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	st := &structpb.Struct{}
+	if protojson.Unmarshal(data, st) != nil {
+		return nil
+	}
+	return st
+}
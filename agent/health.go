@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// health is the body of /healthz and /readyz.
+type health struct {
+	Status         string `json:"status"`
+	Connected      bool   `json:"connected"`
+	LastWrite      string `json:"last_write,omitempty"`
+	SinceLastWrite string `json:"since_last_write,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// ServeHealth serves /healthz, which is OK as long as teller is running, and
+// /readyz, which is OK while teller has written to the server within
+// ReadyTimeout. Heartbeats count, so a healthy idle teller stays ready. It
+// only returns if the listener fails.
+func (a *App) ServeHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, health{Status: "ok", Connected: a.Stats.ConnState() == StateConnected})
+	})
+	mux.HandleFunc("/readyz", a.handleReady)
+	slog.Info("Serving health checks", "addr", addr, "paths", "/healthz,/readyz")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Health check server stopped", "addr", addr, "err", err)
+	}
+}
+
+func (a *App) handleReady(w http.ResponseWriter, r *http.Request) {
+	h := health{Status: "ok", Connected: a.Stats.ConnState() == StateConnected}
+	if !remoteSink(a.Sink) {
+		// Local sinks have nothing to be cut off from
+		writeHealth(w, http.StatusOK, h)
+		return
+	}
+	if a.Sink != sinkQUIC {
+		// Syslog sinks send no heartbeats, so all there is to go on is
+		// whether they're connected
+		if !h.Connected {
+			h.Status, h.Reason = "not ready", "not connected to the server"
+			writeHealth(w, http.StatusServiceUnavailable, h)
+			return
+		}
+		writeHealth(w, http.StatusOK, h)
+		return
+	}
+	code := http.StatusOK
+	last := a.Stats.LastWrite.Load()
+	if last == 0 {
+		h.Status, h.Reason = "not ready", "nothing written to the server yet"
+		code = http.StatusServiceUnavailable
+	} else {
+		since := time.Since(time.Unix(0, last))
+		h.LastWrite = time.Unix(0, last).UTC().Format(time.RFC3339)
+		h.SinceLastWrite = since.Round(time.Second).String()
+		if since > a.ReadyTimeout {
+			h.Status, h.Reason = "not ready", "no successful write to the server within "+a.ReadyTimeout.String()
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, code, h)
+}
+
+func writeHealth(w http.ResponseWriter, code int, h health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,22 @@
+//go:build !wasip1
+
+package agent
+
+import "os"
+
+// tailsFiles says whether -source file can work here, and hasSockets
+// whether the sinks with a server at the other end can.
+const (
+	tailsFiles = true
+	hasSockets = true
+)
+
+// systemHostname is the name the system goes by.
+func systemHostname() (string, error) {
+	return os.Hostname()
+}
+
+// processID is teller's own pid.
+func processID() int {
+	return os.Getpid()
+}
@@ -0,0 +1,28 @@
+//go:build wasip1
+
+package agent
+
+import "errors"
+
+// tailsFiles says whether -source file can work here, and hasSockets
+// whether the sinks with a server at the other end can. WASI has nothing to
+// watch a directory with, so the host hands teller Readers instead, and no
+// way to open a socket: Go's net package is an in-memory stand-in there,
+// where a dial finds nothing and a UDP datagram goes nowhere.
+const (
+	tailsFiles = false
+	hasSockets = false
+)
+
+// systemHostname is the name the system goes by. A WASI sandbox has none of
+// its own, so it's up to the host to say, with Hostname.
+func systemHostname() (string, error) {
+	return "", errors.New("WASI has no hostname")
+}
+
+// processID is teller's own pid. WASI has no processes to number, and the Go
+// runtime's stand-in is the same for every module, so it's 0, leaving the
+// host to set Pid.
+func processID() int {
+	return 0
+}
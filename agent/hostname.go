@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// resolveHostname works out the name lines are shipped under: override if
+// it's set, else the system's hostname, looked up in full with fqdn. Either
+// way it comes back lowercased and without a trailing dot, and is checked to
+// be a valid hostname.
+func resolveHostname(override string, fqdn bool) (string, error) {
+	name := override
+	if name == "" {
+		var err error
+		if name, err = systemHostname(); err != nil {
+			return "", fmt.Errorf("error getting hostname (set -hostname): %v", err)
+		}
+		if fqdn && !strings.Contains(name, ".") {
+			if full := lookupFQDN(name); full != "" {
+				name = full
+			} else {
+				slog.Warn("Couldn't look up the fully-qualified hostname, using the short one", "hostname", name)
+			}
+		}
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if err := validHostname(name); err != nil {
+		return "", fmt.Errorf("invalid hostname %q: %v", name, err)
+	}
+	return name, nil
+}
+
+// validHostname checks name against RFC 1123: dot-separated labels of
+// letters, digits and hyphens, none starting or ending with a hyphen.
+func validHostname(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty")
+	}
+	if len(name) > 253 {
+		return fmt.Errorf("longer than 253 bytes")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("labels must be 1 to 63 bytes")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("labels can't start or end with a hyphen")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("%q isn't allowed", c)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupFQDN finds the fully-qualified name of host through the resolver:
+// its addresses, then their reverse lookups. It returns "" if that gets
+// nowhere within a couple of seconds.
+func lookupFQDN(host string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		names, err := net.DefaultResolver.LookupAddr(ctx, addr)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if name = strings.TrimSuffix(name, "."); strings.Contains(name, ".") {
+				return name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rexlx/teller/protocol"
+)
+
+// http3Sink POSTs each batch, as a gzipped JSON array of the events, to a
+// collector's HTTP/3 ingest endpoint at https://server/path. Servers are
+// tried in order, moving on to the next when one errors or answers 5xx. A
+// 429, or a 503 saying when to come back, is waited out on the same server
+// for as long as its Retry-After asks. Any other 4xx means the collector
+// won't take the batch however often it's sent, so it's dropped.
+type http3Sink struct {
+	servers      []string
+	path         string
+	userAgent    string
+	client       *http.Client
+	tr           *http3.Transport
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	maxAttempts  int
+	stats        *Stats
+	// setState, if set, is told when the connection comes and goes
+	setState func(ConnState)
+	// family is the -address-family to dial
+	family string
+	// proxy, if set, relays the QUIC connection
+	proxy *socksProxy
+
+	next int
+	up   bool
+}
+
+// errRejected is a batch the collector answered with a 4xx other than 408
+// or 429.
+type errRejected struct {
+	status int
+	body   string
+}
+
+func (e errRejected) Error() string { return fmt.Sprintf("%d %s", e.status, e.body) }
+
+// newHTTP3Sink makes a sink for servers, over TLS set up by tlsConf. Nothing
+// is dialled until the first write.
+func newHTTP3Sink(servers []string, path, version string, tlsConf *tls.Config, dialTimeout time.Duration, maxAttempts int, stats *Stats) *http3Sink {
+	s := &http3Sink{servers: servers, path: path, userAgent: "teller/" + version, dialTimeout: dialTimeout, maxAttempts: maxAttempts, stats: stats}
+	s.tr = &http3.Transport{
+		TLSClientConfig: tlsConf,
+		QUICConfig:      &quic.Config{HandshakeIdleTimeout: dialTimeout, KeepAlivePeriod: 15 * time.Second},
+		Dial:            s.dial,
+	}
+	s.client = &http.Client{Transport: s.tr}
+	return s
+}
+
+func (s *http3Sink) Write(ctx context.Context, events [][]byte) error {
+	start := time.Now()
+	body, err := gzipJSONArray(events)
+	if err != nil {
+		return err
+	}
+	raw := 2 + max(len(events)-1, 0)
+	for _, e := range events {
+		raw += len(e)
+	}
+	s.stats.codec(protocol.CodecGzip).add(raw, len(body), time.Since(start))
+
+	backoff := initialBackoff
+	for attempt := 0; ; {
+		addr := s.servers[s.next]
+		wait, err := s.post(ctx, addr, body)
+		if err == nil {
+			s.stats.LastWrite.Store(time.Now().UnixNano())
+			if !s.up {
+				s.up = true
+				slog.Info("Connected to HTTP/3 endpoint", "server", addr)
+			}
+			s.state(StateConnected)
+			return nil
+		}
+		var rej errRejected
+		if errors.As(err, &rej) {
+			s.stats.BatchesRejected.Add(1)
+			slog.Error("HTTP/3 endpoint rejected a batch, dropping it", "server", addr, "lines", len(events), "err", err)
+			return nil
+		}
+		if wait > 0 {
+			// Asked to come back later: not the server failing
+			s.stats.SlowDowns.Add(1)
+			slog.Warn("HTTP/3 endpoint asked teller to slow down, holding off sending", "server", addr, "for", wait, "err", err)
+		} else {
+			slog.Warn("Error posting to HTTP/3 endpoint (server might be down)", "server", addr, "err", err)
+			s.stats.SendErrors.Add(1)
+			s.stats.noteError(err)
+			s.next = (s.next + 1) % len(s.servers)
+			if s.maxAttempts > 0 && attempt >= s.maxAttempts {
+				s.state(StateDisconnected)
+				return fmt.Errorf("giving up after %d retries", s.maxAttempts)
+			}
+			attempt++
+			s.state(StateReconnecting)
+			wait = backoff + rand.N(backoff/2)
+			backoff = min(backoff*2, maxBackoff)
+			slog.Info("Retrying", "wait", wait.Round(time.Millisecond), "attempt", attempt)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			s.state(StateDisconnected)
+			return fmt.Errorf("gave up retrying: %v", ctx.Err())
+		}
+	}
+}
+
+// post sends body to addr once. A non-zero wait is how long the server asked
+// for before trying again. The request outlives ctx, bounded only by
+// writeTimeout, so the last batch still goes out on shutdown.
+func (s *http3Sink) post(ctx context.Context, addr string, body []byte) (wait time.Duration, err error) {
+	ctx = context.WithoutCancel(ctx)
+	if s.writeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.writeTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+addr+s.path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", s.userAgent)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// A connection that's gone bad would only be tried again
+		s.tr.CloseIdleConnections()
+		return 0, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return 0, nil
+	case code == http.StatusTooManyRequests:
+		return cmp.Or(retryAfter(resp.Header.Get("Retry-After"), time.Now()), initialBackoff), statusError(resp, msg)
+	case code == http.StatusServiceUnavailable:
+		return retryAfter(resp.Header.Get("Retry-After"), time.Now()), statusError(resp, msg)
+	case code >= 500, code == http.StatusRequestTimeout:
+		return 0, statusError(resp, msg)
+	default:
+		return 0, errRejected{status: code, body: strings.TrimSpace(string(msg))}
+	}
+}
+
+func statusError(resp *http.Response, msg []byte) error {
+	if m := strings.TrimSpace(string(msg)); m != "" {
+		return fmt.Errorf("%s: %s", resp.Status, m)
+	}
+	return errors.New(resp.Status)
+}
+
+// retryAfter reads a Retry-After header, seconds or an HTTP date, as a wait
+// from now of at most protocol.MaxSlowDown. It's zero if there's no telling.
+func retryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(h); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(h); err == nil {
+		d = t.Sub(now)
+	}
+	return min(max(d, 0), protocol.MaxSlowDown*time.Millisecond)
+}
+
+// gzipJSONArray gzips events, each already JSON, as one JSON array.
+func gzipJSONArray(events [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte{'['})
+	for i, e := range events {
+		if i > 0 {
+			zw.Write([]byte{','})
+		}
+		zw.Write(e)
+	}
+	zw.Write([]byte{']'})
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dial connects to addr the way the QUIC sink does, from a socket of the
+// family -address-family picks or through -proxy, trying each address in
+// turn.
+func (s *http3Sink) dial(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+	rctx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+	targets, err := resolveUDP(rctx, addr, s.family)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %v", addr, err)
+	}
+	var errs []error
+	for _, target := range targets {
+		network := "udp6"
+		if target.IP.To4() != nil {
+			network = "udp4"
+		}
+		dctx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+		var pc net.PacketConn
+		if s.proxy != nil {
+			pc, err = s.proxy.listenUDP(dctx)
+		} else {
+			pc, err = net.ListenUDP(network, nil)
+		}
+		if err != nil {
+			cancel()
+			errs = append(errs, err)
+			continue
+		}
+		conn, err := quic.DialEarly(dctx, pc, target, tlsConf, quicConf)
+		cancel()
+		if err != nil {
+			pc.Close()
+			errs = append(errs, fmt.Errorf("%s: %v", target, err))
+			continue
+		}
+		go func() {
+			<-conn.Context().Done()
+			pc.Close()
+		}()
+		return conn, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// redial closes the connections the transport holds, for the next post to
+// dial a new one. Posts are only made by Write, so none is in flight.
+func (s *http3Sink) redial() {
+	s.tr.CloseIdleConnections()
+}
+
+func (s *http3Sink) state(st ConnState) {
+	if s.setState != nil {
+		s.setState(st)
+	}
+}
+
+func (s *http3Sink) Close() error {
+	s.state(StateDisconnected)
+	return s.tr.Close()
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalKey is the name the journal's cursor is saved under.
+const journalKey = "journald"
+
+// journalSource follows the systemd journal through journalctl, which saves
+// linking against libsystemd. Each entry comes out as one line of JSON.
+type journalSource struct {
+	cmd   *exec.Cmd
+	out   io.ReadCloser
+	lines chan Line
+	once  sync.Once
+	// stopped is closed by Stop, after which journalctl dying is expected
+	stopped chan struct{}
+}
+
+// openJournal starts following the journal after cursor. If cursor is empty
+// it starts from now on, or with all set from the oldest entry there is.
+// units, if any, limit it to those systemd units.
+func openJournal(cursor string, all bool, units []string) (Source, error) {
+	args := []string{"--follow", "--output=json", "--no-pager"}
+	switch {
+	case cursor != "":
+		args = append(args, "--after-cursor="+cursor)
+	case all:
+		args = append(args, "--lines=all")
+	default:
+		args = append(args, "--lines=0")
+	}
+	for _, u := range units {
+		args = append(args, "--unit="+u)
+	}
+	cmd := exec.Command("journalctl", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting journalctl: %v", err)
+	}
+	s := &journalSource{cmd: cmd, out: out, lines: make(chan Line), stopped: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+func (s *journalSource) Lines() <-chan Line { return s.lines }
+
+func (s *journalSource) Stop() {
+	s.once.Do(func() {
+		close(s.stopped)
+		s.cmd.Process.Kill()
+	})
+}
+
+func (s *journalSource) run() {
+	defer close(s.lines)
+	sc := bufio.NewScanner(s.out)
+	// Entries can carry big fields, core dumps' backtraces for one
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line, err := parseJournal(sc.Bytes())
+		if err != nil {
+			s.lines <- Line{Err: fmt.Errorf("error parsing journal entry: %v", err)}
+			continue
+		}
+		s.lines <- line
+	}
+	if err := sc.Err(); err != nil {
+		s.lines <- Line{Err: err}
+	}
+	err := s.cmd.Wait()
+	select {
+	case <-s.stopped:
+	default:
+		if err != nil {
+			s.lines <- Line{Err: fmt.Errorf("journalctl exited: %v", err)}
+		}
+	}
+}
+
+// journalField is a field of a journalctl JSON entry. Text is a string, but
+// fields that aren't valid UTF-8 come as an array of bytes instead.
+type journalField string
+
+func (f *journalField) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*f = journalField(s)
+		return nil
+	}
+	var ints []int
+	if err := json.Unmarshal(b, &ints); err != nil {
+		// Null, for a field too big for journalctl to print, or a field
+		// repeated in the entry, which comes as an array of values
+		return nil
+	}
+	raw := make([]byte, len(ints))
+	for i, n := range ints {
+		raw[i] = byte(n)
+	}
+	*f = journalField(raw)
+	return nil
+}
+
+// parseJournal turns one journalctl JSON entry into a Line. The unit becomes
+// the program, falling back to the syslog identifier for entries that don't
+// come from a unit. The offset is the entry's time in microseconds; the cursor
+// is what's saved.
+func parseJournal(raw []byte) (Line, error) {
+	var e struct {
+		Message  journalField `json:"MESSAGE"`
+		Priority journalField `json:"PRIORITY"`
+		Pid      journalField `json:"_PID"`
+		Unit     journalField `json:"_SYSTEMD_UNIT"`
+		Ident    journalField `json:"SYSLOG_IDENTIFIER"`
+		Hostname journalField `json:"_HOSTNAME"`
+		Realtime journalField `json:"__REALTIME_TIMESTAMP"`
+		Cursor   journalField `json:"__CURSOR"`
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return Line{}, err
+	}
+	sl := &SyslogLine{
+		Hostname: string(e.Hostname),
+		Program:  string(e.Unit),
+		Message:  strings.TrimRight(string(e.Message), "\n"),
+	}
+	if sl.Program == "" {
+		sl.Program = string(e.Ident)
+	}
+	sl.Pid, _ = strconv.Atoi(string(e.Pid))
+	usec, _ := strconv.ParseInt(string(e.Realtime), 10, 64)
+	if usec > 0 {
+		sl.Timestamp = time.UnixMicro(usec).UTC().Format(time.RFC3339)
+	}
+	if sev, err := strconv.Atoi(string(e.Priority)); err == nil && sev >= 0 && sev < len(levelNames) {
+		sl.Level = levelNames[sev]
+		sl.Severity = &sev
+	}
+	return Line{Text: sl.Message, Offset: usec, Cursor: string(e.Cursor), Event: sl}, nil
+}
+
+// runJournal follows the journal until it ends, resuming after the saved
+// cursor if there is one.
+func (a *App) runJournal() {
+	src, err := openJournal(a.savedCursors[journalKey], a.FromBeginning, a.JournalUnits)
+	if err != nil {
+		slog.Error("Error opening journal", "err", err)
+		return
+	}
+	a.pump(journalKey, src)
+}
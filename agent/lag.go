@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// lagTracker knows how far behind the end of each tailed file the shipped
+// offset is. Tailers never skip ahead when the sender can't keep up, they
+// just stop reading, so this is where falling behind shows. It checks on its
+// own schedule so a sender stuck on a blocked write still gets noticed.
+type lagTracker struct {
+	// Warn and After: a file that stays more than Warn bytes behind for
+	// After is logged about. Zero Warn never warns.
+	Warn  int64
+	After time.Duration
+
+	mu      sync.Mutex
+	shipped map[string]int64
+	bytes   map[string]int64
+	// over is when each file went over Warn; warned, the ones logged
+	over   map[string]time.Time
+	warned map[string]bool
+}
+
+// set records that file has been shipped up to off.
+func (l *lagTracker) set(file string, off int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shipped == nil {
+		l.shipped = make(map[string]int64)
+	}
+	l.shipped[file] = off
+}
+
+// forget stops tracking a file that's no longer tailed.
+func (l *lagTracker) forget(file string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.shipped, file)
+}
+
+// run checks every interval until done is closed.
+func (l *lagTracker) run(every time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.check()
+		case <-done:
+			return
+		}
+	}
+}
+
+// check works out every file's lag and warns about files that have been too
+// far behind for too long. Sources that aren't files are skipped.
+func (l *lagTracker) check() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytes = make(map[string]int64, len(l.shipped))
+	for file, off := range l.shipped {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		l.bytes[file] = max(fi.Size()-off, 0)
+	}
+	if l.Warn <= 0 {
+		return
+	}
+	if l.over == nil {
+		l.over = make(map[string]time.Time)
+		l.warned = make(map[string]bool)
+	}
+
+	now := time.Now()
+	for file, since := range l.over {
+		if l.bytes[file] > l.Warn {
+			continue
+		}
+		if l.warned[file] {
+			slog.Info("Caught up with file", "file", file, "behind_for", now.Sub(since).Round(time.Second))
+		}
+		delete(l.over, file)
+		delete(l.warned, file)
+	}
+	for file, n := range l.bytes {
+		if n <= l.Warn {
+			continue
+		}
+		since, ok := l.over[file]
+		if !ok {
+			l.over[file] = now
+			continue
+		}
+		if !l.warned[file] && now.Sub(since) >= l.After {
+			slog.Warn("FALLING BEHIND: shipping can't keep up with file", "file", file, "lag_bytes", n,
+				"behind_for", now.Sub(since).Round(time.Second))
+			l.warned[file] = true
+		}
+	}
+}
+
+// snapshot returns every file's lag in bytes as of the last check.
+func (l *lagTracker) snapshot() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bytes
+}
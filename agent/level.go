@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultLevel is what a line gets when nothing says otherwise.
+const defaultLevel = "info"
+
+// severities maps level names, as they tend to turn up in application logs,
+// to the numeric syslog severity (RFC5424 section 6.2.1).
+var severities = map[string]int{
+	"emerg":         0,
+	"emergency":     0,
+	"panic":         0,
+	"alert":         1,
+	"crit":          2,
+	"critical":      2,
+	"fatal":         2,
+	"err":           3,
+	"error":         3,
+	"warn":          4,
+	"warning":       4,
+	"notice":        5,
+	"info":          6,
+	"informational": 6,
+	"debug":         7,
+	"trace":         7,
+}
+
+// levelNames is the inverse of severities, for lines whose level comes from a
+// syslog priority.
+var levelNames = [8]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// setLevel fills in sl.Level and sl.Severity. A match of the level group in
+// re wins; failing that a parsed syslog priority says what the severity is;
+// failing that the line is info. Severity is left unset for level names we
+// don't know a number for.
+func setLevel(sl *SyslogLine, re *regexp.Regexp, line string) {
+	if re != nil {
+		if m := re.FindStringSubmatch(line); m != nil {
+			if lvl := strings.ToLower(m[re.SubexpIndex("level")]); lvl != "" {
+				sl.Level = lvl
+				if sev, ok := severities[lvl]; ok {
+					sl.Severity = &sev
+				}
+				return
+			}
+		}
+	}
+	if sl.Priority != nil {
+		sev := *sl.Priority % 8
+		sl.Level = levelNames[sev]
+		sl.Severity = &sev
+		return
+	}
+	sev := severities[defaultLevel]
+	sl.Level = defaultLevel
+	sl.Severity = &sev
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// lineBuf is the scratch space a line is encoded in: its SyslogLine, and the
+// encoder and buffer that turn it into JSON. They're pooled so a busy tail
+// doesn't allocate them afresh for every line; a lineBuf goes back to the
+// pool once its JSON has been copied into the batch.
+type lineBuf struct {
+	sl   SyslogLine
+	meta Meta
+	buf  bytes.Buffer
+	enc  *json.Encoder
+}
+
+// maxPooledLine is the largest buffer kept for reuse, so one huge line
+// doesn't pin its memory for good.
+const maxPooledLine = 64 << 10
+
+var lineBufs = sync.Pool{New: func() any {
+	lb := &lineBuf{}
+	lb.enc = json.NewEncoder(&lb.buf)
+	return lb
+}}
+
+// getLineBuf returns an empty lineBuf.
+func getLineBuf() *lineBuf {
+	lb := lineBufs.Get().(*lineBuf)
+	lb.buf.Reset()
+	return lb
+}
+
+// marshal encodes lb.sl into lb.buf, byte for byte as json.Marshal would,
+// or laid out by s if there is one, and returns lb. If that fails lb is
+// released.
+func (lb *lineBuf) marshal(s *schema) (*lineBuf, error) {
+	if s != nil {
+		if err := s.marshal(&lb.buf, &lb.sl); err != nil {
+			lb.release()
+			return nil, err
+		}
+		return lb, nil
+	}
+	if err := lb.enc.Encode(&lb.sl); err != nil {
+		lb.release()
+		return nil, err
+	}
+	// Encode ends every value with a newline
+	lb.buf.Truncate(lb.buf.Len() - 1)
+	return lb, nil
+}
+
+// marshalLine encodes one of teller's own events, such as a stats report,
+// the way lines are.
+func (a *App) marshalLine(sl SyslogLine) ([]byte, error) {
+	if a.Schema == nil {
+		return json.Marshal(sl)
+	}
+	var buf bytes.Buffer
+	err := a.Schema.marshal(&buf, &sl)
+	return buf.Bytes(), err
+}
+
+// setMeta fills in lb.sl's Meta from m, as read at now. With stamped the
+// line's timestamp is its own, and the lag since is worked out.
+func (lb *lineBuf) setMeta(m marks, now time.Time, stamped bool) {
+	lb.meta = Meta{Offset: m.offset, Cursor: m.cursor, ReadAt: now.Format(time.RFC3339Nano)}
+	if t, err := time.Parse(time.RFC3339Nano, lb.sl.Timestamp); stamped && err == nil {
+		lb.meta.ReadLagSeconds = now.Sub(t).Seconds()
+	}
+	lb.sl.Meta = &lb.meta
+}
+
+// Bytes is the encoded line, valid until release.
+func (lb *lineBuf) Bytes() []byte { return lb.buf.Bytes() }
+
+// release hands lb back for reuse. A nil lb is fine.
+func (lb *lineBuf) release() {
+	if lb == nil || lb.buf.Cap() > maxPooledLine {
+		return
+	}
+	// Don't keep the last line's strings and maps alive
+	lb.sl = SyslogLine{}
+	lineBufs.Put(lb)
+}
@@ -0,0 +1,476 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// Stats are counters about what teller has shipped. They're updated by the
+// sender and tailers and safe to read from anywhere.
+type Stats struct {
+	LinesRead       atomic.Int64
+	LinesFiltered   atomic.Int64 // dropped by -include/-exclude
+	LinesSampledOut atomic.Int64 // dropped by -sample-rate
+	LinesRouted     atomic.Int64 // dropped, or sent elsewhere, by -route
+	LinesDeduped    atomic.Int64 // folded into a repeat count by -dedup-window
+	LinesTruncated  atomic.Int64 // cut short by -max-line-bytes
+	LinesRedacted   atomic.Int64 // had something blanked out by -redact
+	Redactions      atomic.Int64 // matches blanked out by -redact, all told
+	LinesBadUTF8    atomic.Int64 // had invalid UTF-8 replaced
+	EncodeErrors    atomic.Int64 // dropped for failing to encode
+	LinesSent       atomic.Int64
+	Batches         atomic.Int64
+	Heartbeats      atomic.Int64
+	SendErrors      atomic.Int64
+	Reconnects      atomic.Int64
+	connState       atomic.Int32 // a ConnState, see App.setConnState
+
+	// LinesThrottled were held back by the rate limit, LinesRateDropped
+	// thrown away by it.
+	LinesThrottled   atomic.Int64
+	LinesRateDropped atomic.Int64
+	// SlowDowns are slow-down commands from the server, or with -sink
+	// http3 answers asking teller to come back later. BatchesRejected were
+	// turned down by the HTTP/3 endpoint for good, and dropped.
+	SlowDowns       atomic.Int64
+	BatchesRejected atomic.Int64
+
+	// RawBytes is what batches added up to before compression, WireBytes
+	// what was actually handed to the stream.
+	RawBytes  atomic.Int64
+	WireBytes atomic.Int64
+	// Codecs breaks compression down by the codec that did it.
+	Codecs [codecCount]CodecStats
+
+	// Acks counts batches the server acknowledged, Unacked how many are
+	// waiting on it right now.
+	Acks    atomic.Int64
+	Unacked atomic.Int64
+	// AckTimeouts counts reconnects because the server stopped ACKing.
+	AckTimeouts atomic.Int64
+
+	// BufferBytes is what the pending and unACKed batches hold in memory,
+	// BufferStalls how often reading stopped because that hit
+	// -max-memory-buffer-bytes, and BufferOverflows batches spooled instead
+	// of kept for want of room.
+	BufferBytes     atomic.Int64
+	BufferStalls    atomic.Int64
+	BufferOverflows atomic.Int64
+
+	// FailoverLines were written to -failover-file for want of delivery,
+	// FailoverReplayed shipped from it later.
+	FailoverLines    atomic.Int64
+	FailoverReplayed atomic.Int64
+
+	// ParseErrors are lines that didn't fit -parse-format and were shipped
+	// raw, and TimestampFallbacks lines stamped with the time they were read
+	// because -timestamp-regex found no time in them.
+	ParseErrors        atomic.Int64
+	TimestampFallbacks atomic.Int64
+
+	// Datagrams counts lines sent as QUIC datagrams, DatagramsTooLarge the
+	// ones that didn't fit in one and went on the stream.
+	Datagrams         atomic.Int64
+	DatagramsTooLarge atomic.Int64
+
+	// ClockSkew is the server's clock less ours at the last handshake, in
+	// nanoseconds, with -max-clock-skew.
+	ClockSkew atomic.Int64
+
+	// LastWrite is when something last made it onto a stream, in Unix
+	// nanoseconds.
+	LastWrite atomic.Int64
+	// lastErr is the last error writing or connecting to the server.
+	lastErr atomic.Pointer[errorAt]
+
+	Conn ConnStats
+}
+
+// errorAt is an error and when it happened.
+type errorAt struct {
+	err string
+	at  time.Time
+}
+
+// noteError remembers err as the last thing to go wrong with the server.
+func (s *Stats) noteError(err error) {
+	s.lastErr.Store(&errorAt{err: err.Error(), at: time.Now()})
+}
+
+// LastError is the last error writing or connecting to the server and when
+// it happened, or "" if there hasn't been one.
+func (s *Stats) LastError() (string, time.Time) {
+	if e := s.lastErr.Load(); e != nil {
+		return e.err, e.at
+	}
+	return "", time.Time{}
+}
+
+// AvgBatchSize is the mean number of lines per batch sent so far.
+func (s *Stats) AvgBatchSize() float64 {
+	n := s.Batches.Load()
+	if n == 0 {
+		return 0
+	}
+	return float64(s.LinesSent.Load()) / float64(n)
+}
+
+// CompressionRatio is raw bytes over wire bytes, so 4 means batches shrank
+// to a quarter of their size.
+func (s *Stats) CompressionRatio() float64 {
+	n := s.WireBytes.Load()
+	if n == 0 {
+		return 0
+	}
+	return float64(s.RawBytes.Load()) / float64(n)
+}
+
+// codecCount is how many codecs protocol has, none included.
+const codecCount = int(protocol.CodecZstd) + 1
+
+// ratioWeight is how much each batch moves CodecStats's moving average of
+// the compression ratio: the last 20 or so batches count for most of it.
+const ratioWeight = 0.1
+
+// CodecStats is what compressing batches with one codec has come to. A
+// batch that didn't shrink is sent as it was, and counts as coming out the
+// size it went in. Time is wall time spent compressing, which as it's all
+// CPU work is close to the CPU time.
+type CodecStats struct {
+	Batches  atomic.Int64
+	BytesIn  atomic.Int64
+	BytesOut atomic.Int64
+	Nanos    atomic.Int64
+	ratio    atomic.Uint64 // float64 bits
+}
+
+// codec returns the stats for compressing with c.
+func (s *Stats) codec(c protocol.Codec) *CodecStats {
+	return &s.Codecs[c]
+}
+
+// add counts a batch of in bytes compressed to out in took.
+func (c *CodecStats) add(in, out int, took time.Duration) {
+	c.Batches.Add(1)
+	c.BytesIn.Add(int64(in))
+	c.BytesOut.Add(int64(out))
+	c.Nanos.Add(int64(took))
+	if out == 0 {
+		return
+	}
+	r := float64(in) / float64(out)
+	for {
+		old := c.ratio.Load()
+		avg := r
+		if old != 0 {
+			avg = math.Float64frombits(old)*(1-ratioWeight) + r*ratioWeight
+		}
+		if c.ratio.CompareAndSwap(old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+// Ratio is the moving average of bytes in over bytes out across recent
+// batches, 0 before the first.
+func (c *CodecStats) Ratio() float64 {
+	return math.Float64frombits(c.ratio.Load())
+}
+
+// compressionReport is the codecs that have compressed anything, by name,
+// for the stats event.
+func (s *Stats) compressionReport() map[string]protocol.CompressionStats {
+	var m map[string]protocol.CompressionStats
+	for i := range s.Codecs {
+		c := &s.Codecs[i]
+		if c.Batches.Load() == 0 {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]protocol.CompressionStats)
+		}
+		m[protocol.Codec(i).String()] = protocol.CompressionStats{
+			Batches:  c.Batches.Load(),
+			BytesIn:  c.BytesIn.Load(),
+			BytesOut: c.BytesOut.Load(),
+			Seconds:  time.Duration(c.Nanos.Load()).Seconds(),
+			Ratio:    c.Ratio(),
+		}
+	}
+	return m
+}
+
+// queueStats adds a protocol.StatsProgram event reporting Stats to the
+// pending batch, where it's shipped like any other line: acked, spooled or
+// written to a local sink as they are. It's counted as a line sent.
+func (a *App) queueStats() error {
+	s := &a.Stats
+	r := &protocol.StatsReport{
+		UptimeSeconds:    time.Since(a.started).Seconds(),
+		IntervalSeconds:  a.StatsInterval.Seconds(),
+		LinesRead:        s.LinesRead.Load(),
+		LinesSent:        s.LinesSent.Load(),
+		LinesFiltered:    s.LinesFiltered.Load(),
+		LinesSampledOut:  s.LinesSampledOut.Load(),
+		LinesRateDropped: s.LinesRateDropped.Load(),
+		LinesTruncated:   s.LinesTruncated.Load(),
+		LinesDeduped:     s.LinesDeduped.Load(),
+		LinesRedacted:    s.LinesRedacted.Load(),
+		Redactions:       s.Redactions.Load(),
+		LinesInvalidUTF8: s.LinesBadUTF8.Load(),
+		EncodeErrors:     s.EncodeErrors.Load(),
+		Batches:          s.Batches.Load(),
+		BytesSent:        s.WireBytes.Load(),
+		SendErrors:       s.SendErrors.Load(),
+		Reconnects:       s.Reconnects.Load(),
+		AckTimeouts:      s.AckTimeouts.Load(),
+		State:            s.ConnState().String(),
+		Unacked:          a.unacked(),
+		LagBytes:         a.Lag.snapshot(),
+		Compression:      s.compressionReport(),
+	}
+	if a.Spool != nil {
+		n, b, d := a.Spool.Len(), a.Spool.Bytes(), a.Spool.Dropped()
+		r.SpoolEntries, r.SpoolBytes, r.SpoolDropped = &n, &b, &d
+	}
+	data, err := a.marshalLine(SyslogLine{
+		Timestamp: a.now().Format(time.RFC3339),
+		Hostname:  a.Hostname,
+		Program:   protocol.StatsProgram,
+		Pid:       processID(),
+		Message:   fmt.Sprintf("lines read=%d sent=%d, reconnects=%d", r.LinesRead, r.LinesSent, r.Reconnects),
+		Tags:      a.Tags,
+		Stats:     r,
+	})
+	if err != nil {
+		return err
+	}
+	a.batch.add(event{data: data})
+	return nil
+}
+
+// queueLifecycle adds a protocol.LifecycleProgram event for phase to the
+// pending batch, shipped the way queueStats's are.
+func (a *App) queueLifecycle(phase, reason string) error {
+	lc := &protocol.Lifecycle{
+		Phase:        phase,
+		Version:      a.cfg.Version,
+		Hostname:     a.Hostname,
+		ConfigDigest: a.ConfigDigest,
+		Reason:       reason,
+	}
+	if phase == protocol.PhaseStop {
+		lc.UptimeSeconds = time.Since(a.started).Seconds()
+	}
+	data, err := a.marshalLine(SyslogLine{
+		Timestamp: a.now().Format(time.RFC3339),
+		Hostname:  a.Hostname,
+		Program:   protocol.LifecycleProgram,
+		Pid:       processID(),
+		Message:   fmt.Sprintf("teller %s %s", a.cfg.Version, phase),
+		Tags:      a.Tags,
+		Lifecycle: lc,
+	})
+	if err != nil {
+		return err
+	}
+	a.batch.add(event{data: data})
+	return nil
+}
+
+// queueStop queues the stop event, if there's to be one.
+func (a *App) queueStop(reason string) {
+	if !a.Lifecycle {
+		return
+	}
+	if err := a.queueLifecycle(protocol.PhaseStop, reason); err != nil {
+		slog.Warn("Error encoding stop event", "err", err)
+	}
+}
+
+// ServeMetrics exposes Stats in the Prometheus text format on addr. It only
+// returns if the listener fails.
+func (a *App) ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	if a.cfg.AdminUI {
+		mux.HandleFunc("GET /{$}", a.handleAdmin)
+		slog.Info("Serving the status page", "addr", addr, "path", "/")
+	}
+	slog.Info("Serving metrics", "addr", addr, "path", "/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Metrics server stopped", "addr", addr, "err", err)
+	}
+}
+
+func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s := &a.Stats
+
+	fmt.Fprintf(w, "# HELP teller_build_info Which build of teller this is.\n# TYPE teller_build_info gauge\n")
+	fmt.Fprintf(w, "teller_build_info{version=%q,commit=%q,build_date=%q} 1\n", a.cfg.Version, a.cfg.Commit, a.cfg.BuildDate)
+	counter(w, "teller_lines_read_total", "Lines read from tailed files.", s.LinesRead.Load())
+	counter(w, "teller_lines_filtered_total", "Lines dropped by the include/exclude filters.", s.LinesFiltered.Load())
+	counter(w, "teller_lines_sampled_out_total", "Lines left out of the sample.", s.LinesSampledOut.Load())
+	if a.routes != nil {
+		counter(w, "teller_lines_routed_away_total", "Lines a -route rule dropped, sampled out or sent to another sink.", s.LinesRouted.Load())
+	}
+	counter(w, "teller_lines_truncated_total", "Lines cut short to the maximum line length.", s.LinesTruncated.Load())
+	if len(a.Redactor.Rules) > 0 {
+		counter(w, "teller_lines_redacted_total", "Lines with something redacted before shipping.", s.LinesRedacted.Load())
+		counter(w, "teller_redactions_total", "Matches replaced by the redaction rules.", s.Redactions.Load())
+	}
+	counter(w, "teller_lines_invalid_utf8_total", "Lines with invalid UTF-8 replaced before shipping.", s.LinesBadUTF8.Load())
+	counter(w, "teller_lines_encode_errors_total", "Lines dropped because they couldn't be encoded.", s.EncodeErrors.Load())
+	counter(w, "teller_lines_deduped_total", "Repeated lines folded into another line's repeat count.", s.LinesDeduped.Load())
+	counter(w, "teller_lines_throttled_total", "Lines delayed to stay under the rate limit.", s.LinesThrottled.Load())
+	counter(w, "teller_slow_downs_total", "Times the server asked teller to hold off sending.", s.SlowDowns.Load())
+	counter(w, "teller_lines_rate_dropped_total", "Lines dropped for going over the rate limit.", s.LinesRateDropped.Load())
+	counter(w, "teller_lines_sent_total", "Lines handed to the stream, or to the spool while disconnected.", s.LinesSent.Load())
+	counter(w, "teller_batches_sent_total", "Batches sent.", s.Batches.Load())
+	counter(w, "teller_bytes_sent_total", "Bytes sent after compression.", s.WireBytes.Load())
+	counter(w, "teller_bytes_uncompressed_total", "Bytes sent before compression.", s.RawBytes.Load())
+	codecMetrics(w, s)
+	counter(w, "teller_send_errors_total", "Failed writes to the stream.", s.SendErrors.Load())
+	if a.Sink == sinkHTTP3 {
+		counter(w, "teller_batches_rejected_total", "Batches the HTTP/3 endpoint turned down for good, and dropped.", s.BatchesRejected.Load())
+	}
+	counter(w, "teller_reconnects_total", "Successful reconnects after a dropped connection.", s.Reconnects.Load())
+	counter(w, "teller_heartbeats_sent_total", "Heartbeats sent.", s.Heartbeats.Load())
+	if a.Timestamps != nil {
+		counter(w, "teller_timestamp_fallbacks_total", "Lines stamped with the time they were read for want of a timestamp of their own.", s.TimestampFallbacks.Load())
+	}
+	if a.ParseFormat != "raw" || a.Timestamps != nil {
+		fmt.Fprintf(w, "# HELP teller_parse_errors_total Lines that couldn't be parsed, by what failed: the -parse-format, or the timestamp.\n# TYPE teller_parse_errors_total counter\n")
+		if a.ParseFormat != "raw" {
+			fmt.Fprintf(w, "teller_parse_errors_total{stage=%q} %d\n", a.ParseFormat, s.ParseErrors.Load())
+		}
+		if a.Timestamps != nil {
+			fmt.Fprintf(w, "teller_parse_errors_total{stage=\"timestamp\"} %d\n", s.TimestampFallbacks.Load())
+		}
+	}
+
+	state := s.ConnState()
+	var up int64
+	if state == StateConnected {
+		up = 1
+	}
+	gauge(w, "teller_connection_up", "Whether the connection to the server is up.", float64(up))
+	fmt.Fprintf(w, "# HELP teller_connection_state Where the connection to the server stands, 1 for the current state.\n# TYPE teller_connection_state gauge\n")
+	for i, name := range connStates {
+		var v int
+		if ConnState(i) == state {
+			v = 1
+		}
+		fmt.Fprintf(w, "teller_connection_state{state=%q} %d\n", name, v)
+	}
+
+	if a.Sink == sinkQUIC {
+		c := &s.Conn
+		gauge(w, "teller_rtt_smoothed_seconds", "Smoothed round trip time to the server.", time.Duration(c.SmoothedRTT.Load()).Seconds())
+		gauge(w, "teller_rtt_min_seconds", "Lowest round trip time to the server seen.", time.Duration(c.MinRTT.Load()).Seconds())
+		gauge(w, "teller_rtt_latest_seconds", "Last round trip time to the server measured.", time.Duration(c.LatestRTT.Load()).Seconds())
+		gauge(w, "teller_congestion_window_bytes", "QUIC congestion window.", float64(c.Cwnd.Load()))
+		gauge(w, "teller_bytes_in_flight", "Bytes sent but not yet acknowledged by QUIC.", float64(c.BytesInFlight.Load()))
+		counter(w, "teller_packets_sent_total", "QUIC packets sent.", c.PacketsSent.Load())
+		counter(w, "teller_packets_lost_total", "QUIC packets declared lost.", c.PacketsLost.Load())
+		gauge(w, "teller_handshake_seconds", "How long the last connection to the server took to set up.", time.Duration(c.Handshake.Load()).Seconds())
+		counter(w, "teller_handshakes_resumed_total", "Handshakes that resumed an earlier TLS session.", c.Resumed.Load())
+		counter(w, "teller_handshakes_0rtt_total", "Handshakes whose 0-RTT data the server accepted.", c.EarlyData.Load())
+		if a.Datagrams {
+			counter(w, "teller_datagrams_sent_total", "Lines sent as QUIC datagrams.", s.Datagrams.Load())
+			counter(w, "teller_datagrams_oversized_total", "Lines too big for a datagram, sent on the stream instead.", s.DatagramsTooLarge.Load())
+		}
+		if a.MaxClockSkew > 0 {
+			gauge(w, "teller_clock_skew_seconds", "The server's clock less the local one, as of the last handshake.", time.Duration(s.ClockSkew.Load()).Seconds())
+		}
+	}
+
+	if a.AckWindow > 0 {
+		counter(w, "teller_batches_acked_total", "Batches acknowledged by the server.", s.Acks.Load())
+		gauge(w, "teller_batches_unacked", "Batches written but not yet acknowledged.", float64(s.Unacked.Load()))
+		counter(w, "teller_ack_timeout_reconnects_total", "Reconnects because the server went -ack-timeout without acknowledging a batch.", s.AckTimeouts.Load())
+	}
+
+	if a.FailoverFile != "" {
+		counter(w, "teller_failover_lines_total", "Lines written to the failover file because they couldn't be delivered.", s.FailoverLines.Load())
+		counter(w, "teller_failover_replayed_lines_total", "Lines shipped from the failover file once batches got through again.", s.FailoverReplayed.Load())
+	}
+
+	if a.MaxBufferBytes > 0 {
+		gauge(w, "teller_memory_buffer_bytes", "Bytes held in memory by the pending batch and batches awaiting an ACK.", float64(s.BufferBytes.Load()))
+		gauge(w, "teller_memory_buffer_limit_bytes", "The -max-memory-buffer-bytes cap.", float64(a.MaxBufferBytes))
+		counter(w, "teller_memory_buffer_stalls_total", "Times reading stopped because the memory buffer was full.", s.BufferStalls.Load())
+		counter(w, "teller_memory_buffer_spooled_total", "Batches spooled rather than held in memory for want of room.", s.BufferOverflows.Load())
+	}
+
+	lag := a.Lag.snapshot()
+	if len(lag) > 0 {
+		fmt.Fprintf(w, "# HELP teller_lag_bytes Bytes written to a file but not yet shipped.\n# TYPE teller_lag_bytes gauge\n")
+		for _, file := range slices.Sorted(maps.Keys(lag)) {
+			fmt.Fprintf(w, "teller_lag_bytes{file=%q} %d\n", file, lag[file])
+		}
+	}
+
+	if a.Spool != nil {
+		gauge(w, "teller_spool_entries", "Entries waiting in the disk spool.", float64(a.Spool.Len()))
+		gauge(w, "teller_spool_bytes", "Bytes waiting in the disk spool.", float64(a.Spool.Bytes()))
+		counter(w, "teller_spool_dropped_total", "Spool entries dropped because the spool was full.", a.Spool.Dropped())
+	}
+
+	if len(a.Tees) > 0 {
+		teeMetrics(w, a.Tees)
+	}
+}
+
+// codecMetrics writes the compression figures of each codec that's been
+// used, labelled with its name.
+func codecMetrics(w io.Writer, s *Stats) {
+	var used []protocol.Codec
+	for i := range s.Codecs {
+		if s.Codecs[i].Batches.Load() > 0 {
+			used = append(used, protocol.Codec(i))
+		}
+	}
+	if len(used) == 0 {
+		return
+	}
+	series := []struct {
+		name, help, kind string
+		value            func(*CodecStats) float64
+	}{
+		{"teller_compression_batches_total", "Batches compressed, whether or not they shrank.", "counter",
+			func(c *CodecStats) float64 { return float64(c.Batches.Load()) }},
+		{"teller_compression_input_bytes_total", "Bytes going into compression.", "counter",
+			func(c *CodecStats) float64 { return float64(c.BytesIn.Load()) }},
+		{"teller_compression_output_bytes_total", "Bytes coming out of compression, or going out as they were when they didn't shrink.", "counter",
+			func(c *CodecStats) float64 { return float64(c.BytesOut.Load()) }},
+		{"teller_compression_seconds_total", "Time spent compressing.", "counter",
+			func(c *CodecStats) float64 { return time.Duration(c.Nanos.Load()).Seconds() }},
+		{"teller_compression_ratio", "Moving average of bytes in over bytes out across recent batches.", "gauge",
+			func(c *CodecStats) float64 { return c.Ratio() }},
+	}
+	for _, m := range series {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, c := range used {
+			fmt.Fprintf(w, "%s{codec=%q} %g\n", m.name, c.String(), m.value(s.codec(c)))
+		}
+	}
+}
+
+func counter(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func gauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
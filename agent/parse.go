@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRFC3164 fills sl from a BSD syslog line:
+//
+//	<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+//
+// The <PRI> part is optional since syslog daemons usually leave it out when
+// writing to files, and so is [PID]. The timestamp carries no year, so the
+// current one is assumed, or last year if that would put the line more than
+// a day in the future. It reports false, leaving sl untouched, if line isn't
+// in that shape.
+func parseRFC3164(sl *SyslogLine, line string, now time.Time) bool {
+	rest := line
+	var pri *int
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end < 2 || end > 4 {
+			return false
+		}
+		p, err := strconv.Atoi(rest[1:end])
+		if err != nil || p < 0 || p > 191 {
+			return false
+		}
+		pri = &p
+		rest = rest[end+1:]
+	}
+
+	if len(rest) < len(time.Stamp)+1 || rest[len(time.Stamp)] != ' ' {
+		return false
+	}
+	stamp, err := time.ParseInLocation(time.Stamp, rest[:len(time.Stamp)], now.Location())
+	if err != nil {
+		return false
+	}
+	ts := time.Date(now.Year(), stamp.Month(), stamp.Day(), stamp.Hour(), stamp.Minute(), stamp.Second(), 0, now.Location())
+	if ts.After(now.Add(24 * time.Hour)) {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	rest = rest[len(time.Stamp)+1:]
+
+	host, rest, ok := strings.Cut(rest, " ")
+	if !ok || host == "" {
+		return false
+	}
+
+	i := strings.IndexAny(rest, "[: ")
+	if i <= 0 {
+		return false
+	}
+	tag, rest := rest[:i], rest[i:]
+	pid := 0
+	if rest[0] == '[' {
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			return false
+		}
+		if pid, err = strconv.Atoi(rest[1:end]); err != nil {
+			return false
+		}
+		rest = rest[end+1:]
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return false
+	}
+
+	sl.Priority = pri
+	sl.Timestamp = ts.Format(time.RFC3339)
+	sl.Hostname = host
+	sl.Program = tag
+	sl.Pid = pid
+	sl.Message = strings.TrimPrefix(rest[1:], " ")
+	return true
+}
+
+// parseRFC5424 fills sl from an IETF syslog line:
+//
+//	<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID k="v"...] MSG
+//
+// where any header field may be the nil value "-". The raw line always goes
+// into Raw. If the header parses but the structured data is malformed, the
+// header fields are kept and everything after MSGID becomes the message.
+// It reports false, leaving sl untouched, if the header doesn't parse.
+func parseRFC5424(sl *SyslogLine, line string) bool {
+	if !strings.HasPrefix(line, "<") {
+		return false
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return false
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return false
+	}
+
+	fields := strings.SplitN(line[end+1:], " ", 7)
+	if len(fields) < 6 {
+		return false
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version < 1 {
+		return false
+	}
+	var ts time.Time
+	if fields[1] != "-" {
+		if ts, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			return false
+		}
+	}
+
+	sl.Priority = &pri
+	sl.Version = version
+	if !ts.IsZero() {
+		sl.Timestamp = ts.Format(time.RFC3339Nano)
+	}
+	if fields[2] != "-" {
+		sl.Hostname = fields[2]
+	}
+	if fields[3] != "-" {
+		sl.Program = fields[3]
+	}
+	if pid, err := strconv.Atoi(fields[4]); err == nil {
+		sl.Pid = pid
+	}
+	if fields[5] != "-" {
+		sl.MsgID = fields[5]
+	}
+	sl.Raw = line
+
+	rest := ""
+	if len(fields) == 7 {
+		rest = fields[6]
+	}
+	sd, msg, ok := parseStructuredData(rest)
+	if !ok {
+		sl.Message = rest
+		return true
+	}
+	sl.StructuredData = sd
+	// An optional BOM marks the message as UTF-8
+	sl.Message = strings.TrimPrefix(msg, "\xef\xbb\xbf")
+	return true
+}
+
+// parseStructuredData splits the STRUCTURED-DATA part off the front of s,
+// returning the elements and whatever message follows.
+func parseStructuredData(s string) (map[string]map[string]string, string, bool) {
+	if s == "-" || strings.HasPrefix(s, "- ") {
+		return nil, strings.TrimPrefix(s[1:], " "), true
+	}
+	if s == "" {
+		return nil, "", true
+	}
+	if s[0] != '[' {
+		return nil, "", false
+	}
+
+	sd := make(map[string]map[string]string)
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		i++
+		idEnd := strings.IndexAny(s[i:], " ]")
+		if idEnd <= 0 {
+			return nil, "", false
+		}
+		id := s[i : i+idEnd]
+		i += idEnd
+		params := make(map[string]string)
+
+		for i < len(s) && s[i] == ' ' {
+			i++
+			eq := strings.IndexByte(s[i:], '=')
+			if eq <= 0 || i+eq+1 >= len(s) || s[i+eq+1] != '"' {
+				return nil, "", false
+			}
+			name := s[i : i+eq]
+			i += eq + 2
+
+			// PARAM-VALUE escapes ", \ and ] with a backslash
+			var val strings.Builder
+			closed := false
+			for i < len(s) {
+				c := s[i]
+				if c == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					val.WriteByte(s[i+1])
+					i += 2
+					continue
+				}
+				i++
+				if c == '"' {
+					closed = true
+					break
+				}
+				val.WriteByte(c)
+			}
+			if !closed {
+				return nil, "", false
+			}
+			params[name] = val.String()
+		}
+		if i >= len(s) || s[i] != ']' {
+			return nil, "", false
+		}
+		i++
+		sd[id] = params
+	}
+	return sd, strings.TrimPrefix(s[i:], " "), true
+}
+
+// jsonMessageKeys and jsonLevelKeys are the fields a JSON log line's message
+// and level are taken from, in order of preference.
+var (
+	jsonMessageKeys = []string{"message", "msg"}
+	jsonLevelKeys   = []string{"level", "lvl", "severity"}
+)
+
+// parseJSON fills sl from a line holding one JSON object. The message and
+// level fields, and the timestamp from tsField if there is one, are lifted
+// into sl; every other field is carried as is in sl.Fields. A string
+// timestamp is kept verbatim, a number is taken as Unix seconds. It reports
+// false, leaving sl untouched, if line isn't a JSON object.
+func parseJSON(sl *SyslogLine, line, tsField string) bool {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil || fields == nil || dec.More() {
+		return false
+	}
+
+	for _, k := range jsonMessageKeys {
+		if msg, ok := fields[k].(string); ok {
+			sl.Message = msg
+			delete(fields, k)
+			break
+		}
+	}
+	for _, k := range jsonLevelKeys {
+		if lvl, ok := fields[k].(string); ok && lvl != "" {
+			sl.Level = strings.ToLower(lvl)
+			if sev, ok := severities[sl.Level]; ok {
+				sl.Severity = &sev
+			}
+			delete(fields, k)
+			break
+		}
+	}
+	if tsField != "" {
+		switch ts := fields[tsField].(type) {
+		case string:
+			sl.Timestamp = ts
+			delete(fields, tsField)
+		case json.Number:
+			if secs, err := ts.Float64(); err == nil {
+				sl.Timestamp = time.UnixMilli(int64(secs * 1000)).UTC().Format(time.RFC3339Nano)
+				delete(fields, tsField)
+			}
+		}
+	}
+	if len(fields) > 0 {
+		sl.Fields = fields
+	}
+	return true
+}
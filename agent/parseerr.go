@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// parseReportsPerMinute caps -report-parse-errors, so a parser that's wrong
+// for every line doesn't double what's shipped.
+const parseReportsPerMinute = 10
+
+// parseReporter rations parse error reports to parseReportsPerMinute,
+// counting the failures left out in between.
+type parseReporter struct {
+	mu      sync.Mutex
+	start   time.Time
+	sent    int
+	skipped int64
+}
+
+// allow reports whether a failure at now gets reported, and if so how many
+// weren't since the last one that was.
+func (r *parseReporter) allow(now time.Time) (bool, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.start) >= time.Minute {
+		r.start, r.sent = now, 0
+	}
+	if r.sent >= parseReportsPerMinute {
+		r.skipped++
+		return false, 0
+	}
+	r.sent++
+	skipped := r.skipped
+	r.skipped = 0
+	return true, skipped
+}
+
+// reportParseError ships a copy of a line from file that stage couldn't
+// make sense of, as it was to be shipped (redacted, say), in a
+// protocol.ParseErrorProgram event ahead of it, unless it's over the ration.
+func (a *App) reportParseError(stage, file, text string) {
+	ok, skipped := a.parseReports.allow(time.Now())
+	if !ok {
+		return
+	}
+	msg := fmt.Sprintf("couldn't parse a line from %s as %s", file, stage)
+	if stage == "timestamp" {
+		msg = fmt.Sprintf("found no timestamp in a line from %s", file)
+	}
+	data, err := a.marshalLine(SyslogLine{
+		Timestamp:  a.now().Format(time.RFC3339),
+		Hostname:   a.Hostname,
+		Program:    protocol.ParseErrorProgram,
+		Pid:        processID(),
+		File:       file,
+		Message:    msg,
+		Raw:        text,
+		Tags:       a.Tags,
+		ParseError: &protocol.ParseError{Stage: stage, Skipped: skipped},
+	})
+	if err != nil {
+		slog.Warn("Error encoding parse error report", "err", err)
+		return
+	}
+	a.deliver(event{data: data})
+}
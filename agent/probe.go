@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// probeAckTimeout is how long Probe waits for its event's ACK when
+// AckTimeout doesn't say.
+const probeAckTimeout = 10 * time.Second
+
+// Probe checks that teller can get logs to cfg's server without tailing
+// anything: it connects as Run would, verifying the certificate, opens the
+// stream with its hello, sends one protocol.ProbeProgram event and, with
+// -ack-window, waits for the server to ACK it. It returns a line for each
+// step, with how long it took and what was agreed, and the first step that
+// failed. Run's state and spool are left alone.
+func Probe(ctx context.Context, cfg Config) ([]string, error) {
+	cfg.dryRun = true
+	a, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if a.Sink != sinkQUIC {
+		return nil, fmt.Errorf("-probe only works with -sink quic, not %s", a.Sink)
+	}
+	a.probing = true
+	a.Control = false
+	// OpenStream has ACKs read into here
+	a.acks = make(chan ackMsg, 1)
+	var summary []string
+	say := func(format string, args ...any) { summary = append(summary, fmt.Sprintf(format, args...)) }
+
+	start := time.Now()
+	if err := a.InitQUICConnection(ctx); err != nil {
+		return summary, fmt.Errorf("error connecting: %v", err)
+	}
+	defer a.Conn.CloseWithError(0, "probe done")
+	cs := a.Conn.ConnectionState()
+	say("connected to %s (%s) in %v", a.ServerAddr, a.Conn.RemoteAddr(), time.Since(start).Round(time.Microsecond))
+	say("tls: %s, %s, alpn %q", tls.VersionName(cs.TLS.Version), tls.CipherSuiteName(cs.TLS.CipherSuite), cs.TLS.NegotiatedProtocol)
+	if certs := cs.TLS.PeerCertificates; len(certs) > 0 {
+		verified := "verified"
+		if a.TLSConfig.InsecureSkipVerify {
+			verified = "not verified (-insecure)"
+		}
+		say("server certificate: %s, issued by %s, expires %s, %s", certs[0].Subject, certs[0].Issuer, certs[0].NotAfter.Format(time.RFC3339), verified)
+	}
+
+	asked := time.Now()
+	if err := a.OpenStream(ctx); err != nil {
+		return summary, fmt.Errorf("error opening stream: %v", err)
+	}
+	defer a.Stream.Close()
+	if r := a.answer; r != nil {
+		msg := fmt.Sprintf("hello answered in %v: protocol %d (teller speaks %d), compression %s", time.Since(asked).Round(time.Microsecond), r.Protocol, protocol.Version, a.Codec)
+		if t, err := time.Parse(time.RFC3339Nano, r.Time); err == nil {
+			msg += fmt.Sprintf(", clock %v off the server's", time.Since(t).Round(time.Millisecond))
+		}
+		say("%s", msg)
+	} else {
+		say("hello sent, no answer: the server predates negotiating, so no compression")
+	}
+	if a.Datagrams {
+		say("datagrams: server takes them: %v", cs.SupportsDatagrams)
+	}
+
+	data, err := a.marshalLine(SyslogLine{
+		Timestamp: a.now().Format(time.RFC3339),
+		Hostname:  a.Hostname,
+		Program:   protocol.ProbeProgram,
+		Pid:       processID(),
+		Message:   fmt.Sprintf("teller %s probe from %s", a.cfg.Version, a.Hostname),
+		Tags:      a.Tags,
+	})
+	if err != nil {
+		return summary, err
+	}
+	frame := protocol.AppendFrame(nil, data)
+	var seq uint64
+	if a.acking() {
+		seq = a.nextSeq()
+		frame = protocol.AppendBatchFrame(nil, seq, frame)
+	}
+	sent := time.Now()
+	if err := a.writeTo(a.Stream, frame); err != nil {
+		return summary, fmt.Errorf("error sending the test event: %v", err)
+	}
+	if !a.acking() {
+		say("test event sent; without -ack-window there's no telling the server got it")
+		return summary, nil
+	}
+
+	wait := a.AckTimeout
+	if wait <= 0 {
+		wait = probeAckTimeout
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case ack := <-a.acks:
+			if ack.seq != seq {
+				continue
+			}
+			say("test event ACKed in %v", time.Since(sent).Round(time.Microsecond))
+			return summary, nil
+		case <-timer.C:
+			return summary, fmt.Errorf("no ACK for the test event within %v, check the server ACKs batches as -ack-window needs", wait)
+		case <-ctx.Done():
+			return summary, errors.New("interrupted waiting for the ACK")
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package agent
+
+import "path/filepath"
+
+// defaultProgram is what lines are shipped as when nothing says otherwise.
+const defaultProgram = "teller"
+
+// SourceProgram names the program lines from files matching Pattern, a
+// -file path or glob, are shipped as.
+type SourceProgram struct {
+	Pattern string
+	Program string
+}
+
+// programFor is the program lines from file go out as: the first of
+// Programs whose pattern is file or matches it, else ProcName, else Program,
+// else defaultProgram. force is set when it's ProcName, which a line naming
+// its own program doesn't get to override.
+func (a *App) programFor(file string) (name string, force bool) {
+	for _, sp := range a.Programs {
+		if sp.Pattern == file {
+			return sp.Program, false
+		}
+		if ok, _ := filepath.Match(sp.Pattern, file); ok {
+			return sp.Program, false
+		}
+	}
+	if a.ProcName != "" {
+		return a.ProcName, true
+	}
+	if a.Program != "" {
+		return a.Program, false
+	}
+	return defaultProgram, false
+}
@@ -0,0 +1,37 @@
+package agent
+
+import "testing"
+
+// TestProcName checks -procname takes over from a program the line names
+// itself, where -program doesn't, and that -file-program still wins.
+func TestProcName(t *testing.T) {
+	const line = "<13>Oct 11 22:14:15 web1 sshd[4721]: Accepted publickey for deploy"
+	for _, tc := range []struct {
+		name              string
+		program, procName string
+		file, format      string
+		want              string
+	}{
+		{"program, raw", "app", "", "app.log", "raw", "app"},
+		{"program, parsed", "app", "", "app.log", "rfc3164", "sshd"},
+		{"procname, raw", "app", "worker", "app.log", "raw", "worker"},
+		{"procname, parsed", "app", "worker", "app.log", "rfc3164", "worker"},
+		{"procname, file-program", "app", "worker", "/var/log/nginx.log", "raw", "nginx"},
+		{"procname, file-program, parsed", "app", "worker", "/var/log/nginx.log", "rfc3164", "sshd"},
+	} {
+		cfg := testConfig()
+		cfg.Program = tc.program
+		cfg.ProcName = tc.procName
+		cfg.Programs = []SourceProgram{{Pattern: "/var/log/nginx*", Program: "nginx"}}
+		cfg.ParseFormat = tc.format
+		a := newTestApp(t, cfg, nil, nil)
+		lb, err := a.encode(tc.file, line, nil, marks{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lb.sl.Program != tc.want {
+			t.Errorf("%s: shipped as %q, want %q", tc.name, lb.sl.Program, tc.want)
+		}
+		lb.release()
+	}
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilling at rate tokens a second and holding up
+// to a second's worth. A rate of zero means no limit.
+type bucket struct {
+	rate   float64
+	tokens float64
+}
+
+func (b *bucket) refill(elapsed time.Duration) {
+	b.tokens = min(b.tokens+b.rate*elapsed.Seconds(), b.rate)
+}
+
+// need is how long until n tokens are available. n is capped at the bucket
+// size so a line bigger than a second's worth of bytes can still get out.
+func (b *bucket) need(n float64) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	n = min(n, b.rate)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate != 0 {
+		b.tokens -= min(n, b.rate)
+	}
+}
+
+// rateLimiter caps lines and bytes per second across all tailed files. In
+// drop mode lines over the limit are discarded, otherwise the tailer that
+// read them waits, which backs up into the file rather than the network.
+type rateLimiter struct {
+	mu    sync.Mutex
+	lines bucket
+	bytes bucket
+	drop  bool
+	last  time.Time
+}
+
+// newRateLimiter returns nil, which limits nothing, if both rates are zero.
+func newRateLimiter(linesPerSec, bytesPerSec float64, drop bool) *rateLimiter {
+	if linesPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		lines: bucket{rate: max(linesPerSec, 0), tokens: max(linesPerSec, 0)},
+		bytes: bucket{rate: max(bytesPerSec, 0), tokens: max(bytesPerSec, 0)},
+		drop:  drop,
+		last:  time.Now(),
+	}
+}
+
+// wait admits one line of n bytes. It reports whether the line may be sent,
+// and whether it had to be held back to get under the limit. Cancelling ctx
+// ends the wait, and the line isn't sent.
+func (r *rateLimiter) wait(ctx context.Context, n int) (ok, throttled bool) {
+	if r == nil {
+		return true, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		now := time.Now()
+		r.lines.refill(now.Sub(r.last))
+		r.bytes.refill(now.Sub(r.last))
+		r.last = now
+
+		d := max(r.lines.need(1), r.bytes.need(float64(n)))
+		if d == 0 {
+			r.lines.take(1)
+			r.bytes.take(float64(n))
+			return true, throttled
+		}
+		if r.drop {
+			return false, false
+		}
+		// Waiting with the lock held is the point: every other tailer
+		// queues up behind this one
+		throttled = true
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return false, throttled
+		}
+	}
+}
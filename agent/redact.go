@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Redactor blanks out what mustn't leave the host. Each rule's matches are
+// replaced with Placeholder, rule by rule in order. A rule with a check only
+// replaces the matches check agrees with.
+type Redactor struct {
+	Rules       []redactRule
+	Placeholder string
+}
+
+type redactRule struct {
+	re    *regexp.Regexp
+	check func(string) bool
+}
+
+// redactPresets are the -redact-preset choices.
+var redactPresets = map[string]redactRule{
+	// 13 to 19 digits, optionally grouped by spaces or dashes, that pass
+	// the Luhn check, so order numbers and the like mostly survive
+	"credit-card": {re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), check: luhn},
+	"email":       {re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	// Access key IDs, long-lived and temporary
+	"aws-key": {re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+}
+
+// newRedactor makes a Redactor from preset names, then patterns, in that
+// order.
+func newRedactor(presets []string, patterns []*regexp.Regexp, placeholder string) (Redactor, error) {
+	r := Redactor{Placeholder: placeholder}
+	for _, name := range presets {
+		rule, ok := redactPresets[strings.ToLower(name)]
+		if !ok {
+			return Redactor{}, fmt.Errorf("unknown preset %q (want %s)", name, strings.Join(slices.Sorted(maps.Keys(redactPresets)), ", "))
+		}
+		r.Rules = append(r.Rules, rule)
+	}
+	for _, re := range patterns {
+		r.Rules = append(r.Rules, redactRule{re: re})
+	}
+	return r, nil
+}
+
+// Redact returns s with the rules applied, and how many matches were
+// replaced.
+func (r *Redactor) Redact(s string) (string, int) {
+	n := 0
+	for _, rule := range r.Rules {
+		s = rule.re.ReplaceAllStringFunc(s, func(m string) string {
+			if rule.check != nil && !rule.check(m) {
+				return m
+			}
+			n++
+			return r.Placeholder
+		})
+	}
+	return s, n
+}
+
+// luhn reports whether the digits in s pass the Luhn checksum that card
+// numbers carry. Anything else in s is skipped.
+func luhn(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// ReloadClientCert reads the client certificate and key again, from
+// certFile and keyFile, and if they've changed has new handshakes present
+// them. The sender of the App and each of its tees then reconnects, so the
+// connections up now stop going by the old certificate; what's unACKed is
+// sent again or spooled as after any other reconnect, and offsets are kept.
+// It reports whether the certificate changed. Safe to call from any
+// goroutine.
+func (a *App) ReloadClientCert(certFile, keyFile string) (bool, error) {
+	if a.clientCert == nil {
+		if certFile == "" {
+			return false, nil
+		}
+		return false, errors.New("teller was started without -client-cert, restart it to start presenting one")
+	}
+	if certFile == "" || keyFile == "" {
+		return false, errors.New("-client-cert and -client-key must be given together")
+	}
+	cert, err := loadClientCert(certFile, keyFile)
+	if err != nil {
+		return false, err
+	}
+	if slices.EqualFunc(cert.Certificate, a.clientCert.cur.Load().Certificate, bytes.Equal) {
+		return false, nil
+	}
+	a.clientCert.cur.Store(cert)
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		slog.Info("Client certificate reloaded", "file", certFile, "subject", leaf.Subject.String(),
+			"serial", leaf.SerialNumber.String(), "not_after", leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		slog.Info("Client certificate reloaded", "file", certFile)
+	}
+	for _, app := range append([]*App{a}, a.Tees...) {
+		select {
+		case app.redial <- struct{}{}:
+		default:
+		}
+	}
+	return true, nil
+}
+
+// redialer is a Sink with a connection it can let go of, for the next write
+// to dial a new one.
+type redialer interface {
+	redial()
+}
+
+// redialNow reconnects after ReloadClientCert, for the server to see the new
+// certificate. Like checkAcks, with a spool the reconnect happens in the
+// background and what's unACKed is spooled; without one it's sent again.
+func (a *App) redialNow(ctx context.Context) error {
+	if a.Sink != sinkQUIC {
+		if r, ok := a.Output.(redialer); ok && a.Sink != sinkTCP {
+			slog.Info("Reconnecting to present the new client certificate", "sink", a.Sink)
+			r.redial()
+		}
+		return nil
+	}
+	if !a.up || a.Conn == nil {
+		return nil
+	}
+	slog.Info("Reconnecting to present the new client certificate", "server", a.ServerAddr)
+	if a.Spool != nil {
+		a.goDown(ctx)
+		return nil
+	}
+	if err := a.reconnect(ctx); err != nil {
+		return err
+	}
+	return a.resend()
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// The -address-family choices. auto uses every address a server name has,
+// in the order the resolver prefers them.
+const (
+	familyAuto = "auto"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// lookupNetIP is the resolver's lookup, which tests swap for one that knows
+// names with addresses of both families.
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// checkServer makes sure addr is host:port, which for an IPv6 literal means
+// in brackets, so a missing port isn't taken for part of the address.
+func checkServer(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("%q isn't host:port (IPv6 addresses go in brackets, [2001:db8::1]:5140)", addr)
+	}
+	return nil
+}
+
+// familyNetwork narrows a network, "tcp" or "udp", to family: "tcp4" for
+// ipv4 and so on.
+func familyNetwork(network, family string) string {
+	switch family {
+	case familyIPv4:
+		return network + "4"
+	case familyIPv6:
+		return network + "6"
+	}
+	return network
+}
+
+// resolveUDP looks addr up and returns every address of family it has, in
+// the resolver's order, so a dial can move on to the next when one doesn't
+// answer. An IP literal resolves to itself, if it's of the family.
+func resolveUDP(ctx context.Context, addr, family string) ([]*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupNetIP(ctx, familyNetwork("ip", family), host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.UDPAddr
+	for _, ip := range ips {
+		// LookupNetIP can hand back IPv4 addresses in IPv6 form
+		addrs = append(addrs, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port))))
+	}
+	return addrs, nil
+}
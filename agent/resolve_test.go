@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// dualStack has lookupNetIP answer for both.test with an IPv6 and an IPv4
+// address, in that order, narrowed to the family asked for as the real
+// resolver would, and look everything else up as usual.
+func dualStack(t *testing.T, addrs ...string) {
+	t.Helper()
+	lookup := lookupNetIP
+	t.Cleanup(func() { lookupNetIP = lookup })
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		if host != "both.test" {
+			return lookup(ctx, network, host)
+		}
+		var ips []netip.Addr
+		for _, s := range addrs {
+			ip := netip.MustParseAddr(s)
+			if network == "ip" || (network == "ip4") == ip.Is4() {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return ips, nil
+	}
+}
+
+func TestResolveUDP(t *testing.T) {
+	dualStack(t, "::1", "127.0.0.1")
+	for _, tc := range []struct {
+		addr, family string
+		want         []string
+	}{
+		{"[::1]:5140", familyAuto, []string{"[::1]:5140"}},
+		{"[::1]:5140", familyIPv6, []string{"[::1]:5140"}},
+		{"[::1]:5140", familyIPv4, nil},
+		{"127.0.0.1:5140", familyIPv4, []string{"127.0.0.1:5140"}},
+		{"127.0.0.1:5140", familyIPv6, nil},
+		{"both.test:5140", familyAuto, []string{"[::1]:5140", "127.0.0.1:5140"}},
+		{"both.test:5140", familyIPv4, []string{"127.0.0.1:5140"}},
+		{"both.test:5140", familyIPv6, []string{"[::1]:5140"}},
+		{"::1:5140", familyAuto, nil},
+	} {
+		addrs, err := resolveUDP(context.Background(), tc.addr, tc.family)
+		var got []string
+		for _, a := range addrs {
+			got = append(got, a.String())
+		}
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s with %s resolved to %q, want it rejected", tc.addr, tc.family, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("%s with %s resolved to %q (%v), want %q", tc.addr, tc.family, got, err, tc.want)
+		}
+	}
+}
+
+// TestDialFallback has both.test's IPv6 address, which comes first, go
+// unanswered, and checks the dial moves on to its IPv4 one, where the
+// server is, unless -address-family rules that out.
+func TestDialFallback(t *testing.T) {
+	srv := newTestServer(t, true)
+	_, port, _ := net.SplitHostPort(srv.addr)
+	dualStack(t, "::1", "127.0.0.1")
+	cfg := srv.quicConfig()
+	cfg.DialTimeout = 300 * time.Millisecond
+	a := newTestApp(t, cfg, nil, nil)
+	addr := net.JoinHostPort("both.test", port)
+
+	l, err := a.dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	l.conn.CloseWithError(0, "")
+	if got := l.conn.RemoteAddr().String(); got != srv.addr {
+		t.Errorf("connected to %s, want the server at %s", got, srv.addr)
+	}
+
+	a.AddressFamily = familyIPv6
+	if l, err := a.dial(context.Background(), addr); err == nil {
+		l.conn.CloseWithError(0, "")
+		t.Fatalf("dial with ipv6 connected to %s", l.conn.RemoteAddr())
+	}
+}
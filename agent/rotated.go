@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// rotatedFile is a rotated sibling of a tailed file with lines in it that
+// were never shipped, from offset on.
+type rotatedFile struct {
+	path    string
+	offset  int64
+	modTime time.Time
+}
+
+// rotatedBacklog works out what of file's rotated siblings, the paths
+// matching file+RotatedPattern, was never shipped because teller was down
+// when it was rotated. The saved head says which file the saved offset was
+// in: if file still starts with it there's nothing to catch up on, and
+// otherwise the sibling that does is shipped from the offset and every one
+// rotated after it in full, oldest first. Without a head, or with no
+// sibling matching it, there's no telling, and nothing is caught up.
+func (a *App) rotatedBacklog(file string) []rotatedFile {
+	off, ok := a.saved[file]
+	head := a.savedHeads[file]
+	if !ok || len(head) == 0 {
+		return nil
+	}
+	if h, err := readHead(file, len(head)); err == nil && bytes.Equal(h, head) {
+		return nil
+	}
+	self, _ := os.Stat(file)
+	matches, _ := filepath.Glob(file + a.RotatedPattern)
+	var siblings []rotatedFile
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil || !fi.Mode().IsRegular() || (self != nil && os.SameFile(fi, self)) {
+			continue
+		}
+		siblings = append(siblings, rotatedFile{path: m, modTime: fi.ModTime()})
+	}
+	slices.SortFunc(siblings, func(x, y rotatedFile) int { return x.modTime.Compare(y.modTime) })
+	for i, r := range siblings {
+		if h, err := readHead(r.path, len(head)); err != nil || !bytes.Equal(h, head) {
+			continue
+		}
+		todo := siblings[i:]
+		todo[0].offset = off
+		// An earlier catch-up may have got further into it than file did
+		if roff, ok := a.saved[r.path]; ok && roff > off && len(a.savedHeads[r.path]) > 0 {
+			if h, err := readHead(r.path, len(a.savedHeads[r.path])); err == nil && bytes.Equal(h, a.savedHeads[r.path]) {
+				todo[0].offset = roff
+			}
+		}
+		return todo
+	}
+	slog.Info("File was rotated while teller was down, but no rotated file has where it left off", "file", file, "pattern", file+a.RotatedPattern)
+	return nil
+}
+
+// catchUp ships the rotated files in todo, in order, and then tails file
+// from the top, all in the background. Each rotated file is shipped under
+// its own name and forgotten once it's done.
+func (w *Watcher) catchUp(file string, todo []rotatedFile) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for _, r := range todo {
+			src, err := openRotated(r.path, r.offset, w.app.MaxLineBytes, w.app.Delimiter)
+			if err != nil {
+				slog.Error("Error opening rotated file", "file", r.path, "err", err)
+				continue
+			}
+			slog.Info("Catching up on a rotated file", "file", file, "rotated", r.path, "offset", r.offset)
+			if !w.app.deliver(event{file: r.path, offset: r.offset, start: true, reset: true}) {
+				src.Stop()
+				return
+			}
+			w.app.pump(r.path, src)
+			if !w.app.deliver(event{file: r.path, forget: true}) {
+				return
+			}
+		}
+		// The saved offset was in the rotated file, not this one
+		if w.app.deliver(event{file: file, start: true, reset: true}) {
+			w.follow(file, 0, true)
+		}
+	}()
+}
+
+// openRotated reads path, gunzipped if it's gzipped, from offset to its end.
+// Offsets in a compressed file count the bytes it decompresses to. A last
+// line without a newline is shipped as it is, since nothing more is going to
+// be written to it. The file is closed once the source ends.
+func openRotated(path string, offset int64, maxLine int, delim byte) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	if isGzip(path) {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// A saved offset past the end leaves nothing to read, not an error
+		if _, err := io.CopyN(io.Discard, zr, offset); err != nil && !errors.Is(err, io.EOF) {
+			f.Close()
+			return nil, fmt.Errorf("%s is truncated or corrupt: %v", path, err)
+		}
+		r = &gzipReader{zr: zr, path: path}
+	} else if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newReaderSource(r, f, offset, maxLine, delim), nil
+}
+
+// isGzip reports whether path is gzipped, going by its name ending in .gz or
+// by it starting with gzip's magic bytes.
+func isGzip(path string) bool {
+	if strings.HasSuffix(path, ".gz") {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var magic [2]byte
+	_, err = io.ReadFull(f, magic[:])
+	return err == nil && magic == [2]byte{0x1f, 0x8b}
+}
+
+// gunzippedSize returns how many bytes path decompresses to, or as far as it
+// gets before any damage. gzip's own trailer only has the size mod 4GiB, and
+// of the last member, so it takes reading the whole file.
+func gunzippedSize(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0
+	}
+	n, _ := io.Copy(io.Discard, zr)
+	return n
+}
+
+// gzipReader says which file a decompression error is in. A truncated
+// archive ends the source there: the complete lines before the damage have
+// been shipped, the broken one isn't.
+type gzipReader struct {
+	zr   *gzip.Reader
+	path string
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%s is truncated or corrupt, skipping the rest of it: %v", r.path, err)
+	}
+	return n, err
+}
+
+// readHead returns the first n bytes of path, gunzipped if it's gzipped, or
+// fewer if that's all there is.
+func readHead(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if isGzip(path) {
+		if r, err = gzip.NewReader(f); err != nil {
+			return nil, err
+		}
+	}
+	b := make([]byte, n)
+	n, err = io.ReadFull(r, b)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// updateHeads tops up the saved head of every file with an offset, the
+// first headSize bytes of it or as much as has been shipped, so the next
+// start can tell whether the file it names is still that one. A head only
+// has to be read again once the offset has gone back, which commit
+// notices.
+func (a *App) updateHeads() {
+	if a.heads == nil {
+		return
+	}
+	for file, off := range a.offsets {
+		want := int(min(headSize, off))
+		if len(a.heads[file]) >= want {
+			continue
+		}
+		if h, err := readHead(file, want); err == nil && len(h) == want {
+			a.heads[file] = h
+		}
+	}
+	for file := range a.heads {
+		if _, ok := a.offsets[file]; !ok {
+			delete(a.heads, file)
+		}
+	}
+}
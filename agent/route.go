@@ -0,0 +1,532 @@
+package agent
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// router is the -route rules: each an expression over a line's fields and
+// what to do with the lines it matches. The first rule that matches a line
+// decides, and a line no rule matches is shipped as if there were none.
+// Every sink, the main one and each tee, runs the rules for itself, so a
+// rule routing lines to one tee has the others leave them out.
+type router struct {
+	rules []routeRule
+}
+
+type routeRule struct {
+	spec string
+	cond expr
+	// action is drop, ship, route or sample. route sends lines to the sinks
+	// in to, "sink" for the main one and tee names for the rest, and sample
+	// ships rate of them.
+	action string
+	to     []string
+	rate   float64
+}
+
+// parseRoutes compiles -route rules, "expression -> action", in order.
+func parseRoutes(specs []string) (*router, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	r := &router{}
+	for _, spec := range specs {
+		rule, err := parseRoute(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", spec, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func parseRoute(spec string) (routeRule, error) {
+	i := strings.LastIndex(spec, "->")
+	if i < 0 {
+		return routeRule{}, fmt.Errorf("no -> between the expression and the action")
+	}
+	rule := routeRule{spec: strings.TrimSpace(spec)}
+	cond, err := parseExpr(spec[:i])
+	if err != nil {
+		return routeRule{}, err
+	}
+	rule.cond = cond
+	action, arg, _ := strings.Cut(strings.TrimSpace(spec[i+2:]), " ")
+	arg = strings.TrimSpace(arg)
+	rule.action = action
+	switch action {
+	case "drop", "ship":
+		if arg != "" {
+			return routeRule{}, fmt.Errorf("%s takes nothing after it", action)
+		}
+	case "route":
+		for _, t := range strings.Split(arg, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				if t != "sink" {
+					t = teeName(t)
+				}
+				rule.to = append(rule.to, t)
+			}
+		}
+		if len(rule.to) == 0 {
+			return routeRule{}, fmt.Errorf("route needs sink or a tee to send to")
+		}
+	case "sample":
+		rule.rate, err = strconv.ParseFloat(arg, 64)
+		if err != nil || rule.rate < 0 || rule.rate > 1 {
+			return routeRule{}, fmt.Errorf("sample needs a rate between 0 and 1")
+		}
+	default:
+		return routeRule{}, fmt.Errorf("unknown action %q (want drop, ship, route or sample)", action)
+	}
+	return rule, nil
+}
+
+// match returns the first rule sl matches, or nil.
+func (r *router) match(sl *SyslogLine) *routeRule {
+	for i := range r.rules {
+		if truthy(r.rules[i].cond.eval(sl)) {
+			return &r.rules[i]
+		}
+	}
+	return nil
+}
+
+// targets is every sink named by a route rule, to check against the tees.
+func (r *router) targets() []string {
+	var to []string
+	for _, rule := range r.rules {
+		for _, t := range rule.to {
+			if !slices.Contains(to, t) {
+				to = append(to, t)
+			}
+		}
+	}
+	return to
+}
+
+// An expr is one node of a rule's expression. Values are strings, float64s,
+// bools, or nil for a field the line doesn't have.
+type expr interface {
+	eval(sl *SyslogLine) any
+}
+
+type (
+	literalExpr struct{ v any }
+	fieldExpr   struct{ path []string }
+	notExpr     struct{ x expr }
+	andExpr     struct{ x, y expr }
+	orExpr      struct{ x, y expr }
+	compareExpr struct {
+		op   string
+		x, y expr
+	}
+	matchExpr struct {
+		re     *regexp.Regexp
+		x      expr
+		negate bool
+	}
+)
+
+func (e literalExpr) eval(*SyslogLine) any  { return e.v }
+func (e fieldExpr) eval(sl *SyslogLine) any { return lineField(sl, e.path) }
+func (e notExpr) eval(sl *SyslogLine) any   { return !truthy(e.x.eval(sl)) }
+func (e andExpr) eval(sl *SyslogLine) any   { return truthy(e.x.eval(sl)) && truthy(e.y.eval(sl)) }
+func (e orExpr) eval(sl *SyslogLine) any    { return truthy(e.x.eval(sl)) || truthy(e.y.eval(sl)) }
+
+func (e matchExpr) eval(sl *SyslogLine) any {
+	v := e.x.eval(sl)
+	return v != nil && e.re.MatchString(valueString(v)) != e.negate
+}
+
+func (e compareExpr) eval(sl *SyslogLine) any {
+	x, y := e.x.eval(sl), e.y.eval(sl)
+	xn, xok := x.(float64)
+	yn, yok := y.(float64)
+	var c int
+	switch {
+	case xok && yok:
+		c = cmpFloat(xn, yn)
+	case x == nil || y == nil:
+		// A missing field only equals another missing one
+		switch e.op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		}
+		return false
+	default:
+		c = strings.Compare(valueString(x), valueString(y))
+	}
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func cmpFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	}
+	return true
+}
+
+func valueString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// lineField looks path up in sl by its JSON names: level, program,
+// tags.env, fields.user.id, structured_data.origin.ip and so on.
+func lineField(sl *SyslogLine, path []string) any {
+	optInt := func(p *int) any {
+		if p == nil {
+			return nil
+		}
+		return float64(*p)
+	}
+	if len(path) == 1 {
+		switch path[0] {
+		case "timestamp":
+			return sl.Timestamp
+		case "hostname":
+			return sl.Hostname
+		case "program":
+			return sl.Program
+		case "pid":
+			return float64(sl.Pid)
+		case "msgid":
+			return sl.MsgID
+		case "file":
+			return sl.File
+		case "message":
+			return sl.Message
+		case "level":
+			return sl.Level
+		case "severity":
+			return optInt(sl.Severity)
+		case "priority":
+			return optInt(sl.Priority)
+		case "raw":
+			return sl.Raw
+		case "repeat_count":
+			return float64(sl.RepeatCount)
+		case "truncated":
+			return sl.Truncated
+		}
+		return nil
+	}
+	switch path[0] {
+	case "tags":
+		if v, ok := sl.Tags[path[1]]; ok {
+			return v
+		}
+	case "structured_data":
+		if v, ok := sl.StructuredData[path[1]][strings.Join(path[2:], ".")]; ok {
+			return v
+		}
+	case "fields":
+		var v any = sl.Fields
+		for _, k := range path[1:] {
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		}
+		switch v := v.(type) {
+		case string, float64, bool, nil:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// lineFields are the fields lineField has at the top level.
+var lineFields = []string{"timestamp", "hostname", "program", "pid", "msgid", "file", "message", "level", "severity", "priority", "raw", "repeat_count", "truncated"}
+
+// knownField reports whether path names something lineField can look up,
+// so a misspelt field is caught at startup rather than never matching.
+func knownField(path []string) bool {
+	switch path[0] {
+	case "tags":
+		return len(path) == 2
+	case "fields":
+		return len(path) > 1
+	case "structured_data":
+		return len(path) > 2
+	}
+	return len(path) == 1 && slices.Contains(lineFields, path[0])
+}
+
+// parseExpr compiles an expression: comparisons of fields and literals with
+// == != < <= > >=, =~ and !~ against a quoted regexp, combined with && || !
+// and parentheses. A field on its own is true if it's set and not empty,
+// zero or false.
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{}
+	if err := p.lex(s); err != nil {
+		return nil, err
+	}
+	if len(p.toks) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %s", p.toks[p.pos].text)
+	}
+	return e, nil
+}
+
+type token struct {
+	kind byte // i(dent), s(tring), n(umber) or o(perator)
+	text string
+}
+
+type exprParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *exprParser) lex(s string) error {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return fmt.Errorf("unterminated string")
+			}
+			text := s[i+1 : j]
+			if c == '"' {
+				var err error
+				if text, err = strconv.Unquote(s[i : j+1]); err != nil {
+					return fmt.Errorf("bad string %s", s[i:j+1])
+				}
+			}
+			p.toks = append(p.toks, token{'s', text})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			p.toks = append(p.toks, token{'n', s[i:j]})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || s[j] == '-' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			p.toks = append(p.toks, token{'i', s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "=~", "!~", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected %q", c)
+			}
+			p.toks = append(p.toks, token{'o', op})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) peek(op string) bool {
+	return p.pos < len(p.toks) && p.toks[p.pos].kind == 'o' && p.toks[p.pos].text == op
+}
+
+func (p *exprParser) or() (expr, error) {
+	x, err := p.and()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var y expr
+		if y, err = p.and(); err == nil {
+			x = orExpr{x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) and() (expr, error) {
+	x, err := p.unary()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var y expr
+		if y, err = p.unary(); err == nil {
+			x = andExpr{x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) unary() (expr, error) {
+	if p.peek("!") {
+		p.pos++
+		x, err := p.unary()
+		return notExpr{x}, err
+	}
+	x, err := p.operand()
+	if err != nil || p.pos >= len(p.toks) || p.toks[p.pos].kind != 'o' {
+		return x, err
+	}
+	op := p.toks[p.pos].text
+	switch op {
+	case "=~", "!~":
+		p.pos++
+		if p.pos >= len(p.toks) || p.toks[p.pos].kind != 's' {
+			return nil, fmt.Errorf("%s needs a quoted regexp after it", op)
+		}
+		re, err := regexp.Compile(p.toks[p.pos].text)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+		return matchExpr{re: re, x: x, negate: op == "!~"}, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		y, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{op: op, x: x, y: y}, nil
+	}
+	return x, nil
+}
+
+func (p *exprParser) operand() (expr, error) {
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("expression ends too soon")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t.kind {
+	case 's':
+		return literalExpr{t.text}, nil
+	case 'n':
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %s", t.text)
+		}
+		return literalExpr{n}, nil
+	case 'i':
+		switch t.text {
+		case "true":
+			return literalExpr{true}, nil
+		case "false":
+			return literalExpr{false}, nil
+		}
+		path := strings.Split(t.text, ".")
+		if !knownField(path) {
+			return nil, fmt.Errorf("unknown field %s", t.text)
+		}
+		return fieldExpr{path}, nil
+	}
+	if t.text == "(" {
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t.text)
+}
+
+// route runs the -route rules on an encoded line and reports whether this
+// sink ships it, and whether a sample rule changed its sample_rate so it has
+// to be encoded again. A line passed through as its own JSON was never
+// parsed, so the rules only see its file, program, hostname and message.
+func (a *App) route(file, text string, lb *lineBuf) (ship, resampled bool) {
+	sl := &lb.sl
+	passthrough := sl.File == "" && sl.Message == ""
+	if passthrough {
+		program, _ := a.programFor(file)
+		sl = &SyslogLine{Hostname: a.Hostname, Program: program, File: file, Message: text}
+	}
+	rule := a.routes.match(sl)
+	if rule == nil {
+		return true, false
+	}
+	switch rule.action {
+	case "drop":
+		slog.Debug("Line dropped by -route", "file", file, "rule", rule.spec)
+		return false, false
+	case "route":
+		return slices.Contains(rule.to, cmp.Or(a.Name, "sink")), false
+	case "sample":
+		s := Sampler{Rate: rule.rate, Hash: a.Sampler.Hash}
+		if !s.Keep(text) {
+			return false, false
+		}
+		if !passthrough && rule.rate < 1 {
+			// Say so on the line, on top of any -sample-rate, so the server
+			// can still scale counts back up
+			sl.SampleRate = cmp.Or(sl.SampleRate, 1) * rule.rate
+			return true, true
+		}
+	}
+	return true, false
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+)
+
+// Sampler ships a fraction Rate of lines. Random sampling picks lines at
+// random; hash sampling keeps or drops a line based on a hash of its text,
+// so the same message gets the same answer every time, across restarts and
+// across hosts.
+type Sampler struct {
+	Rate float64
+	Hash bool
+}
+
+// Keep reports whether line makes the sample.
+func (s *Sampler) Keep(line string) bool {
+	if s.Rate >= 1 {
+		return true
+	}
+	if !s.Hash {
+		return rand.Float64() < s.Rate
+	}
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return float64(mix(h.Sum64())) < s.Rate*math.MaxUint64
+}
+
+// mix spreads FNV's output over the whole range (it's the splitmix64
+// finalizer). Without it, lines that differ only in their last few bytes,
+// which is most log lines, hash too close together to sample evenly.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
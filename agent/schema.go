@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// lineKeys are SyslogLine's JSON keys, in the order they're written.
+var lineKeys = []string{
+	"priority", "version", "timestamp", "hostname", "program", "pid", "msgid",
+	"file", "message", "level", "severity", "sample_rate", "structured_data",
+	"raw", "fields", "tags", "repeat_count", "truncated", "stats", "lifecycle",
+	"parse_error", "meta",
+}
+
+// timestampFormats are the -timestamp-format choices other than a Go time
+// layout. The unix ones are numbers rather than strings.
+var timestampFormats = []string{"rfc3339", "unix", "unix_ms", "unix_us", "unix_ns"}
+
+// schema is how events are laid out for collectors that want other JSON than
+// teller's own: keys renamed (or left out, when renamed to ""), empty fields
+// left out, and the timestamp in another format. It writes the JSON itself
+// rather than going through a renaming map, so it's about as fast as
+// encoding/json.
+type schema struct {
+	keys      map[string]string
+	omitEmpty bool
+	// tsFormat is one of timestampFormats or a time layout
+	tsFormat string
+}
+
+// newSchema makes a schema from -field-map key=newkey pairs, or nil if
+// nothing differs from the default, in which case encoding/json does.
+func newSchema(fieldMap []string, omitEmpty bool, tsFormat string) (*schema, error) {
+	s := &schema{keys: make(map[string]string), omitEmpty: omitEmpty, tsFormat: tsFormat}
+	for _, f := range fieldMap {
+		k, v, ok := strings.Cut(f, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || !slices.Contains(lineKeys, k) {
+			return nil, fmt.Errorf("%q isn't field=name for one of %s", f, strings.Join(lineKeys, ", "))
+		}
+		s.keys[k] = v
+	}
+	for _, k := range lineKeys {
+		if name := s.key(k); name != "" && slices.ContainsFunc(lineKeys, func(o string) bool { return o != k && s.key(o) == name }) {
+			return nil, fmt.Errorf("two fields would both be called %q", name)
+		}
+	}
+	if s.tsFormat == "" {
+		s.tsFormat = "rfc3339"
+	}
+	if !slices.Contains(timestampFormats, s.tsFormat) && !strings.ContainsAny(s.tsFormat, "0123456789") {
+		return nil, fmt.Errorf("unknown timestamp format %q (want %s or a Go time layout)", s.tsFormat, strings.Join(timestampFormats, ", "))
+	}
+	if len(s.keys) == 0 && !omitEmpty && s.tsFormat == "rfc3339" {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// key is what field k is called, "" if it's left out.
+func (s *schema) key(k string) string {
+	if name, ok := s.keys[k]; ok {
+		return name
+	}
+	return k
+}
+
+// marshal appends sl's JSON to buf.
+func (s *schema) marshal(buf *bytes.Buffer, sl *SyslogLine) error {
+	// Built in buf's spare room, and only written once it's all there
+	b := append(buf.AvailableBuffer(), '{')
+	first := true
+	field := func(k string) bool {
+		name := s.key(k)
+		if name == "" {
+			return false
+		}
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		b = appendJSONString(b, name)
+		b = append(b, ':')
+		return true
+	}
+	str := func(k, v string, omit bool) {
+		if (v != "" || !omit) && field(k) {
+			b = appendJSONString(b, v)
+		}
+	}
+	num := func(k string, v int, omit bool) {
+		if (v != 0 || !omit) && field(k) {
+			b = strconv.AppendInt(b, int64(v), 10)
+		}
+	}
+	value := func(k string, v any) error {
+		if !field(k) {
+			return nil
+		}
+		data, err := json.Marshal(v)
+		b = append(b, data...)
+		return err
+	}
+
+	if sl.Priority != nil {
+		num("priority", *sl.Priority, false)
+	}
+	num("version", sl.Version, true)
+	if sl.Timestamp != "" || !s.omitEmpty {
+		if field("timestamp") {
+			b = s.appendTimestamp(b, sl.Timestamp)
+		}
+	}
+	str("hostname", sl.Hostname, s.omitEmpty)
+	str("program", sl.Program, s.omitEmpty)
+	num("pid", sl.Pid, s.omitEmpty)
+	str("msgid", sl.MsgID, true)
+	str("file", sl.File, s.omitEmpty)
+	str("message", sl.Message, s.omitEmpty)
+	str("level", sl.Level, true)
+	if sl.Severity != nil {
+		num("severity", *sl.Severity, false)
+	}
+	if sl.SampleRate != 0 && field("sample_rate") {
+		b = strconv.AppendFloat(b, sl.SampleRate, 'g', -1, 64)
+	}
+	var err error
+	if len(sl.StructuredData) > 0 {
+		err = value("structured_data", sl.StructuredData)
+	}
+	str("raw", sl.Raw, true)
+	if len(sl.Fields) > 0 && err == nil {
+		err = value("fields", sl.Fields)
+	}
+	if len(sl.Tags) > 0 && field("tags") {
+		b = append(b, '{')
+		for i, k := range slices.Sorted(maps.Keys(sl.Tags)) {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(appendJSONString(b, k), ':')
+			b = appendJSONString(b, sl.Tags[k])
+		}
+		b = append(b, '}')
+	}
+	num("repeat_count", sl.RepeatCount, true)
+	if sl.Truncated && field("truncated") {
+		b = append(b, "true"...)
+	}
+	if sl.Stats != nil && err == nil {
+		err = value("stats", sl.Stats)
+	}
+	if sl.Lifecycle != nil && err == nil {
+		err = value("lifecycle", sl.Lifecycle)
+	}
+	if sl.ParseError != nil && err == nil {
+		err = value("parse_error", sl.ParseError)
+	}
+	if sl.Meta != nil && err == nil {
+		err = value("meta", sl.Meta)
+	}
+	if err != nil {
+		return err
+	}
+	buf.Write(append(b, '}'))
+	return nil
+}
+
+// appendTimestamp appends ts, an RFC 3339 time, in the schema's format. A
+// timestamp that doesn't parse, say from a JSON line's own field, goes out
+// as it is.
+func (s *schema) appendTimestamp(b []byte, ts string) []byte {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if s.tsFormat == "rfc3339" || err != nil {
+		return appendJSONString(b, ts)
+	}
+	switch s.tsFormat {
+	case "unix":
+		return strconv.AppendFloat(b, float64(t.UnixNano())/1e9, 'f', -1, 64)
+	case "unix_ms":
+		return strconv.AppendInt(b, t.UnixMilli(), 10)
+	case "unix_us":
+		return strconv.AppendInt(b, t.UnixMicro(), 10)
+	case "unix_ns":
+		return strconv.AppendInt(b, t.UnixNano(), 10)
+	}
+	return appendJSONString(b, t.Format(s.tsFormat))
+}
+
+// appendJSONString appends s as a JSON string, escaped as encoding/json
+// escapes it, invalid UTF-8 included.
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(append(b, s[start:i]...), "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(append(b, s[start:i]...), '\\', 'u', '2', '0', '2', hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	return append(append(b, s[start:]...), '"')
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// finish closes the streams cleanly on the way out. Each gets a FIN after
+// the last of its data, then teller waits up to CloseTimeout for the server
+// to have it all before the connection is closed under it, which would throw
+// away anything still unsent. When ACKing, that means an ACK for every batch
+// in flight, so their offsets get saved; otherwise it's QUIC having had every
+// packet acknowledged.
+func (a *App) finish() {
+	if a.Sink != sinkQUIC {
+		a.Output.Close()
+		return
+	}
+	a.closeStreams()
+	a.Stream.Close()
+	if !a.up || a.Conn.Context().Err() != nil {
+		return
+	}
+
+	t := time.NewTimer(a.CloseTimeout)
+	defer t.Stop()
+	if a.acking() {
+		for len(a.inflight) > 0 {
+			select {
+			case m := <-a.acks:
+				a.ack(m)
+			case <-t.C:
+				slog.Warn("Server didn't acknowledge the last batches in time, they'll be sent again", "server", a.ServerAddr, "batches", a.unacked())
+				a.complete = false
+				if a.Spool != nil {
+					a.spoolInflight()
+				}
+				return
+			case <-a.Conn.Context().Done():
+				a.closedEarly()
+				if a.Spool != nil {
+					a.spoolInflight()
+				}
+				return
+			}
+		}
+		slog.Debug("Server acknowledged every batch", "server", a.ServerAddr)
+		return
+	}
+
+	// The last packets may not have gone out yet, so look after a moment
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		select {
+		case <-poll.C:
+		case <-t.C:
+			slog.Warn("Server didn't receive everything in time", "server", a.ServerAddr, "bytes_in_flight", a.Stats.Conn.BytesInFlight.Load())
+			a.complete = false
+			return
+		case <-a.Conn.Context().Done():
+			a.closedEarly()
+			return
+		}
+		if a.Stats.Conn.BytesInFlight.Load() == 0 {
+			return
+		}
+	}
+}
+
+// closedEarly is the connection going while finish waits on the server,
+// most often the server turning down our client certificate, which with
+// TLS 1.3 it only does once we've started sending.
+func (a *App) closedEarly() {
+	err := explainHandshakeError(context.Cause(a.Conn.Context()), a.TLSConfig)
+	slog.Warn("Connection closed before the server had everything", "server", a.ServerAddr, "err", err)
+	a.Stats.noteError(err)
+	a.complete = false
+}
+
+// shippedAll reports whether TailAndProcess got everything to the server
+// before it returned, with nothing left unacknowledged or waiting in the
+// spool, and no file given up on for never turning up.
+func (a *App) shippedAll() bool {
+	return a.complete && !a.missing && len(a.inflight) == 0 && (a.Spool == nil || a.Spool.Len() == 0)
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/rexlx/teller/protocol"
+)
+
+// Where shipped lines go. quic is the real thing; tcp, tls and udp are syslog
+// collectors that don't speak QUIC, grpc a collector implementing
+// tellerpb.LogService, and http3 one with an HTTP/3 ingest endpoint; stdout
+// and null are for trying out a config without a server.
+const (
+	sinkQUIC   = "quic"
+	sinkTCP    = "tcp"
+	sinkTLS    = "tls"
+	sinkUDP    = "udp"
+	sinkGRPC   = "grpc"
+	sinkHTTP3  = "http3"
+	sinkStdout = "stdout"
+	sinkNull   = "null"
+)
+
+// Sink is somewhere batches go other than the QUIC server, which has acks,
+// spooling and streams of its own and is handled by App itself. Write gets a
+// batch's events, each the JSON teller would have sent the server, and only
+// returns an error once the batch can't be delivered.
+type Sink interface {
+	Write(ctx context.Context, events [][]byte) error
+	Close() error
+}
+
+// remoteSink reports whether kind is a sink with a connection to a server at
+// the other end. UDP has no connection to lose.
+func remoteSink(kind string) bool {
+	return kind == sinkQUIC || kind == sinkTCP || kind == sinkTLS || kind == sinkGRPC || kind == sinkHTTP3
+}
+
+// jsonSink reports whether kind ships events as the JSON they're encoded as,
+// rather than reading it back to make syslog of it.
+func jsonSink(kind string) bool {
+	return kind == sinkQUIC || kind == sinkHTTP3 || kind == sinkStdout || kind == sinkNull
+}
+
+// stdoutSink prints each event's JSON on a line of its own.
+type stdoutSink struct{ w io.Writer }
+
+func (s stdoutSink) Write(ctx context.Context, events [][]byte) error {
+	var out []byte
+	for _, e := range events {
+		out = append(append(out, e...), '\n')
+	}
+	_, err := s.w.Write(out)
+	return err
+}
+
+func (s stdoutSink) Close() error { return nil }
+
+// nullSink throws batches away, which still exercises everything up to the
+// network.
+type nullSink struct{}
+
+func (nullSink) Write(ctx context.Context, events [][]byte) error { return nil }
+func (nullSink) Close() error                                     { return nil }
+
+// newStdoutSink prints to teller's stdout.
+func newStdoutSink() Sink { return stdoutSink{w: os.Stdout} }
+
+// writeLocal delivers the pending batch to a.Output.
+func (a *App) writeLocal(ctx context.Context) error {
+	var events [][]byte
+	r := protocol.NewReader(bytes.NewReader(a.batch.buf))
+	for {
+		payload, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		events = append(events, payload)
+	}
+	return a.Output.Write(ctx, events)
+}
+
+// openSink connects to a.Sink: dials the QUIC server, or sets up Output for
+// everything else. disconnect closes the QUIC connection on the way out.
+func (a *App) openSink(ctx context.Context, format syslogFormat, udpMax int) (disconnect func(), err error) {
+	if a.Sink == sinkQUIC {
+		slog.Info("Connecting to QUIC server", "servers", strings.Join(a.Servers, ","))
+		a.setConnState(StateConnecting)
+		if err := a.InitQUICConnection(ctx); err != nil {
+			return nil, fmt.Errorf("error initializing QUIC connection: %v", err)
+		}
+		slog.Info("Connected", "server", a.ServerAddr)
+		// a.Conn is replaced on reconnect, so resolve it at exit time
+		return func() {
+			a.Conn.CloseWithError(0, "client exiting")
+			a.setConnState(StateDisconnected)
+		}, nil
+	}
+
+	// Only the QUIC server ACKs
+	a.AckWindow = 0
+	switch a.Sink {
+	case sinkTCP, sinkTLS:
+		var tc *tls.Config
+		if a.Sink == sinkTLS {
+			tc = a.TLSConfig
+		}
+		out := newSyslogSink(a.Servers, a.Hostname, format, tc, a.DialTimeout, a.MaxReconnectAttempts, &a.Stats)
+		out.setState = a.setConnState
+		out.writeTimeout = a.WriteTimeout
+		out.network = familyNetwork("tcp", a.AddressFamily)
+		out.proxy = a.proxy
+		slog.Info("Connecting to syslog server", "servers", strings.Join(a.Servers, ","), "sink", a.Sink)
+		a.setConnState(StateConnecting)
+		if err := out.connect(ctx); err != nil {
+			return nil, fmt.Errorf("error connecting to syslog server: %v", err)
+		}
+		a.Output = out
+	case sinkGRPC:
+		out := newGRPCSink(a.Servers, a.Hostname, a.TLSConfig, a.DialTimeout, a.MaxReconnectAttempts, &a.Stats)
+		out.setState = a.setConnState
+		out.writeTimeout = a.WriteTimeout
+		out.closeTimeout = a.CloseTimeout
+		out.network = familyNetwork("tcp", a.AddressFamily)
+		slog.Info("Connecting to gRPC server", "servers", strings.Join(a.Servers, ","))
+		a.setConnState(StateConnecting)
+		if err := out.connect(ctx); err != nil {
+			return nil, fmt.Errorf("error connecting to gRPC server: %v", err)
+		}
+		a.Output = out
+	case sinkHTTP3:
+		out := newHTTP3Sink(a.Servers, a.cfg.HTTP3Path, a.cfg.Version, a.TLSConfig, a.DialTimeout, a.MaxReconnectAttempts, &a.Stats)
+		out.setState = a.setConnState
+		out.writeTimeout = a.WriteTimeout
+		out.family = a.AddressFamily
+		out.proxy = a.proxy
+		slog.Info("Shipping to HTTP/3 endpoint", "servers", strings.Join(a.Servers, ","), "path", a.cfg.HTTP3Path)
+		a.Output = out
+	case sinkUDP:
+		out, err := newUDPSink(familyNetwork("udp", a.AddressFamily), a.Servers[0], a.Hostname, format, udpMax, &a.Stats)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up UDP syslog: %v", err)
+		}
+		slog.Info("Sending syslog over UDP", "server", a.Servers[0])
+		a.Output = out
+	case sinkStdout:
+		a.Output = newStdoutSink()
+		slog.Info("Not connecting to a server", "sink", a.Sink)
+	default:
+		a.Output = nullSink{}
+		slog.Info("Not connecting to a server", "sink", a.Sink)
+	}
+	return func() {}, nil
+}
@@ -0,0 +1,314 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) as much as teller needs of it, with RFC 1929's
+// username and password.
+const (
+	socksVersion        = 5
+	socksNoAuth         = 0
+	socksUserPass       = 2
+	socksConnect        = 1
+	socksUDPAssociate   = 3
+	socksIPv4           = 1
+	socksDomain         = 3
+	socksIPv6           = 4
+	socksNotSupported   = 7
+	socksDefaultPort    = "1080"
+	socksMaxUDPHeader   = 4 + 1 + 255 + 2
+	socksMaxUDPDatagram = 64 << 10
+)
+
+// socksProxy is -proxy, a SOCKS5 proxy to reach the servers through: QUIC's
+// datagrams are relayed with UDP ASSOCIATE, and the tcp and tls sinks'
+// connections made with CONNECT.
+type socksProxy struct {
+	addr       string
+	user, pass string
+}
+
+// parseProxy reads -proxy, socks5://[user:password@]host[:port].
+func parseProxy(s string) (*socksProxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5":
+	case "http", "https":
+		return nil, fmt.Errorf("%s: an HTTP proxy can't relay UDP, so QUIC can't go through one; it takes a SOCKS5 proxy, socks5://host:port", s)
+	default:
+		return nil, fmt.Errorf("%s: want socks5://host:port", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: no host", s)
+	}
+	p := &socksProxy{addr: net.JoinHostPort(u.Hostname(), u.Port())}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), socksDefaultPort)
+	}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.pass, _ = u.User.Password()
+		if len(p.user) > 255 || len(p.pass) > 255 {
+			return nil, fmt.Errorf("%s: username and password can be 255 bytes at most", s)
+		}
+	}
+	return p, nil
+}
+
+// DialContext connects to addr through the proxy, for the tcp and tls
+// sinks. The proxy picks the address family, so network is ignored.
+func (p *socksProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, _, err := p.request(ctx, socksConnect, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenUDP asks the proxy to relay datagrams, returning a PacketConn for
+// QUIC that sends and receives through it. The association lasts as long as
+// the TCP connection it was asked for on, which is closed along with it.
+func (p *socksProxy) listenUDP(ctx context.Context) (net.PacketConn, error) {
+	ctrl, relay, err := p.request(ctx, socksUDPAssociate, "0.0.0.0:0")
+	var rerr socksError
+	if errors.As(err, &rerr) && rerr == socksNotSupported {
+		return nil, fmt.Errorf("proxy %s doesn't relay UDP, so QUIC can't go through it; -sink tls can, over TCP", p.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A relay on the unspecified address is on the proxy's own
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	udp, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("error reaching proxy %s's UDP relay %s: %v", p.addr, relay, err)
+	}
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		udp.Close()
+	}()
+	return &socksPacketConn{udp: udp, ctrl: ctrl, buf: make([]byte, socksMaxUDPHeader+socksMaxUDPDatagram)}, nil
+}
+
+// request connects to the proxy, authenticates and sends it cmd for addr,
+// returning the connection and the address the proxy bound for it.
+func (p *socksProxy) request(ctx context.Context, cmd byte, addr string) (net.Conn, *net.UDPAddr, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to proxy %s: %v", p.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	bound, err := p.handshake(conn, cmd, addr)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (p *socksProxy) handshake(conn net.Conn, cmd byte, addr string) (*net.UDPAddr, error) {
+	methods := []byte{socksVersion, 1, socksNoAuth}
+	if p.user != "" {
+		methods = []byte{socksVersion, 2, socksNoAuth, socksUserPass}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return nil, fmt.Errorf("error talking to proxy %s: %v", p.addr, err)
+	}
+	var b [4]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, fmt.Errorf("error talking to proxy %s: %v", p.addr, err)
+	}
+	if b[0] != socksVersion {
+		return nil, fmt.Errorf("proxy %s doesn't speak SOCKS5", p.addr)
+	}
+	switch b[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if p.user == "" {
+			return nil, fmt.Errorf("proxy %s wants a username and password", p.addr)
+		}
+		auth := append([]byte{1, byte(len(p.user))}, p.user...)
+		auth = append(append(auth, byte(len(p.pass))), p.pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, fmt.Errorf("error talking to proxy %s: %v", p.addr, err)
+		}
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return nil, fmt.Errorf("error talking to proxy %s: %v", p.addr, err)
+		}
+		if b[1] != 0 {
+			return nil, fmt.Errorf("proxy %s turned down the username and password", p.addr)
+		}
+	default:
+		return nil, fmt.Errorf("proxy %s takes none of teller's ways to authenticate", p.addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := appendSocksAddr([]byte{socksVersion, cmd, 0}, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("error talking to proxy %s: %v", p.addr, err)
+	}
+	if _, err := io.ReadFull(conn, b[:3]); err != nil {
+		return nil, fmt.Errorf("error talking to proxy %s: %v", p.addr, err)
+	}
+	if b[1] != 0 {
+		return nil, fmt.Errorf("proxy %s: %w", p.addr, socksError(b[1]))
+	}
+	bound, err := readSocksAddr(conn)
+	if err != nil {
+		return nil, fmt.Errorf("error talking to proxy %s: %v", p.addr, err)
+	}
+	return bound, nil
+}
+
+// appendSocksAddr appends host and port to b the way SOCKS5 addresses go,
+// as 4 or 16 bytes for an IP and otherwise as a name.
+func appendSocksAddr(b []byte, host, port string) ([]byte, error) {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q", port)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("name %s is too long for SOCKS5", host)
+		}
+		b = append(append(b, socksDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socksIPv4), ip4...)
+	} else {
+		b = append(append(b, socksIPv6), ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(n)), nil
+}
+
+// readSocksAddr reads an address from a proxy's reply. Proxies answer with
+// IPs, so a name is an error.
+func readSocksAddr(r io.Reader) (*net.UDPAddr, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	switch typ[0] {
+	case socksIPv4:
+		ip = make(net.IP, 4)
+	case socksIPv6:
+		ip = make(net.IP, 16)
+	default:
+		return nil, fmt.Errorf("unexpected address type %d", typ[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
+
+// socksError is a proxy's reply code for a request it didn't carry out.
+type socksError byte
+
+func (e socksError) Error() string {
+	switch e {
+	case 1:
+		return "general failure"
+	case 2:
+		return "not allowed by the proxy's rules"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case socksNotSupported:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("error %d", byte(e))
+}
+
+// socksPacketConn is a UDP association: each datagram goes to the relay
+// behind a header saying where it's for, and comes back behind one saying
+// where it's from. It's deliberately not a *net.UDPConn, so quic-go sticks
+// to ReadFrom and WriteTo rather than reaching for the socket underneath.
+type socksPacketConn struct {
+	udp  *net.UDPConn
+	ctrl net.Conn
+	buf  []byte
+}
+
+func (c *socksPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, err := c.udp.Read(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Fragments aren't worth reassembling for QUIC, which never sends
+		// any, so like anything garbled they're dropped as lost
+		if n < 4 || c.buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(c.buf[3:n])
+		from, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		m, _ := r.Read(p)
+		return m, from, nil
+	}
+}
+
+func (c *socksPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("can't send to %v through a SOCKS5 proxy", addr)
+	}
+	pkt, err := appendSocksAddr(make([]byte, 3, socksMaxUDPHeader+len(p)), ua.IP.String(), strconv.Itoa(ua.Port))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.udp.Write(append(pkt, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.udp.Close()
+}
+
+func (c *socksPacketConn) LocalAddr() net.Addr                { return c.udp.LocalAddr() }
+func (c *socksPacketConn) SetDeadline(t time.Time) error      { return c.udp.SetDeadline(t) }
+func (c *socksPacketConn) SetReadDeadline(t time.Time) error  { return c.udp.SetReadDeadline(t) }
+func (c *socksPacketConn) SetWriteDeadline(t time.Time) error { return c.udp.SetWriteDeadline(t) }
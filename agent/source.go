@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Line is one line, or one event, from a Source.
+type Line struct {
+	Text string
+	// Offset is the source's position just past this line, which is what's
+	// saved so a restart resumes after it. For files it's a byte offset.
+	Offset int64
+	// Cursor, for sources that have them, is the position to resume after
+	// instead of Offset.
+	Cursor string
+	// Event, for sources whose records come with fields of their own, holds
+	// them already filled in. Text is then the message.
+	Event *SyslogLine
+	Err   error
+}
+
+// Source is somewhere lines come from: a tailed file, the Windows event log.
+// Lines is closed once the source has ended, for good or because Stop was
+// called.
+type Source interface {
+	Lines() <-chan Line
+	Stop()
+}
+
+// runSources ships a.Sources until they've all ended.
+func (a *App) runSources() {
+	var wg sync.WaitGroup
+	for name, src := range a.Sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.pump(name, src)
+		}()
+	}
+	wg.Wait()
+}
+
+const (
+	// How often a file at EOF is checked for new lines and rotation
+	filePoll = 250 * time.Millisecond
+	// How much of the start of a file is remembered to spot it being
+	// truncated and written again between polls
+	headSize = 64
+)
+
+// fileSource follows a file by polling it, which also works on mounted
+// filesystems. A line is only sent once its newline has been written.
+//
+// With reopen set it survives rotation. When the path comes to name a
+// different file (logrotate's create, or any rename and recreate), the rest
+// of the old file is read first and the new one is then followed from the
+// top. When the file shrinks below what has been read, or its first bytes
+// change (copytruncate, even if it's been refilled since), it's read again
+// from the top. Lines written between copytruncate's copy and its truncate
+// are lost, as they are for any reader. Without reopen the source ends once
+// the file is rotated away or deleted. With toEOF it ends as soon as it's
+// read what the file holds, leaving a last line without its newline for
+// next time.
+//
+// With max set, no more than max+1 bytes of a line are kept, so a runaway
+// line can't eat the memory; emit does the truncating proper. Lines end at
+// delim, which is newline unless -delimiter says otherwise.
+type fileSource struct {
+	path   string
+	reopen bool
+	toEOF  bool
+	max    int
+	delim  byte
+	lines  chan Line
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newFileSource opens path and follows it from offset, or with toEOF reads
+// it to the end. With reopen set a missing file is waited for, unless toEOF
+// is set too. maxLine, if set, bounds how much of a line is kept.
+func newFileSource(path string, offset int64, reopen, toEOF bool, maxLine int, delim byte) (*fileSource, error) {
+	f, err := openFile(path)
+	if err != nil && !(reopen && !toEOF && errors.Is(err, os.ErrNotExist)) {
+		return nil, err
+	}
+	if f == nil {
+		offset = 0
+	} else if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &fileSource{path: path, reopen: reopen, toEOF: toEOF, max: maxLine, delim: delim, lines: make(chan Line), done: make(chan struct{})}
+	go s.run(f, offset)
+	return s, nil
+}
+
+func (s *fileSource) Lines() <-chan Line { return s.lines }
+
+func (s *fileSource) Stop() { s.once.Do(func() { close(s.done) }) }
+
+// send reports false once the source has been stopped.
+func (s *fileSource) send(l Line) bool {
+	select {
+	case s.lines <- l:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// run reads f from offset, which is where it's positioned, until the source
+// ends. f is nil while waiting for the file to appear.
+func (s *fileSource) run(f *os.File, offset int64) {
+	defer close(s.lines)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	var r *bufio.Reader
+	var fi os.FileInfo
+	var partial, head []byte
+	// over counts the bytes of the current line dropped past s.max
+	var over int64
+	if f != nil {
+		r = bufio.NewReader(f)
+		fi, _ = f.Stat()
+	}
+	t := time.NewTicker(filePoll)
+	defer t.Stop()
+	for {
+		// Send every complete line there is so far
+		for r != nil {
+			b, err := r.ReadSlice(s.delim)
+			partial = append(partial, b...)
+			if s.max > 0 && len(partial) > s.max+1 {
+				over += int64(len(partial) - s.max - 1)
+				partial = partial[:s.max+1]
+			}
+			if errors.Is(err, bufio.ErrBufferFull) {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				s.send(Line{Err: err, Offset: offset})
+				return
+			}
+			// The head is taken from what was read, not what the file holds
+			// by the next poll, which may be a refill already
+			if int64(len(head)) == offset && len(head) < headSize {
+				head = append(head, partial[:min(len(partial), headSize-len(head))]...)
+			}
+			offset += int64(len(partial)) + over
+			if !s.send(Line{Text: string(bytes.TrimSuffix(partial, []byte{s.delim})), Offset: offset}) {
+				return
+			}
+			partial, over = partial[:0], 0
+		}
+		if s.toEOF {
+			return
+		}
+
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		// read is how far into the file we've got, partial line included
+		read := offset + int64(len(partial)) + over
+		now, err := os.Stat(s.path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if !s.reopen {
+				return
+			}
+		case err != nil:
+			slog.Warn("Error checking file", "file", s.path, "err", err)
+
+		case fi == nil || !os.SameFile(fi, now):
+			if !s.reopen {
+				return
+			}
+			if f != nil {
+				// Finish the old file before moving on: anything written to
+				// it just before the rotation is read on the next pass
+				if cur, err := f.Stat(); err == nil && cur.Size() > read {
+					continue
+				}
+				// It won't be finished now, so a last line without a newline
+				// is as complete as it's going to get
+				if len(partial) > 0 && !s.send(Line{Text: string(partial), Offset: read}) {
+					return
+				}
+				f.Close()
+				slog.Info("File rotated, following the new one", "file", s.path)
+			}
+			f, r, fi, offset, partial, over, head = nil, nil, nil, 0, partial[:0], 0, head[:0]
+			nf, err := openFile(s.path)
+			if err != nil {
+				// Gone again already, try next time
+				continue
+			}
+			f, r = nf, bufio.NewReader(nf)
+			fi, _ = nf.Stat()
+
+		case now.Size() < read || !sameHead(f, &head, read):
+			slog.Info("File truncated, reading it from the top", "file", s.path, "offset", read, "size", now.Size())
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				s.send(Line{Err: err, Offset: offset})
+				return
+			}
+			r.Reset(f)
+			offset, partial, over, head = 0, partial[:0], 0, head[:0]
+		}
+	}
+}
+
+// sameHead reports whether f still starts with head, then tops head up to
+// headSize bytes from the read bytes of f. A file that can't be read is
+// given the benefit of the doubt.
+func sameHead(f *os.File, head *[]byte, read int64) bool {
+	buf := make([]byte, min(headSize, read))
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return true
+	}
+	buf = buf[:n]
+	if !bytes.HasPrefix(buf, *head) {
+		return false
+	}
+	*head = append((*head)[:0], buf...)
+	return true
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// parseDelimiter reads -delimiter, one byte given as itself or as an escape:
+// \n, \r, \t, \0 or \xHH, and \\ for a backslash.
+func parseDelimiter(s string) (byte, error) {
+	if len(s) == 1 {
+		return s[0], nil
+	}
+	switch s {
+	case `\n`:
+		return '\n', nil
+	case `\r`:
+		return '\r', nil
+	case `\t`:
+		return '\t', nil
+	case `\0`:
+		return 0, nil
+	case `\\`:
+		return '\\', nil
+	}
+	if len(s) == 4 && strings.HasPrefix(s, `\x`) {
+		if b, err := strconv.ParseUint(s[2:], 16, 8); err == nil {
+			return byte(b), nil
+		}
+	}
+	return 0, fmt.Errorf("%q: want a single byte, e.g. \\0, \\x1e or |", s)
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendFile(t *testing.T, path string, text string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLines takes n lines from s, failing if they're slow to come.
+func readLines(t *testing.T, s Source, n int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < n {
+		select {
+		case l, ok := <-s.Lines():
+			if !ok {
+				t.Fatalf("source ended after %q", got)
+			}
+			if l.Err != nil {
+				t.Fatalf("source failed: %v", l.Err)
+			}
+			got = append(got, l.Text)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, still waiting on %d more lines", got, n-len(got))
+		}
+	}
+	return got
+}
+
+// noMoreLines checks s has nothing else to send for a few polls.
+func noMoreLines(t *testing.T, s Source) {
+	t.Helper()
+	select {
+	case l := <-s.Lines():
+		t.Fatalf("got %q, when there should be nothing left", l.Text)
+	case <-time.After(3 * filePoll):
+	}
+}
+
+// TestFileSourceRotation rotates a file under a fileSource in each of the
+// ways it's meant to follow, and checks every line comes through once, in
+// order.
+func TestFileSourceRotation(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rotate func(t *testing.T, path string)
+		want   []string
+	}{
+		{
+			// logrotate's create: moved aside, with a last line written to
+			// it after the move, and a new file in its place
+			name: "create",
+			rotate: func(t *testing.T, path string) {
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path+".1", "late\n")
+				appendFile(t, path, "three\nfour\n")
+			},
+			want: []string{"late", "three", "four"},
+		},
+		{
+			// logrotate's copytruncate
+			name: "copytruncate",
+			rotate: func(t *testing.T, path string) {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path+".1", b, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(path, 0); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(2 * filePoll)
+				appendFile(t, path, "three\nfour\n")
+			},
+			want: []string{"three", "four"},
+		},
+		{
+			// Truncated and written past where it was read to before the
+			// source gets to look, so only its first bytes give it away.
+			// It's done once the source is at the end, but before its first
+			// poll.
+			name: "copytruncate refilled",
+			rotate: func(t *testing.T, path string) {
+				time.Sleep(filePoll / 5)
+				if err := os.WriteFile(path, []byte("three\nfour\nfive, which is longer\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"three", "four", "five, which is longer"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.log")
+			appendFile(t, path, "one\ntwo\n")
+			s, err := newFileSource(path, 0, true, false, 0, '\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+			if got := readLines(t, s, 2); !slices.Equal(got, []string{"one", "two"}) {
+				t.Fatalf("before rotating got %q", got)
+			}
+			tc.rotate(t, path)
+			if got := readLines(t, s, len(tc.want)); !slices.Equal(got, tc.want) {
+				t.Fatalf("after rotating got %q, want %q", got, tc.want)
+			}
+			noMoreLines(t, s)
+		})
+	}
+}
+
+// TestFileSourceRotatedAway checks a source that isn't following rotation
+// ends once its file is moved aside, after what's left in it.
+func TestFileSourceRotatedAway(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "one\n")
+	s, err := newFileSource(path, 0, false, false, 0, '\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	readLines(t, s, 1)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "new\n")
+	select {
+	case l, ok := <-s.Lines():
+		if ok {
+			t.Fatalf("got %q from the new file", l.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("source didn't end")
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want byte
+		ok   bool
+	}{
+		{`\n`, '\n', true},
+		{`\0`, 0, true},
+		{`\r`, '\r', true},
+		{`\t`, '\t', true},
+		{`\\`, '\\', true},
+		{`\x1e`, 0x1e, true},
+		{`\x1E`, 0x1e, true},
+		{"|", '|', true},
+		{"\\", '\\', true},
+		{"", 0, false},
+		{"||", 0, false},
+		{`\x1`, 0, false},
+		{`\xzz`, 0, false},
+		{`\q`, 0, false},
+	} {
+		got, err := parseDelimiter(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseDelimiter(%q) = %#x, %v; want %#x, ok %v", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+// nulRecords are JSON blobs pretty-printed over several lines, NUL
+// terminated, with the last one still being written.
+const nulRecords = "{\n  \"message\": \"one\"\n}\x00{\n  \"message\": \"two\",\n  \"n\": 2\n}\x00{\n  \"mess"
+
+// TestFileSourceDelimiter tails NUL-terminated records, and checks the
+// newlines in them don't split them, and the one without its NUL yet waits
+// for it.
+func TestFileSourceDelimiter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, nulRecords)
+	s, err := newFileSource(path, 0, true, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	want := []string{"{\n  \"message\": \"one\"\n}", "{\n  \"message\": \"two\",\n  \"n\": 2\n}"}
+	if got := readLines(t, s, 2); !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	noMoreLines(t, s)
+	appendFile(t, path, "age\": \"three\"\n}\x00")
+	if got := readLines(t, s, 1); got[0] != "{\n  \"message\": \"three\"\n}" {
+		t.Fatalf("got %q once the last record was finished", got[0])
+	}
+}
+
+// TestDelimiterShipped reads NUL-terminated JSON records through the whole
+// App, as -delimiter '\0' -parse-format json would, and checks each is
+// shipped whole as one event.
+func TestDelimiterShipped(t *testing.T) {
+	cfg := testConfig()
+	cfg.Delimiter = `\0`
+	cfg.ParseFormat = "json"
+	cfg.Readers = map[string]io.Reader{"app.log": strings.NewReader(nulRecords + "age\": \"three\"\n}")}
+	out := &fakeSink{}
+	a := newTestApp(t, cfg, nil, out)
+	if err := a.TailAndProcess(context.Background()); err != nil {
+		t.Fatalf("TailAndProcess: %v", err)
+	}
+	if got := out.messages(t); !slices.Equal(got, []string{"one", "two", "three"}) {
+		t.Errorf("shipped %q, want one, two and three", got)
+	}
+	if n := a.Stats.ParseErrors.Load(); n != 0 {
+		t.Errorf("%d records failed to parse, so were split", n)
+	}
+}
@@ -0,0 +1,499 @@
+package agent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolDataFile  = "spool.dat"
+	spoolAltFile   = "spool.1.dat"
+	spoolIndexFile = "spool.idx"
+	spoolRecHeader = 4
+)
+
+// Spool is a bounded, on-disk FIFO for frames that couldn't be sent. Records
+// are appended to spool.dat as a 4-byte big-endian length and the frame
+// bytes. spool.idx remembers where the oldest undelivered record starts, so
+// a restarted teller picks up the same queue. When the file is rewritten the
+// new one goes next to it, as spool.1.dat or back to spool.dat, and only
+// replaces it once the index names it, so a crash leaves the index and the
+// file it names in step. Once the queue goes over
+// maxBytes the oldest records are dropped to make room. With a key, each
+// record is sealed with AES-GCM under a nonce of its own, which is stored in
+// front of it.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	aead     cipher.AEAD // nil for a plaintext spool
+
+	mu      sync.Mutex
+	data    *os.File
+	file    string // data's name in dir
+	head    int64  // offset of the oldest record in data
+	size    int64  // end of the last complete record
+	count   int
+	dropped int64
+}
+
+// spoolIndex is the on-disk form of spool.idx. File is the data file Head is
+// in, spool.dat if it's empty. Encrypted says the records are sealed, so
+// they're never read without the key.
+type spoolIndex struct {
+	File      string `json:"file,omitempty"`
+	Head      int64  `json:"head"`
+	Dropped   int64  `json:"dropped"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// OpenSpool opens (or creates) the spool in dir, encrypted under key if it's
+// set. Any partial record left at the end by a crash mid-append is cut off.
+// A spool that still holds records sealed with another key, or none, is an
+// error rather than something to ship.
+func OpenSpool(dir string, maxBytes int64, key []byte) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating spool dir: %v", err)
+	}
+	var idx spoolIndex
+	corrupt := false
+	b, err := os.ReadFile(filepath.Join(dir, spoolIndexFile))
+	if err == nil {
+		if err := json.Unmarshal(b, &idx); err != nil {
+			slog.Warn("Spool index is corrupt, replaying spool from the start", "err", err)
+			idx, corrupt = spoolIndex{}, true
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading spool index: %v", err)
+	}
+	if idx.File != spoolAltFile {
+		idx.File = spoolDataFile
+	}
+	if corrupt {
+		// No telling which file is the live one, so go by which is there
+		if _, err := os.Stat(filepath.Join(dir, idx.File)); errors.Is(err, os.ErrNotExist) {
+			idx.File = otherSpoolFile(idx.File)
+		}
+	} else {
+		// A rewrite the index never came to name is left over from a crash
+		os.Remove(filepath.Join(dir, otherSpoolFile(idx.File)))
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, idx.File), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening spool: %v", err)
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, data: f, file: idx.File}
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err == nil {
+			s.aead, err = cipher.NewGCM(block)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error setting up spool encryption: %v", err)
+		}
+	}
+	s.head, s.dropped = idx.Head, idx.Dropped
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if s.head > fi.Size() {
+		s.head = 0
+	}
+	if err := s.scan(fi.Size()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := s.checkKey(idx.Encrypted); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkKey makes sure the records left in the spool can be read with the
+// key it was opened with, encrypted says whether they were sealed. An empty
+// spool simply starts over in the new mode.
+func (s *Spool) checkKey(encrypted bool) error {
+	if s.count == 0 {
+		if encrypted != (s.aead != nil) {
+			return s.saveIndex()
+		}
+		return nil
+	}
+	switch {
+	case encrypted && s.aead == nil:
+		return fmt.Errorf("spool in %s is encrypted and no -spool-key-file was given", s.dir)
+	case !encrypted && s.aead != nil:
+		return fmt.Errorf("spool in %s holds unencrypted entries; drain it without -spool-key-file first, or remove it", s.dir)
+	case encrypted:
+		if _, err := s.Peek(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal encrypts rec for the spool, if it's encrypted.
+func (s *Spool) seal(rec []byte) ([]byte, error) {
+	if s.aead == nil {
+		return rec, nil
+	}
+	out := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(rec)+s.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(out, out, rec, nil), nil
+}
+
+// open decrypts a record read from the spool, if it's encrypted.
+func (s *Spool) open(rec []byte) ([]byte, error) {
+	if s.aead == nil {
+		return rec, nil
+	}
+	n := s.aead.NonceSize()
+	if len(rec) < n {
+		return nil, errors.New("error decrypting spool entry: too short")
+	}
+	out, err := s.aead.Open(rec[n:n], rec[:n], rec[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting spool entry (wrong -spool-key-file?): %v", err)
+	}
+	return out, nil
+}
+
+// spoolKeyEnv is where the spool key is looked for without a key file.
+const spoolKeyEnv = "TELLER_SPOOL_KEY"
+
+// loadSpoolKey reads the spool key from path, or failing that from
+// TELLER_SPOOL_KEY, either holding 32 bytes as hex or base64. With neither
+// set the spool isn't encrypted, and the key returned is nil.
+func loadSpoolKey(path string) ([]byte, error) {
+	var text string
+	switch {
+	case path != "":
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading spool key: %v", err)
+		}
+		text = string(b)
+	case os.Getenv(spoolKeyEnv) != "":
+		text = os.Getenv(spoolKeyEnv)
+	default:
+		return nil, nil
+	}
+	text = strings.TrimSpace(text)
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("spool key must be 32 bytes, written as hex or base64 (e.g. openssl rand -hex 32)")
+	}
+	return key, nil
+}
+
+// scan walks the records from head to find the end of the last complete one
+// and truncates anything after it.
+func (s *Spool) scan(fileSize int64) error {
+	var hdr [spoolRecHeader]byte
+	pos := s.head
+	for pos+spoolRecHeader <= fileSize {
+		if _, err := s.data.ReadAt(hdr[:], pos); err != nil {
+			return fmt.Errorf("error reading spool: %v", err)
+		}
+		next := pos + spoolRecHeader + int64(binary.BigEndian.Uint32(hdr[:]))
+		if next > fileSize {
+			break
+		}
+		pos = next
+		s.count++
+	}
+	s.size = pos
+	if pos != fileSize {
+		slog.Warn("Discarding partial record at the end of the spool", "bytes", fileSize-pos)
+		return s.data.Truncate(pos)
+	}
+	return nil
+}
+
+// Push appends rec to the queue, dropping the oldest records if it would
+// otherwise go over the size cap.
+func (s *Spool) Push(rec []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, err := s.seal(rec)
+	if err != nil {
+		return fmt.Errorf("error encrypting spool entry: %v", err)
+	}
+
+	need := int64(spoolRecHeader + len(rec))
+	if need > s.maxBytes {
+		s.dropped++
+		slog.Warn("Frame is larger than the whole spool, dropping it", "bytes", len(rec))
+		return s.saveIndex()
+	}
+
+	dropped := s.dropped
+	for s.size-s.head+need > s.maxBytes {
+		n, err := s.recLen(s.head)
+		if err != nil {
+			return err
+		}
+		s.head += spoolRecHeader + n
+		s.count--
+		s.dropped++
+	}
+	if s.dropped != dropped {
+		slog.Warn("Spool full, dropped oldest entries", "dropped", s.dropped-dropped, "dropped_total", s.dropped)
+	}
+	// Reclaim the dead space at the front once it's as big as the live data
+	// could ever be, so the file doesn't grow forever during a long outage.
+	if s.head >= s.maxBytes {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, need), uint32(len(rec)))
+	buf = append(buf, rec...)
+	if _, err := s.data.WriteAt(buf, s.size); err != nil {
+		return fmt.Errorf("error writing to spool: %v", err)
+	}
+	s.size += need
+	s.count++
+	if s.dropped != dropped {
+		return s.saveIndex()
+	}
+	return nil
+}
+
+// PushFront puts recs, oldest first, at the front of the queue, ahead of
+// everything already in it. The file is rewritten to do that, so it's for
+// the odd batch that has to go back in line, not for queueing. If that takes
+// the queue over the size cap the oldest records are dropped, as with Push.
+func (s *Spool) PushFront(recs [][]byte) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for _, rec := range recs {
+		rec, err := s.seal(rec)
+		if err != nil {
+			return fmt.Errorf("error encrypting spool entry: %v", err)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(rec)))
+		buf = append(buf, rec...)
+	}
+	if err := s.rewrite(buf); err != nil {
+		return fmt.Errorf("error writing to spool: %v", err)
+	}
+	s.count += len(recs)
+
+	dropped := s.dropped
+	for s.size-s.head > s.maxBytes {
+		n, err := s.recLen(s.head)
+		if err != nil {
+			return err
+		}
+		s.head += spoolRecHeader + n
+		s.count--
+		s.dropped++
+	}
+	if s.dropped != dropped {
+		slog.Warn("Spool full, dropped oldest entries", "dropped", s.dropped-dropped, "dropped_total", s.dropped)
+	}
+	return s.saveIndex()
+}
+
+// Peek returns the oldest record without removing it, or io.EOF if the
+// spool is empty.
+func (s *Spool) Peek() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.head == s.size {
+		return nil, io.EOF
+	}
+	n, err := s.recLen(s.head)
+	if err != nil {
+		return nil, err
+	}
+	rec := make([]byte, n)
+	if _, err := s.data.ReadAt(rec, s.head+spoolRecHeader); err != nil {
+		return nil, fmt.Errorf("error reading spool: %v", err)
+	}
+	return s.open(rec)
+}
+
+// Pop removes the oldest record. Call it only once the record returned by
+// Peek has been delivered.
+func (s *Spool) Pop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.head == s.size {
+		return nil
+	}
+	n, err := s.recLen(s.head)
+	if err != nil {
+		return err
+	}
+	s.head += spoolRecHeader + n
+	s.count--
+	if s.head == s.size {
+		// Drained, start the file over. The index is synced so it can't be
+		// left behind pointing into records written from now on.
+		if err := s.data.Truncate(0); err != nil {
+			return err
+		}
+		s.head, s.size = 0, 0
+		return s.writeIndex(true)
+	}
+	return s.saveIndex()
+}
+
+// Len returns the number of records waiting in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Bytes returns how much queued data the spool holds.
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size - s.head
+}
+
+// Dropped returns how many records have been thrown away because the spool
+// was full, across restarts.
+func (s *Spool) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Close()
+}
+
+func (s *Spool) recLen(pos int64) (int64, error) {
+	var hdr [spoolRecHeader]byte
+	if _, err := s.data.ReadAt(hdr[:], pos); err != nil {
+		return 0, fmt.Errorf("error reading spool: %v", err)
+	}
+	return int64(binary.BigEndian.Uint32(hdr[:])), nil
+}
+
+// compact rewrites the live records to a fresh file so head is back at 0.
+func (s *Spool) compact() error {
+	if err := s.rewrite(nil); err != nil {
+		return fmt.Errorf("error compacting spool: %v", err)
+	}
+	return nil
+}
+
+// rewrite moves the queue to a new data file holding front followed by the
+// live records, with head back at 0. The new file is synced before the
+// index is switched over to it, and the old one only removed after, so
+// whenever a crash comes the index names a whole file and where in it the
+// queue starts.
+func (s *Spool) rewrite(front []byte) error {
+	next := otherSpoolFile(s.file)
+	f, err := os.Create(filepath.Join(s.dir, next))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(front)
+	if err == nil {
+		_, err = io.Copy(f, io.NewSectionReader(s.data, s.head, s.size-s.head))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	old, oldFile, oldHead, oldSize := s.data, s.file, s.head, s.size
+	s.data, s.file = f, next
+	s.size += int64(len(front)) - s.head
+	s.head = 0
+	if err := s.writeIndex(true); err != nil {
+		s.data, s.file, s.head, s.size = old, oldFile, oldHead, oldSize
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	old.Close()
+	os.Remove(filepath.Join(s.dir, oldFile))
+	return nil
+}
+
+// otherSpoolFile is the name the data file called file is rewritten to.
+func otherSpoolFile(file string) string {
+	if file == spoolAltFile {
+		return spoolDataFile
+	}
+	return spoolAltFile
+}
+
+func (s *Spool) saveIndex() error {
+	return s.writeIndex(false)
+}
+
+// writeIndex saves the index, making sure it's on disk before returning
+// with sync. Otherwise a crash can lose it, which only means replaying
+// records that were already delivered.
+func (s *Spool) writeIndex(sync bool) error {
+	b, err := json.Marshal(spoolIndex{File: s.file, Head: s.head, Dropped: s.dropped, Encrypted: s.aead != nil})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, spoolIndexFile)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("error writing spool index: %v", err)
+	}
+	_, err = f.Write(b)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing spool index: %v", err)
+	}
+	if sync {
+		syncDir(s.dir)
+	}
+	return nil
+}
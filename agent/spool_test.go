@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// spoolContents pops everything left in s, oldest first.
+func spoolContents(t *testing.T, s *Spool) [][]byte {
+	t.Helper()
+	var recs [][]byte
+	for {
+		rec, err := s.Peek()
+		if err == io.EOF {
+			return recs
+		}
+		if err != nil {
+			t.Fatalf("Peek: %v", err)
+		}
+		recs = append(recs, rec)
+		if err := s.Pop(); err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+	}
+}
+
+func checkRecs(t *testing.T, got, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("record %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// reopen drops s without closing it cleanly, as a crash would, and opens the
+// spool in dir again.
+func reopen(t *testing.T, s *Spool, dir string, maxBytes int64) *Spool {
+	t.Helper()
+	// Close only gives up the file; nothing is written, so it's as good as
+	// the process dying, and the file isn't left open under the test
+	s.data.Close()
+	s, err := OpenSpool(dir, maxBytes, nil)
+	if err != nil {
+		t.Fatalf("reopening spool: %v", err)
+	}
+	return s
+}
+
+// TestSpoolCrash interleaves pushes, pops and pushes to the front with
+// crashes, small enough a spool that it's compacted along the way, and
+// checks the queue that comes back each time is exactly the one that went
+// down.
+func TestSpoolCrash(t *testing.T) {
+	for _, seed := range []uint64{1, 2, 3, 4} {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			const maxBytes = 2048
+			dir := t.TempDir()
+			s, err := OpenSpool(dir, maxBytes, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rng := rand.New(rand.NewPCG(seed, seed))
+			var queue [][]byte
+			live := func() int64 {
+				var n int64
+				for _, r := range queue {
+					n += int64(spoolRecHeader + len(r))
+				}
+				return n
+			}
+			next := 0
+			rec := func() []byte {
+				next++
+				return bytes.Repeat([]byte{byte('a' + next%26)}, 10+rng.IntN(70))
+			}
+
+			for range 2000 {
+				switch op := rng.IntN(10); {
+				case op < 4:
+					r := rec()
+					if live()+int64(spoolRecHeader+len(r)) > maxBytes {
+						continue
+					}
+					if err := s.Push(r); err != nil {
+						t.Fatalf("Push: %v", err)
+					}
+					queue = append(queue, r)
+				case op < 8:
+					if len(queue) == 0 {
+						continue
+					}
+					got, err := s.Peek()
+					if err != nil {
+						t.Fatalf("Peek: %v", err)
+					}
+					if !bytes.Equal(got, queue[0]) {
+						t.Fatalf("Peek returned %q, want %q", got, queue[0])
+					}
+					if err := s.Pop(); err != nil {
+						t.Fatalf("Pop: %v", err)
+					}
+					queue = queue[1:]
+				case op < 9:
+					front := [][]byte{rec(), rec()}
+					if live()+int64(2*spoolRecHeader+len(front[0])+len(front[1])) > maxBytes {
+						continue
+					}
+					if err := s.PushFront(front); err != nil {
+						t.Fatalf("PushFront: %v", err)
+					}
+					queue = append(front, queue...)
+				default:
+					s = reopen(t, s, dir, maxBytes)
+					if s.Len() != len(queue) {
+						t.Fatalf("after a crash the spool holds %d records, want %d", s.Len(), len(queue))
+					}
+				}
+			}
+			if s.Dropped() != 0 {
+				t.Fatalf("%d records dropped, the test meant to stay under the cap", s.Dropped())
+			}
+			s = reopen(t, s, dir, maxBytes)
+			checkRecs(t, spoolContents(t, s), queue)
+			s.Close()
+		})
+	}
+}
+
+// TestSpoolCrashMidRewrite crashes PushFront part way, before its new file
+// is in the index and after, and checks the spool comes back as it was
+// before or after, never a mix of the two.
+func TestSpoolCrashMidRewrite(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		indexed  bool // whether the index had been switched to the new file
+		wantHead bool // whether the records pushed to the front survive
+	}{
+		{"before the index", false, false},
+		{"before removing the old file", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := OpenSpool(dir, 1<<20, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var older [][]byte
+			for i := range 5 {
+				r := []byte(fmt.Sprintf("record %d", i))
+				if err := s.Push(r); err != nil {
+					t.Fatal(err)
+				}
+				older = append(older, r)
+			}
+			// Delivered, but still in the file in front of head
+			if err := s.Pop(); err != nil {
+				t.Fatal(err)
+			}
+			older = older[1:]
+
+			read := func(name string) []byte {
+				b, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			}
+			oldData, oldIndex := read(spoolDataFile), read(spoolIndexFile)
+			front := [][]byte{[]byte("resent 1"), []byte("resent 2")}
+			if err := s.PushFront(front); err != nil {
+				t.Fatal(err)
+			}
+			s.data.Close()
+
+			// Put back what the crash would have left behind
+			if err := os.WriteFile(filepath.Join(dir, spoolDataFile), oldData, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if !tc.indexed {
+				if err := os.WriteFile(filepath.Join(dir, spoolIndexFile), oldIndex, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, err = OpenSpool(dir, 1<<20, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := older
+			if tc.wantHead {
+				want = append(front, older...)
+			}
+			checkRecs(t, spoolContents(t, s), want)
+			s.Close()
+
+			left := spoolAltFile
+			if tc.indexed {
+				left = spoolDataFile
+			}
+			if _, err := os.Stat(filepath.Join(dir, left)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s was left behind after reopening: %v", left, err)
+			}
+		})
+	}
+}
+
+// TestSpoolEncrypted round-trips records through an encrypted spool, with a
+// PushFront to have it rewritten along the way, and checks they're not on
+// disk in the clear and can't be read without the key, or with another.
+func TestSpoolEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	s, err := OpenSpool(dir, 1<<20, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want [][]byte
+	for i := range 5 {
+		r := []byte(fmt.Sprintf(`{"message":"secret %d"}`, i))
+		if err := s.Push(r); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, r)
+	}
+	front := [][]byte{[]byte(`{"message":"secret resent"}`)}
+	if err := s.PushFront(front); err != nil {
+		t.Fatal(err)
+	}
+	want = append(front, want...)
+	s.Close()
+
+	b, err := os.ReadFile(filepath.Join(dir, spoolAltFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Fatal("spool file holds records in the clear")
+	}
+
+	if _, err := OpenSpool(dir, 1<<20, nil); err == nil {
+		t.Error("opened an encrypted spool without the key")
+	}
+	if _, err := OpenSpool(dir, 1<<20, bytes.Repeat([]byte{8}, 32)); err == nil {
+		t.Error("opened an encrypted spool with the wrong key")
+	}
+
+	s, err = OpenSpool(dir, 1<<20, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecs(t, spoolContents(t, s), want)
+	s.Close()
+}
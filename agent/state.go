@@ -0,0 +1,334 @@
+package agent
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// tailState is what gets written to --state-file so a restart can resume
+// each file from the last line that made it out the door.
+type tailState struct {
+	Offsets map[string]int64 `json:"offsets"`
+	// Cursors are positions in sources that don't use byte offsets, the
+	// journal's cursor for example.
+	Cursors map[string]string `json:"cursors,omitempty"`
+	// Heads are the first bytes of each file, up to headSize, with
+	// -catch-up-rotated, to tell whether a path still names the file its
+	// offset was in.
+	Heads map[string][]byte `json:"heads,omitempty"`
+
+	// File and Offset are the single-file layout older builds wrote. They're
+	// only read, so upgrading doesn't throw away a saved position.
+	File   string `json:"file,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+// readState loads the saved offsets from path. A missing file just means
+// there's nothing to resume yet.
+func readState(path string) (*tailState, error) {
+	st := &tailState{}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		b = []byte("{}")
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading state file: %v", err)
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("error parsing state file %s: %v", path, err)
+	}
+	if st.Offsets == nil {
+		st.Offsets = make(map[string]int64)
+	}
+	if st.Cursors == nil {
+		st.Cursors = make(map[string]string)
+	}
+	if st.File != "" {
+		if _, ok := st.Offsets[st.File]; !ok {
+			st.Offsets[st.File] = st.Offset
+		}
+	}
+	return st, nil
+}
+
+// writeState writes the state file via a temp file and rename so a crash
+// mid-write can't leave a half-written offset behind. The temp file is synced
+// before the rename, and the directory after it, so a power cut can't leave
+// the new name pointing at nothing either.
+func writeState(path string, offsets map[string]int64, cursors map[string]string, heads map[string][]byte) error {
+	b, err := json.Marshal(tailState{Offsets: offsets, Cursors: cursors, Heads: heads})
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(path, b); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// replaceFile writes b to path.tmp, syncs it and renames it over path.
+func replaceFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// sourceState is one file's record in -state-dir: where it's got to, as
+// tailState has for every file at once.
+type sourceState struct {
+	Source string  `json:"source"`
+	Offset *int64  `json:"offset,omitempty"`
+	Cursor *string `json:"cursor,omitempty"`
+	Head   []byte  `json:"head,omitempty"`
+}
+
+// sourceStateFile is where source's record goes in dir: its base name, to
+// find it by, and a hash of the whole, so two app.log in different
+// directories can't clash.
+func sourceStateFile(dir, source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(dir, teeName(filepath.Base(source))+"-"+hex.EncodeToString(sum[:6])+".json")
+}
+
+// readStateDir loads every record in dir. A missing dir is nothing to
+// resume yet, as a missing state file is. A broken record is left out, and
+// said so in the error, without losing the rest.
+func readStateDir(dir string) (*tailState, error) {
+	st := &tailState{Offsets: map[string]int64{}, Cursors: map[string]string{}, Heads: map[string][]byte{}}
+	if _, err := os.ReadDir(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading state dir: %v", err)
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var errs []error
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error reading state file: %v", err))
+			continue
+		}
+		var rec sourceState
+		if err := json.Unmarshal(b, &rec); err != nil || rec.Source == "" {
+			errs = append(errs, fmt.Errorf("error parsing state file %s: %v", path, cmp.Or(err, errors.New("no source"))))
+			continue
+		}
+		if rec.Offset != nil {
+			st.Offsets[rec.Source] = *rec.Offset
+		}
+		if rec.Cursor != nil {
+			st.Cursors[rec.Source] = *rec.Cursor
+		}
+		if len(rec.Head) > 0 {
+			st.Heads[rec.Source] = rec.Head
+		}
+	}
+	return st, errors.Join(errs...)
+}
+
+// writeStateDir writes the record of each source in changed, or removes it
+// for one that's been forgotten, taking it out of changed once that's done.
+// Each is replaced as writeState replaces the state file, so one source's
+// progress never waits on, or risks, another's.
+func writeStateDir(dir string, changed map[string]bool, offsets map[string]int64, cursors map[string]string, heads map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error writing state dir: %v", err)
+	}
+	var errs []error
+	for source := range changed {
+		path := sourceStateFile(dir, source)
+		rec := sourceState{Source: source, Head: heads[source]}
+		if off, ok := offsets[source]; ok {
+			rec.Offset = &off
+		}
+		if c, ok := cursors[source]; ok {
+			rec.Cursor = &c
+		}
+		var err error
+		if rec.Offset == nil && rec.Cursor == nil {
+			if err = os.Remove(path); errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			var b []byte
+			if b, err = json.Marshal(rec); err == nil {
+				err = replaceFile(path, b)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", source, err))
+			continue
+		}
+		delete(changed, source)
+	}
+	syncDir(dir)
+	return errors.Join(errs...)
+}
+
+// loadState reads StateFile, or the records in StateDir, into a.saved,
+// a.savedCursors and a.savedHeads. A broken state file is logged and ignored
+// rather than stopping teller from shipping.
+func (a *App) loadState() {
+	a.saved = map[string]int64{}
+	a.savedCursors = map[string]string{}
+	if a.StateDir != "" {
+		st, err := readStateDir(a.StateDir)
+		if err != nil {
+			slog.Warn("Ignoring state file", "err", err)
+		}
+		if st != nil {
+			a.saved, a.savedCursors, a.savedHeads = st.Offsets, st.Cursors, st.Heads
+		}
+		return
+	}
+	if a.StateFile == "" {
+		return
+	}
+	st, err := readState(a.StateFile)
+	if err != nil {
+		slog.Warn("Ignoring state file", "err", err)
+		return
+	}
+	a.saved = st.Offsets
+	a.savedCursors = st.Cursors
+	a.savedHeads = st.Heads
+}
+
+// startOffset works out where tailing file should begin. A saved offset wins
+// as long as it still fits in the file; if the file has shrunk below it the
+// log was rotated or truncated, so we start over from the top. Without saved
+// state we start at the current end of file, as teller always has, or with
+// FromBeginning at the top. A gzipped file's size is what it decompresses
+// to, as its offsets are.
+func (a *App) startOffset(file string) int64 {
+	var size int64
+	fi, err := os.Stat(file)
+	if err == nil {
+		size = fi.Size()
+		if isGzip(file) {
+			size = gunzippedSize(file)
+		}
+	}
+
+	offset, ok := a.saved[file]
+	if !ok {
+		if a.FromBeginning {
+			return 0
+		}
+		return size
+	}
+	if offset > size {
+		slog.Warn("Saved offset is past end of file, file was likely rotated; starting from 0", "file", file, "offset", offset, "size", size)
+		return 0
+	}
+	return offset
+}
+
+// commit records that everything up to offsets and cursors has been
+// delivered: written out locally, spooled, or when ACKing, acknowledged by
+// the server. It's only called in the order batches were sent, so a file's
+// offset only moves forward, short of the file being rotated or truncated.
+func (a *App) commit(offsets map[string]int64, cursors map[string]string) {
+	for file, off := range offsets {
+		a.touch(file)
+		if off < a.offsets[file] {
+			// Rotated or truncated, so the head it had is no more
+			delete(a.heads, file)
+		}
+		a.offsets[file] = off
+		a.Lag.set(file, off)
+	}
+	for file, c := range cursors {
+		a.touch(file)
+		a.cursors[file] = c
+	}
+}
+
+// touch notes that file's position has changed since the last save.
+func (a *App) touch(file string) {
+	a.dirty = true
+	if a.StateDir == "" {
+		return
+	}
+	if a.changed == nil {
+		a.changed = map[string]bool{}
+	}
+	a.changed[file] = true
+}
+
+// rotateState saves the state file now, even if no offset has moved, first
+// moving the one already there aside to StateFile.1 so there's a copy to go
+// back to, before a maintenance job say. A StateDir is moved aside whole.
+func (a *App) rotateState() error {
+	if a.StateDir != "" {
+		if err := os.RemoveAll(a.StateDir + ".1"); err != nil {
+			return err
+		}
+		if err := os.Rename(a.StateDir, a.StateDir+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		a.updateHeads()
+		for file := range a.offsets {
+			a.touch(file)
+		}
+		for file := range a.cursors {
+			a.touch(file)
+		}
+		if err := writeStateDir(a.StateDir, a.changed, a.offsets, a.cursors, a.heads); err != nil {
+			return err
+		}
+		a.dirty = false
+		return nil
+	}
+	if a.StateFile == "" {
+		return errors.New("no -state-file to rotate")
+	}
+	if err := os.Rename(a.StateFile, a.StateFile+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	a.updateHeads()
+	if err := writeState(a.StateFile, a.offsets, a.cursors, a.heads); err != nil {
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+// saveState persists the sender's offsets if a state file or dir is
+// configured and they've changed since last time. With a dir only the
+// records of files that moved are written.
+func (a *App) saveState() {
+	if (a.StateFile == "" && a.StateDir == "") || !a.dirty {
+		return
+	}
+	a.updateHeads()
+	var err error
+	if a.StateDir != "" {
+		err = writeStateDir(a.StateDir, a.changed, a.offsets, a.cursors, a.heads)
+	} else {
+		err = writeState(a.StateFile, a.offsets, a.cursors, a.heads)
+	}
+	if err != nil {
+		slog.Error("Error saving offsets", "err", err)
+		return
+	}
+	a.dirty = false
+}
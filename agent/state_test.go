@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestStateDir tails three files that move on at their own pace, each with
+// its own record in the state dir, and throws one record back to where it
+// was, as a crash before it was saved would, to check each file resumes
+// from its own record alone.
+func TestStateDir(t *testing.T) {
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, "state")
+	files := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		files[name] = filepath.Join(dir, name+".log")
+	}
+	appendFile(t, files["a"], "a1\na2\na3\n")
+	appendFile(t, files["b"], "b1\n")
+	appendFile(t, files["c"], "c1\nc2\n")
+
+	srv := newTestServer(t, true)
+	// run ships whatever's new once over, and returns what the server got
+	run := func(want int) []string {
+		t.Helper()
+		cfg := srv.quicConfig()
+		cfg.Files = []string{files["a"], files["b"], files["c"]}
+		cfg.FromBeginning = true
+		cfg.Once = true
+		cfg.StateDir = stateDir
+		cfg.AckWindow = 4
+		a := newTestApp(t, cfg, nil, nil)
+		if err := a.Run(context.Background()); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		a.Close()
+		var got []string
+		for range want {
+			got = append(got, srv.next(t))
+		}
+		select {
+		case l := <-srv.lines:
+			t.Fatalf("server got %s as well", l)
+		default:
+		}
+		slices.Sort(got)
+		return got
+	}
+	checkOffsets := func(want map[string]int64) {
+		t.Helper()
+		st, err := readStateDir(stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, off := range want {
+			if got := st.Offsets[files[name]]; got != off {
+				t.Errorf("%s.log's record has offset %d, want %d", name, got, off)
+			}
+		}
+	}
+
+	if got := run(6); !slices.Equal(got, []string{"a1", "a2", "a3", "b1", "c1", "c2"}) {
+		t.Fatalf("first run shipped %q", got)
+	}
+	checkOffsets(map[string]int64{"a": 9, "b": 3, "c": 6})
+	paths, _ := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	if len(paths) != 3 {
+		t.Fatalf("state dir has %d records, want one per file", len(paths))
+	}
+	cRecord := sourceStateFile(stateDir, files["c"])
+	saved, err := os.ReadFile(cRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendFile(t, files["a"], "a4\n")
+	appendFile(t, files["c"], "c3\n")
+	if got := run(2); !slices.Equal(got, []string{"a4", "c3"}) {
+		t.Fatalf("second run shipped %q", got)
+	}
+	checkOffsets(map[string]int64{"a": 12, "b": 3, "c": 9})
+
+	// c's last save never made it to disk
+	if err := os.WriteFile(cRecord, saved, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, files["b"], "b2\n")
+	if got := run(2); !slices.Equal(got, []string{"b2", "c3"}) {
+		t.Fatalf("after the crash shipped %q, want b2 and c3 sent again", got)
+	}
+	checkOffsets(map[string]int64{"a": 12, "b": 6, "c": 9})
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdinKey is the name lines read from stdin are shipped under.
+const stdinKey = "stdin"
+
+// readerSource reads lines from r until EOF, for input that's piped in
+// rather than tailed: there's nothing to reopen or resume. Offsets count on
+// from offset, where r is already positioned. As with fileSource, no more
+// than max+1 bytes of a line are kept when max is set, and lines end at
+// delim. closer, if set, is closed once the source ends.
+type readerSource struct {
+	r      io.Reader
+	closer io.Closer
+	offset int64
+	max    int
+	delim  byte
+	lines  chan Line
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newReaderSource(r io.Reader, closer io.Closer, offset int64, maxLine int, delim byte) *readerSource {
+	s := &readerSource{r: r, closer: closer, offset: offset, max: maxLine, delim: delim, lines: make(chan Line), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *readerSource) Lines() <-chan Line { return s.lines }
+
+func (s *readerSource) Stop() { s.once.Do(func() { close(s.done) }) }
+
+func (s *readerSource) send(l Line) bool {
+	select {
+	case s.lines <- l:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *readerSource) run() {
+	defer close(s.lines)
+	if s.closer != nil {
+		defer s.closer.Close()
+	}
+	r := bufio.NewReader(s.r)
+	var partial []byte
+	offset, over := s.offset, int64(0)
+	for {
+		b, err := r.ReadSlice(s.delim)
+		partial = append(partial, b...)
+		if s.max > 0 && len(partial) > s.max+1 {
+			over += int64(len(partial) - s.max - 1)
+			partial = partial[:s.max+1]
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			s.send(Line{Err: err, Offset: offset})
+			return
+		}
+		// At EOF a last line without its delimiter is as complete as it gets
+		if len(partial) > 0 {
+			offset += int64(len(partial)) + over
+			if !s.send(Line{Text: string(bytes.TrimSuffix(partial, []byte{s.delim})), Offset: offset}) {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+		partial, over = partial[:0], 0
+	}
+}
+
+// runStdin ships stdin until it's closed.
+func (a *App) runStdin() {
+	a.pump(stdinKey, newReaderSource(os.Stdin, nil, 0, a.MaxLineBytes, a.Delimiter))
+}
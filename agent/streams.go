@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rexlx/teller/protocol"
+)
+
+// priorityKey is the priority stream's key. No file path has a NUL in it.
+const priorityKey = "\x00priority"
+
+// streamFor returns the stream to write key's frames on. The empty key is
+// the main stream; with StreamPerFile every file is its own key and gets its
+// own stream, opened on first use with a hello frame naming the file. A new
+// stream for a file that already had one starts by resending that file's
+// unACKed batches, since the old stream may have lost them. priorityKey is
+// opened the same way, its hello saying it's for priority lines.
+func (a *App) streamFor(key string) (quic.Stream, error) {
+	if key == "" {
+		return a.Stream, nil
+	}
+	if s, ok := a.streams[key]; ok {
+		return s, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := a.Conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h := protocol.StreamHello{Purpose: "file", File: key, Hostname: a.Hostname, Version: a.cfg.Version, Protocol: protocol.Version}
+	if key == priorityKey {
+		h.Purpose, h.File = "priority", ""
+	}
+	hello, err := protocol.AppendHelloFrame(nil, h)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.writeTo(s, hello); err != nil {
+		s.CancelWrite(0)
+		return nil, err
+	}
+	for i := range a.inflight {
+		f := &a.inflight[i]
+		if f.key != key || f.acked {
+			continue
+		}
+		if err := a.writeTo(s, f.frame); err != nil {
+			s.CancelWrite(0)
+			return nil, err
+		}
+		f.sent = time.Now()
+	}
+	if a.acking() {
+		go a.readAcks(s, key)
+	}
+	a.streams[key] = s
+	slog.Debug("Opened stream", "server", a.ServerAddr, "purpose", h.Purpose, "file", h.File)
+	return s, nil
+}
+
+// dropStream forgets key's stream after a write error on it, resetting it so
+// the server can tell what it got was cut short.
+func (a *App) dropStream(key string) {
+	if s, ok := a.streams[key]; ok {
+		s.CancelWrite(0)
+		delete(a.streams, key)
+	}
+}
+
+// closeStreams closes every per-file stream, for a clean exit or because the
+// connection they belonged to is gone.
+func (a *App) closeStreams() {
+	for key, s := range a.streams {
+		s.Close()
+		delete(a.streams, key)
+	}
+}
@@ -0,0 +1,366 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdID is the structured data element teller puts the file and tags in. The
+// enterprise number is the one RFC 5612 sets aside for examples like this.
+const sdID = "teller@32473"
+
+// syslogSink ships events as RFC 5424 syslog over TCP, or TLS when tls is
+// set, framed by octet counting (RFC 6587) so messages can hold newlines.
+// Servers are tried in order; when a write fails the connection is redialled
+// with backoff and the whole batch written again, so a collector can see
+// some of it twice.
+type syslogSink struct {
+	servers     []string
+	hostname    string
+	format      syslogFormat
+	tls         *tls.Config
+	dialTimeout time.Duration
+	maxAttempts int
+	stats       *Stats
+	// setState, if set, is told when the connection comes and goes
+	setState func(ConnState)
+	// writeTimeout, if set, bounds each write, so a collector that's stopped
+	// reading has the connection redialled rather than hanging teller
+	writeTimeout time.Duration
+	// network, if set, is tcp4 or tcp6 to dial only that family
+	network string
+	// proxy, if set, is the SOCKS5 proxy to connect through
+	proxy *socksProxy
+
+	conn net.Conn
+	addr string
+}
+
+// newSyslogSink makes a sink for servers, sending as hostname. tlsConf is nil
+// for plain TCP. Nothing is dialled until the first write.
+func newSyslogSink(servers []string, hostname string, format syslogFormat, tlsConf *tls.Config, dialTimeout time.Duration, maxAttempts int, stats *Stats) *syslogSink {
+	if tlsConf != nil {
+		// Syslog collectors don't do ALPN
+		tlsConf = tlsConf.Clone()
+		tlsConf.NextProtos = nil
+	}
+	return &syslogSink{servers: servers, hostname: hostname, format: format, tls: tlsConf, dialTimeout: dialTimeout, maxAttempts: maxAttempts, stats: stats}
+}
+
+func (s *syslogSink) Write(ctx context.Context, events [][]byte) error {
+	var out []byte
+	for _, e := range events {
+		msg := s.format(e, s.hostname)
+		out = append(strconv.AppendInt(out, int64(len(msg)), 10), ' ')
+		out = append(out, msg...)
+	}
+
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.connect(ctx)
+		if err == nil {
+			if s.writeTimeout > 0 {
+				s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+			}
+			if _, err = s.conn.Write(out); err == nil {
+				s.stats.LastWrite.Store(time.Now().UnixNano())
+				return nil
+			}
+			slog.Warn("Error writing to syslog server (server might be down)", "server", s.addr, "err", err)
+			s.stats.SendErrors.Add(1)
+			s.drop()
+		} else {
+			slog.Warn("Error connecting to syslog server", "err", err)
+		}
+		s.stats.noteError(err)
+		if s.maxAttempts > 0 && attempt >= s.maxAttempts {
+			s.state(StateDisconnected)
+			return fmt.Errorf("giving up after %d reconnect attempts", s.maxAttempts)
+		}
+		s.state(StateReconnecting)
+		wait := backoff + rand.N(backoff/2)
+		slog.Info("Reconnecting", "wait", wait.Round(time.Millisecond), "attempt", attempt+1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			s.state(StateDisconnected)
+			return fmt.Errorf("gave up reconnecting: %v", ctx.Err())
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// connect dials the first server that answers, unless already connected.
+func (s *syslogSink) connect(ctx context.Context) error {
+	if s.conn != nil {
+		return nil
+	}
+	var errs []error
+	for _, addr := range s.servers {
+		d := &net.Dialer{Timeout: s.dialTimeout, KeepAlive: 30 * time.Second}
+		network := cmp.Or(s.network, "tcp")
+		var conn net.Conn
+		var err error
+		switch {
+		case s.proxy != nil:
+			conn, err = s.dialProxy(ctx, addr)
+		case s.tls != nil:
+			conn, err = (&tls.Dialer{NetDialer: d, Config: s.tls}).DialContext(ctx, network, addr)
+		default:
+			conn, err = d.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", addr, err))
+			continue
+		}
+		if s.addr != "" {
+			s.stats.Reconnects.Add(1)
+		}
+		s.conn, s.addr = conn, addr
+		s.state(StateConnected)
+		slog.Info("Connected to syslog server", "server", addr)
+		return nil
+	}
+	return fmt.Errorf("no server reachable: %v", errors.Join(errs...))
+}
+
+// dialProxy connects to addr through the proxy, within dialTimeout, with
+// TLS on top for the tls sink.
+func (s *syslogSink) dialProxy(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+	defer cancel()
+	conn, err := s.proxy.DialContext(ctx, "tcp", addr)
+	if err != nil || s.tls == nil {
+		return conn, err
+	}
+	conf := s.tls
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, conf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// drop closes a connection that's gone bad.
+func (s *syslogSink) drop() {
+	s.conn.Close()
+	s.conn = nil
+	s.state(StateDisconnected)
+}
+
+// redial drops the connection, for the next write to dial a new one.
+func (s *syslogSink) redial() {
+	if s.conn != nil {
+		s.drop()
+	}
+}
+
+func (s *syslogSink) state(st ConnState) {
+	if s.setState != nil {
+		s.setState(st)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	s.state(StateDisconnected)
+	return err
+}
+
+// syslogFormat renders an event's JSON as a syslog message, as from hostname
+// if the event doesn't say.
+type syslogFormat func(event []byte, hostname string) []byte
+
+// syslogFormats are the -syslog-format choices.
+var syslogFormats = map[string]syslogFormat{
+	"rfc5424": formatRFC5424,
+	"rfc3164": formatRFC3164,
+}
+
+// syslogEvent decodes an event for formatting. Lines that were shipped as
+// their own JSON become the message of an event from hostname.
+func syslogEvent(event []byte, hostname string) (sl SyslogLine, pri int) {
+	if err := json.Unmarshal(event, &sl); err != nil || (sl.Message == "" && sl.Program == "") {
+		sl = SyslogLine{Hostname: hostname, Message: string(event)}
+	}
+	pri = 1*8 + 6 // user.info
+	if sl.Priority != nil {
+		pri = *sl.Priority
+	} else if sl.Severity != nil {
+		pri = 1*8 + *sl.Severity
+	}
+	return sl, pri
+}
+
+// formatRFC5424 renders an event as an RFC 5424 message.
+func formatRFC5424(event []byte, hostname string) []byte {
+	sl, pri := syslogEvent(event, hostname)
+	ts := "-"
+	if t, err := time.Parse(time.RFC3339Nano, sl.Timestamp); err == nil {
+		ts = t.Format("2006-01-02T15:04:05.999999Z07:00")
+	}
+	procID := "-"
+	if sl.Pid > 0 {
+		procID = strconv.Itoa(sl.Pid)
+	}
+
+	b := fmt.Appendf(nil, "<%d>1 %s %s %s %s %s ", pri, ts,
+		syslogHeader(sl.Hostname, 255), syslogHeader(sl.Program, 48), procID, syslogHeader(sl.MsgID, 32))
+	b = appendSD(b, sl)
+	if sl.Message != "" {
+		b = append(append(b, ' '), sl.Message...)
+	}
+	return b
+}
+
+// formatRFC3164 renders an event in the older BSD format, for collectors
+// that don't understand RFC 5424. It has nowhere to put structured data, the
+// file or tags, so they're left out. Without a timestamp of its own the
+// event is stamped with now.
+func formatRFC3164(event []byte, hostname string) []byte {
+	sl, pri := syslogEvent(event, hostname)
+	t, err := time.Parse(time.RFC3339Nano, sl.Timestamp)
+	if err != nil {
+		t = time.Now()
+	}
+	tag := syslogHeader(sl.Program, 32)
+	if tag == "-" {
+		tag = "teller"
+	}
+	b := fmt.Appendf(nil, "<%d>%s %s %s", pri, t.Format(time.Stamp), syslogHeader(sl.Hostname, 255), tag)
+	if sl.Pid > 0 {
+		b = fmt.Appendf(b, "[%d]", sl.Pid)
+	}
+	return append(append(b, ": "...), sl.Message...)
+}
+
+// syslogHeader makes s fit a header field: printable ASCII with no spaces,
+// at most max bytes, and "-" if that leaves nothing.
+func syslogHeader(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// appendSD appends the event's structured data, with the file and tags in
+// a teller element of their own, or "-" if there's none.
+func appendSD(b []byte, sl SyslogLine) []byte {
+	sd := maps.Clone(sl.StructuredData)
+	own := maps.Clone(sl.Tags)
+	if sl.File != "" {
+		if own == nil {
+			own = map[string]string{}
+		}
+		own["file"] = sl.File
+	}
+	if len(own) > 0 {
+		if sd == nil {
+			sd = map[string]map[string]string{}
+		}
+		sd[sdID] = own
+	}
+	if len(sd) == 0 {
+		return append(b, '-')
+	}
+	for _, id := range slices.Sorted(maps.Keys(sd)) {
+		b = append(append(b, '['), sdName(id)...)
+		params := sd[id]
+		for _, k := range slices.Sorted(maps.Keys(params)) {
+			b = append(append(append(b, ' '), sdName(k)...), `="`...)
+			b = append(b, sdEscaper.Replace(params[k])...)
+			b = append(b, '"')
+		}
+		b = append(b, ']')
+	}
+	return b
+}
+
+// sdName drops the characters an SD-ID or parameter name can't hold.
+func sdName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > 32 {
+		s = s[:32]
+	}
+	return s
+}
+
+// sdEscaper escapes the characters a parameter value can't hold as is.
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// udpSink sends each event as a syslog datagram (RFC 5426) to server, fire
+// and forget: nothing is acknowledged or retried, so events lost on the way go
+// unnoticed. Messages longer than max are cut short to fit in a packet.
+type udpSink struct {
+	conn     net.Conn
+	hostname string
+	format   syslogFormat
+	max      int
+	stats    *Stats
+}
+
+// newUDPSink makes a sink sending to server over network, udp or udp4 or
+// udp6, as hostname.
+func newUDPSink(network, server, hostname string, format syslogFormat, max int, stats *Stats) (*udpSink, error) {
+	conn, err := net.Dial(network, server)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSink{conn: conn, hostname: hostname, format: format, max: max, stats: stats}, nil
+}
+
+func (s *udpSink) Write(ctx context.Context, events [][]byte) error {
+	for _, e := range events {
+		msg := s.format(e, s.hostname)
+		if len(msg) > s.max {
+			msg = []byte(truncateUTF8(string(msg), s.max))
+		}
+		// The only errors are local ones, or the ICMP reply to an earlier
+		// packet nobody was listening for, and neither is worth stopping for
+		if _, err := s.conn.Write(msg); err != nil {
+			s.stats.SendErrors.Add(1)
+			s.stats.noteError(err)
+			slog.Debug("Error sending syslog datagram", "server", s.conn.RemoteAddr(), "err", err)
+			continue
+		}
+		s.stats.LastWrite.Store(time.Now().UnixNano())
+	}
+	return nil
+}
+
+func (s *udpSink) Close() error { return s.conn.Close() }
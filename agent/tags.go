@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseTags turns -tag key=value flags into the tags added to every event,
+// on top of the defaults. A tag with no value removes that default.
+func parseTags(flags []string, defaults map[string]string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for k, v := range defaults {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	for _, f := range flags {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("tag %q isn't key=value", f)
+		}
+		if v == "" {
+			delete(tags, k)
+			continue
+		}
+		tags[k] = v
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
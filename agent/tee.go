@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// parseTee splits a -tee spec, sink://server[,server...], or just stdout or
+// null, into the sink and its servers.
+func parseTee(spec string) (sink string, servers []string, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == sinkStdout || spec == sinkNull {
+		return spec, nil, nil
+	}
+	sink, rest, ok := strings.Cut(spec, "://")
+	switch sink {
+	case sinkQUIC, sinkTCP, sinkTLS, sinkUDP, sinkGRPC, sinkHTTP3:
+	default:
+		ok = false
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("%q isn't quic://, tcp://, tls://, udp://, grpc:// or http3:// followed by servers, stdout or null", spec)
+	}
+	for _, s := range strings.Split(rest, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			if err := checkServer(s); err != nil {
+				return "", nil, err
+			}
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return "", nil, fmt.Errorf("%q has no server", spec)
+	}
+	return sink, servers, nil
+}
+
+// teeName turns a -tee spec into something fit for a file name or a metric
+// label, for the tee's state file and spool.
+func teeName(spec string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '-'
+	}, strings.Replace(strings.TrimSpace(spec), "://", "-", 1)), "-")
+}
+
+// runTee connects tee t and ships to it until ctx is done. A tee that
+// can't connect, or gives up reconnecting, is logged and left behind
+// without holding up the others.
+func runTee(ctx context.Context, t *App, format syslogFormat, udpMax int) {
+	disconnect, err := t.openSink(ctx, format, udpMax)
+	if err != nil {
+		slog.Error("Tee failed to connect, not shipping to it", "tee", t.Name, "err", err)
+		return
+	}
+	defer disconnect()
+	slog.Info("Teeing", "tee", t.Name, "sink", t.Sink)
+	if err := t.TailAndProcess(ctx); err != nil {
+		slog.Error("Tee stopped shipping", "tee", t.Name, "err", err)
+	}
+}
+
+// teeMetrics writes the headline metrics of each tee, labelled by name.
+func teeMetrics(w io.Writer, tees []*App) {
+	series := []struct {
+		name, help, kind string
+		value            func(*App) float64
+	}{
+		{"teller_tee_lines_sent_total", "Lines a tee handed to its sink.", "counter",
+			func(t *App) float64 { return float64(t.Stats.LinesSent.Load()) }},
+		{"teller_tee_send_errors_total", "Failed writes to a tee's sink.", "counter",
+			func(t *App) float64 { return float64(t.Stats.SendErrors.Load()) }},
+		{"teller_tee_reconnects_total", "Successful reconnects of a tee after a dropped connection.", "counter",
+			func(t *App) float64 { return float64(t.Stats.Reconnects.Load()) }},
+		{"teller_tee_connection_up", "Whether a tee's connection to its server is up.", "gauge",
+			func(t *App) float64 {
+				if t.Stats.ConnState() == StateConnected {
+					return 1
+				}
+				return 0
+			}},
+		{"teller_tee_batches_unacked", "Batches written to a tee but not yet acknowledged.", "gauge",
+			func(t *App) float64 { return float64(t.Stats.Unacked.Load()) }},
+		{"teller_tee_spool_entries", "Entries waiting in a tee's disk spool.", "gauge",
+			func(t *App) float64 {
+				if t.Spool == nil {
+					return 0
+				}
+				return float64(t.Spool.Len())
+			}},
+	}
+	for _, s := range series {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+		for _, t := range tees {
+			fmt.Fprintf(w, "%s{sink=%q} %g\n", s.name, t.Name, s.value(t))
+		}
+	}
+}
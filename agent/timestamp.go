@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// timestampLayouts are names for layouts that turn up a lot, usable in place
+// of a Go layout. unix and unix_ms are numbers rather than layouts.
+var timestampLayouts = map[string]string{
+	"rfc3339":  time.RFC3339Nano,
+	"datetime": time.DateTime,
+	"common":   "02/Jan/2006:15:04:05 -0700", // Apache and nginx access logs
+	"stamp":    time.Stamp,                   // syslog, no year
+	"unix":     "unix",
+	"unix_ms":  "unix_ms",
+}
+
+// timestampParser pulls a line's own time out of it: the "ts" group of re,
+// or the whole match if there's no such group, parsed with layout. Times
+// without a zone are taken to be in loc, and times without a year in the
+// current one.
+type timestampParser struct {
+	re     *regexp.Regexp
+	group  int
+	layout string
+	loc    *time.Location
+}
+
+func newTimestampParser(expr, layout, tz string) (*timestampParser, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := timestampLayouts[layout]; ok {
+		layout = l
+	}
+	loc := time.Local
+	if tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q: %v", tz, err)
+		}
+	}
+	p := &timestampParser{re: re, layout: layout, loc: loc}
+	if i := re.SubexpIndex("ts"); i > 0 {
+		p.group = i
+	}
+	return p, nil
+}
+
+// parse reports false if line has no timestamp it can make sense of.
+func (p *timestampParser) parse(line string, now time.Time) (time.Time, bool) {
+	m := p.re.FindStringSubmatch(line)
+	if m == nil || m[p.group] == "" {
+		return time.Time{}, false
+	}
+	s := m[p.group]
+	switch p.layout {
+	case "unix", "unix_ms":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if p.layout == "unix" {
+			n *= 1000
+		}
+		return time.UnixMilli(int64(n)), true
+	}
+	t, err := time.ParseInLocation(p.layout, s, p.loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if t.Year() == 0 {
+		// Same guess as for RFC3164: this year, unless that's more than a
+		// day ahead
+		t = t.AddDate(now.In(p.loc).Year(), 0, 0)
+		if t.After(now.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+	}
+	return t, true
+}
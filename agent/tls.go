@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// TLSOptions are the knobs for how teller authenticates the server.
+type TLSOptions struct {
+	// CACert is a PEM bundle to verify the server against instead of the
+	// system roots.
+	CACert string
+	// ServerName overrides the name used for SNI and certificate checks,
+	// which otherwise comes from the server address.
+	ServerName string
+	// Insecure turns off certificate verification entirely.
+	Insecure bool
+	// ClientCert and ClientKey are a PEM certificate and key to present to
+	// servers that require client authentication. Both or neither.
+	ClientCert string
+	ClientKey  string
+	// Pins are base64 SHA-256 hashes of acceptable server public keys. With
+	// pins and no CACert the chain isn't checked at all, just the pin, which
+	// is how a self-signed server cert can be trusted safely.
+	Pins []string
+	// ALPN lists the application protocols to offer the server, the
+	// rider-protocol teller has always spoken if empty.
+	ALPN []string
+}
+
+// NewTLSConfig builds the client TLS config. Verification is on unless
+// Insecure is set explicitly.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	conf, _, err := newTLSConfig(opts)
+	return conf, err
+}
+
+// newTLSConfig is NewTLSConfig, also returning where the client certificate
+// is kept, nil without one, for ReloadClientCert to swap it.
+func newTLSConfig(opts TLSOptions) (*tls.Config, *clientCert, error) {
+	conf := &tls.Config{
+		ServerName: opts.ServerName,
+		NextProtos: opts.ALPN,
+	}
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{"rider-protocol"}
+	}
+
+	if opts.CACert != "" {
+		pem, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", opts.CACert)
+		}
+		conf.RootCAs = pool
+	}
+
+	if (opts.ClientCert == "") != (opts.ClientKey == "") {
+		return nil, nil, fmt.Errorf("-client-cert and -client-key must be given together")
+	}
+	var cc *clientCert
+	if opts.ClientCert != "" {
+		cert, err := loadClientCert(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		cc = &clientCert{}
+		cc.cur.Store(cert)
+		conf.GetClientCertificate = cc.get
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, p := range opts.Pins {
+			if b, err := base64.StdEncoding.DecodeString(p); err != nil || len(b) != sha256.Size {
+				return nil, nil, fmt.Errorf("-pin-sha256 %q is not a base64 SHA-256 hash", p)
+			}
+			pins[p] = true
+		}
+		conf.VerifyPeerCertificate = verifyPins(pins)
+		if opts.CACert == "" {
+			// The pin is the trust anchor, so skip chain verification
+			// (VerifyPeerCertificate still runs with this set)
+			conf.InsecureSkipVerify = true
+		}
+	}
+
+	if opts.Insecure {
+		slog.Warn("-insecure is set, the server's certificate will not be verified")
+		conf.InsecureSkipVerify = true
+	}
+	return conf, cc, nil
+}
+
+// clientCert is the client certificate presented to servers. Every
+// tls.Config made from the one newTLSConfig returns, tees' and other
+// sinks' included, asks it for the certificate at each handshake, so
+// swapping it has new connections present the new one.
+type clientCert struct {
+	cur atomic.Pointer[tls.Certificate]
+}
+
+func (c *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.cur.Load(), nil
+}
+
+// loadClientCert reads a certificate and its key from PEM files.
+func loadClientCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client certificate %s with key %s: %v", certFile, keyFile, err)
+	}
+	return &cert, nil
+}
+
+// hasClientCert reports whether conf presents a client certificate.
+func hasClientCert(conf *tls.Config) bool {
+	return len(conf.Certificates) > 0 || conf.GetClientCertificate != nil
+}
+
+// verifyPins returns a VerifyPeerCertificate callback that accepts the
+// connection only if the leaf certificate's public key hash is pinned.
+func verifyPins(pins map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server presented no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("error parsing server certificate: %v", err)
+		}
+		hash := spkiHash(leaf)
+		if !pins[hash] {
+			return fmt.Errorf("server public key %s does not match any -pin-sha256", hash)
+		}
+		return nil
+	}
+}
+
+// spkiHash is the base64 SHA-256 of a certificate's SubjectPublicKeyInfo.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// explainHandshakeError adds a hint to TLS failures whose cause isn't obvious
+// from the alert alone. With TLS 1.3 the server checks a client certificate
+// after the client considers the handshake done, so a rejection can surface
+// on the first write rather than the dial; callers should run both through
+// here.
+func explainHandshakeError(err error, conf *tls.Config) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "certificate required") && !hasClientCert(conf):
+		return fmt.Errorf("%v (the server requires a client certificate, set -client-cert and -client-key)", err)
+	case strings.Contains(msg, "bad certificate") || strings.Contains(msg, "unknown certificate authority"):
+		if hasClientCert(conf) {
+			return fmt.Errorf("%v (the server rejected our client certificate, check it's signed by a CA the server trusts)", err)
+		}
+	case strings.Contains(msg, "no application protocol"):
+		return fmt.Errorf("%v (the server speaks none of %s, check -alpn)", err, strings.Join(conf.NextProtos, ","))
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a CA to sign client certificates with.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// clientPair writes a client certificate signed by ca, and its key, as PEM
+// files in dir, returning their paths.
+func (ca *testCA) clientPair(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "teller"},
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// TestClientCert connects to a server that requires a client certificate,
+// with one it trusts, without one, and with one from a CA it doesn't, and
+// checks the last two fail saying why. The server turns a certificate down
+// after the client's done with the handshake, so it's the shutdown that
+// sees it.
+func TestClientCert(t *testing.T) {
+	ca := newTestCA(t, "teller test CA")
+	srv := newTestServerTLS(t, true, ca.pool)
+	good, goodKey := ca.clientPair(t, t.TempDir())
+	other, otherKey := newTestCA(t, "someone else's CA").clientPair(t, t.TempDir())
+
+	for _, tc := range []struct {
+		name      string
+		cert, key string
+		want      string
+	}{
+		{"trusted", good, goodKey, ""},
+		{"none", "", "", "set -client-cert and -client-key"},
+		{"untrusted", other, otherKey, "the server rejected our client certificate"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := srv.quicConfig()
+			cfg.TLS.ClientCert, cfg.TLS.ClientKey = tc.cert, tc.key
+			cfg.Once = true
+			cfg.MaxReconnectAttempts = 1
+			a := newTestApp(t, cfg, map[string]Source{"app.log": newFakeSource(nil, false, textLines("hello")...)}, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := a.Run(ctx)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("Run: %v", err)
+				}
+				if got := srv.next(t); got != "hello" {
+					t.Errorf("server got %q, want hello", got)
+				}
+				return
+			}
+			if !errors.Is(err, ErrUndelivered) {
+				t.Fatalf("Run returned %v, want ErrUndelivered", err)
+			}
+			if last, _ := a.Stats.LastError(); !strings.Contains(last, tc.want) {
+				t.Errorf("last error is %q, want it to say %q", last, tc.want)
+			}
+		})
+	}
+}
+
+// TestClientCertMismatch checks a client certificate given with some other
+// key is turned down when the config is built, not left to the handshake.
+func TestClientCertMismatch(t *testing.T) {
+	ca := newTestCA(t, "teller test CA")
+	cert, _ := ca.clientPair(t, t.TempDir())
+	_, key := ca.clientPair(t, t.TempDir())
+	_, err := NewTLSConfig(TLSOptions{ClientCert: cert, ClientKey: key})
+	if err == nil || !strings.Contains(err.Error(), "error loading client certificate "+cert+" with key "+key) {
+		t.Fatalf("NewTLSConfig returned %v, want the pair's files named", err)
+	}
+}
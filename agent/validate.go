@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// resolveTimeout bounds looking up each server's name in Validate.
+const resolveTimeout = 5 * time.Second
+
+// Validate checks cfg as New does, compiling every regexp and loading the
+// certificates and keys, and then goes on to what New leaves until Run:
+// that each -file matches something, that the state files can be read and
+// that each server's name resolves. Nothing is written and nothing is
+// dialled, so it's safe next to a teller that's running. It returns a line
+// for each part of the config, saying how it stands, and every problem it
+// found.
+func Validate(ctx context.Context, cfg Config) ([]string, error) {
+	cfg.dryRun = true
+	a, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var summary []string
+	var errs []error
+	say := func(format string, args ...any) { summary = append(summary, fmt.Sprintf(format, args...)) }
+
+	switch a.SourceKind {
+	case "file":
+		for _, f := range a.InputFiles {
+			matches, _ := filepath.Glob(f)
+			switch {
+			case len(matches) > 0:
+				say("file %s: matches %d", f, len(matches))
+			case a.WaitForFile > 0:
+				say("file %s: doesn't exist yet, will be waited for up to %v", f, a.WaitForFile)
+			default:
+				say("file %s: no match", f)
+				errs = append(errs, fmt.Errorf("-file %s matches nothing", f))
+			}
+		}
+	case "eventlog":
+		say("source: event log channels %s", strings.Join(a.EventLogChannels, ","))
+	default:
+		say("source: %s", a.SourceKind)
+	}
+	say("filters: %d include, %d exclude, %d redaction rules", len(a.Filter.Include), len(a.Filter.Exclude), len(a.Redactor.Rules))
+
+	for _, app := range append([]*App{a}, a.Tees...) {
+		name := "sink"
+		if app.Name != "" {
+			name = "tee " + app.Name
+		}
+		if app.StateFile != "" {
+			if _, err := readState(app.StateFile); err != nil {
+				errs = append(errs, err)
+			} else {
+				say("%s: state file %s readable", name, app.StateFile)
+			}
+		}
+		if app.StateDir != "" {
+			if st, err := readStateDir(app.StateDir); err != nil {
+				errs = append(errs, err)
+			} else {
+				say("%s: state dir %s readable, %d records", name, app.StateDir, len(st.Offsets)+len(st.Cursors))
+			}
+		}
+		if !remoteSink(app.Sink) {
+			say("%s: %s", name, app.Sink)
+			continue
+		}
+		for _, s := range app.Servers {
+			addrs, err := resolveServer(ctx, s, app.AddressFamily)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: error resolving %s: %v", name, s, err))
+				continue
+			}
+			say("%s: %s %s resolves to %s", name, app.Sink, s, strings.Join(addrs, ", "))
+		}
+	}
+	if cfg.SpoolDir != "" {
+		if err := checkDir(cfg.SpoolDir); err != nil {
+			errs = append(errs, fmt.Errorf("-spool-dir: %v", err))
+		} else {
+			say("spool: %s", cfg.SpoolDir)
+		}
+	}
+	return summary, errors.Join(errs...)
+}
+
+// resolveServer looks addr's host up, returning its addresses of family.
+func resolveServer(ctx context.Context, addr, family string) ([]string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	ips, err := lookupNetIP(ctx, familyNetwork("ip", family), host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.Unmap().String()
+	}
+	return addrs, nil
+}
+
+// checkDir makes sure dir is a directory, or that the nearest directory it
+// would be made in exists, without making anything.
+func checkDir(dir string) error {
+	for d := dir; ; d = filepath.Dir(d) {
+		fi, err := os.Stat(d)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s isn't a directory", d)
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) || d == filepath.Dir(d) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher owns the set of files being tailed. Plain paths are followed for
+// the life of the process, rotations included. Glob patterns are expanded at
+// startup and their directories watched, so matching files created later get
+// picked up and deleted ones are let go. With App.Once nothing is watched
+// and every file is only read to its end. With App.WaitForFile, plain paths
+// that don't exist yet are waited for, for that long at most.
+type Watcher struct {
+	app      *App
+	plain    map[string]bool
+	patterns []string
+
+	mu    sync.Mutex
+	tails map[string]Source
+	wg    sync.WaitGroup
+}
+
+// NewWatcher sorts files into plain paths and glob patterns, rejecting any
+// pattern filepath can't parse.
+func NewWatcher(a *App, files []string) (*Watcher, error) {
+	w := &Watcher{
+		app:   a,
+		plain: make(map[string]bool),
+		tails: make(map[string]Source),
+	}
+	for _, f := range files {
+		if !strings.ContainsAny(f, "*?[") {
+			w.plain[f] = true
+			continue
+		}
+		if _, err := filepath.Match(f, ""); err != nil {
+			return nil, fmt.Errorf("bad file pattern %q: %v", f, err)
+		}
+		w.patterns = append(w.patterns, f)
+	}
+	return w, nil
+}
+
+// Run starts tailing everything that matches right now, then watches for
+// new files if there are any patterns. It returns once there is nothing left
+// to tail and nothing left to watch for.
+func (w *Watcher) Run() {
+	for file := range w.plain {
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			if w.app.WaitForFile > 0 {
+				w.await(file)
+				continue
+			}
+			if !w.app.Once {
+				slog.Info("File doesn't exist yet, will tail it once it does", "file", file)
+			}
+		}
+		if w.app.CatchUpRotated {
+			if todo := w.app.rotatedBacklog(file); len(todo) > 0 {
+				w.catchUp(file, todo)
+				continue
+			}
+		}
+		w.follow(file, w.app.startOffset(file), true)
+	}
+	for _, p := range w.patterns {
+		matches, _ := filepath.Glob(p)
+		for _, m := range matches {
+			w.follow(m, w.app.startOffset(m), false)
+		}
+	}
+	if len(w.patterns) > 0 && !w.app.Once {
+		w.watch()
+	}
+	w.wg.Wait()
+}
+
+// watch listens on the directories the patterns live in. The directory part
+// of a pattern can be a glob too, but only directories that exist at startup
+// are watched.
+func (w *Watcher) watch() {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("Error starting directory watcher, new files won't be picked up", "err", err)
+		return
+	}
+	defer fsw.Close()
+
+	watched := 0
+	seen := make(map[string]bool)
+	for _, p := range w.patterns {
+		dirs, _ := filepath.Glob(filepath.Dir(p))
+		for _, d := range dirs {
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			if err := fsw.Add(d); err != nil {
+				slog.Warn("Error watching directory", "dir", d, "err", err)
+				continue
+			}
+			watched++
+		}
+	}
+	if watched == 0 {
+		slog.Warn("No directories to watch", "patterns", strings.Join(w.patterns, ","))
+		return
+	}
+
+	for {
+		select {
+		case ev, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+			switch {
+			case ev.Has(fsnotify.Create):
+				if w.matches(ev.Name) {
+					slog.Info("New file, tailing it", "file", ev.Name)
+					// It's brand new, so everything in it is unshipped
+					w.follow(ev.Name, 0, false)
+				}
+			case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+				w.stop(ev.Name)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Directory watcher error", "err", err)
+		case <-w.app.quit.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) matches(file string) bool {
+	for _, p := range w.patterns {
+		if ok, _ := filepath.Match(p, file); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// await follows file once it exists, checking every filePoll, or gives up on
+// it after App.WaitForFile. A program and its logger started together, in
+// containers say, race each other to the file.
+func (w *Watcher) await(file string) {
+	slog.Info("Waiting for file to appear", "file", file, "timeout", w.app.WaitForFile)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		t := time.NewTicker(filePoll)
+		defer t.Stop()
+		give := time.After(w.app.WaitForFile)
+		for {
+			select {
+			case <-t.C:
+				if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				slog.Info("File appeared, tailing it", "file", file)
+				w.follow(file, w.app.startOffset(file), true)
+				return
+			case <-give:
+				slog.Error("Gave up waiting for file", "file", file, "waited", w.app.WaitForFile)
+				// Read by the sender once the watcher's done
+				w.app.missing = true
+				return
+			case <-w.app.quit.Done():
+				return
+			}
+		}
+	}()
+}
+
+// follow starts a tail on file unless one is already running.
+func (w *Watcher) follow(file string, offset int64, reopen bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.tails[file]; ok {
+		return
+	}
+
+	t, err := w.app.tailFile(file, offset, reopen)
+	if err != nil {
+		slog.Error("Error starting tail", "file", file, "err", err)
+		return
+	}
+	w.tails[file] = t
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		if !w.app.deliver(event{file: file, offset: offset, start: true}) {
+			t.Stop()
+			return
+		}
+		w.app.pump(file, t)
+
+		w.mu.Lock()
+		if w.tails[file] == t {
+			delete(w.tails, file)
+		}
+		w.mu.Unlock()
+
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			w.app.deliver(event{file: file, forget: true})
+		}
+	}()
+}
+
+// stop ends the tail on a file that was deleted or renamed away. Plain paths
+// are left alone since their tail reopens the path after rotation.
+func (w *Watcher) stop(file string) {
+	if w.plain[file] {
+		return
+	}
+	w.mu.Lock()
+	t, ok := w.tails[file]
+	delete(w.tails, file)
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+	slog.Info("File is gone, no longer tailing it", "file", file)
+	t.Stop()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// repeatable reports whether a flag accumulates values, so its config key
+// may take a list.
+func repeatable(f *flag.Flag) bool {
+	switch v := f.Value.(type) {
+	case *recorded:
+		return v.list
+	case *stringList, *regexList, *teeList, *programList, *routeList:
+		return true
+	}
+	return false
+}
+
+// envPrefix starts the name of every environment variable teller reads.
+const envPrefix = "TELLER_"
+
+// envName is the environment variable that sets flag name: -heartbeat-interval
+// is TELLER_HEARTBEAT_INTERVAL.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnv applies TELLER_* environment variables to the flags in fs that
+// weren't given on the command line, and returns the names of every flag it
+// or the command line set, which the config file mustn't touch.
+func loadEnv(fs *flag.FlagSet) (map[string]bool, error) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if e := f.Value.Set(v); e != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), e)
+			return
+		}
+		set[f.Name] = true
+	})
+	return set, err
+}
+
+// loadConfig applies the settings in a YAML config file to fs. Keys are flag
+// names and values are written as they would be on the command line, so
+// every flag can be set from the file without a second list of options to
+// keep in step. Repeatable flags also take a YAML list. Flags in skip, the
+// ones already set on the command line or in the environment, are left
+// alone, so they override the file. A file in the list can also be a
+// mapping of its path and the program to ship it as, which sets
+// -file-program for it.
+func loadConfig(fs *flag.FlagSet, path string, skip map[string]bool) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: config file must be a mapping of setting names to values", path, root.Line)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, val := root.Content[i], root.Content[i+1]
+		f := fs.Lookup(key.Value)
+		if f == nil || f.Name == "config" {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, key.Line, key.Value)
+		}
+		if skip[f.Name] {
+			continue
+		}
+
+		var values []*yaml.Node
+		switch val.Kind {
+		case yaml.ScalarNode:
+			values = []*yaml.Node{val}
+		case yaml.SequenceNode:
+			if !repeatable(f) {
+				return fmt.Errorf("%s:%d: %s takes a single value, not a list", path, val.Line, f.Name)
+			}
+			values = val.Content
+		default:
+			return fmt.Errorf("%s:%d: %s must be a value or a list of values", path, val.Line, f.Name)
+		}
+		for _, v := range values {
+			if v.Kind == yaml.MappingNode && f.Name == "file" {
+				if err := setFileProgram(fs, v); err != nil {
+					return fmt.Errorf("%s:%d: %v", path, v.Line, err)
+				}
+				continue
+			}
+			if v.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%s:%d: %s must be a value or a list of values", path, v.Line, f.Name)
+			}
+			if err := f.Value.Set(v.Value); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, v.Line, v.Value, f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setFileProgram sets -file from a {path: ..., program: ...} entry in the
+// config file's file list, and -file-program too if it has a program.
+func setFileProgram(fs *flag.FlagSet, v *yaml.Node) error {
+	var path, program string
+	for i := 0; i+1 < len(v.Content); i += 2 {
+		key, val := v.Content[i], v.Content[i+1]
+		if val.Kind != yaml.ScalarNode {
+			return fmt.Errorf("file %s must be a value", key.Value)
+		}
+		switch key.Value {
+		case "path":
+			path = val.Value
+		case "program":
+			program = val.Value
+		default:
+			return fmt.Errorf("unknown file setting %q (want path or program)", key.Value)
+		}
+	}
+	if path == "" {
+		return fmt.Errorf("file entry has no path")
+	}
+	if err := fs.Lookup("file").Value.Set(path); err != nil {
+		return err
+	}
+	if program == "" {
+		return nil
+	}
+	return fs.Lookup("file-program").Value.Set(path + "=" + program)
+}
+
+// configDigest is a digest of every setting in fs, as teller ended up with
+// it from the command line, environment and config file, so two runs with
+// the same digest had the same settings.
+func configDigest(fs *flag.FlagSet) string {
+	h := sha256.New()
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%q\n", f.Name, f.Value.String())
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rexlx/teller/agent"
+)
+
+// stringList is a flag that can be repeated and also accepts
+// comma-separated lists.
+type stringList []string
+
+func (f *stringList) String() string { return strings.Join(*f, ",") }
+
+func (f *stringList) Set(v string) error {
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			*f = append(*f, p)
+		}
+	}
+	return nil
+}
+
+// regexList is a repeatable flag of regular expressions. Patterns are
+// compiled as they're parsed, so a bad one stops teller at startup. Unlike
+// stringList it doesn't split on commas, which are common in patterns.
+type regexList []*regexp.Regexp
+
+func (r *regexList) String() string {
+	s := make([]string, len(*r))
+	for i, re := range *r {
+		s[i] = re.String()
+	}
+	return strings.Join(s, " ")
+}
+
+func (r *regexList) Set(v string) error {
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// programList is the -file-program flag: repeatable file=program pairs, kept
+// in order since the first match wins. The program is after the last "=",
+// so a path with one in it still works.
+type programList []agent.SourceProgram
+
+func (p *programList) String() string {
+	s := make([]string, len(*p))
+	for i, sp := range *p {
+		s[i] = sp.Pattern + "=" + sp.Program
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *programList) Set(v string) error {
+	i := strings.LastIndex(v, "=")
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("%q isn't file=program", v)
+	}
+	pattern := strings.TrimSpace(v[:i])
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("bad file pattern %q: %v", pattern, err)
+	}
+	*p = append(*p, agent.SourceProgram{Pattern: pattern, Program: strings.TrimSpace(v[i+1:])})
+	return nil
+}
+
+// teeList is the -tee flag: repeatable, but not split on commas, since a
+// tee's own servers are comma-separated. Specs are checked by agent.New.
+type teeList []string
+
+func (f *teeList) String() string { return strings.Join(*f, " ") }
+
+func (f *teeList) Set(v string) error {
+	*f = append(*f, strings.TrimSpace(v))
+	return nil
+}
+
+// routeList is the -route flag: repeatable and kept in order, since the
+// first rule to match wins. Rules have commas and spaces of their own, so
+// they're taken whole; agent.New compiles them.
+type routeList []string
+
+func (f *routeList) String() string { return strings.Join(*f, "; ") }
+
+func (f *routeList) Set(v string) error {
+	*f = append(*f, strings.TrimSpace(v))
+	return nil
+}
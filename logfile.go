@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// logFile is -log-file: teller's own log, moved aside to path.1 (and path.1
+// to path.2, and so on up to backups) once writing to it would take it past
+// maxBytes, so it can't fill the disk however chatty teller gets.
+type logFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openLogFile opens path for appending, keeping what's already in it.
+func openLogFile(path string, maxBytes int64, backups int) (*logFile, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("-log-file-max-bytes must be positive")
+	}
+	if backups < 0 {
+		return nil, fmt.Errorf("-log-file-backups can't be negative")
+	}
+	l := &logFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening -log-file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error opening -log-file: %v", err)
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// Write writes one log message, rotating first if it wouldn't fit. A
+// message bigger than maxBytes on its own still gets a file to itself.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(p)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the file we have rather than not at all
+			fmt.Fprintf(os.Stderr, "error rotating -log-file: %v\n", err)
+		}
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts path
+// afresh. With no backups the log is just emptied.
+func (l *logFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	if l.backups == 0 {
+		return os.Truncate(l.path, 0)
+	}
+	for i := l.backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.path, l.path+".1")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// logLevelVar is the least severe level logged. It's a LevelVar so the server
+// can change it through the control stream.
+var logLevelVar slog.LevelVar
+
+// setupLogging points slog, and with it the standard log package, at out in
+// the requested format. Messages below level are dropped, and with
+// repeatWindow set warnings and errors repeated within it are collapsed
+// (see repeatHandler).
+func setupLogging(out io.Writer, format, level string, repeatWindow time.Duration) error {
+	if err := logLevelVar.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid -log-level %q (want debug, info, warn or error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: &logLevelVar}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(out, opts)
+	case "json":
+		h = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q (want text or json)", format)
+	}
+	if repeatWindow < 0 {
+		return fmt.Errorf("-log-repeat-window can't be negative")
+	}
+	if repeatWindow > 0 {
+		h = newRepeatHandler(h, repeatWindow)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// repeatHandler keeps a warning or error that keeps coming up, a server
+// that's down say, from flooding the log. The first of a message is logged
+// as usual; the same message again, at the same level, within window of it
+// is only counted, and once the window is over the count is logged in its
+// place. Messages are told apart by their text alone, since their fields,
+// the error say, often differ in some small way each time.
+type repeatHandler struct {
+	slog.Handler
+	s *repeatState
+}
+
+type repeatState struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[repeatKey]*repeated
+}
+
+type repeatKey struct {
+	level slog.Level
+	msg   string
+}
+
+type repeated struct {
+	since time.Time
+	count int
+	// h is the handler the message was first logged through, to log the
+	// count through with the same fields
+	h slog.Handler
+}
+
+func newRepeatHandler(h slog.Handler, window time.Duration) *repeatHandler {
+	s := &repeatState{window: window, seen: make(map[repeatKey]*repeated)}
+	go s.run()
+	return &repeatHandler{Handler: h, s: s}
+}
+
+func (h *repeatHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+	k := repeatKey{r.Level, r.Message}
+	s := h.s
+	s.mu.Lock()
+	if rep, ok := s.seen[k]; ok && r.Time.Sub(rep.since) < s.window {
+		rep.count++
+		s.mu.Unlock()
+		return nil
+	}
+	s.seen[k] = &repeated{since: r.Time, h: h.Handler}
+	s.mu.Unlock()
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *repeatHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &repeatHandler{Handler: h.Handler.WithAttrs(attrs), s: h.s}
+}
+
+func (h *repeatHandler) WithGroup(name string) slog.Handler {
+	return &repeatHandler{Handler: h.Handler.WithGroup(name), s: h.s}
+}
+
+// run logs, every window, how often each message that was held back came
+// up, and forgets messages whose window is over.
+func (s *repeatState) run() {
+	t := time.NewTicker(s.window)
+	defer t.Stop()
+	for now := range t.C {
+		s.mu.Lock()
+		var due []slog.Record
+		var hs []slog.Handler
+		for k, rep := range s.seen {
+			if now.Sub(rep.since) < s.window {
+				continue
+			}
+			delete(s.seen, k)
+			if rep.count == 0 {
+				continue
+			}
+			r := slog.NewRecord(now, k.level, k.msg, 0)
+			r.AddAttrs(slog.Int("repeated", rep.count), slog.Duration("over", now.Sub(rep.since).Round(time.Second)))
+			due, hs = append(due, r), append(hs, rep.h)
+		}
+		s.mu.Unlock()
+		for i, r := range due {
+			hs[i].Handle(context.Background(), r)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rexlx/teller/agent"
+)
+
+var (
+	defaults    = agent.DefaultConfig()
+	filePaths   stringList
+	evChannels  stringList
+	jrnlUnits   stringList
+	alpn        stringList
+	tagFlags    stringList
+	fieldMaps   stringList
+	pins        stringList
+	tees        teeList
+	routes      routeList
+	programs    programList
+	includes    regexList
+	excludes    regexList
+	redacts     regexList
+	redactSets  stringList
+	showVersion = flag.Bool("version", false, "Print teller's version and exit")
+	validate    = flag.Bool("validate", false, "Check the settings, regexps, certificates, files and servers, print what was found and exit, non-zero if something's wrong")
+	probeOnly   = flag.Bool("probe", false, "Connect to the server, send it one test event and wait for its ACK, print how it went and exit, non-zero if it failed; nothing is tailed")
+	configFile  = flag.String("config", "", "YAML file of settings, keyed by flag name; command-line flags override it")
+	serverAddr  = flag.String("server", strings.Join(defaults.Servers, ","), "Server address (a syslog collector with -sink tcp or tls), or a comma-separated list to fail over between")
+	strategy    = flag.String("server-strategy", defaults.ServerStrategy, "Order to try servers in: priority (always prefer the first) or round-robin")
+	progName    = flag.String("program", defaults.Program, "Program name to ship lines as, unless -file-program or the line itself says otherwise")
+	procName    = flag.String("procname", "", "Program name to ship every line as, even lines that name their own; -file-program still wins")
+	pidFlag     = flag.Int("pid", 0, "PID to ship lines as, the process whose logs they are when that isn't teller (default: teller's own)")
+	hostFlag    = flag.String("hostname", "", "Hostname to ship lines as (default: the system's, in full with -fqdn)")
+	fqdnOn      = flag.Bool("fqdn", false, "Ship lines as the host's fully-qualified name, looked up from its short one")
+	stateFile   = flag.String("state-file", "", "File to persist the tail offset in so restarts resume where they left off")
+	stateDir    = flag.String("state-dir", "", "Directory to keep each file's offset in, a record per file saved only when it moves, instead of -state-file")
+	stateEvery  = flag.Duration("state-save-interval", defaults.StateInterval, "How often to save offsets to -state-file when they've moved")
+	spoolDir    = flag.String("spool-dir", "", "Directory to spool undelivered logs in while the server is unreachable")
+	failFile    = flag.String("failover-file", "", "Without -spool-dir, append batches that can't be delivered to this file as JSON lines rather than stop")
+	failReplay  = flag.Bool("replay-failover-file", false, "Ship what's in -failover-file once batches get through again, then remove it")
+	spoolMax    = flag.Int64("spool-max-bytes", defaults.SpoolMaxBytes, "Maximum size of the spool; oldest entries are dropped past this")
+	spoolKey    = flag.String("spool-key-file", "", "File holding a 32-byte key, as hex or base64, to encrypt the spool with (default: $TELLER_SPOOL_KEY, else unencrypted)")
+	batchSize   = flag.Int("batch-size", defaults.BatchSize, "Maximum number of lines to send in one write")
+	batchBytes  = flag.Int("write-buffer-size", defaults.BatchBytes, "Maximum bytes of lines to send in one write")
+	batchWait   = flag.Duration("batch-flush-interval", defaults.BatchInterval, "Maximum time a line waits for its batch to fill before being sent")
+	compressTo  = flag.String("compression", defaults.Compression, "Compress batches on the wire, if the server agrees to it: gzip, zstd or none")
+	caCert      = flag.String("ca-cert", "", "PEM CA bundle to verify the server certificate against (default: system roots)")
+	addrFamily  = flag.String("address-family", defaults.AddressFamily, "Which of a server's addresses to use: auto (any, in the resolver's order), ipv4 or ipv6")
+	proxyURL    = flag.String("proxy", "", "SOCKS5 proxy to reach the server through, socks5://[user:password@]host[:port]; QUIC goes over its UDP relay (-sink quic, http3, tcp or tls)")
+	serverName  = flag.String("server-name", "", "Server name for SNI and certificate verification (default: host part of -server)")
+	clientCert  = flag.String("client-cert", "", "PEM client certificate for servers that require client authentication")
+	clientKey   = flag.String("client-key", "", "PEM private key for -client-cert")
+	zeroRTT     = flag.Bool("enable-0rtt", false, "Resume TLS sessions on reconnect, sending the stream hello as 0-RTT data to save a round trip")
+	maxSkew     = flag.Duration("max-clock-skew", 0, "Warn when the local clock is further than this from the server's, which it says in answer to the hello (0 doesn't check)")
+	fixSkew     = flag.Bool("correct-clock-skew", false, "Stamp events with the server's time rather than the local clock when they're more than -max-clock-skew apart")
+	insecure    = flag.Bool("insecure", false, "Skip server certificate verification (testing only)")
+	beatEvery   = flag.Duration("heartbeat-interval", defaults.HeartbeatInterval, "How often to send a heartbeat")
+	lifecycleOn = flag.Bool("lifecycle-events", defaults.Lifecycle, "Send a teller-lifecycle event on starting and on a graceful stop, with the version and a digest of the settings")
+	statsEvery  = flag.Duration("stats-interval", 0, "How often to ship teller's own stats as a teller-stats event (default: never)")
+	keepAlive   = flag.Duration("keepalive-period", defaults.KeepAlive, "How often to send QUIC keep-alives on an idle connection (0 for never)")
+	idleWait    = flag.Duration("max-idle-timeout", defaults.IdleTimeout, "How long a connection may go without hearing from the server before it's considered dead")
+	lagWarn     = flag.Int64("lag-warn-bytes", 0, "Warn when a file is more than this many bytes ahead of what's been shipped (0 never warns)")
+	lagAfter    = flag.Duration("lag-warn-after", defaults.LagWarnAfter, "How long a file must stay over -lag-warn-bytes before the warning")
+	catchUp     = flag.Bool("catch-up-rotated", false, "On startup, ship what's left of a -file that was rotated while teller was down, from its rotated copy (.gz too), before tailing the new one; needs -state-file or -state-dir")
+	rotatedAs   = flag.String("rotated-pattern", defaults.RotatedPattern, "Glob added to a -file path to find its rotated copies with -catch-up-rotated, e.g. -* for dated ones")
+	waitFile    = flag.Duration("wait-for-file", 0, "How long to wait at startup for a -file that doesn't exist yet before giving up on it (0: follow it whenever it turns up, or with -once fail)")
+	startJitter = flag.Duration("startup-jitter", 0, "Wait a random time up to this long before first connecting, so a fleet started together doesn't hit the server at once")
+	dialWait    = flag.Duration("dial-timeout", defaults.DialTimeout, "How long to wait for a server to answer before trying the next one")
+	writeWait   = flag.Duration("write-timeout", defaults.WriteTimeout, "How long a write to the server may block before the connection is taken for dead (0: forever)")
+	closeWait   = flag.Duration("close-timeout", defaults.CloseTimeout, "How long to wait on exit for the server to receive, or with -ack-window acknowledge, the last batches")
+	stopWait    = flag.Duration("shutdown-timeout", 10*time.Second, "How long to spend flushing on SIGINT/SIGTERM before exiting anyway")
+	maxRuntime  = flag.Duration("max-runtime", 0, "Shut down as on SIGTERM after running this long, for a supervisor to start teller afresh (0 for never)")
+	metricsOn   = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9100 (off if empty)")
+	adminUI     = flag.Bool("admin-ui", false, "Also serve an HTML status page at / on -metrics-addr, reloading itself every 5s")
+	healthOn    = flag.String("health-addr", "", "Address to serve /healthz and /readyz on, e.g. :8080 (off if empty)")
+	readyWait   = flag.Duration("ready-timeout", defaults.ReadyTimeout, "How long without a successful write to the server before /readyz reports not ready")
+	connStatsOn = flag.Duration("log-conn-stats", 0, "How often to log the connection's RTT, congestion window and packet loss (0 for never)")
+	tsRegex     = flag.String("timestamp-regex", "", "Regexp matching each line's own timestamp, or its named group \"ts\" if it has one (default: the time the line is read)")
+	tsLayout    = flag.String("timestamp-layout", defaults.TimestampLayout, "Go time layout of -timestamp-regex's match, or one of rfc3339, datetime, common, stamp, unix, unix_ms")
+	tsZone      = flag.String("timestamp-tz", "", "Time zone for timestamps that don't carry one, e.g. UTC or Europe/Berlin (default local time)")
+	tsField     = flag.String("timestamp-field", defaults.TimestampField, "JSON field holding each line's own timestamp with -parse-format json")
+	tsFormat    = flag.String("timestamp-format", defaults.TimestampFormat, "How events' timestamps are written: rfc3339, unix, unix_ms, unix_us, unix_ns or a Go time layout")
+	withMeta    = flag.Bool("include-metadata", false, "Add each line's offset, when it was read and how long after its own timestamp, under meta")
+	omitEmpty   = flag.Bool("omit-empty", false, "Leave empty fields out of events, even the ones that are always there")
+	parseAs     = flag.String("parse-format", defaults.ParseFormat, "How to parse lines: raw, rfc3164, rfc5424 or json")
+	parseReport = flag.Bool("report-parse-errors", false, "Also ship a copy of lines that don't parse, or have no timestamp, as teller-parse-error events, up to 10 a minute")
+	maxLine     = flag.Int("max-line-bytes", 0, "Cut lines longer than this many bytes short, marking them truncated (0 for no limit)")
+	delimiter   = flag.String("delimiter", defaults.Delimiter, "Byte that ends each line of input, as itself or an escape: \\n, \\0, \\x1e...")
+	dedupFor    = flag.Duration("dedup-window", 0, "Collapse identical lines repeated within this long into one event with a repeat_count (0 is off)")
+	dedupCut    = flag.String("dedup-strip", "", "Regexp cut out of lines before comparing them for -dedup-window, e.g. their timestamps")
+	mlPattern   = flag.String("multiline-pattern", "", "Regexp matching the first line of an event; other lines are appended to the previous event")
+	mlTimeout   = flag.Duration("multiline-timeout", defaults.MultilineTimeout, "How long to wait for more continuation lines before sending a multiline event")
+	levelRegex  = flag.String("level-regex", "", "Regexp with a named group \"level\" to pull each line's severity out of (default: from the syslog priority, else info)")
+	ackWindow   = flag.Int("ack-window", 0, "Batches that may await the server's ACK at once; offsets only advance once ACKed (0: server doesn't ACK)")
+	ackWait     = flag.Duration("ack-timeout", defaults.AckTimeout, "Reconnect if the server hasn't ACKed a batch in this long, with -ack-window (0: wait forever)")
+	maxLines    = flag.Float64("max-lines-per-sec", 0, "Cap on lines shipped per second across all files (0 for no limit)")
+	maxBytes    = flag.Float64("max-bytes-per-sec", 0, "Cap on event bytes shipped per second across all files (0 for no limit)")
+	maxBuffer   = flag.Int("max-memory-buffer-bytes", 0, "Cap on bytes held in memory by the pending batch and unACKed batches; past it reading stops, or batches go to the spool (0 for no limit)")
+	limitMode   = flag.String("rate-limit-mode", defaults.RateLimitMode, "What to do with lines over the rate limit: block (wait, leaving them in the file) or drop")
+	sampleRate  = flag.Float64("sample-rate", defaults.SampleRate, "Fraction of lines to ship, from 0.0 to 1.0")
+	redactWith  = flag.String("redact-placeholder", defaults.RedactPlaceholder, "What -redact and -redact-preset matches are replaced with")
+	sampleMode  = flag.String("sample-mode", defaults.SampleMode, "How to sample: random, or hash to keep or drop identical messages consistently")
+	sinkTo      = flag.String("sink", defaults.Sink, "Where to send lines: quic (the server), tcp, tls or udp (a syslog collector at -server), grpc (a gRPC collector at -server), http3 (an HTTP/3 ingest endpoint at -server), stdout (print the JSON, for testing) or null (discard)")
+	syslogAs    = flag.String("syslog-format", defaults.SyslogFormat, "Message format for -sink tcp, tls and udp: rfc5424 or rfc3164")
+	http3Path   = flag.String("http3-path", defaults.HTTP3Path, "Path on -server to POST batches to with -sink http3")
+	udpMax      = flag.Int("udp-max-packet-size", defaults.UDPMaxPacketSize, "Largest datagram -sink udp sends; longer messages are cut short")
+	logFormat   = flag.String("log-format", "text", "Format of teller's own log messages: text or json")
+	logLevel    = flag.String("log-level", "info", "Least severe of teller's own messages to log: debug, info, warn or error")
+	logFileTo   = flag.String("log-file", "", "File to write teller's own log messages to instead of stderr, rotated at -log-file-max-bytes")
+	logFileMax  = flag.Int64("log-file-max-bytes", 10<<20, "Size -log-file may grow to before it's moved aside to .1")
+	logFileKeep = flag.Int("log-file-backups", 3, "How many rotated -log-file backups to keep")
+	logRepeat   = flag.Duration("log-repeat-window", time.Minute, "Log a warning or error repeated within this long once, then how many times it came up (0 logs every one)")
+	perFile     = flag.Bool("stream-per-file", false, "Ship each file on its own QUIC stream so one file can't hold up the others")
+	useDgrams   = flag.Bool("use-datagrams", false, "Send lines as unreliable QUIC datagrams, if the server takes them, rather than on the stream; lines too big for one still go on the stream")
+	prioLevel   = flag.String("priority-level", "", "Ship lines at this level or more severe (e.g. err) on a QUIC stream of their own, ahead of the rest (default: off)")
+	controlOn   = flag.Bool("control", false, "Open a control stream the server can send commands (pause, resume, flush, status, log-level, rotate-state, slow-down) on")
+	controlSock = flag.String("control-socket", "", "Unix socket to take control commands on, one per line (e.g. echo pause | nc -U path)")
+	onceOnly    = flag.Bool("once", false, "Ship what's in the files now, up to their end, then exit, non-zero if any of it wasn't delivered")
+	fromStart   = flag.Bool("from-beginning", false, "Ship what's already in files (and the event log or journal) that have no saved offset, rather than only new lines")
+	sourceKind  = flag.String("source", defaults.SourceKind, "Where lines come from: file (tail -file), eventlog (the Windows event log), journald (the systemd journal) or stdin (read until EOF, same as -file -)")
+	maxRetries  = flag.Int("max-reconnect-attempts", 0, "Reconnect attempts before giving up after a send failure (0 retries forever)")
+)
+
+func init() {
+	flag.Var(&filePaths, "file", "File or glob to tail, comma-separated or repeated for several (default log.txt)")
+	flag.Var(&programs, "file-program", "file=program to ship lines from a -file path or glob as that program, repeatable (the first match wins)")
+	flag.Var(&evChannels, "eventlog-channel", "Event log channel to follow with -source eventlog, comma-separated or repeated (default Application,System)")
+	flag.Var(&jrnlUnits, "journald-unit", "Only follow these systemd units with -source journald, comma-separated or repeated (default all)")
+	flag.Var(&includes, "include", "Only ship lines matching this regexp, repeatable (any may match)")
+	flag.Var(&excludes, "exclude", "Never ship lines matching this regexp, repeatable")
+	flag.Var(&redacts, "redact", "Replace matches of this regexp with -redact-placeholder before shipping, repeatable (applied in order)")
+	flag.Var(&redactSets, "redact-preset", "Built-in -redact rules to apply first: credit-card (Luhn-checked), email, aws-key; comma-separated or repeated")
+	flag.Var(&alpn, "alpn", "ALPN protocol to offer the server, comma-separated or repeated (default rider-protocol)")
+	flag.Var(&tagFlags, "tag", "key=value tag to add to every event, comma-separated or repeated")
+	flag.Var(&fieldMaps, "field-map", "field=name renaming a field of the events shipped, or field= to leave it out; comma-separated or repeated")
+	flag.Var(&pins, "pin-sha256", "Base64 SHA-256 of the server's SubjectPublicKeyInfo to pin, repeatable for rotation")
+	flag.Var(&routes, "route", "Rule for what to do with the lines an expression matches, as 'expression -> action', the action drop, ship, route sink|<tee>,... or sample <rate>; repeatable, the first match wins")
+	flag.Var(&tees, "tee", "Also ship everything to this sink, as quic://servers, tcp://servers, tls://servers, udp://server, grpc://servers, http3://servers, stdout or null; repeatable")
+}
+
+// usage is flag's usage message plus the environment variable for each flag.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nEvery flag can also be set from the environment (flags win, then the environment, then -config):\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(out, "  %-32s -%s\n", envName(f.Name), f.Name)
+	})
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	set, err := loadEnv(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+	if *configFile != "" {
+		if err := loadConfig(flag.CommandLine, *configFile, set); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+	}
+	var logOut io.Writer = os.Stderr
+	if *logFileTo != "" {
+		f, err := openLogFile(*logFileTo, *logFileMax, *logFileKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logOut = f
+	}
+	if err := setupLogging(logOut, *logFormat, *logLevel, *logRepeat); err != nil {
+		log.Fatal(err)
+	}
+	if *closeWait >= *stopWait {
+		slog.Warn("-close-timeout isn't shorter than -shutdown-timeout, teller may be cut off waiting for the server",
+			"close_timeout", *closeWait, "shutdown_timeout", *stopWait)
+	}
+	if *maxRuntime < 0 {
+		log.Fatal("-max-runtime can't be negative")
+	}
+
+	cfg := agent.Config{
+		SourceKind:       *sourceKind,
+		Files:            filePaths,
+		Programs:         programs,
+		Program:          *progName,
+		ProcName:         *procName,
+		EventLogChannels: evChannels,
+		JournalUnits:     jrnlUnits,
+		FromBeginning:    *fromStart,
+		Once:             *onceOnly,
+		WaitForFile:      *waitFile,
+		CatchUpRotated:   *catchUp,
+		RotatedPattern:   *rotatedAs,
+
+		Hostname: *hostFlag,
+		FQDN:     *fqdnOn,
+		Pid:      *pidFlag,
+		Tags:     tagFlags,
+
+		StateFile:      *stateFile,
+		StateDir:       *stateDir,
+		StateInterval:  *stateEvery,
+		SpoolDir:       *spoolDir,
+		SpoolMaxBytes:  *spoolMax,
+		SpoolKeyFile:   *spoolKey,
+		FailoverFile:   *failFile,
+		ReplayFailover: *failReplay,
+
+		BatchSize:            *batchSize,
+		BatchBytes:           *batchBytes,
+		BatchInterval:        *batchWait,
+		Compression:          *compressTo,
+		AckWindow:            *ackWindow,
+		AckTimeout:           *ackWait,
+		MaxBufferBytes:       *maxBuffer,
+		MaxReconnectAttempts: *maxRetries,
+
+		Servers:        strings.Split(*serverAddr, ","),
+		ServerStrategy: *strategy,
+		AddressFamily:  *addrFamily,
+		Proxy:          *proxyURL,
+		TLS: agent.TLSOptions{
+			CACert:     *caCert,
+			ServerName: *serverName,
+			Insecure:   *insecure,
+			ClientCert: *clientCert,
+			ClientKey:  *clientKey,
+			Pins:       pins,
+			ALPN:       alpn,
+		},
+		ZeroRTT:           *zeroRTT,
+		MaxClockSkew:      *maxSkew,
+		CorrectClockSkew:  *fixSkew,
+		DialTimeout:       *dialWait,
+		WriteTimeout:      *writeWait,
+		CloseTimeout:      *closeWait,
+		KeepAlive:         *keepAlive,
+		IdleTimeout:       *idleWait,
+		StartupJitter:     *startJitter,
+		HeartbeatInterval: *beatEvery,
+		Lifecycle:         *lifecycleOn,
+		StatsInterval:     *statsEvery,
+
+		ParseFormat:      *parseAs,
+		ReportParseErrs:  *parseReport,
+		TimestampRegex:   *tsRegex,
+		TimestampLayout:  *tsLayout,
+		TimestampTZ:      *tsZone,
+		TimestampField:   *tsField,
+		TimestampFormat:  *tsFormat,
+		FieldMap:         fieldMaps,
+		OmitEmpty:        *omitEmpty,
+		IncludeMeta:      *withMeta,
+		LevelRegex:       *levelRegex,
+		MaxLineBytes:     *maxLine,
+		Delimiter:        *delimiter,
+		DedupWindow:      *dedupFor,
+		DedupStrip:       *dedupCut,
+		MultilinePattern: *mlPattern,
+		MultilineTimeout: *mlTimeout,
+
+		Include:           includes,
+		Exclude:           excludes,
+		Redact:            redacts,
+		RedactPresets:     redactSets,
+		RedactPlaceholder: *redactWith,
+		SampleRate:        *sampleRate,
+		SampleMode:        *sampleMode,
+		MaxLinesPerSec:    *maxLines,
+		MaxBytesPerSec:    *maxBytes,
+		RateLimitMode:     *limitMode,
+
+		Sink:             *sinkTo,
+		SyslogFormat:     *syslogAs,
+		HTTP3Path:        *http3Path,
+		UDPMaxPacketSize: *udpMax,
+		Tees:             tees,
+		Routes:           routes,
+		StreamPerFile:    *perFile,
+		UseDatagrams:     *useDgrams,
+		PriorityLevel:    *prioLevel,
+		Control:          *controlOn,
+		ControlSocket:    *controlSock,
+
+		MetricsAddr:       *metricsOn,
+		AdminUI:           *adminUI,
+		HealthAddr:        *healthOn,
+		ReadyTimeout:      *readyWait,
+		ConnStatsInterval: *connStatsOn,
+		LagWarnBytes:      *lagWarn,
+		LagWarnAfter:      *lagAfter,
+
+		ConfigDigest: configDigest(flag.CommandLine),
+		LogLevel:     &logLevelVar,
+		Version:      version,
+		Commit:       commit,
+		BuildDate:    buildDate,
+	}
+	if *validate {
+		summary, err := agent.Validate(context.Background(), cfg)
+		for _, line := range summary {
+			fmt.Println(line)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config is invalid:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("config is valid")
+		return
+	}
+	if *probeOnly {
+		summary, err := agent.Probe(context.Background(), cfg)
+		for _, line := range summary {
+			fmt.Println(line)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "probe failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("probe passed")
+		return
+	}
+
+	// With -once the exit code says whether everything got through. It's
+	// deferred ahead of the cleanups so they still run first
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	app, err := agent.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *maxRuntime > 0 {
+		// Most settings are only read at startup, so a restart is how
+		// they're picked up again
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, *maxRuntime, agent.ErrMaxRuntime)
+		defer cancel()
+	}
+	reloadOnHangup(ctx, app, set)
+	go func() {
+		<-ctx.Done()
+		// A second signal kills us outright, and so does a flush that hangs
+		stop()
+		time.Sleep(*stopWait)
+		slog.Error("Shutdown took too long, exiting anyway", "timeout", *stopWait)
+		os.Exit(1)
+	}()
+
+	// Errors are logged rather than fatal so app.Close and the rest still
+	// get to run
+	if err := app.Run(ctx); errors.Is(err, agent.ErrUndelivered) {
+		exitCode = 1
+	} else if err != nil {
+		slog.Error("Shipping stopped", "err", err)
+		exitCode = 1
+	}
+}
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec says how the data in a frame is encoded.
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecZstd
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	case TypeBatch:
+		return "batch"
+	case TypeAck:
+		return "ack"
+	case TypeHello:
+		return "hello"
+	case TypeHelloReply:
+		return "hello reply"
+	case TypeHeartbeat:
+		return "heartbeat"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// ParseCodec maps a codec name as used on the command line to a Codec.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "none":
+		return CodecNone, nil
+	case "gzip":
+		return CodecGzip, nil
+	case "zstd":
+		return CodecZstd, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q (want gzip, zstd or none)", name)
+}
+
+// The zstd coders are safe for concurrent EncodeAll/DecodeAll calls and
+// expensive to set up, so there's one of each per process.
+var (
+	zstdEnc, _ = zstd.NewWriter(nil)
+	zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize))
+)
+
+// Compress encodes data with codec c.
+func Compress(c Codec, data []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		return zstdEnc.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("protocol: can't compress with %v", c)
+}
+
+// Decompress decodes data that was encoded with codec c. Output larger than
+// MaxFrameSize is rejected.
+func Decompress(c Codec, data []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("protocol: bad gzip frame: %v", err)
+		}
+		raw, err := io.ReadAll(io.LimitReader(zr, MaxFrameSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("protocol: bad gzip frame: %v", err)
+		}
+		if len(raw) > MaxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		return raw, nil
+	case CodecZstd:
+		raw, err := zstdDec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("protocol: bad zstd frame: %v", err)
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("protocol: unknown codec %v", c)
+}
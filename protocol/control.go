@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// The control stream is one teller opens, when asked to, so the server can
+// manage it at runtime. It starts with a hello whose purpose is "control";
+// after that the server sends Command frames and teller answers each with a
+// Reply frame carrying the same ID. Both are CodecNone frames holding JSON.
+
+// Commands teller understands.
+const (
+	CmdPause       = "pause"        // stop shipping until resumed; lines wait in a batch, then in the files
+	CmdResume      = "resume"       // start shipping again
+	CmdFlush       = "flush"        // send the pending batch now
+	CmdStatus      = "status"       // reply with a Status
+	CmdLogLevel    = "log-level"    // set teller's own log level to Level
+	CmdRotateState = "rotate-state" // save the state file now, keeping the old one beside it
+	CmdSlowDown    = "slow-down"    // hold off sending for Ms milliseconds, as the server is struggling
+)
+
+// MaxSlowDown is the longest, in milliseconds, a slow-down command can hold
+// teller off for.
+const MaxSlowDown = 5 * 60 * 1000
+
+type Command struct {
+	ID    string `json:"id"`
+	Cmd   string `json:"cmd"`
+	Level string `json:"level,omitempty"`
+	Ms    int64  `json:"ms,omitempty"`
+}
+
+type Reply struct {
+	ID     string  `json:"id"`
+	OK     bool    `json:"ok"`
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Status is a snapshot of what teller is up to.
+type Status struct {
+	Hostname     string           `json:"hostname"`
+	Server       string           `json:"server"`
+	State        string           `json:"state"` // disconnected, connecting, connected or reconnecting
+	Paused       bool             `json:"paused"`
+	Buffered     int              `json:"buffered"` // lines batched but not yet sent
+	Offsets      map[string]int64 `json:"offsets"`
+	LinesSent    int64            `json:"lines_sent"`
+	SpoolEntries int              `json:"spool_entries"`
+	Unacked      int              `json:"unacked"`
+	SlowDownMs   int64            `json:"slow_down_ms,omitempty"` // what's left of a slow-down
+
+	// What the connection agreed on, while there is one
+	Protocol int    `json:"protocol,omitempty"` // from the server's hello reply
+	Codec    string `json:"codec,omitempty"`
+	TLS      string `json:"tls,omitempty"` // version and cipher suite
+	ALPN     string `json:"alpn,omitempty"`
+}
+
+// WriteJSON marshals v and writes it to w as one frame.
+func WriteJSON(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, b)
+}
+
+// ReadJSON reads one frame from r and unmarshals it into v.
+func ReadJSON(r io.Reader, v any) error {
+	_, data, err := ReadFrame(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,26 @@
+package protocol
+
+// LifecycleProgram is the program name on the events teller sends when it
+// starts and stops shipping. Their "lifecycle" field is a Lifecycle.
+const LifecycleProgram = "teller-lifecycle"
+
+// The phases of a Lifecycle event.
+const (
+	PhaseStart = "start"
+	PhaseStop  = "stop"
+)
+
+// Lifecycle is the "lifecycle" field of a LifecycleProgram event. A start
+// is the first event teller sends once connected, after anything spooled
+// from an earlier run; a stop is the last, sent only on a graceful shutdown,
+// so a start without a stop before it means teller died. ConfigDigest
+// changes whenever teller's settings do.
+type Lifecycle struct {
+	Phase        string `json:"phase"`
+	Version      string `json:"version"`
+	Hostname     string `json:"hostname"`
+	ConfigDigest string `json:"config_digest,omitempty"`
+	// Reason, on a stop, is "shutdown" for a signal or "sources ended"
+	Reason        string  `json:"reason,omitempty"`
+	UptimeSeconds float64 `json:"uptime_seconds,omitempty"`
+}
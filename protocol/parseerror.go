@@ -0,0 +1,15 @@
+package protocol
+
+// ParseErrorProgram is the program name on the events teller sends, with
+// -report-parse-errors, carrying a line it couldn't parse. The line itself is
+// the event's "raw", and its "parse_error" field is a ParseError.
+const ParseErrorProgram = "teller-parse-error"
+
+// ParseError says what went wrong. Stage is the -parse-format that the line
+// didn't fit, or "timestamp" when -timestamp-regex found no time in it.
+// Reports are rate limited, and Skipped is how many failures went
+// unreported since the last one.
+type ParseError struct {
+	Stage   string `json:"stage"`
+	Skipped int64  `json:"skipped,omitempty"`
+}
@@ -0,0 +1,378 @@
+// Package protocol is the wire format teller speaks to the log server. It
+// lives in its own package so the server can import the same framing code
+// rather than reimplementing it.
+//
+// Every message on the stream is a frame: a 4-byte big-endian data length, a
+// codec byte, and then that many bytes of data. With CodecNone the data is a
+// single JSON log event. With gzip or zstd the data is a compressed run of
+// CodecNone frames, which is how teller ships a whole batch in one go. Reader
+// takes care of unpacking those.
+//
+// When teller is asked for at-least-once delivery, each batch is wrapped in a
+// TypeBatch frame carrying a sequence number, and the server answers every
+// one with a TypeAck frame holding the same number once it has dealt with
+// the batch. Reader.AckTo does that for servers built on this package.
+//
+// Every so often teller sends a TypeHeartbeat frame so the server can tell a
+// quiet stream from a dead one. Heartbeats aren't log events: a server
+// reading frames itself should skip any frame with that type byte, and
+// Reader.Next skips them for it.
+//
+// A stream may start with a TypeHello frame saying what it carries, which is
+// how teller labels the separate stream it opens per file, and says which
+// version of teller it is. On the main stream the hello also offers the
+// codecs teller can compress with, and teller waits for a TypeHelloReply
+// naming the one to use, compressing nothing if none comes. The reply also
+// says what time the server makes it, which teller can check its clock
+// against. Reader.AnswerTo does that for servers built on this package.
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version is bumped whenever the frame layout changes.
+//
+//	0: newline-delimited JSON, no framing
+//	1: 4-byte big-endian length prefix
+//	2: codec byte after the length, compressed batches
+//	3: heartbeats are JSON events from HeartbeatProgram, not "|beat|"
+//	4: TypeBatch and TypeAck frames for acknowledged delivery
+//	5: TypeHello frame at the start of a stream
+//	6: hellos carry the protocol version and codecs, TypeHelloReply
+//	7: heartbeats are TypeHeartbeat frames, not HeartbeatProgram events
+const Version = 7
+
+// HeaderSize is the length of the frame header in bytes.
+const HeaderSize = 5
+
+// MaxFrameSize caps the data length ReadFrame will accept, and the size a
+// compressed frame may expand to, so a corrupt or hostile header can't make
+// the reader allocate gigabytes.
+const MaxFrameSize = 16 << 20
+
+// HeartbeatProgram is the program name heartbeats were sent as, as ordinary
+// events, before Version 7 gave them a frame type of their own. Servers that
+// also take older tellers should still drop events from it.
+const HeartbeatProgram = "teller-heartbeat"
+
+// StatsProgram is the program name on the events teller reports its own
+// numbers in, every -stats-interval. Their "stats" field is a StatsReport.
+const StatsProgram = "teller-stats"
+
+// ProbeProgram is the program name on the one event teller -probe sends to
+// check it can get through.
+const ProbeProgram = "teller-probe"
+
+// The codec byte doubles as the frame type for frames that aren't plain or
+// compressed log data.
+const (
+	// TypeBatch data is an 8-byte big-endian sequence number followed by the
+	// batch itself: a run of CodecNone frames or a single compressed one.
+	TypeBatch Codec = 0x10
+	// TypeAck is sent by the server, and its data is the 8-byte sequence
+	// number of the batch being acknowledged.
+	TypeAck Codec = 0x11
+	// TypeHello data is a JSON StreamHello.
+	TypeHello Codec = 0x12
+	// TypeHelloReply is sent by the server in answer to a hello offering
+	// codecs, and its data is a JSON HelloReply.
+	TypeHelloReply Codec = 0x13
+	// TypeHeartbeat is a keep-alive, and its data is a JSON Heartbeat. It's
+	// never part of a batch and never acknowledged.
+	TypeHeartbeat Codec = 0x14
+)
+
+// Heartbeat is what a TypeHeartbeat frame says: who's alive, and when they
+// said so.
+type Heartbeat struct {
+	Timestamp string `json:"timestamp"`
+	Hostname  string `json:"hostname,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+}
+
+// AppendHeartbeatFrame appends a TypeHeartbeat frame for h to dst.
+func AppendHeartbeatFrame(dst []byte, h Heartbeat) ([]byte, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return AppendCodecFrame(dst, TypeHeartbeat, b), nil
+}
+
+// StreamHello describes a stream. Purpose is "logs" for the main stream,
+// which carries anything, "file" for a stream carrying the lines of File
+// alone, and "priority" for one carrying lines severe enough to be worth
+// handling ahead of the rest. Streams without a hello carry anything.
+// Version is the sender's version, for telling which build a host is
+// running, and Protocol the Version it speaks. Codecs, on the main stream,
+// are the codecs the sender would like to compress with, best first.
+type StreamHello struct {
+	Purpose  string   `json:"purpose"`
+	File     string   `json:"file,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Protocol int      `json:"protocol,omitempty"`
+	Codecs   []string `json:"codecs,omitempty"`
+}
+
+// HelloReply answers a StreamHello that offered codecs: Codec is the one to
+// compress with, "none" if the server can't take any of them. Time is the
+// server's clock as it answered, in RFC 3339, for the sender to check its
+// own against; servers that predate it leave it out.
+type HelloReply struct {
+	Protocol int    `json:"protocol"`
+	Codec    string `json:"codec"`
+	Time     string `json:"time,omitempty"`
+}
+
+// WriteHelloReply writes a TypeHelloReply frame for h to w.
+func WriteHelloReply(w io.Writer, h HelloReply) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(AppendCodecFrame(nil, TypeHelloReply, b))
+	return err
+}
+
+// ReadHelloReply reads one TypeHelloReply frame from r.
+func ReadHelloReply(r io.Reader) (HelloReply, error) {
+	var h HelloReply
+	c, data, err := ReadFrame(r)
+	if err != nil {
+		return h, err
+	}
+	if c != TypeHelloReply {
+		return h, fmt.Errorf("protocol: expected a hello reply, got a %v frame", c)
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, fmt.Errorf("protocol: bad hello reply: %v", err)
+	}
+	return h, nil
+}
+
+// AppendHelloFrame appends a TypeHello frame for h to dst.
+func AppendHelloFrame(dst []byte, h StreamHello) ([]byte, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return AppendCodecFrame(dst, TypeHello, b), nil
+}
+
+// ErrFrameTooLarge is returned for frames longer than MaxFrameSize.
+var ErrFrameTooLarge = errors.New("protocol: frame too large")
+
+// AppendFrame appends payload to dst as a single uncompressed frame and
+// returns the extended slice.
+func AppendFrame(dst, payload []byte) []byte {
+	return AppendCodecFrame(dst, CodecNone, payload)
+}
+
+// AppendCodecFrame appends data to dst as a frame tagged with codec c.
+func AppendCodecFrame(dst []byte, c Codec, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)))
+	dst = append(dst, byte(c))
+	return append(dst, data...)
+}
+
+// WriteFrame writes payload to w as a single uncompressed frame. Header and
+// payload go out in one Write so they can't be interleaved with another
+// writer's frame.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	_, err := w.Write(AppendFrame(make([]byte, 0, HeaderSize+len(payload)), payload))
+	return err
+}
+
+// ReadFrame reads one frame from r and returns its codec and data, still
+// compressed. It returns io.EOF only if r ends cleanly between frames; a
+// stream that ends partway through a frame yields io.ErrUnexpectedEOF.
+func ReadFrame(r io.Reader) (Codec, []byte, error) {
+	var hdr [HeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n > MaxFrameSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return Codec(hdr[4]), data, nil
+}
+
+// AppendBatchFrame appends a TypeBatch frame holding seq and the frames in
+// batch to dst.
+func AppendBatchFrame(dst []byte, seq uint64, batch []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(8+len(batch)))
+	dst = append(dst, byte(TypeBatch))
+	dst = binary.BigEndian.AppendUint64(dst, seq)
+	return append(dst, batch...)
+}
+
+// WriteAck acknowledges batch seq.
+func WriteAck(w io.Writer, seq uint64) error {
+	_, err := w.Write(AppendCodecFrame(nil, TypeAck, binary.BigEndian.AppendUint64(nil, seq)))
+	return err
+}
+
+// ReadAck reads one TypeAck frame from r and returns its sequence number.
+func ReadAck(r io.Reader) (uint64, error) {
+	c, data, err := ReadFrame(r)
+	if err != nil {
+		return 0, err
+	}
+	if c != TypeAck || len(data) != 8 {
+		return 0, fmt.Errorf("protocol: expected an ack, got a %d byte %v frame", len(data), c)
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// Reader yields the payloads of the frames on a stream, transparently
+// unwrapping and decompressing batches.
+type Reader struct {
+	r       io.Reader
+	batch   *bytes.Reader
+	seq     uint64
+	pending *bytes.Reader
+	ack     io.Writer
+	answer  io.Writer
+	hello   *StreamHello
+	beats   int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// AckTo makes r acknowledge each TypeBatch frame on w, usually the same
+// stream, when Next is called after the batch's last payload was returned,
+// that is once the caller is done with the whole batch.
+func (r *Reader) AckTo(w io.Writer) {
+	r.ack = w
+}
+
+// AnswerTo makes r answer a hello offering codecs on w, usually the same
+// stream, picking the first one this package can decompress.
+func (r *Reader) AnswerTo(w io.Writer) {
+	r.answer = w
+}
+
+// Hello returns what the stream said it carries, or nil if it didn't say (or
+// Next hasn't been called yet).
+func (r *Reader) Hello() *StreamHello {
+	return r.hello
+}
+
+// Heartbeats returns how many heartbeats Next has skipped so far.
+func (r *Reader) Heartbeats() int {
+	return r.beats
+}
+
+// Next returns the next payload. Heartbeats are skipped, and counted.
+func (r *Reader) Next() ([]byte, error) {
+	for {
+		if r.pending != nil {
+			c, data, err := ReadFrame(r.pending)
+			if err == io.EOF {
+				r.pending = nil
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("protocol: bad frame in compressed batch: %v", err)
+			}
+			if c != CodecNone {
+				return nil, fmt.Errorf("protocol: nested %v frame in compressed batch", c)
+			}
+			return data, nil
+		}
+
+		// Inside a TypeBatch frame its contents are read as if they were
+		// the stream
+		src := r.r
+		if r.batch != nil {
+			src = r.batch
+		}
+		c, data, err := ReadFrame(src)
+		if r.batch != nil {
+			if err == io.EOF {
+				r.batch = nil
+				if r.ack != nil {
+					if err := WriteAck(r.ack, r.seq); err != nil {
+						return nil, fmt.Errorf("protocol: error sending ack: %v", err)
+					}
+				}
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("protocol: bad frame in batch %d: %v", r.seq, err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case CodecNone:
+			return data, nil
+		case TypeBatch:
+			if r.batch != nil {
+				return nil, fmt.Errorf("protocol: nested batch in batch %d", r.seq)
+			}
+			if len(data) < 8 {
+				return nil, fmt.Errorf("protocol: short batch frame")
+			}
+			r.seq = binary.BigEndian.Uint64(data)
+			r.batch = bytes.NewReader(data[8:])
+			continue
+		case TypeAck:
+			return nil, fmt.Errorf("protocol: unexpected ack from the sending side")
+		case TypeHello:
+			var h StreamHello
+			if err := json.Unmarshal(data, &h); err != nil {
+				return nil, fmt.Errorf("protocol: bad hello frame: %v", err)
+			}
+			r.hello = &h
+			if r.answer != nil && len(h.Codecs) > 0 {
+				pick := CodecNone
+				for _, name := range h.Codecs {
+					if c, err := ParseCodec(name); err == nil {
+						pick = c
+						break
+					}
+				}
+				if err := WriteHelloReply(r.answer, HelloReply{Protocol: Version, Codec: pick.String(), Time: time.Now().UTC().Format(time.RFC3339Nano)}); err != nil {
+					return nil, fmt.Errorf("protocol: error answering hello: %v", err)
+				}
+			}
+			continue
+		case TypeHelloReply:
+			return nil, fmt.Errorf("protocol: unexpected hello reply from the sending side")
+		case TypeHeartbeat:
+			if r.batch != nil {
+				return nil, fmt.Errorf("protocol: heartbeat in batch %d", r.seq)
+			}
+			r.beats++
+			continue
+		}
+		raw, err := Decompress(c, data)
+		if err != nil {
+			return nil, err
+		}
+		r.pending = bytes.NewReader(raw)
+	}
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func heartbeat(t *testing.T, dst []byte) []byte {
+	t.Helper()
+	dst, err := AppendHeartbeatFrame(dst, Heartbeat{Timestamp: "2024-01-02T03:04:05Z", Hostname: "web1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+// TestReaderHeartbeats interleaves heartbeats with log frames of every kind
+// a stream can carry, and checks Reader hands back the log events alone, in
+// order, with the heartbeats counted and the batch ACKed.
+func TestReaderHeartbeats(t *testing.T) {
+	stream, err := AppendHelloFrame(nil, StreamHello{Purpose: "logs", Protocol: Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream = heartbeat(t, stream)
+	stream = AppendFrame(stream, []byte(`{"message":"a"}`))
+	stream = heartbeat(t, stream)
+	stream = AppendBatchFrame(stream, 7, AppendFrame(AppendFrame(nil, []byte(`{"message":"b"}`)), []byte(`{"message":"c"}`)))
+	stream = heartbeat(t, stream)
+	for _, c := range []Codec{CodecGzip, CodecZstd} {
+		z, err := Compress(c, AppendFrame(AppendFrame(nil, []byte(`{"message":"`+c.String()+` 1"}`)), []byte(`{"message":"`+c.String()+` 2"}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = AppendCodecFrame(stream, c, z)
+		stream = heartbeat(t, stream)
+	}
+	stream = heartbeat(t, stream)
+
+	var acks bytes.Buffer
+	r := NewReader(bytes.NewReader(stream))
+	r.AckTo(&acks)
+	var got []string
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got = append(got, string(p))
+	}
+	want := []string{
+		`{"message":"a"}`, `{"message":"b"}`, `{"message":"c"}`,
+		`{"message":"gzip 1"}`, `{"message":"gzip 2"}`,
+		`{"message":"zstd 1"}`, `{"message":"zstd 2"}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if r.Heartbeats() != 6 {
+		t.Errorf("counted %d heartbeats, want 6", r.Heartbeats())
+	}
+	if r.Hello() == nil || r.Hello().Purpose != "logs" {
+		t.Errorf("hello is %+v, want the logs stream's", r.Hello())
+	}
+	seq, err := ReadAck(&acks)
+	if err != nil || seq != 7 {
+		t.Errorf("ACKed %d (%v), want 7", seq, err)
+	}
+	if acks.Len() != 0 {
+		t.Errorf("%d bytes left after the one ACK", acks.Len())
+	}
+}
+
+// TestReaderHeartbeatInBatch checks a heartbeat turning up inside a batch,
+// where it can't be, is an error rather than skipped.
+func TestReaderHeartbeatInBatch(t *testing.T) {
+	batch := heartbeat(t, AppendFrame(nil, []byte(`{"message":"a"}`)))
+	r := NewReader(bytes.NewReader(AppendBatchFrame(nil, 1, batch)))
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if _, err := r.Next(); err == nil || !strings.Contains(err.Error(), "heartbeat in batch") {
+		t.Fatalf("Next returned %v, want a heartbeat in batch error", err)
+	}
+}
+
+// TestHeartbeatFrame checks what a heartbeat looks like on the wire, for
+// servers that read frames themselves and need to skip it.
+func TestHeartbeatFrame(t *testing.T) {
+	c, data, err := ReadFrame(bytes.NewReader(heartbeat(t, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != TypeHeartbeat || byte(c) != 0x14 {
+		t.Errorf("heartbeat frame has type %#x, want 0x14", byte(c))
+	}
+	if want := `{"timestamp":"2024-01-02T03:04:05Z","hostname":"web1"}`; string(data) != want {
+		t.Errorf("heartbeat is %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,52 @@
+package protocol
+
+// StatsReport is the "stats" field of a StatsProgram event. Counters are
+// totals since teller started, so a dashboard wants their rate, or the
+// difference between two reports; the rest are as of the report. Fields are
+// only ever added, never renamed.
+type StatsReport struct {
+	UptimeSeconds   float64 `json:"uptime_seconds"`
+	IntervalSeconds float64 `json:"interval_seconds"` // how often reports are sent
+
+	LinesRead        int64 `json:"lines_read"`
+	LinesSent        int64 `json:"lines_sent"`
+	LinesFiltered    int64 `json:"lines_filtered"`
+	LinesSampledOut  int64 `json:"lines_sampled_out"`
+	LinesRateDropped int64 `json:"lines_rate_dropped"`
+	LinesTruncated   int64 `json:"lines_truncated"`
+	LinesDeduped     int64 `json:"lines_deduped"`
+	LinesRedacted    int64 `json:"lines_redacted"`
+	Redactions       int64 `json:"redactions"`
+	LinesInvalidUTF8 int64 `json:"lines_invalid_utf8"`
+	EncodeErrors     int64 `json:"encode_errors"` // lines dropped for failing to encode
+	Batches          int64 `json:"batches"`
+	BytesSent        int64 `json:"bytes_sent"` // after compression
+	SendErrors       int64 `json:"send_errors"`
+	Reconnects       int64 `json:"reconnects"`
+	AckTimeouts      int64 `json:"ack_timeouts"` // reconnects because the server stopped ACKing
+
+	State   string `json:"state"` // disconnected, connecting, connected or reconnecting
+	Unacked int    `json:"unacked"`
+
+	// Spool figures are only there with a spool
+	SpoolEntries *int   `json:"spool_entries,omitempty"`
+	SpoolBytes   *int64 `json:"spool_bytes,omitempty"`
+	SpoolDropped *int64 `json:"spool_dropped,omitempty"`
+
+	// LagBytes is how far behind each tailed file shipping is
+	LagBytes map[string]int64 `json:"lag_bytes,omitempty"`
+
+	// Compression is what each codec that's been used has done, by name
+	Compression map[string]CompressionStats `json:"compression,omitempty"`
+}
+
+// CompressionStats is what compressing batches with one codec has come to.
+// Ratio is a moving average over recent batches, of bytes in over bytes
+// out; Seconds is the time spent compressing.
+type CompressionStats struct {
+	Batches  int64   `json:"batches"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Seconds  float64 `json:"seconds"`
+	Ratio    float64 `json:"ratio"`
+}
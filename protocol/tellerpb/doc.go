@@ -0,0 +1,5 @@
+// Package tellerpb is the protobuf and gRPC code for -sink grpc, generated
+// from teller.proto. A collector implements LogServiceServer.
+package tellerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative teller.proto
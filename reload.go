@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/rexlx/teller/agent"
+)
+
+// hotSettings are the config file settings a SIGHUP applies. Anything else
+// the file changes takes a restart.
+var hotSettings = map[string]bool{"log-level": true, "client-cert": true, "client-key": true}
+
+// reloadOnHangup has each SIGHUP, until ctx is done, read the -config file
+// again and apply what changed in it of hotSettings, then read the client
+// certificate again, from wherever -client-cert and -client-key now say,
+// for app to reconnect with if it's changed. Settings in set, the ones
+// given on the command line or in the environment, still override the file.
+func reloadOnHangup(ctx context.Context, app *agent.App, set map[string]bool) {
+	var was map[string][]string
+	if *configFile != "" {
+		var err error
+		if was, err = fileSettings(*configFile); err != nil {
+			slog.Warn("Error reading config file, SIGHUP will apply all of it", "file", *configFile, "err", err)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+			case <-ctx.Done():
+				return
+			}
+			slog.Info("Got SIGHUP, reloading")
+			if *configFile != "" {
+				now, err := fileSettings(*configFile)
+				if err != nil {
+					slog.Error("Error reloading config file, keeping the settings teller has", "file", *configFile, "err", err)
+				} else {
+					applySettings(was, now, set)
+					was = now
+				}
+			}
+			if _, err := app.ReloadClientCert(*clientCert, *clientKey); err != nil {
+				slog.Error("Error reloading client certificate, keeping the one teller has", "err", err)
+			}
+		}
+	}()
+}
+
+// applySettings applies the hotSettings that differ between was and now, a
+// config file's settings before and after, and logs the rest of what differs
+// as waiting on a restart. A setting taken out of the file goes back to its
+// default.
+func applySettings(was, now map[string][]string, set map[string]bool) {
+	names := slices.Collect(maps.Keys(was))
+	for name := range now {
+		if _, ok := was[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if slices.Equal(was[name], now[name]) || set[name] {
+			continue
+		}
+		if !hotSettings[name] {
+			slog.Warn("Setting changed in the config file, restart teller to apply it", "setting", name)
+			continue
+		}
+		f := flag.Lookup(name)
+		from, to := f.Value.String(), f.DefValue
+		if v := now[name]; len(v) > 0 {
+			to = v[len(v)-1]
+		}
+		if name == "log-level" {
+			if err := logLevelVar.UnmarshalText([]byte(to)); err != nil {
+				slog.Error("Invalid -log-level in the config file, keeping the level teller has", "level", to)
+				continue
+			}
+		}
+		f.Value.Set(to)
+		slog.Info("Setting reloaded", "setting", name, "from", from, "to", to)
+	}
+}
+
+// fileSettings reads the config file at path as loadConfig would, returning
+// each setting's values as written.
+func fileSettings(path string) (map[string][]string, error) {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	got := map[string]*recorded{}
+	flag.VisitAll(func(f *flag.Flag) {
+		got[f.Name] = &recorded{list: repeatable(f)}
+		fs.Var(got[f.Name], f.Name, f.Usage)
+	})
+	if err := loadConfig(fs, path, nil); err != nil {
+		return nil, err
+	}
+	settings := map[string][]string{}
+	for name, r := range got {
+		if r.values != nil {
+			settings[name] = r.values
+		}
+	}
+	return settings, nil
+}
+
+// recorded is a flag that keeps the values it's set to rather than parsing
+// them, standing in for one of teller's, list saying whether that one's
+// repeatable.
+type recorded struct {
+	values []string
+	list   bool
+}
+
+func (r *recorded) String() string { return strings.Join(r.values, ",") }
+
+func (r *recorded) Set(v string) error {
+	r.values = append(r.values, v)
+	return nil
+}
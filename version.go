@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// version, commit and buildDate describe the build, and are set with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=... -X main.buildDate=...".
+// Left unset, they're filled in from what the Go toolchain recorded, as far
+// as it goes.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && commit == "":
+			commit = s.Value
+		case s.Key == "vcs.time" && buildDate == "":
+			buildDate = s.Value
+		}
+	}
+}
+
+// versionString is what -version prints.
+func versionString() string {
+	s := "teller " + version
+	if commit != "" {
+		s += fmt.Sprintf(" (commit %s", commit)
+		if buildDate != "" {
+			s += ", built " + buildDate
+		}
+		s += ")"
+	} else if buildDate != "" {
+		s += " (built " + buildDate + ")"
+	}
+	return s
+}